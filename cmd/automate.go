@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+
+	"github.com/jcodybaker/shellyctl/pkg/automation"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	automateCmd.Flags().String("rules", "", "path to a YAML file of automation rules.")
+	automateCmd.Flags().Duration("action-timeout", automation.DefaultActionTimeout, "maximum time allowed for each rule action.")
+	automateCmd.MarkFlagRequired("rules")
+	watchFlags(automateCmd.Flags())
+	replayFlags(automateCmd.Flags())
+	discoveryFlags(automateCmd.Flags(), discoveryFlagsOptions{
+		withTTL:                    true,
+		interactive:                false,
+		searchStrictTimeoutDefault: true,
+	})
+	rootCmd.AddCommand(automateCmd)
+}
+
+var automateCmd = &cobra.Command{
+	Use:     "automate",
+	GroupID: "notifications",
+	Short:   "Run actions when device notifications match automation rules",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, signalStop := signal.NotifyContext(ctx, os.Interrupt)
+		defer signalStop()
+
+		l := log.Ctx(ctx)
+
+		rules, err := automation.Load(viper.GetString("rules"))
+		if err != nil {
+			l.Fatal().Err(err).Msg("loading rules")
+		}
+		dOpts, err := discoveryOptionsFromFlags(cmd.Flags())
+		if err != nil {
+			l.Fatal().Err(err).Msg("parsing flags")
+		}
+		disc := discovery.NewDiscoverer(dOpts...)
+		ready := make(chan struct{})
+		engine := automation.NewEngine(
+			disc,
+			rules,
+			automation.WithActionTimeout(viper.GetDuration("action-timeout")),
+			automation.WithReady(func() { close(ready) }),
+		)
+		if err := disc.MQTTConnect(ctx); err != nil {
+			l.Fatal().Err(err).Msg("connecting to MQTT broker")
+		}
+		if err := discoveryAddDevices(ctx, disc); err != nil {
+			l.Fatal().Err(err).Msg("adding devices")
+		}
+		if _, err := disc.Search(ctx); err != nil {
+			l.Fatal().Err(err).Msg("searching for devices")
+		}
+
+		wg := watchDevices(ctx, disc)
+		defer wg.Wait()
+		if err := startReplay(ctx, disc, ready); err != nil {
+			l.Fatal().Err(err).Msg("starting replay")
+		}
+		l.Info().Int("rules", len(rules.Rules)).Msg("running automation rules")
+		engine.Run(ctx)
+	},
+}
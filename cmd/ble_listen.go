@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/jcodybaker/shellyctl/pkg/bthome"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var bleListenCmd = &cobra.Command{
+	Use:   "listen",
+	Short: "Passively decode BTHome advertisements from Shelly BLU and other BLE sensors",
+	Long: "Passively decode BTHome advertisements from Shelly BLU and other BLE sensors. Readings are\n" +
+		"output as they're received, until interrupted. Devices aren't connected, so no gateway is required.",
+	Run: bleListenCmdRun,
+}
+
+func init() {
+	bthomeKeyFlags(bleListenCmd.Flags())
+	bleComponent.Parent.AddCommand(bleListenCmd)
+}
+
+func bleListenCmdRun(cmd *cobra.Command, args []string) {
+	ctx, signalStop := signal.NotifyContext(ctx, os.Interrupt)
+	defer signalStop()
+
+	l := log.Ctx(ctx)
+
+	opts, err := bthomeOptionsFromFlags()
+	if err != nil {
+		l.Fatal().Err(err).Msg("parsing flags")
+	}
+	opts = append(opts, bthome.WithHandler(func(r *bthome.Reading) {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			l.Err(err).Msg("encoding reading")
+			return
+		}
+		Output(ctx, bthomeReadingSummary(r), "reading", r, raw)
+	}))
+	listener := bthome.NewListener(discovery.NewDiscoverer(), opts...)
+	l.Info().Msg("listening for BTHome advertisements")
+	if err := listener.Run(ctx); err != nil {
+		l.Fatal().Err(err).Msg("listening for BLE advertisements")
+	}
+}
+
+// bthomeReadingSummary describes a reading, ex.
+// `SBHT-003C (3C:2E:F5:00:11:22): battery=99% temperature=27.3°C`.
+func bthomeReadingSummary(r *bthome.Reading) string {
+	var b strings.Builder
+	if r.Name != "" {
+		fmt.Fprintf(&b, "%s (%s):", r.Name, r.MACAddr)
+	} else {
+		fmt.Fprintf(&b, "%s:", r.MACAddr)
+	}
+	for _, m := range r.Measurements {
+		name := m.Name
+		if m.Index > 0 {
+			name += strconv.Itoa(m.Index + 1)
+		}
+		fmt.Fprintf(&b, " %s=%s%s", name, strconv.FormatFloat(m.Value, 'f', -1, 64), m.Unit)
+	}
+	for _, e := range r.Events {
+		if e.Type == "" {
+			continue
+		}
+		name := e.Name
+		if e.Index > 0 {
+			name += strconv.Itoa(e.Index + 1)
+		}
+		fmt.Fprintf(&b, " %s=%s", name, e.Type)
+		if e.Steps != 0 {
+			fmt.Fprintf(&b, "(%d)", e.Steps)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/jcodybaker/shellyctl/pkg/bridge"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var (
+	bridgeCmd = &cobra.Command{
+		Use:     "bridge",
+		GroupID: "servers",
+		Short:   "Expose devices reachable by any transport to other systems via the --mqtt-addr broker",
+	}
+	bridgeHomeAssistantCmd = &cobra.Command{
+		Use:     "homeassistant",
+		Aliases: []string{"hass", "ha"},
+		Short:   "Publish Home Assistant MQTT discovery configs and state for devices, and relay commands to them",
+		Run:     bridgeHomeAssistantCmdRun,
+	}
+	bridgeMQTTCmd = &cobra.Command{
+		Use:   "mqtt",
+		Short: "Republish the status and notifications of devices not connected to the broker with the native Shelly MQTT topics, and relay RPCs to them",
+		Run:   bridgeMQTTCmdRun,
+	}
+)
+
+func init() {
+	bridgeHomeAssistantCmd.Flags().String("topic-prefix", bridge.DefaultHomeAssistantTopicPrefix, "prefix of the state, availability, and command topics of each device.")
+	bridgeHomeAssistantCmd.Flags().String("discovery-prefix", bridge.DefaultDiscoveryPrefix, "topic prefix Home Assistant watches for MQTT discovery configs.")
+	bridgeFlags(bridgeHomeAssistantCmd.Flags())
+	bridgeCmd.AddCommand(bridgeHomeAssistantCmd)
+
+	bridgeMQTTCmd.Flags().String("topic-prefix", "", "prefix prepended to the topics of each device.")
+	bridgeFlags(bridgeMQTTCmd.Flags())
+	bridgeCmd.AddCommand(bridgeMQTTCmd)
+	rootCmd.AddCommand(bridgeCmd)
+}
+
+// bridgeFlags adds the flags shared by bridge commands.
+func bridgeFlags(f *pflag.FlagSet) {
+	f.Duration("poll-interval", bridge.DefaultPollInterval, "interval at which device status is polled and new devices are searched for.")
+	f.Duration("device-timeout", bridge.DefaultRPCTimeout, "maximum time allowed for each request to a device.")
+	f.Int("poll-concurrency", bridge.DefaultConcurrency, "number of devices polled concurrently.")
+	watchFlags(f)
+	discoveryFlags(f, discoveryFlagsOptions{
+		withTTL:                    true,
+		interactive:                false,
+		searchStrictTimeoutDefault: true,
+	})
+}
+
+// bridgeOptionsFromFlags returns the bridge options from the flags added by bridgeFlags.
+func bridgeOptionsFromFlags() []bridge.Option {
+	return []bridge.Option{
+		bridge.WithTopicPrefix(viper.GetString("topic-prefix")),
+		bridge.WithPollInterval(viper.GetDuration("poll-interval")),
+		bridge.WithRPCTimeout(viper.GetDuration("device-timeout")),
+		bridge.WithConcurrency(viper.GetInt("poll-concurrency")),
+	}
+}
+
+// bridgeDiscoverer connects to the broker and adds the devices specified by flags for a bridge
+// command. extra options are applied after those from flags.
+func bridgeDiscoverer(ctx context.Context, cmd *cobra.Command, extra ...discovery.DiscovererOption) *discovery.Discoverer {
+	l := log.Ctx(ctx)
+	dOpts, err := discoveryOptionsFromFlags(cmd.Flags())
+	if err != nil {
+		l.Fatal().Err(err).Msg("parsing flags")
+	}
+	dOpts = append(dOpts, extra...)
+	if !viper.IsSet("mqtt-addr") {
+		l.Fatal().Msg("--mqtt-addr is required")
+	}
+	disc := discovery.NewDiscoverer(dOpts...)
+	if err := disc.MQTTConnect(ctx); err != nil {
+		l.Fatal().Err(err).Msg("connecting to MQTT broker")
+	}
+	if err := discoveryAddDevices(ctx, disc); err != nil {
+		l.Fatal().Err(err).Msg("adding devices")
+	}
+	return disc
+}
+
+func bridgeHomeAssistantCmdRun(cmd *cobra.Command, args []string) {
+	ctx, signalStop := signal.NotifyContext(ctx, os.Interrupt)
+	defer signalStop()
+
+	l := log.Ctx(ctx)
+	disc := bridgeDiscoverer(ctx, cmd)
+	if _, err := disc.Search(ctx); err != nil {
+		l.Fatal().Err(err).Msg("searching for devices")
+	}
+	wg := watchDevices(ctx, disc)
+	defer wg.Wait()
+
+	opts := append(bridgeOptionsFromFlags(), bridge.WithDiscoveryPrefix(viper.GetString("discovery-prefix")))
+	h := bridge.NewHomeAssistant(disc, opts...)
+	l.Info().Msg("running home assistant bridge")
+	if err := h.Run(ctx); err != nil {
+		l.Fatal().Err(err).Msg("running home assistant bridge")
+	}
+}
+
+func bridgeMQTTCmdRun(cmd *cobra.Command, args []string) {
+	ctx, signalStop := signal.NotifyContext(ctx, os.Interrupt)
+	defer signalStop()
+
+	l := log.Ctx(ctx)
+	var dOpts []discovery.DiscovererOption
+	if !viper.IsSet("mqtt-topic") {
+		// The republished topics mimic those of native MQTT devices; subscribing to them by
+		// default would find the bridged devices a second time.
+		dOpts = append(dOpts, discovery.WithMQTTTopicSubscriptions(nil))
+	}
+	disc := bridgeDiscoverer(ctx, cmd, dOpts...)
+	if _, err := disc.Search(ctx); err != nil {
+		l.Fatal().Err(err).Msg("searching for devices")
+	}
+	wg := watchDevices(ctx, disc)
+	defer wg.Wait()
+
+	r := bridge.NewRepublisher(disc, bridgeOptionsFromFlags()...)
+	l.Info().Msg("running mqtt republisher")
+	if err := r.Run(ctx); err != nil {
+		l.Fatal().Err(err).Msg("running mqtt republisher")
+	}
+}
@@ -67,7 +67,7 @@ func btHomeDiscoverCmdRunE(cmd *cobra.Command, args []string) error {
 			reqContext, cancel = context.WithTimeout(ctx, time.Duration(req.Duration)*time.Second)
 		}
 
-		events := discoverer.GetEventNotifications(50)
+		events := discoverer.SubscribeEvents()
 
 		_, err = shelly.Do(reqContext, conn, d.AuthCallback(ctx), req, resp)
 		cancel()
@@ -80,7 +80,7 @@ func btHomeDiscoverCmdRunE(cmd *cobra.Command, args []string) error {
 	discoveryLoop:
 		for {
 			select {
-			case e := <-events:
+			case e := <-events.C():
 				// how do we match this to the particular channel.
 				ll.Info().Str("event", string(e.Frame.Params)).Msg("got event")
 			case <-ctx.Done():
@@ -90,7 +90,7 @@ func btHomeDiscoverCmdRunE(cmd *cobra.Command, args []string) error {
 			}
 		}
 		timeout.Stop()
-
+		events.Unsubscribe()
 	}
 	return nil
 }
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/otlpexporter"
+	"github.com/jcodybaker/shellyctl/pkg/promserver"
+	"github.com/jcodybaker/shellyctl/pkg/pushexporter"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	exportCmd = &cobra.Command{
+		Use:     "export",
+		GroupID: "servers",
+		Short:   "Push device metrics to time series databases",
+	}
+	exportInfluxCmd = &cobra.Command{
+		Use:     "influx",
+		Aliases: []string{"influxdb"},
+		Short:   "Periodically write device metrics as InfluxDB line protocol or with the Prometheus remote-write protocol",
+		Run:     exportInfluxCmdRun,
+	}
+)
+
+func init() {
+	f := exportInfluxCmd.Flags()
+	f.String("endpoint", "", "URL metrics are written to, ex. http://influxdb:8086/api/v2/write?org=home&bucket=shelly or http://victoriametrics:8428/api/v1/write.")
+	f.String("format", pushexporter.FormatLineProtocol, "format of written metrics, either line-protocol or remote-write.")
+	f.Duration("interval", pushexporter.DefaultInterval, "interval at which metrics are gathered and written.")
+	f.Int("batch-size", pushexporter.DefaultBatchSize, "maximum number of samples written in each request.")
+	f.Duration("write-timeout", pushexporter.DefaultTimeout, "maximum time allowed for each write request.")
+	f.Bool("gzip", false, "compress line protocol requests with gzip. Remote-write requests are always compressed with snappy.")
+	f.StringArray("header", nil, "headers specified as `k=v` to add to each request, ex. \"Authorization=Token abc\". This may be specified multiple times.")
+	f.Int("max-retries", pushexporter.DefaultMaxRetries, "number of times a write which failed with a network error, 429, or 5xx status is retried before its batch is dropped.")
+	f.Duration("retry-interval", pushexporter.DefaultRetryInterval, "delay before the first retry of a failed write. The delay doubles with each retry.")
+
+	f.String("prometheus-namespace", promserver.DefaultNamespace, "set the namespace string to use for metric names.")
+	f.String("prometheus-subsystem", promserver.DefaultSubsystem, "set the subsystem section of the metric names.")
+	f.Int("probe-concurrency", promserver.DefaultConcurrency, "set the number of concurrent probes which will be made to gather metrics.")
+	f.Duration("device-timeout", promserver.DefaultDeviceTimeout, "set the maximum time allowed for a device to respond to it probe.")
+	f.Duration("poll-interval", 0, "poll devices in the background at this interval and write the latest results. The default of 0 queries devices synchronously each --interval.")
+	f.Duration("poll-jitter", 0, "randomize each device's poll interval by up to this amount. Defaults to 10% of --poll-interval.")
+	f.Duration("poll-max-backoff", promserver.DefaultPollMaxBackoff, "maximum delay between polls of a device which is failing to respond.")
+	f.Duration("poll-staleness", 0, "omit a device's metrics if it hasn't been successfully polled within this duration. Defaults to 3x --poll-interval.")
+	labelFlags(f)
+	energyFlags(f)
+	bleListenFlags(f)
+	replayFlags(f)
+	discoveryFlags(f, discoveryFlagsOptions{
+		withTTL:                    true,
+		interactive:                false,
+		searchStrictTimeoutDefault: true,
+	})
+	exportCmd.AddCommand(exportInfluxCmd)
+	rootCmd.AddCommand(exportCmd)
+}
+
+func exportInfluxCmdRun(cmd *cobra.Command, args []string) {
+	ctx, signalStop := signal.NotifyContext(ctx, os.Interrupt)
+	defer signalStop()
+
+	l := log.Ctx(ctx)
+
+	if viper.GetDuration("poll-interval") < 0 {
+		l.Fatal().Msg("poll-interval must not be negative")
+	}
+	dOpts, err := discoveryOptionsFromFlags(cmd.Flags())
+	if err != nil {
+		l.Fatal().Err(err).Msg("parsing flags")
+	}
+	lm, err := labelMapperFromFlags()
+	if err != nil {
+		l.Fatal().Err(err).Msg("parsing label flags")
+	}
+	headers, err := otlpexporter.ParseHeaders(viper.GetStringSlice("header"), false)
+	if err != nil {
+		l.Fatal().Err(err).Msg("parsing header flags")
+	}
+	acc, err := energyAccumulatorFromFlags()
+	if err != nil {
+		l.Fatal().Err(err).Msg("loading energy state")
+	}
+	disc := discovery.NewDiscoverer(dOpts...)
+	listener, err := bleListenerFromFlags(disc)
+	if err != nil {
+		l.Fatal().Err(err).Msg("parsing ble-listen flags")
+	}
+	if err := disc.MQTTConnect(ctx); err != nil {
+		l.Fatal().Err(err).Msg("connecting to MQTT broker")
+	}
+	if err := discoveryAddDevices(ctx, disc); err != nil {
+		l.Fatal().Err(err).Msg("adding devices")
+	}
+
+	var wg sync.WaitGroup
+	ready := make(chan struct{})
+	opts := []promserver.Option{
+		promserver.WithReady(func() { close(ready) }),
+		promserver.WithPrometheusNamespace(viper.GetString("prometheus-namespace")),
+		promserver.WithPrometheusSubsystem(viper.GetString("prometheus-subsystem")),
+		promserver.WithConcurrency(viper.GetInt("probe-concurrency")),
+		promserver.WithDeviceTimeout(viper.GetDuration("device-timeout")),
+		// Writes aren't subject to a scrape timeout; only warn if gathering takes most of the
+		// interval.
+		promserver.WithScrapeDurationWarning(viper.GetDuration("interval") * 8 / 10),
+		promserver.WithPollInterval(viper.GetDuration("poll-interval")),
+		promserver.WithPollJitter(viper.GetDuration("poll-jitter")),
+		promserver.WithPollMaxBackoff(viper.GetDuration("poll-max-backoff")),
+		promserver.WithPollStaleness(viper.GetDuration("poll-staleness")),
+		promserver.WithLabelMapper(lm),
+	}
+	if acc != nil {
+		opts = append(opts, promserver.WithEnergyAccumulator(acc))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acc.Run(ctx, viper.GetDuration("energy-save-interval"))
+		}()
+	}
+	if listener != nil {
+		opts = append(opts, promserver.WithBTHomeListener(listener))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := listener.Run(ctx); err != nil {
+				l.Err(err).Msg("listening for BLE advertisements")
+			}
+		}()
+	}
+	consumer, g := promserver.NewGatherer(ctx, disc, opts...)
+	e, err := pushexporter.NewExporter(viper.GetString("endpoint"), g,
+		pushexporter.WithFormat(viper.GetString("format")),
+		pushexporter.WithInterval(viper.GetDuration("interval")),
+		pushexporter.WithBatchSize(viper.GetInt("batch-size")),
+		pushexporter.WithTimeout(viper.GetDuration("write-timeout")),
+		pushexporter.WithGzip(viper.GetBool("gzip")),
+		pushexporter.WithHeaders(headers),
+		pushexporter.WithRetries(viper.GetInt("max-retries"), viper.GetDuration("retry-interval")),
+	)
+	if err != nil {
+		l.Fatal().Err(err).Msg("creating exporter")
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		consumer(ctx)
+	}()
+	if err := startReplay(ctx, disc, ready); err != nil {
+		l.Fatal().Err(err).Msg("starting replay")
+	}
+	l.Info().Str("endpoint", viper.GetString("endpoint")).Str("format", viper.GetString("format")).Msg("starting metrics export")
+	e.Run(ctx)
+	wg.Wait()
+}
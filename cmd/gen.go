@@ -6,6 +6,7 @@ import (
 	"github.com/jcodybaker/shellyctl/pkg/gencobra"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -304,6 +305,7 @@ var (
 func init() {
 	baggage := &gencobra.Baggage{
 		Output: Output,
+		Queue:  queueRequest,
 	}
 	cmds, err := gencobra.ComponentsToCmd(components, baggage)
 	if err != nil {
@@ -330,10 +332,15 @@ func init() {
 		}
 		childRun := childCmd.RunE
 		discoveryFlags(childCmd.Flags(), discoveryFlagsOptions{interactive: true})
+		queueFlags(childCmd.Flags())
 		childCmd.RunE = func(cmd *cobra.Command, args []string) error {
 			if err := rootCmd.PersistentPreRunE(cmd, args); err != nil {
 				return err
 			}
+			if viper.GetBool("queue") {
+				// Queued requests are addressed by topic prefix, without contacting the devices.
+				return childRun(cmd, args)
+			}
 			ctx := cmd.Context()
 			l := log.Ctx(ctx)
 			dOpts, err := discoveryOptionsFromFlags(cmd.Flags())
@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jcodybaker/shellyctl/pkg/bthome"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func bthomeKeyFlags(f *pflag.FlagSet) {
+	f.StringArray(
+		"bthome-key",
+		[]string{},
+		"encryption key of a BTHome device, specified as mac=key with the key hex encoded, ex. 3C:2E:F5:00:11:22=231d39c1d7cc1ab1aee224cd096db932. May be specified multiple times.")
+}
+
+func bleListenFlags(f *pflag.FlagSet) {
+	f.Bool(
+		"ble-listen",
+		false,
+		"if true, passively listen for BTHome advertisements from Shelly BLU and other BLE sensors, and export their readings. Cannot be combined with --ble-search or --ble-device.")
+	bthomeKeyFlags(f)
+}
+
+// bthomeOptionsFromFlags parses the `bthome-key` flags.
+func bthomeOptionsFromFlags() ([]bthome.Option, error) {
+	var opts []bthome.Option
+	for _, kv := range viper.GetStringSlice("bthome-key") {
+		mac, k, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid bthome-key %q; expected mac=key", kv)
+		}
+		key, err := bthome.ParseKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bthome-key for %q: %w", mac, err)
+		}
+		opts = append(opts, bthome.WithKey(strings.TrimSpace(mac), key))
+	}
+	return opts, nil
+}
+
+// bleListenerFromFlags returns a BTHome listener for disc, or nil if `ble-listen` is disabled.
+func bleListenerFromFlags(disc *discovery.Discoverer) (*bthome.Listener, error) {
+	if !viper.GetBool("ble-listen") {
+		if viper.IsSet("bthome-key") {
+			return nil, errors.New("bthome-key is invalid without ble-listen")
+		}
+		return nil, nil
+	}
+	// The adapter only runs one scan at a time, so listening would block searches and
+	// connections indefinitely.
+	if viper.GetBool("ble-search") {
+		return nil, errors.New("ble-listen cannot be combined with ble-search")
+	}
+	if len(viper.GetStringSlice("ble-device")) > 0 {
+		return nil, errors.New("ble-listen cannot be combined with ble-device")
+	}
+	opts, err := bthomeOptionsFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	return bthome.NewListener(disc, opts...), nil
+}
@@ -13,6 +13,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"math/rand"
 
@@ -164,6 +165,16 @@ func discoveryFlags(f *pflag.FlagSet, opts discoveryFlagsOptions) {
 		false,
 		"if set skip, verifying the TLS host certificate provided by the MQTT server.",
 	)
+	f.Bool(
+		"mqtt-v5",
+		false,
+		"if set, connect to the mqtt server with MQTT v5, matching RPC responses by response topic and correlation data.",
+	)
+	f.Duration(
+		"mqtt-max-reconnect-interval",
+		time.Minute,
+		"maximum interval between attempts to reconnect to the mqtt server after the connection is lost.",
+	)
 	f.Bool(
 		"mqtt-search",
 		false,
@@ -172,6 +183,19 @@ func discoveryFlags(f *pflag.FlagSet, opts discoveryFlagsOptions) {
 		"mqtt-device",
 		[]string{},
 		"topic prefix or device-id (ex. shellyplugus-0123456789ab) of device to add. `mqtt-device` may be specified multiple times to add mutiple devices.")
+	f.StringArray(
+		"mqtt-topic",
+		[]string{},
+		"MQTT `topic` filter to subscribe to for notifications. Topics of the form `<prefix>/status/<component>` are read as retained component status,\n"+
+			"others as RPC notification frames. May be specified multiple times. Defaults to `+/events/rpc` and `+/status/+`,\n"+
+			"or the topics of each `--mqtt-device`.")
+	if opts.withTTL {
+		f.Bool(
+			"mqtt-follow",
+			false,
+			"if true, devices found by any means will have their MQTT topic prefix looked up with MQTT.GetConfig and their\n"+
+				"notification, status, and online topics subscribed. Useful for devices with a custom topic prefix.")
+	}
 
 }
 
@@ -181,9 +205,6 @@ func discoveryOptionsFromFlags(flags *pflag.FlagSet) (opts []discovery.Discovere
 	// bleDevices := viper.GetStringSlice("ble-device")
 	// mqttDevices := viper.GetStringSlice("mqtt-device")
 	mqttDevices := viper.GetStringSlice("mqtt-device")
-	if len(mqttDevices) == 0 && !viper.IsSet("mqtt-topic") {
-		opts = append(opts, discovery.WithMQTTTopicSubscriptions([]string{"+/events/rpc"}))
-	}
 	mdnsSearch := viper.GetBool("mdns-search")
 	bleSearch := viper.GetBool("ble-search")
 	mqttSearch := viper.GetBool("mqtt-search")
@@ -225,80 +246,24 @@ func discoveryOptionsFromFlags(flags *pflag.FlagSet) (opts []discovery.Discovere
 	}
 
 	if viper.IsSet("mqtt-addr") {
-		mqttConnectOptions := mqtt.NewClientOptions()
-		var u *url.URL
-		addr := viper.GetString("mqtt-addr")
-		if strings.Contains(addr, "://") {
-			var err error
-			u, err = url.Parse(addr)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse `mqtt-addr`: %v", err)
-			}
-			if u.User != nil {
-				mqttConnectOptions.Username = u.User.Username()
-				mqttConnectOptions.Password, _ = u.User.Password()
-			}
-		} else {
-			u = &url.URL{
-				Host: addr,
-			}
-		}
-		mqttPort := u.Port()
-		if strings.EqualFold(u.Scheme, "mqtt") {
-			u.Scheme = "tcp"
-		}
-		if strings.EqualFold(u.Scheme, "mqtts") {
-			u.Scheme = "tcps"
-		}
-		if u.Scheme == "" {
-			if mqttPort == "1883" {
-				u.Scheme = "tcp"
-			} else {
-				u.Scheme = "tcps"
-			}
-		}
-		if mqttPort == "" {
-			if u.Scheme == "tcp" {
-				mqttPort = "1883"
-			} else {
-				mqttPort = "8883"
-			}
-		}
-		u.Host = net.JoinHostPort(u.Hostname(), mqttPort)
-		if viper.IsSet("mqtt-user") {
-			mqttConnectOptions.Username = viper.GetString("mqtt-user")
-		}
-		if viper.IsSet("mqtt-password") {
-			mqttConnectOptions.Password = viper.GetString("mqtt-password")
+		mqttConnectOptions, err := mqttClientOptionsFromFlags()
+		if err != nil {
+			return nil, err
 		}
-		if viper.IsSet("mqtt-tls-ca-cert") || viper.GetBool("mqtt-tls-insecure") {
-			mqttConnectOptions.TLSConfig = &tls.Config{
-				InsecureSkipVerify: viper.GetBool("mqtt-tls-insecure"),
+		topics := viper.GetStringSlice("mqtt-topic")
+		if len(topics) == 0 {
+			if len(mqttDevices) == 0 || mqttSearch {
+				topics = discovery.MQTTPrefixTopics("+")
 			}
-			if viper.IsSet("mqtt-tls-ca-cert") {
-				mqttConnectOptions.TLSConfig.RootCAs = x509.NewCertPool()
-				certs, err := os.ReadFile(viper.GetString("mqtt-tls-ca-cert"))
-				if err != nil {
-					return nil, fmt.Errorf("reading `mqtt-tls-ca-cert`: %w", err)
-				}
-				if ok := mqttConnectOptions.TLSConfig.RootCAs.AppendCertsFromPEM(certs); !ok {
-					return nil, fmt.Errorf("failed to parse `mqtt-tls-ca-cert` as PEM cert bundle")
-				}
+			for _, d := range mqttDevices {
+				topics = append(topics, discovery.MQTTPrefixTopics(d)...)
 			}
 		}
-		if viper.IsSet("mqtt-client-id") {
-			mqttConnectOptions.ClientID = viper.GetString("mqtt-client-id")
-		} else {
-			mqttConnectOptions.ClientID = fmt.Sprintf("shellyctl-%d", rand.Uint32())
-		}
-		if topics := viper.GetStringSlice("mqtt-topic"); len(topics) > 0 {
-			opts = append(opts)
-		}
-		mqttConnectOptions.Servers = append(mqttConnectOptions.Servers, u)
-		mqttConnectOptions.KeepAlive = 10
+		opts = append(opts, discovery.WithMQTTTopicSubscriptions(topics))
 		opts = append(opts,
 			discovery.WithMQTTConnectOptions(mqttConnectOptions),
-			discovery.WithMQTTSearchEnabled(viper.GetBool("mqtt-search")))
+			discovery.WithMQTTSearchEnabled(viper.GetBool("mqtt-search")),
+			discovery.WithMQTTFollow(viper.GetBool("mqtt-follow")))
 	} else {
 		if viper.IsSet("mqtt-user") {
 			return nil, errors.New("mqtt-user is invalid without mqtt-addr")
@@ -318,9 +283,21 @@ func discoveryOptionsFromFlags(flags *pflag.FlagSet) (opts []discovery.Discovere
 		if viper.IsSet("mqtt-device") {
 			return nil, errors.New("mqtt-device is invalid without mqtt-addr")
 		}
+		if viper.IsSet("mqtt-topic") {
+			return nil, errors.New("mqtt-topic is invalid without mqtt-addr")
+		}
+		if viper.IsSet("mqtt-follow") {
+			return nil, errors.New("mqtt-follow is invalid without mqtt-addr")
+		}
 		if viper.IsSet("mqtt-client-id") {
 			return nil, errors.New("mqtt-client-id is invalid without mqtt-addr")
 		}
+		if viper.IsSet("mqtt-max-reconnect-interval") {
+			return nil, errors.New("mqtt-max-reconnect-interval is invalid without mqtt-addr")
+		}
+		if viper.IsSet("mqtt-v5") {
+			return nil, errors.New("mqtt-v5 is invalid without mqtt-addr")
+		}
 	}
 
 	if searchInteractive {
@@ -349,6 +326,85 @@ func discoveryOptionsFromFlags(flags *pflag.FlagSet) (opts []discovery.Discovere
 	return opts, err
 }
 
+// mqttClientOptionsFromFlags builds the MQTT broker connection from the `mqtt-*` flags.
+func mqttClientOptionsFromFlags() (*mqtt.ClientOptions, error) {
+	mqttConnectOptions := mqtt.NewClientOptions()
+	var u *url.URL
+	addr := viper.GetString("mqtt-addr")
+	if strings.Contains(addr, "://") {
+		var err error
+		u, err = url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse `mqtt-addr`: %v", err)
+		}
+		if u.User != nil {
+			mqttConnectOptions.Username = u.User.Username()
+			mqttConnectOptions.Password, _ = u.User.Password()
+		}
+	} else {
+		u = &url.URL{
+			Host: addr,
+		}
+	}
+	mqttPort := u.Port()
+	if strings.EqualFold(u.Scheme, "mqtt") {
+		u.Scheme = "tcp"
+	}
+	if strings.EqualFold(u.Scheme, "mqtts") {
+		u.Scheme = "tcps"
+	}
+	if u.Scheme == "" {
+		if mqttPort == "1883" {
+			u.Scheme = "tcp"
+		} else {
+			u.Scheme = "tcps"
+		}
+	}
+	if mqttPort == "" {
+		if u.Scheme == "tcp" {
+			mqttPort = "1883"
+		} else {
+			mqttPort = "8883"
+		}
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), mqttPort)
+	if viper.IsSet("mqtt-user") {
+		mqttConnectOptions.Username = viper.GetString("mqtt-user")
+	}
+	if viper.IsSet("mqtt-password") {
+		mqttConnectOptions.Password = viper.GetString("mqtt-password")
+	}
+	if viper.IsSet("mqtt-tls-ca-cert") || viper.GetBool("mqtt-tls-insecure") {
+		mqttConnectOptions.TLSConfig = &tls.Config{
+			InsecureSkipVerify: viper.GetBool("mqtt-tls-insecure"),
+		}
+		if viper.IsSet("mqtt-tls-ca-cert") {
+			mqttConnectOptions.TLSConfig.RootCAs = x509.NewCertPool()
+			certs, err := os.ReadFile(viper.GetString("mqtt-tls-ca-cert"))
+			if err != nil {
+				return nil, fmt.Errorf("reading `mqtt-tls-ca-cert`: %w", err)
+			}
+			if ok := mqttConnectOptions.TLSConfig.RootCAs.AppendCertsFromPEM(certs); !ok {
+				return nil, fmt.Errorf("failed to parse `mqtt-tls-ca-cert` as PEM cert bundle")
+			}
+		}
+	}
+	if viper.IsSet("mqtt-client-id") {
+		mqttConnectOptions.ClientID = viper.GetString("mqtt-client-id")
+	} else {
+		mqttConnectOptions.ClientID = fmt.Sprintf("shellyctl-%d", rand.Uint32())
+	}
+	mqttConnectOptions.Servers = append(mqttConnectOptions.Servers, u)
+	mqttConnectOptions.KeepAlive = 10
+	if d := viper.GetDuration("mqtt-max-reconnect-interval"); d > 0 {
+		mqttConnectOptions.MaxReconnectInterval = d
+	}
+	if viper.GetBool("mqtt-v5") {
+		mqttConnectOptions.ProtocolVersion = 5
+	}
+	return mqttConnectOptions, nil
+}
+
 func discoveryAddDevices(ctx context.Context, d *discovery.Discoverer) error {
 	l := log.Ctx(ctx)
 	var wg sync.WaitGroup
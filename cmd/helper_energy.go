@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func energyFlags(f *pflag.FlagSet) {
+	f.Bool(
+		"energy-accumulate",
+		false,
+		"export energy counters which remain monotonic when a device resets its energy totals on reboot or firmware update. Implied by --energy-state-file.")
+
+	f.String(
+		"energy-state-file",
+		"",
+		"path to a file where accumulated energy totals are persisted, so they also survive restarts of shellyctl.")
+
+	f.Duration(
+		"energy-save-interval",
+		energy.DefaultSaveInterval,
+		"interval at which accumulated energy totals are written to --energy-state-file.")
+}
+
+// energyAccumulatorFromFlags returns the configured energy accumulator, or nil if accumulation
+// is disabled.
+func energyAccumulatorFromFlags() (*energy.Accumulator, error) {
+	path := viper.GetString("energy-state-file")
+	if path == "" && !viper.GetBool("energy-accumulate") {
+		return nil, nil
+	}
+	return energy.NewAccumulator(path)
+}
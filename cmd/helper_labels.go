@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jcodybaker/shellyctl/pkg/labels"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+func labelFlags(f *pflag.FlagSet) {
+	f.StringArray(
+		"label",
+		nil,
+		"static label specified as `k=v` to add to all device metrics. May be specified multiple times. "+
+			"Per-device labels may be set with the `device-labels` config file key, a map of device MAC, name, or address to labels.")
+
+	f.Bool(
+		"drop-instance-label",
+		false,
+		"omit the instance label from device metrics to reduce cardinality.")
+
+	f.Bool(
+		"location-labels",
+		false,
+		"add location_tz, location_lat, and location_lon labels from each device's configured location.")
+}
+
+func labelMapperFromFlags() (*labels.Mapper, error) {
+	opts := []labels.Option{
+		labels.WithDropInstance(viper.GetBool("drop-instance-label")),
+		labels.WithLocation(viper.GetBool("location-labels")),
+	}
+	if l := viper.GetStringSlice("label"); len(l) > 0 {
+		static := make(map[string]string, len(l))
+		for _, kv := range l {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid label %q; expected k=v", kv)
+			}
+			static[k] = v
+		}
+		opts = append(opts, labels.WithStaticLabels(static))
+	}
+	deviceLabels, err := deviceLabelsFromConfig()
+	if err != nil {
+		return nil, err
+	}
+	for device, l := range deviceLabels {
+		deviceLabels, err := cast.ToStringMapStringE(l)
+		if err != nil {
+			return nil, fmt.Errorf("parsing device-labels for %q: %w", device, err)
+		}
+		opts = append(opts, labels.WithDeviceLabels(device, deviceLabels))
+	}
+	return labels.NewMapper(opts...)
+}
+
+// deviceLabelsFromConfig returns the `device-labels` config file key. Viper lowercases every key,
+// including the label names nested within it, so the config file is decoded again to keep the
+// names as written. INI files fall back to viper.
+func deviceLabelsFromConfig() (map[string]any, error) {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return nil, nil
+	}
+	var raw map[string]any
+	var unmarshal func([]byte, any) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	case ".json":
+		unmarshal = json.Unmarshal
+	case ".toml":
+		unmarshal = toml.Unmarshal
+	default:
+		return viper.GetStringMap("device-labels"), nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	if err := unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing config file: %w", err)
+	}
+	for k, v := range raw {
+		// Like viper, the key itself is case-insensitive.
+		if strings.EqualFold(k, "device-labels") {
+			m, err := cast.ToStringMapE(v)
+			if err != nil {
+				return nil, fmt.Errorf("parsing device-labels: %w", err)
+			}
+			return m, nil
+		}
+	}
+	return nil, nil
+}
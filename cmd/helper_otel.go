@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jcodybaker/shellyctl/pkg/otlpexporter"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func otlpExporterFlags(f *pflag.FlagSet) {
+	d := otlpexporter.Default()
+	f.String("otel-exporter-protocol", d.Protocol, "OTEL exporter protocol. This may be one of `grpc`, `https`, `http`, or `prometheus` (metrics only).")
+	f.String("otel-exporter-endpoint", "", "OTEL endpoint to send metrics to. This may be in the format of `example.com:4317` or URI `https://example.com:4318/v1/metrics`. OTLP/HTTP URIs without a path are sent to the signal's default path.")
+	f.Bool("otel-exporter-insecure", false, "OTEL exporter insecure flag. This is needed if the endpoint does not support TLS.")
+	f.Bool("otel-exporter-gzip", false, "OTEL exporter gzip flag. This will enable gzip compression on the request body.")
+	f.StringArray("otel-exporter-header", nil, "OTEL exporter headers specified as `k=v` to add to the request. This may be specified multiple times.")
+	f.String("otel-exporter-ca-file", "", "path to a PEM encoded CA bundle used to verify the OTEL endpoint's certificate.")
+	f.String("otel-exporter-client-cert", "", "path to a PEM encoded client certificate presented to the OTEL endpoint.")
+	f.String("otel-exporter-client-key", "", "path to a PEM encoded private key for --otel-exporter-client-cert.")
+	f.Bool("otel-exporter-retry", d.Retry.Enabled, "OTEL exporter retry flag. This will enable retry logic on the exporter.")
+	f.Duration("otel-exporter-retry-initial-interval", d.Retry.InitialInterval, "OTEL exporter retry initial interval. This is the time to wait between retries.")
+	f.Duration("otel-exporter-retry-max-interval", d.Retry.MaxInterval, "OTEL exporter retry max interval. This is the upper bound on backoff interval. Once this value is reached the delay between consecutive retries will always be the max-interval.")
+	f.Duration("otel-exporter-retry-max-elapsed-time", d.Retry.MaxElapsedTime, "OTEL exporter retry max elapsed time. This is the maximum amount of time (including retries) spent trying to send a request/batch. Once this value is reached, the data is discarded.")
+	f.Duration("otel-exporter-timeout", d.Timeout, "OTEL exporter timeout. This is the maximum time to wait for a request to complete.")
+}
+
+// otlpConfigFromFlags builds the exporter configuration for a signal. The standard
+// OTEL_EXPORTER_OTLP_* environment variables are applied over the defaults, and explicitly set
+// --otel-exporter-* flags take precedence over both.
+func otlpConfigFromFlags(signal otlpexporter.Signal) (*otlpexporter.Config, error) {
+	c := otlpexporter.Default()
+	if err := c.ApplyEnv(signal, os.LookupEnv); err != nil {
+		return nil, fmt.Errorf("parsing OTEL_EXPORTER_OTLP environment: %w", err)
+	}
+	if viper.IsSet("otel-exporter-protocol") {
+		c.Protocol = viper.GetString("otel-exporter-protocol")
+	}
+	if viper.IsSet("otel-exporter-endpoint") {
+		c.Endpoint = viper.GetString("otel-exporter-endpoint")
+	}
+	if viper.IsSet("otel-exporter-insecure") {
+		c.Insecure = viper.GetBool("otel-exporter-insecure")
+	}
+	if viper.IsSet("otel-exporter-gzip") {
+		c.Gzip = viper.GetBool("otel-exporter-gzip")
+	}
+	if viper.IsSet("otel-exporter-header") {
+		headers, err := otlpexporter.ParseHeaders(viper.GetStringSlice("otel-exporter-header"), false)
+		if err != nil {
+			return nil, err
+		}
+		c.Headers = headers
+	}
+	if viper.IsSet("otel-exporter-ca-file") {
+		c.CAFile = viper.GetString("otel-exporter-ca-file")
+	}
+	if viper.IsSet("otel-exporter-client-cert") {
+		c.ClientCertFile = viper.GetString("otel-exporter-client-cert")
+	}
+	if viper.IsSet("otel-exporter-client-key") {
+		c.ClientKeyFile = viper.GetString("otel-exporter-client-key")
+	}
+	if viper.IsSet("otel-exporter-timeout") {
+		c.Timeout = viper.GetDuration("otel-exporter-timeout")
+	}
+	c.Retry = otlpexporter.RetryConfig{
+		Enabled:         viper.GetBool("otel-exporter-retry"),
+		InitialInterval: viper.GetDuration("otel-exporter-retry-initial-interval"),
+		MaxInterval:     viper.GetDuration("otel-exporter-retry-max-interval"),
+		MaxElapsedTime:  viper.GetDuration("otel-exporter-retry-max-elapsed-time"),
+	}
+	// Validate the TLS configuration before any exporters are created.
+	if _, err := c.TLSConfig(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func replayFlags(f *pflag.FlagSet) {
+	f.String("replay", "", "path to a notification `file` recorded by watch --record. Its notifications are replayed as if received from devices.")
+	f.Float64("replay-speed", 1, "speed multiplier for --replay. 0 replays notifications as fast as they can be consumed.")
+	f.Bool("replay-original-time", false, "report the recorded receive times of replayed notifications, rather than the time they were replayed.")
+}
+
+// startReplay replays the --replay recording, if any, in the background until it's exhausted or
+// ctx is done. If ready is non-nil, the replay starts once it's closed, which consumers do after
+// subscribing to notifications.
+func startReplay(ctx context.Context, disc *discovery.Discoverer, ready <-chan struct{}) error {
+	path := viper.GetString("replay")
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening recording: %w", err)
+	}
+	opts := []discovery.ReplayOption{discovery.WithReplaySpeed(viper.GetFloat64("replay-speed"))}
+	if viper.GetBool("replay-original-time") {
+		opts = append(opts, discovery.WithReplayOriginalTime())
+	}
+	go func() {
+		defer f.Close()
+		if ready != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ready:
+			}
+		}
+		if err := disc.Replay(ctx, f, opts...); err != nil && ctx.Err() == nil {
+			log.Ctx(ctx).Err(err).Str("path", path).Msg("replaying notifications")
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcodybaker/shellyctl/pkg/webconfig"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func webServerFlags(f *pflag.FlagSet) {
+	f.String(
+		"web-config",
+		"",
+		"path to a Prometheus compatible web-config.yml file configuring TLS and basic auth for the metrics server.")
+
+	f.String(
+		"tls-cert",
+		"",
+		"path to a PEM encoded certificate. If specified with --tls-key, the metrics server will use TLS.")
+
+	f.String(
+		"tls-key",
+		"",
+		"path to a PEM encoded private key for --tls-cert.")
+
+	f.String(
+		"tls-client-ca",
+		"",
+		"path to a PEM encoded CA bundle. If specified, clients must present a certificate signed by this CA.")
+
+	f.String(
+		"bearer-token-file",
+		"",
+		"path to a file containing a token which clients must present in an Authorization: Bearer header.")
+}
+
+// webConfigFromFlags loads the --web-config file, if any, and applies the TLS and bearer token
+// flags over it.
+func webConfigFromFlags() (*webconfig.Config, error) {
+	c := &webconfig.Config{}
+	if path := viper.GetString("web-config"); path != "" {
+		var err error
+		if c, err = webconfig.Load(path); err != nil {
+			return nil, err
+		}
+	}
+	cert, key, ca := viper.GetString("tls-cert"), viper.GetString("tls-key"), viper.GetString("tls-client-ca")
+	if cert != "" || key != "" || ca != "" {
+		if c.TLSServerConfig == nil {
+			c.TLSServerConfig = &webconfig.TLSServerConfig{}
+		}
+		if cert != "" {
+			c.TLSServerConfig.CertFile, c.TLSServerConfig.Cert = cert, ""
+		}
+		if key != "" {
+			c.TLSServerConfig.KeyFile, c.TLSServerConfig.Key = key, ""
+		}
+		if ca != "" {
+			c.TLSServerConfig.ClientCAFile = ca
+		}
+	}
+	if path := viper.GetString("bearer-token-file"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading bearer token file: %w", err)
+		}
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return nil, fmt.Errorf("bearer token file %q is empty", path)
+		}
+		c.BearerTokens = append(c.BearerTokens, token)
+	}
+	// Validate the TLS configuration before we start serving.
+	if _, err := c.TLSConfig(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,304 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	mqttOnboardCmd = &cobra.Command{
+		Use:   "onboard",
+		Short: "Configure devices to connect to the --mqtt-addr broker and verify they announce",
+		RunE:  mqttOnboardCmdRunE,
+	}
+)
+
+func init() {
+	mqttOnboardCmd.Flags().String(
+		"topic-prefix", "{{.ID}}", "template for each device's topic_prefix. Fields are .ID, .Name, .MAC, and .Model.",
+	)
+	mqttOnboardCmd.Flags().String(
+		"device-client-id", "{{.ID}}", "template for each device's client_id, with the same fields as --topic-prefix.",
+	)
+	mqttOnboardCmd.Flags().Bool(
+		"rpc-ntf", true, "publish RPC notifications on <prefix>/events/rpc.",
+	)
+	mqttOnboardCmd.Flags().Bool(
+		"status-ntf", false, "publish component status on <prefix>/status/<component>.",
+	)
+	mqttOnboardCmd.Flags().Bool(
+		"enable-control", true, "allow the device to be controlled over MQTT.",
+	)
+	mqttOnboardCmd.Flags().Bool(
+		"no-reboot", false, "don't reboot devices which require it to apply the config. Their announcement can't be verified.",
+	)
+	mqttOnboardCmd.Flags().Duration(
+		"verify-timeout", 2*time.Minute, "time to wait for configured devices to announce themselves over MQTT. 0 skips verification.",
+	)
+	mqttOnboardCmd.Flags().Duration(
+		"announce-interval", 5*time.Second, "interval between MQTT announce requests while verifying.",
+	)
+	mqttComponent.Parent.AddCommand(mqttOnboardCmd)
+	discoveryFlags(mqttOnboardCmd.Flags(), discoveryFlagsOptions{interactive: true})
+}
+
+// onboardTemplateData is available to the --topic-prefix and --device-client-id templates.
+type onboardTemplateData struct {
+	ID    string
+	Name  string
+	MAC   string
+	Model string
+}
+
+// onboardResult is output for each onboarded device.
+type onboardResult struct {
+	Device      string `json:"device"`
+	ID          string `json:"id"`
+	TopicPrefix string `json:"topic_prefix"`
+	Rebooted    bool   `json:"rebooted"`
+	// PendingReboot is set if the device requires a reboot which was skipped with --no-reboot.
+	PendingReboot bool `json:"pending_reboot"`
+	Announced     bool `json:"announced"`
+}
+
+func mqttOnboardCmdRunE(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	ll := log.Ctx(ctx).With().Str("request", (&shelly.MQTTSetConfigRequest{}).Method()).Logger()
+	if !viper.IsSet("mqtt-addr") {
+		return errors.New("--mqtt-addr is required")
+	}
+	dOpts, err := discoveryOptionsFromFlags(cmd.Flags())
+	if err != nil {
+		return fmt.Errorf("parsing flags: %w", err)
+	}
+	cfg, caPEM, err := onboardConfigFromFlags()
+	if err != nil {
+		return err
+	}
+	topicPrefix, err := template.New("topic-prefix").Parse(viper.GetString("topic-prefix"))
+	if err != nil {
+		return fmt.Errorf("parsing --topic-prefix: %w", err)
+	}
+	clientID, err := template.New("device-client-id").Parse(viper.GetString("device-client-id"))
+	if err != nil {
+		return fmt.Errorf("parsing --device-client-id: %w", err)
+	}
+
+	discoverer := discovery.NewDiscoverer(dOpts...)
+	if err := discoverer.MQTTConnect(ctx); err != nil {
+		return fmt.Errorf("connecting to MQTT broker: %w", err)
+	}
+	if err := discoveryAddDevices(ctx, discoverer); err != nil {
+		return fmt.Errorf("adding devices: %w", err)
+	}
+	if _, err := discoverer.Search(ctx); err != nil {
+		return err
+	}
+
+	var results []*onboardResult
+	var ids []string
+	for _, d := range discoverer.AllDevices() {
+		ll := d.Log(ll)
+		data := onboardTemplateData{ID: d.ID, Name: d.Name, MAC: d.MACAddr, Model: d.Model}
+		devCfg := cfg
+		prefix, err := executeTemplate(topicPrefix, data)
+		if err != nil {
+			return fmt.Errorf("executing --topic-prefix for %s: %w", d.BestName(), err)
+		}
+		devCfg.TopicPrefix = (*shelly.NullString)(shelly.StrPtr(prefix))
+		id, err := executeTemplate(clientID, data)
+		if err != nil {
+			return fmt.Errorf("executing --device-client-id for %s: %w", d.BestName(), err)
+		}
+		devCfg.ClientID = (*shelly.NullString)(shelly.StrPtr(id))
+
+		restartRequired, err := onboardDevice(ctx, d, devCfg, caPEM)
+		if err != nil {
+			if viper.GetBool("skip-failed-hosts") {
+				ll.Err(err).Msg("error onboarding device; contining because --skip-failed-hosts=true")
+				continue
+			}
+			return fmt.Errorf("onboarding %s: %w", d.BestName(), err)
+		}
+		r := &onboardResult{
+			Device:      d.BestName(),
+			ID:          d.ID,
+			TopicPrefix: prefix,
+		}
+		if restartRequired {
+			if viper.GetBool("no-reboot") {
+				ll.Warn().Msg("device requires a reboot to apply mqtt config; skipping because --no-reboot=true")
+				r.PendingReboot = true
+			} else if err := reboot(ctx, d); err != nil {
+				return fmt.Errorf("rebooting %s: %w", d.BestName(), err)
+			} else {
+				r.Rebooted = true
+			}
+		}
+		ll.Info().Str("topic_prefix", prefix).Bool("rebooted", r.Rebooted).Msg("configured mqtt")
+		results = append(results, r)
+		if !r.PendingReboot {
+			ids = append(ids, d.ID)
+		}
+	}
+
+	var failed int
+	if timeout := viper.GetDuration("verify-timeout"); timeout > 0 && len(ids) > 0 {
+		ll.Info().Int("devices", len(ids)).Msg("waiting for devices to announce over mqtt")
+		verifyCtx, cancel := context.WithTimeout(ctx, timeout)
+		announced, err := discoverer.AwaitMQTTAnnounce(verifyCtx, ids, viper.GetDuration("announce-interval"))
+		cancel()
+		if err != nil {
+			return fmt.Errorf("verifying mqtt announcements: %w", err)
+		}
+		for _, r := range results {
+			r.Announced = announced[r.ID]
+			if !r.Announced && !r.PendingReboot {
+				failed++
+			}
+		}
+	}
+	for _, r := range results {
+		Output(
+			ctx,
+			fmt.Sprintf("MQTT onboarding result for %s", r.Device),
+			"result",
+			r,
+			nil,
+		)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d device(s) didn't announce over mqtt within --verify-timeout", failed)
+	}
+	return nil
+}
+
+// onboardConfigFromFlags builds the device MQTT config shared by all devices from the broker flags.
+// If the broker is verified with --mqtt-tls-ca-cert, the CA is returned to be installed on devices
+// as their user CA.
+func onboardConfigFromFlags() (cfg shelly.MQTTConfig, caPEM []byte, err error) {
+	opts, err := mqttClientOptionsFromFlags()
+	if err != nil {
+		return cfg, nil, err
+	}
+	u := opts.Servers[0]
+	cfg = shelly.MQTTConfig{
+		Enable:        shelly.BoolPtr(true),
+		Server:        (*shelly.NullString)(shelly.StrPtr(u.Host)),
+		RPC_NTF:       shelly.BoolPtr(viper.GetBool("rpc-ntf")),
+		Status_NTF:    shelly.BoolPtr(viper.GetBool("status-ntf")),
+		EnableControl: shelly.BoolPtr(viper.GetBool("enable-control")),
+	}
+	if opts.Username != "" {
+		cfg.User = shelly.StrPtr(opts.Username)
+	}
+	if opts.Password != "" {
+		cfg.Pass = (*shelly.NullString)(shelly.StrPtr(opts.Password))
+	}
+	switch {
+	case u.Scheme == "tcp":
+		cfg.SSL_CA = shelly.MQTT_SSL_CA_NULL
+	case viper.GetBool("mqtt-tls-insecure"):
+		cfg.SSL_CA = shelly.MQTT_SSL_CA_NO_VERIFY
+	case viper.IsSet("mqtt-tls-ca-cert"):
+		cfg.SSL_CA = shelly.MQTT_SSL_CA_USER_CA
+		if caPEM, err = os.ReadFile(viper.GetString("mqtt-tls-ca-cert")); err != nil {
+			return cfg, nil, fmt.Errorf("reading `mqtt-tls-ca-cert`: %w", err)
+		}
+	default:
+		cfg.SSL_CA = shelly.MQTT_SSL_CA_DEFAULT_CA
+	}
+	return cfg, caPEM, nil
+}
+
+// onboardDevice installs the CA, if any, and applies the MQTT config to a device. It reports
+// whether the device must be rebooted to apply the config.
+func onboardDevice(ctx context.Context, d *discovery.Device, cfg shelly.MQTTConfig, caPEM []byte) (restartRequired bool, err error) {
+	ll := d.LogCtx(ctx)
+	conn, err := d.Open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := conn.Disconnect(ctx); err != nil {
+			ll.Warn().Err(err).Msg("disconnecting from device")
+		}
+	}()
+	if len(caPEM) > 0 {
+		if err := putUserCA(ctx, conn, d, caPEM); err != nil {
+			return false, err
+		}
+	}
+	req := &shelly.MQTTSetConfigRequest{Config: cfg}
+	resp := req.NewTypedResponse()
+	if err := onboardDo(ctx, conn, d, req, resp); err != nil {
+		return false, err
+	}
+	return resp.RestartRequired, nil
+}
+
+func reboot(ctx context.Context, d *discovery.Device) error {
+	ll := d.LogCtx(ctx)
+	conn, err := d.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Disconnect(ctx); err != nil {
+			ll.Warn().Err(err).Msg("disconnecting from device")
+		}
+	}()
+	req := &shelly.ShellyRebootRequest{}
+	return onboardDo(ctx, conn, d, req, req.NewResponse())
+}
+
+// putUserCA replaces the device's user CA, sending the PEM data a line at a time. The scanner drops
+// line endings, so each line's newline is restored; the device can't parse the PEM without them.
+func putUserCA(ctx context.Context, conn mgrpc.MgRPC, d *discovery.Device, caPEM []byte) error {
+	s := bufio.NewScanner(strings.NewReader(string(caPEM)))
+	var line int
+	for s.Scan() {
+		line++
+		req := &shelly.ShellyPutUserCARequest{Data: shelly.StrPtr(s.Text() + "\n"), Append: line > 1}
+		if err := onboardDo(ctx, conn, d, req, req.NewResponse()); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+func onboardDo(ctx context.Context, conn mgrpc.MgRPC, d *discovery.Device, req shelly.RPCRequestBody, resp any) error {
+	reqContext := ctx
+	cancel := func() {} // no-op
+	if dur := viper.GetDuration("rpc-timeout"); dur != 0 {
+		reqContext, cancel = context.WithTimeout(ctx, dur)
+	}
+	defer cancel()
+	ll := d.LogCtx(ctx)
+	ll.Debug().Str("method", req.Method()).Any("request_body", req).Msg("sending request")
+	if _, err := shelly.Do(reqContext, conn, d.AuthCallback(ctx), req, resp); err != nil {
+		return fmt.Errorf("executing %s: %w", req.Method(), err)
+	}
+	return nil
+}
+
+func executeTemplate(t *template.Template, data any) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -1,18 +1,28 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
+	"sync"
+	"time"
 
-	"github.com/jcodybaker/go-shelly"
 	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 func init() {
+	watchFlags(notificationsCmd.Flags())
+	watchFilterFlags(notificationsCmd.Flags())
+	replayFlags(notificationsCmd.Flags())
+	notificationsCmd.Flags().String("record", "", "append the raw notification frames and their arrival times to this `file`, for use with --replay. All notifications are recorded, regardless of filters.")
 	discoveryFlags(notificationsCmd.Flags(), discoveryFlagsOptions{
 		withTTL:                    true,
 		interactive:                false,
@@ -29,8 +39,7 @@ var notificationsCmd = &cobra.Command{
 	Use:     "watch",
 	GroupID: "notifications",
 	Aliases: []string{""},
-	// TODO - Support subscriptions via BLE + Websocket Server
-	Short: "Subscribe to status notifications (via MQTT)",
+	Short:   "Subscribe to status and event notifications (via MQTT, websocket, or BLE)",
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx, signalStop := signal.NotifyContext(ctx, os.Interrupt)
 		defer signalStop()
@@ -41,10 +50,25 @@ var notificationsCmd = &cobra.Command{
 		if err != nil {
 			l.Fatal().Err(err).Msg("parsing flags")
 		}
+		filter := watchFilterFromFlags()
+		var recorder *discovery.Recorder
+		if path := viper.GetString("record"); path != "" {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+			if err != nil {
+				l.Fatal().Err(err).Msg("opening recording")
+			}
+			defer f.Close()
+			recorder = discovery.NewRecorder(f)
+		}
 		disc := discovery.NewDiscoverer(dOpts...)
-		fsnChan := disc.GetFullStatusNotifications(50)
-		snChan := disc.GetStatusNotifications(50)
-		enChan := disc.GetEventNotifications(50)
+		fullStatus := disc.SubscribeFullStatus()
+		defer fullStatus.Unsubscribe()
+		status := disc.SubscribeStatus()
+		defer status.Unsubscribe()
+		events := disc.SubscribeEvents()
+		defer events.Unsubscribe()
+		presence := disc.SubscribePresence()
+		defer presence.Unsubscribe()
 		if err := disc.MQTTConnect(ctx); err != nil {
 			l.Fatal().Err(err).Msg("connecting to MQTT broker")
 		}
@@ -52,50 +76,24 @@ var notificationsCmd = &cobra.Command{
 			l.Fatal().Err(err).Msg("adding devices")
 		}
 
-		for _, d := range disc.AllDevices() {
-			d := d
-			m, err := d.Open(ctx)
-			if err != nil {
-				if viper.GetBool("skip-failed-hosts") {
-					l.Warn().Err(err).
-						Str("instance", d.Instance()).
-						Str("name", d.BestName()).
-						Msg("failed to open device; skipping")
-					continue
-				} else {
-					l.Fatal().Err(err).
-						Str("instance", d.Instance()).
-						Str("name", d.BestName()).
-						Msg("failed to open device")
-				}
-			}
-			// We need to make an initial request for websockets
-			r := &shelly.ShellyGetConfigRequest{}
-			_, respF, err := r.Do(ctx, m, d.AuthCallback(ctx))
-			if err != nil {
-				if viper.GetBool("skip-failed-hosts") {
-					l.Warn().Err(err).
-						Str("instance", d.Instance()).
-						Str("name", d.BestName()).
-						Msg("failed to open device; skipping")
-					continue
-				} else {
-					l.Fatal().Err(err).
-						Str("instance", d.Instance()).
-						Str("name", d.BestName()).
-						Msg("failed to open device")
-				}
-			}
-			log.Info().Int64("id", respF.ID).Msg("connection established")
-			defer m.Disconnect(ctx)
+		wg := watchDevices(ctx, disc)
+		defer wg.Wait()
+		// Notifications are subscribed above, so the replay can start immediately.
+		if err := startReplay(ctx, disc, nil); err != nil {
+			l.Fatal().Err(err).Msg("starting replay")
 		}
 		log.Info().Msg("beginning notification announcements")
 		for {
+			var envs []*eventstream.Envelope
 			select {
 			case <-ctx.Done():
-				l.Info().Msg("shutting down notification watch")
+				l.Info().
+					Uint64("dropped_full_status", fullStatus.Dropped()).
+					Uint64("dropped_status", status.Dropped()).
+					Uint64("dropped_events", events.Dropped()).
+					Msg("shutting down notification watch")
 				return
-			case fsn := <-fsnChan:
+			case fsn := <-fullStatus.C():
 				log.Debug().
 					Str("src", fsn.Frame.Src).
 					Str("dst", fsn.Frame.Dst).
@@ -104,14 +102,9 @@ var notificationsCmd = &cobra.Command{
 					Float64("timestamp", fsn.Status.TS).
 					Str("raw", string(fsn.Frame.Params)).
 					Msg("got NotifyFullStatus")
-				Output(
-					ctx,
-					fmt.Sprintf("Received NotifyFullStatus frame from %s", fsn.Frame.Src),
-					"notification",
-					fsn.Status,
-					fsn.Frame.Params,
-				)
-			case sn := <-snChan:
+				record(ctx, recorder, fsn.ReceivedAt, fsn.Frame)
+				envs, err = eventstream.FromStatus(fsn, disc.DeviceBySrc(fsn.Frame.Src))
+			case sn := <-status.C():
 				log.Debug().
 					Str("src", sn.Frame.Src).
 					Str("dst", sn.Frame.Dst).
@@ -120,14 +113,9 @@ var notificationsCmd = &cobra.Command{
 					Float64("timestamp", sn.Status.TS).
 					Str("raw", string(sn.Frame.Params)).
 					Msg("got NotifyStatus")
-				Output(
-					ctx,
-					fmt.Sprintf("Received NotifyStatus frame from %s", sn.Frame.Src),
-					"notification",
-					sn.Status,
-					sn.Frame.Params,
-				)
-			case en := <-enChan:
+				record(ctx, recorder, sn.ReceivedAt, sn.Frame)
+				envs, err = eventstream.FromStatus(sn, disc.DeviceBySrc(sn.Frame.Src))
+			case en := <-events.C():
 				log.Debug().
 					Str("src", en.Frame.Src).
 					Str("dst", en.Frame.Dst).
@@ -135,15 +123,106 @@ var notificationsCmd = &cobra.Command{
 					Any("msg", en.Event).
 					Float64("timestamp", en.Event.TS).
 					Str("raw", string(en.Frame.Params)).
-					Msg("got NotifyStatus")
+					Msg("got NotifyEvent")
+				record(ctx, recorder, en.ReceivedAt, en.Frame)
+				envs, err = eventstream.FromEvent(en, disc.DeviceBySrc(en.Frame.Src))
+			case pn := <-presence.C():
+				var e *eventstream.Envelope
+				e, err = eventstream.FromPresence(pn)
+				envs = []*eventstream.Envelope{e}
+			}
+			if err != nil {
+				l.Warn().Err(err).Msg("decoding notification")
+				continue
+			}
+			for _, e := range envs {
+				if !filter.Match(e) {
+					continue
+				}
+				raw, err := json.Marshal(e)
+				if err != nil {
+					l.Err(err).Msg("encoding notification")
+					continue
+				}
 				Output(
 					ctx,
-					fmt.Sprintf("Received NotifyStatus frame from %s", en.Frame.Src),
+					fmt.Sprintf("Received %s from %s", e.Method, e.Src),
 					"notification",
-					en.Event,
-					en.Frame.Params,
+					e,
+					raw,
 				)
 			}
 		}
 	},
 }
+
+// record writes a frame to the recording, if one is configured.
+func record(ctx context.Context, r *discovery.Recorder, receivedAt time.Time, f *frame.Frame) {
+	if r == nil {
+		return
+	}
+	if err := r.Record(receivedAt, f); err != nil {
+		log.Ctx(ctx).Err(err).Msg("recording notification")
+	}
+}
+
+func watchFlags(f *pflag.FlagSet) {
+	f.Duration("watch-max-backoff", discovery.DefaultWatchMaxBackoff, "maximum delay between attempts to resubscribe to a device whose connection has dropped.")
+}
+
+// watchDevices watches each known device, and each device discovered later, until ctx is done,
+// resubscribing when connections drop. Unless --skip-failed-hosts is set, a device which can't be
+// subscribed to is fatal. The returned WaitGroup completes when all watches have stopped.
+func watchDevices(ctx context.Context, disc *discovery.Discoverer) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	skipFailedHosts := viper.GetBool("skip-failed-hosts")
+	watched := make(map[string]bool)
+	watch := func(d *discovery.Device) {
+		if watched[d.MACAddr] {
+			return
+		}
+		watched[d.MACAddr] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := d.Watch(ctx, viper.GetDuration("watch-max-backoff"), discovery.WithWatchRetryInitial(skipFailedHosts))
+			if err != nil {
+				ll := d.LogCtx(ctx)
+				ll.Fatal().Err(err).Msg("subscribing to notifications; set --skip-failed-hosts to keep retrying")
+			}
+		}()
+	}
+	// Subscribe before listing known devices, so devices added in between aren't missed.
+	added := disc.SubscribeDevices()
+	for _, d := range disc.AllDevices() {
+		watch(d)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer added.Unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case d := <-added.C():
+				watch(d)
+			}
+		}
+	}()
+	return &wg
+}
+
+func watchFilterFlags(f *pflag.FlagSet) {
+	f.StringSlice("method", nil, "only output notifications with this `method`: NotifyStatus, NotifyFullStatus, NotifyEvent, or Presence. May be specified multiple times.")
+	f.StringSlice("component", nil, "only output notifications for this `component`, specified as a key like switch:0 or a type like switch. May be specified multiple times.")
+	f.StringSlice("event", nil, "only output events with this `name`, ex. single_push. Status notifications are omitted. May be specified multiple times.")
+}
+
+func watchFilterFromFlags() *eventstream.Filter {
+	return &eventstream.Filter{
+		Methods:    viper.GetStringSlice("method"),
+		Components: viper.GetStringSlice("component"),
+		Events:     viper.GetStringSlice("event"),
+	}
+}
@@ -1,20 +1,26 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/jcodybaker/shellyctl/pkg/discovery"
 	"github.com/jcodybaker/shellyctl/pkg/otelserver"
+	"github.com/jcodybaker/shellyctl/pkg/otlpexporter"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
-	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 func init() {
@@ -22,23 +28,23 @@ func init() {
 	otelCmd.Flags().String("meter-name", otelserver.DefeaultMeterName, "name of the meter")
 
 	otelCmd.Flags().Duration("otel-exporter-interval", 10*time.Second, "OTEL exporter interval. This is the time between sending batches of metrics.")
-	otelCmd.Flags().String("otel-exporter-protocol", "grpc", "OTEL exporter protocol. This may be one of `grpc`, `https` or `http`.")
-	otelCmd.Flags().String("otel-exporter-endpoint", "", "OTEL endpoint to send metrics to. This may be in the format of `example.com:4317` or URI `https://example.com:4318/v1/traces`.")
-	otelCmd.Flags().Bool("otel-exporter-insecure", false, "OTEL exporter insecure flag. This is needed if the endpoint does not support TLS.")
-	otelCmd.Flags().Bool("otel-exporter-gzip", false, "OTEL exporter gzip flag. This will enable gzip compression on the request body.")
-	otelCmd.Flags().StringArray("otel-exporter-header", nil, "OTEL exporter headers specified as `k=v` to add to the request. This may be specified multiple times.")
-	otelCmd.Flags().Bool("otel-exporter-retry", true, "OTEL exporter retry flag. This will enable retry logic on the exporter.")
-	otelCmd.Flags().Duration("otel-exporter-retry-initial-interval", 5*time.Second, "OTEL exporter retry initial interval. This is the time to wait between retries.")
-	otelCmd.Flags().Duration("otel-exporter-retry-max-interval", 30*time.Second, "OTEL exporter retry initial interval. This is the upper bound on backoff interval. Once this value is reached the delay between consecutive retries will always be the max-interval.")
-	otelCmd.Flags().Duration("otel-exporter-retry-max-elapsed-time", 1*time.Minute, "OTEL exporter retry initial interval. This is the maximum amount of time (including retries) spent trying to send a request/batch. Once this value is reached, the data is discarded.")
-	otelCmd.Flags().Duration("otel-exporter-timeout", 10*time.Second, "OTEL exporter timeout. This is the maximum time to wait for a request to complete.")
+	otlpExporterFlags(otelCmd.Flags())
+	otelCmd.Flags().Bool("otel-logs", false, "export device events (button presses, input toggles, script and update events) as log records with the OTEL exporter. This requires the grpc, http or https protocol.")
+	otelCmd.Flags().Bool("otel-traces", false, "export traces of device discovery and RPC calls with the OTEL exporter. This requires the grpc, http or https protocol.")
 
 	otelCmd.Flags().IP("prometheus-bind-addr", net.IPv6zero, "local ip address to bind the metrics server to")
 	otelCmd.Flags().Uint16("prometheus-bind-port", 8080, "port to bind the metrics server")
 	otelCmd.Flags().String("prometheus-namespace", "shelly_status", "set the namespace/subsystem string to use for prometheus metric names.")
-	// otelCmd.Flags().Int("probe-concurrency", promserver.DefaultConcurrency, "set the number of concurrent probes which will be made to service a metrics request.")
-	// otelCmd.Flags().Duration("device-timeout", promserver.DefaultDeviceTimeout, "set the maximum time allowed for a device to respond to it probe.")
-	// otelCmd.Flags().Duration("scrape-duration-warning", promserver.DefaultScrapeDurationWarning, "sets the value for scrape duration warning. Scrapes which exceed this duration will log a warning generate. Default value 8s is 80% of the 10s default prometheus scrape_timeout.")
+
+	otelCmd.Flags().Duration("poll-interval", 0, "poll all known devices with Shelly.GetStatus at this interval. This collects metrics from devices which don't send notifications, like those added with --host. The default of 0 disables polling.")
+	otelCmd.Flags().Duration("poll-timeout", otelserver.DefaultPollTimeout, "maximum time allowed for a device to respond to a poll.")
+	otelCmd.Flags().Int("poll-concurrency", otelserver.DefaultPollConcurrency, "maximum number of devices which will be polled concurrently.")
+	otelCmd.Flags().Duration("poll-max-backoff", otelserver.DefaultPollMaxBackoff, "maximum delay between polls of a device which is failing to respond.")
+
+	webServerFlags(otelCmd.Flags())
+	labelFlags(otelCmd.Flags())
+	energyFlags(otelCmd.Flags())
+	replayFlags(otelCmd.Flags())
 
 	discoveryFlags(otelCmd.Flags(), discoveryFlagsOptions{
 		withTTL:                    true,
@@ -66,6 +72,26 @@ var otelCmd = &cobra.Command{
 		if err != nil {
 			l.Fatal().Err(err).Msg("parsing flags")
 		}
+		// The tracer provider is installed first so devices added below are traced.
+		if viper.GetBool("otel-traces") {
+			c, err := otlpConfigFromFlags(otlpexporter.SignalTraces)
+			if err != nil {
+				l.Fatal().Err(err).Msg("parsing otel exporter flags")
+			}
+			e, err := c.TraceExporter(ctx)
+			if err != nil {
+				l.Fatal().Err(err).Msg("creating otel trace exporter")
+			}
+			tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(e))
+			otel.SetTracerProvider(tp)
+			defer func() {
+				sCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("stop-wait"))
+				defer cancel()
+				if err := tp.Shutdown(sCtx); err != nil {
+					l.Err(err).Msg("shutting down otel trace provider")
+				}
+			}()
+		}
 		disc := discovery.NewDiscoverer(dOpts...)
 		if err := disc.MQTTConnect(ctx); err != nil {
 			l.Fatal().Err(err).Msg("connecting to MQTT broker")
@@ -74,84 +100,44 @@ var otelCmd = &cobra.Command{
 			l.Fatal().Err(err).Msg("adding devices")
 		}
 
-		opts := []otelserver.Option{}
-		hOpts := []otlpmetrichttp.Option{}
-		switch viper.GetString("otel-exporter-protocol") {
-		case "grpc":
-			gOpts := []otlpmetricgrpc.Option{}
-			if viper.IsSet("otel-exporter-endpoint") {
-				v := viper.GetString("otel-exporter-endpoint")
-				if strings.Contains(v, "://") {
-					gOpts = append(gOpts, otlpmetricgrpc.WithEndpointURL(v))
-				} else {
-					gOpts = append(gOpts, otlpmetricgrpc.WithEndpoint(v))
-				}
-			}
-			if viper.GetBool("otel-exporter-insecure") {
-				gOpts = append(gOpts, otlpmetricgrpc.WithInsecure())
-			}
-			if h := viper.GetStringSlice("otel-exporter-header"); len(h) > 0 {
-				headers := make(map[string]string, len(h))
-				for _, v := range h {
-					parts := strings.SplitN(v, "=", 2)
-					if len(parts) != 2 {
-						l.Fatal().Str("header", v).Msg("invalid header")
-					}
-				}
-				gOpts = append(gOpts, otlpmetricgrpc.WithHeaders(headers))
-			}
-			r := otlpmetricgrpc.RetryConfig{
-				Enabled:         viper.GetBool("otel-exporter-retry"),
-				InitialInterval: viper.GetDuration("otel-exporter-retry-initial-interval"),
-				MaxInterval:     viper.GetDuration("otel-exporter-retry-max-interval"),
-				MaxElapsedTime:  viper.GetDuration("otel-exporter-retry-max-elapsed-time"),
-			}
-			gOpts = append(gOpts, otlpmetricgrpc.WithRetry(r))
-			e, err := otlpmetricgrpc.New(ctx, gOpts...)
+		lm, err := labelMapperFromFlags()
+		if err != nil {
+			l.Fatal().Err(err).Msg("parsing label flags")
+		}
+		var wg sync.WaitGroup
+		ready := make(chan struct{})
+		opts := []otelserver.Option{
+			otelserver.WithReady(func() { close(ready) }),
+			otelserver.WithLabelMapper(lm),
+			otelserver.WithPollInterval(viper.GetDuration("poll-interval")),
+			otelserver.WithPollTimeout(viper.GetDuration("poll-timeout")),
+			otelserver.WithPollConcurrency(viper.GetInt("poll-concurrency")),
+			otelserver.WithPollMaxBackoff(viper.GetDuration("poll-max-backoff")),
+		}
+		acc, err := energyAccumulatorFromFlags()
+		if err != nil {
+			l.Fatal().Err(err).Msg("loading energy state")
+		}
+		if acc != nil {
+			opts = append(opts, otelserver.WithEnergyAccumulator(acc))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				acc.Run(ctx, viper.GetDuration("energy-save-interval"))
+			}()
+		}
+		if viper.GetBool("otel-logs") {
+			c, err := otlpConfigFromFlags(otlpexporter.SignalLogs)
 			if err != nil {
-				l.Fatal().Err(err).Msg("creating otel exporter")
-			}
-			opts = append(opts, otelserver.WithMetricsExporter(e, viper.GetDuration("otel-exporter-interval")))
-		case "http":
-			hOpts = append(hOpts, otlpmetrichttp.WithInsecure())
-			fallthrough
-		case "https":
-			if viper.IsSet("otel-exporter-endpoint") {
-				v := viper.GetString("otel-exporter-endpoint")
-				if strings.Contains(v, "://") {
-					hOpts = append(hOpts, otlpmetrichttp.WithEndpointURL(v))
-				} else {
-					hOpts = append(hOpts, otlpmetrichttp.WithEndpoint(v))
-				}
+				l.Fatal().Err(err).Msg("parsing otel exporter flags")
 			}
-			if viper.GetBool("otel-exporter-insecure") {
-				hOpts = append(hOpts, otlpmetrichttp.WithInsecure())
-			}
-			if h := viper.GetStringSlice("otel-exporter-header"); len(h) > 0 {
-				headers := make(map[string]string, len(h))
-				for _, v := range h {
-					parts := strings.SplitN(v, "=", 2)
-					if len(parts) != 2 {
-						l.Fatal().Str("header", v).Msg("invalid header")
-					}
-				}
-				hOpts = append(hOpts, otlpmetrichttp.WithHeaders(headers))
-			}
-			r := otlpmetrichttp.RetryConfig{
-				Enabled:         viper.GetBool("otel-exporter-retry"),
-				InitialInterval: viper.GetDuration("otel-exporter-retry-initial-interval"),
-				MaxInterval:     viper.GetDuration("otel-exporter-retry-max-interval"),
-				MaxElapsedTime:  viper.GetDuration("otel-exporter-retry-max-elapsed-time"),
-			}
-			hOpts = append(hOpts, otlpmetrichttp.WithRetry(r))
-			e, err := otlpmetrichttp.New(ctx, hOpts...)
+			e, err := c.LogExporter(ctx)
 			if err != nil {
-				l.Fatal().Err(err).Msg("creating otel exporter")
-			}
-			if viper.GetBool("otel-exporter-gzip") {
-				hOpts = append(hOpts, otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression))
+				l.Fatal().Err(err).Msg("creating otel log exporter")
 			}
-			opts = append(opts, otelserver.WithMetricsExporter(e, viper.GetDuration("otel-exporter-interval")))
+			opts = append(opts, otelserver.WithLogsExporter(e))
+		}
+		switch viper.GetString("otel-exporter-protocol") {
 		case "prometheus":
 			pOpts := []prometheus.Option{}
 			if viper.IsSet("prometheus-namespace") {
@@ -164,12 +150,52 @@ var otelCmd = &cobra.Command{
 				l.Fatal().Err(err).Msg("creating prometheus otel exporter")
 			}
 			opts = append(opts, otelserver.WithMetricsReader(e))
+
+			wc, err := webConfigFromFlags()
+			if err != nil {
+				l.Fatal().Err(err).Msg("parsing web config")
+			}
+			hs := &http.Server{
+				Handler: wc.Handler(promhttp.Handler()),
+				Addr:    net.JoinHostPort(viper.GetString("prometheus-bind-addr"), strconv.Itoa(int(viper.GetUint16("prometheus-bind-port")))),
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.Info().Str("bind_address", hs.Addr).Msg("starting metrics server")
+				if err := wc.ListenAndServe(hs); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					l.Fatal().Err(err).Msg("starting http server")
+				}
+			}()
+			go func() {
+				<-ctx.Done()
+				sCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := hs.Shutdown(sCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					l.Err(err).Msg("shutting down http server")
+				}
+			}()
 		default:
-			l.Fatal().Str("protocol", viper.GetString("otel-exporter-protocol")).Msg("unknown protocol")
+			c, err := otlpConfigFromFlags(otlpexporter.SignalMetrics)
+			if err != nil {
+				l.Fatal().Err(err).Msg("parsing otel exporter flags")
+			}
+			e, err := c.MetricExporter(ctx)
+			if err != nil {
+				l.Fatal().Err(err).Msg("creating otel exporter")
+			}
+			opts = append(opts, otelserver.WithMetricsExporter(e, viper.GetDuration("otel-exporter-interval")))
+		}
+		os, err := otelserver.NewServer(ctx, disc, opts...)
+		if err != nil {
+			l.Fatal().Err(err).Msg("creating otel server")
+		}
+		if err := startReplay(ctx, disc, ready); err != nil {
+			l.Fatal().Err(err).Msg("starting replay")
 		}
-		os := otelserver.NewServer(ctx, disc, opts...)
 		if err := os.Run(ctx); err != nil {
 			l.Fatal().Err(err).Msg("starting otel server")
 		}
+		wg.Wait()
 	},
 }
@@ -26,6 +26,15 @@ func init() {
 	prometheusCmd.Flags().Int("probe-concurrency", promserver.DefaultConcurrency, "set the number of concurrent probes which will be made to service a metrics request.")
 	prometheusCmd.Flags().Duration("device-timeout", promserver.DefaultDeviceTimeout, "set the maximum time allowed for a device to respond to it probe.")
 	prometheusCmd.Flags().Duration("scrape-duration-warning", promserver.DefaultScrapeDurationWarning, "sets the value for scrape duration warning. Scrapes which exceed this duration will log a warning generate. Default value 8s is 80% of the 10s default prometheus scrape_timeout.")
+	prometheusCmd.Flags().Duration("poll-interval", 0, "poll devices in the background at this interval and serve scrapes from the latest results. The default of 0 queries devices synchronously on each scrape.")
+	prometheusCmd.Flags().Duration("poll-jitter", 0, "randomize each device's poll interval by up to this amount. Defaults to 10% of --poll-interval.")
+	prometheusCmd.Flags().Duration("poll-max-backoff", promserver.DefaultPollMaxBackoff, "maximum delay between polls of a device which is failing to respond.")
+	prometheusCmd.Flags().Duration("poll-staleness", 0, "omit a device's metrics if it hasn't been successfully polled within this duration. Defaults to 3x --poll-interval.")
+	webServerFlags(prometheusCmd.Flags())
+	labelFlags(prometheusCmd.Flags())
+	energyFlags(prometheusCmd.Flags())
+	bleListenFlags(prometheusCmd.Flags())
+	replayFlags(prometheusCmd.Flags())
 	discoveryFlags(prometheusCmd.Flags(), discoveryFlagsOptions{
 		withTTL:                    true,
 		interactive:                false,
@@ -49,11 +58,30 @@ var prometheusCmd = &cobra.Command{
 
 		l := log.Ctx(ctx)
 
+		if viper.GetDuration("poll-interval") < 0 {
+			l.Fatal().Msg("poll-interval must not be negative")
+		}
 		dOpts, err := discoveryOptionsFromFlags(cmd.Flags())
 		if err != nil {
 			l.Fatal().Err(err).Msg("parsing flags")
 		}
+		lm, err := labelMapperFromFlags()
+		if err != nil {
+			l.Fatal().Err(err).Msg("parsing label flags")
+		}
+		wc, err := webConfigFromFlags()
+		if err != nil {
+			l.Fatal().Err(err).Msg("parsing web config")
+		}
+		acc, err := energyAccumulatorFromFlags()
+		if err != nil {
+			l.Fatal().Err(err).Msg("loading energy state")
+		}
 		disc := discovery.NewDiscoverer(dOpts...)
+		listener, err := bleListenerFromFlags(disc)
+		if err != nil {
+			l.Fatal().Err(err).Msg("parsing ble-listen flags")
+		}
 		if err := disc.MQTTConnect(ctx); err != nil {
 			l.Fatal().Err(err).Msg("connecting to MQTT broker")
 		}
@@ -61,18 +89,43 @@ var prometheusCmd = &cobra.Command{
 			l.Fatal().Err(err).Msg("adding devices")
 		}
 
-		consumer, ps := promserver.NewServer(
-			ctx,
-			disc,
+		var wg sync.WaitGroup
+		ready := make(chan struct{})
+		opts := []promserver.Option{
+			promserver.WithReady(func() { close(ready) }),
 			promserver.WithPrometheusNamespace(viper.GetString("prometheus-namespace")),
 			promserver.WithPrometheusSubsystem(viper.GetString("prometheus-subsystem")),
 			promserver.WithConcurrency(viper.GetInt("probe-concurrency")),
 			promserver.WithScrapeDurationWarning(viper.GetDuration("scrape-duration-warning")),
 			promserver.WithDeviceTimeout(viper.GetDuration("device-timeout")),
-		)
+			promserver.WithPollInterval(viper.GetDuration("poll-interval")),
+			promserver.WithPollJitter(viper.GetDuration("poll-jitter")),
+			promserver.WithPollMaxBackoff(viper.GetDuration("poll-max-backoff")),
+			promserver.WithPollStaleness(viper.GetDuration("poll-staleness")),
+			promserver.WithLabelMapper(lm),
+		}
+		if acc != nil {
+			opts = append(opts, promserver.WithEnergyAccumulator(acc))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				acc.Run(ctx, viper.GetDuration("energy-save-interval"))
+			}()
+		}
+		if listener != nil {
+			opts = append(opts, promserver.WithBTHomeListener(listener))
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := listener.Run(ctx); err != nil {
+					l.Err(err).Msg("listening for BLE advertisements")
+				}
+			}()
+		}
+		consumer, ps := promserver.NewServer(ctx, disc, opts...)
 
 		hs := http.Server{
-			Handler: ps,
+			Handler: wc.Handler(ps),
 			Addr:    net.JoinHostPort(viper.GetString("bind-addr"), strconv.Itoa(int(viper.GetUint16("bind-port")))),
 		}
 		go func() {
@@ -83,14 +136,16 @@ var prometheusCmd = &cobra.Command{
 				l.Err(err).Msg("shutting down http server")
 			}
 		}()
-		var wg sync.WaitGroup
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			consumer(ctx)
 		}()
+		if err := startReplay(ctx, disc, ready); err != nil {
+			l.Fatal().Err(err).Msg("starting replay")
+		}
 		l.Info().Str("bind_address", hs.Addr).Msg("starting metrics server")
-		if err := hs.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := wc.ListenAndServe(&hs); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			l.Err(err).Msg("starting http server")
 		}
 		wg.Wait()
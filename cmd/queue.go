@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/rpcqueue"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var (
+	queueCmd = &cobra.Command{
+		Use:   "queue",
+		Short: "Manage RPCs queued for MQTT devices which are only occasionally connected",
+	}
+	queueListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List queued requests and their results",
+		RunE:  queueListCmdRunE,
+	}
+	queueCancelCmd = &cobra.Command{
+		Use:   "cancel <id>...",
+		Short: "Cancel pending requests",
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  queueCancelCmdRunE,
+	}
+	queueRunCmd = &cobra.Command{
+		Use:   "run",
+		Short: "Publish queued requests to the MQTT broker and collect their responses",
+		Run:   queueRunCmdRun,
+	}
+)
+
+func init() {
+	queueFileFlag(queueListCmd.Flags())
+	queueFileFlag(queueCancelCmd.Flags())
+	queueFileFlag(queueRunCmd.Flags())
+	queueRunCmd.Flags().Int("max-wakes", rpcqueue.DefaultMaxWakes, "number of device wakes in which a request may be published without an answer before it fails. 0 retries indefinitely.")
+	queueRunCmd.Flags().Duration("sync-interval", rpcqueue.DefaultSyncInterval, "interval at which requests added by other commands are published to devices which are online.")
+	discoveryFlags(queueRunCmd.Flags(), discoveryFlagsOptions{withTTL: true})
+	queueCmd.AddCommand(queueListCmd, queueCancelCmd, queueRunCmd)
+	rootCmd.AddCommand(queueCmd)
+}
+
+func queueFileFlag(f *pflag.FlagSet) {
+	f.String("queue-file", rpcqueue.DefaultPath(), "path to the file which holds queued requests.")
+}
+
+// queueFlags adds flags to RPC commands for queueing requests rather than sending them.
+func queueFlags(f *pflag.FlagSet) {
+	f.Bool("queue", false, "queue the request for each --mqtt-device rather than waiting for a response. The request is delivered by\n"+
+		"shellyctl queue run when the device next connects to the broker, and may be repeated if the device doesn't answer, so\n"+
+		"queued requests should be idempotent.")
+	queueFileFlag(f)
+}
+
+// queueRequest queues req for each --mqtt-device if --queue is set. Requests are published by
+// `queue run`, which must be running if --mqtt-addr is set, since the caller expects the request
+// to be delivered.
+func queueRequest(ctx context.Context, req shelly.RPCRequestBody) (bool, error) {
+	if !viper.GetBool("queue") {
+		return false, nil
+	}
+	devices := viper.GetStringSlice("mqtt-device")
+	if len(devices) == 0 {
+		return true, errors.New("--queue requires at least one --mqtt-device")
+	}
+	params, err := json.Marshal(req)
+	if err != nil {
+		return true, fmt.Errorf("encoding %s params: %w", req.Method(), err)
+	}
+	store := rpcqueue.NewStore(viper.GetString("queue-file"))
+	if viper.IsSet("mqtt-addr") {
+		running, err := store.DispatcherRunning()
+		if err != nil {
+			return true, err
+		}
+		if !running {
+			return true, errors.New("--queue with --mqtt-addr requires `shellyctl queue run` to be running to deliver requests and collect their results")
+		}
+	}
+	for _, dev := range devices {
+		r, err := store.Add(dev, req.Method(), params)
+		if err != nil {
+			return true, fmt.Errorf("queueing %s for %s: %w", req.Method(), dev, err)
+		}
+		Output(ctx, fmt.Sprintf("Queued %s request for %s", req.Method(), dev), "request", r, nil)
+	}
+	return true, nil
+}
+
+func queueListCmdRunE(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	reqs, err := rpcqueue.NewStore(viper.GetString("queue-file")).List()
+	if err != nil {
+		return err
+	}
+	for _, r := range reqs {
+		Output(ctx, fmt.Sprintf("%s request %s for %s", r.Method, r.ID, r.Device), "request", r, nil)
+	}
+	return nil
+}
+
+func queueCancelCmdRunE(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+	store := rpcqueue.NewStore(viper.GetString("queue-file"))
+	for _, id := range args {
+		r, err := store.Cancel(id)
+		if err != nil {
+			return err
+		}
+		Output(ctx, fmt.Sprintf("Cancelled %s request %s for %s", r.Method, r.ID, r.Device), "request", r, nil)
+	}
+	return nil
+}
+
+func queueRunCmdRun(cmd *cobra.Command, args []string) {
+	ctx, signalStop := signal.NotifyContext(ctx, os.Interrupt)
+	defer signalStop()
+
+	l := log.Ctx(ctx)
+	if !viper.IsSet("mqtt-addr") {
+		l.Fatal().Msg("--mqtt-addr is required")
+	}
+	dOpts, err := discoveryOptionsFromFlags(cmd.Flags())
+	if err != nil {
+		l.Fatal().Err(err).Msg("parsing flags")
+	}
+	disc := discovery.NewDiscoverer(dOpts...)
+	if err := disc.MQTTConnect(ctx); err != nil {
+		l.Fatal().Err(err).Msg("connecting to MQTT broker")
+	}
+	d := rpcqueue.NewDispatcher(
+		rpcqueue.NewStore(viper.GetString("queue-file")),
+		disc,
+		rpcqueue.WithMaxWakes(viper.GetInt("max-wakes")),
+		rpcqueue.WithSyncInterval(viper.GetDuration("sync-interval")),
+		rpcqueue.WithResultFunc(func(r *rpcqueue.Request) {
+			Output(ctx, fmt.Sprintf("Result of %s request %s for %s", r.Method, r.ID, r.Device), "request", r, nil)
+		}),
+	)
+	if err := d.Run(ctx); err != nil {
+		l.Fatal().Err(err).Msg("running rpc queue")
+	}
+}
@@ -33,9 +33,9 @@ func init() {
 		rootCmd.Help()
 	}
 	rootCmd.PersistentFlags().String("log-level", "warn", "threshold for outputing logs: trace, debug, info, warn, error, fatal, panic")
-	rootCmd.PersistentFlags().StringP("output-format", "o", "text", "desired output format: json, min-json, yaml, text, log")
+	rootCmd.PersistentFlags().StringP("output-format", "o", "text", "desired output format: json, min-json, ndjson, yaml, text, log")
 	rootCmd.PersistentFlags().String("config", "", "path to config file. format will be determined by extension (.yaml, .json, .toml, .ini valid)")
-	rootCmd.PersistentFlags().Duration("rpc-timeout", 30*time.Second, "timeout for individual RPC requests. NOTE: if you're using mqtt-retain you'll want to bump this to the wake-period used by the device (commonly 10m)")
+	rootCmd.PersistentFlags().Duration("rpc-timeout", 30*time.Second, "timeout for individual RPC requests. NOTE: battery powered devices may only wake every 10m or more; see --queue to send them requests without waiting")
 
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
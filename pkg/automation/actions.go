@@ -0,0 +1,174 @@
+package automation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/internal/rawrpc"
+	"github.com/rs/zerolog/log"
+)
+
+// runActions runs each of the rule's actions in order. A failed action is logged and doesn't
+// prevent later actions from running.
+func (e *Engine) runActions(ctx context.Context, r *Rule, f *Firing) {
+	for i, a := range r.Actions {
+		actx, cancel := context.WithTimeout(ctx, e.actionTimeout)
+		err := e.runAction(actx, a, f)
+		cancel()
+		if err != nil {
+			log.Ctx(ctx).Err(err).Int("action", i+1).Msg("running action")
+		}
+	}
+}
+
+func (e *Engine) runAction(ctx context.Context, a *Action, f *Firing) error {
+	switch {
+	case a.RPC != nil:
+		return e.runRPC(ctx, a.RPC)
+	case a.Webhook != nil:
+		return e.runWebhook(ctx, a.Webhook, f)
+	case a.MQTT != nil:
+		return e.runMQTT(ctx, a.MQTT, f)
+	case a.Command != nil:
+		return runCommand(ctx, a.Command, f)
+	}
+	return nil
+}
+
+func (e *Engine) runRPC(ctx context.Context, a *RPCAction) error {
+	var devices []*discovery.Device
+	for _, d := range e.disc.AllDevices() {
+		if selectorMatch(a.Device, d.Name, d.MACAddr, d.ID, d.Instance()) {
+			devices = append(devices, d)
+		}
+	}
+	if len(devices) == 0 {
+		return fmt.Errorf("no devices match %q", a.Device)
+	}
+	var errs []error
+	for _, d := range devices {
+		if err := callDevice(ctx, d, rawrpc.NewRequest(a.Method, a.Params)); err != nil {
+			errs = append(errs, fmt.Errorf("calling %s on %s: %w", a.Method, d.BestName(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func callDevice(ctx context.Context, d *discovery.Device, req *rawrpc.Request) error {
+	ll := d.LogCtx(ctx)
+	conn, err := d.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Disconnect(ctx); err != nil {
+			ll.Warn().Err(err).Msg("disconnecting from device")
+		}
+	}()
+	resp := req.NewResponse().(*json.RawMessage)
+	if _, err := shelly.Do(ctx, conn, d.AuthCallback(ctx), req, resp); err != nil {
+		return err
+	}
+	ll.Debug().Str("method", req.Method()).RawJSON("response", *resp).Msg("rpc action complete")
+	return nil
+}
+
+// render executes the template, or encodes the firing as JSON if there is no template.
+func render(t *template.Template, f *Firing) ([]byte, error) {
+	if t == nil {
+		return json.Marshal(f)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, f); err != nil {
+		return nil, fmt.Errorf("executing template: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+func (e *Engine) runWebhook(ctx context.Context, a *WebhookAction, f *Firing) error {
+	body, err := render(a.body, f)
+	if err != nil {
+		return err
+	}
+	method := a.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(method), a.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("building webhook request: %w", err)
+	}
+	if a.body == nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range a.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("calling webhook: unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+func (e *Engine) runMQTT(ctx context.Context, a *MQTTAction, f *Firing) error {
+	c := e.disc.MQTTClient()
+	if c == nil {
+		return errors.New("publishing to MQTT: no MQTT broker configured")
+	}
+	payload, err := render(a.payload, f)
+	if err != nil {
+		return err
+	}
+	token := c.Publish(a.Topic, a.QoS, a.Retain, payload)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("publishing to MQTT: %w", ctx.Err())
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("publishing to MQTT: %w", err)
+	}
+	return nil
+}
+
+func runCommand(ctx context.Context, a *CommandAction, f *Firing) error {
+	stdin, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	n := f.Notification
+	cmd := exec.CommandContext(ctx, a.Command[0], a.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Env = append(os.Environ(),
+		"SHELLYCTL_RULE="+f.Rule,
+		"SHELLYCTL_SRC="+n.Src,
+		"SHELLYCTL_MAC="+n.MAC,
+		"SHELLYCTL_DEVICE_NAME="+n.DeviceName,
+		"SHELLYCTL_METHOD="+n.Method,
+		"SHELLYCTL_COMPONENT="+n.Component,
+		"SHELLYCTL_EVENT="+n.EventName(),
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running %q: %w: %s", a.Command[0], err, strings.TrimSpace(string(out)))
+	}
+	log.Ctx(ctx).Debug().Str("output", string(out)).Msg("command action complete")
+	return nil
+}
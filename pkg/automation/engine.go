@@ -0,0 +1,322 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"github.com/jcodybaker/shellyctl/pkg/internal/jsonmerge"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultActionTimeout is the default time limit for each action.
+	DefaultActionTimeout = 10 * time.Second
+
+	// debounceInterval is how often debounced rules are checked.
+	debounceInterval = time.Second
+)
+
+// Firing describes a rule firing. It's passed to webhook and MQTT templates and sent as JSON when
+// no template is configured.
+type Firing struct {
+	Rule         string                `json:"rule"`
+	Time         time.Time             `json:"time"`
+	Notification *eventstream.Envelope `json:"notification"`
+	// State is the component's status, including fields from earlier NotifyStatus notifications,
+	// or the event.
+	State map[string]any `json:"state"`
+}
+
+// Engine evaluates rules against device notifications.
+type Engine struct {
+	rules         []*Rule
+	disc          *discovery.Discoverer
+	httpClient    *http.Client
+	actionTimeout time.Duration
+	now           func() time.Time
+	// ready, if set, is called once Run has subscribed to notifications.
+	ready func()
+
+	lock sync.Mutex
+	// status holds the merged status of each component, keyed by src and component.
+	status map[componentKey]map[string]any
+	states map[ruleKey]*ruleState
+
+	// actions tracks running actions.
+	actions sync.WaitGroup
+}
+
+type componentKey struct {
+	src       string
+	component string
+}
+
+type ruleKey struct {
+	rule *Rule
+	componentKey
+}
+
+type ruleState struct {
+	// active is true while a status rule's conditions hold and it has fired or been suppressed.
+	active bool
+	// pending is a firing waiting for the rule's debounce.
+	pending      *Firing
+	pendingSince time.Time
+	lastFired    time.Time
+}
+
+// EngineOption provides optional parameters for the Engine.
+type EngineOption func(*Engine)
+
+// WithHTTPClient sets the client used for webhook actions.
+func WithHTTPClient(c *http.Client) EngineOption {
+	return func(e *Engine) {
+		e.httpClient = c
+	}
+}
+
+// WithActionTimeout limits the time each action may run.
+func WithActionTimeout(d time.Duration) EngineOption {
+	return func(e *Engine) {
+		e.actionTimeout = d
+	}
+}
+
+// WithReady sets a function which is called once Run has subscribed to the discoverer's
+// notifications, so they can be replayed without loss.
+func WithReady(ready func()) EngineOption {
+	return func(e *Engine) {
+		e.ready = ready
+	}
+}
+
+// NewEngine creates an Engine. The discoverer provides notifications, resolves devices for RPC
+// actions and its MQTT client is used for MQTT actions.
+func NewEngine(disc *discovery.Discoverer, c *Config, opts ...EngineOption) *Engine {
+	e := &Engine{
+		rules:         c.Rules,
+		disc:          disc,
+		httpClient:    http.DefaultClient,
+		actionTimeout: DefaultActionTimeout,
+		now:           time.Now,
+		status:        make(map[componentKey]map[string]any),
+		states:        make(map[ruleKey]*ruleState),
+	}
+	for _, o := range opts {
+		o(e)
+	}
+	return e
+}
+
+// Run evaluates notifications until ctx is done, then waits for running actions to complete.
+func (e *Engine) Run(ctx context.Context) {
+	l := log.Ctx(ctx)
+	fullStatus := e.disc.SubscribeFullStatus()
+	defer fullStatus.Unsubscribe()
+	status := e.disc.SubscribeStatus()
+	defer status.Unsubscribe()
+	events := e.disc.SubscribeEvents()
+	defer events.Unsubscribe()
+	presence := e.disc.SubscribePresence()
+	defer presence.Unsubscribe()
+	if e.ready != nil {
+		e.ready()
+	}
+	t := time.NewTicker(debounceInterval)
+	defer t.Stop()
+	defer e.actions.Wait()
+	for {
+		var envs []*eventstream.Envelope
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			e.checkPending(ctx)
+			continue
+		case pn := <-presence.C():
+			if !pn.Online {
+				e.forget(pn)
+			}
+			continue
+		case fsn := <-fullStatus.C():
+			envs, err = eventstream.FromStatus(fsn, e.disc.DeviceBySrc(fsn.Frame.Src))
+		case sn := <-status.C():
+			envs, err = eventstream.FromStatus(sn, e.disc.DeviceBySrc(sn.Frame.Src))
+		case en := <-events.C():
+			envs, err = eventstream.FromEvent(en, e.disc.DeviceBySrc(en.Frame.Src))
+		}
+		if err != nil {
+			l.Warn().Err(err).Msg("decoding notification")
+			continue
+		}
+		for _, env := range envs {
+			e.Handle(ctx, env)
+		}
+	}
+}
+
+// Handle evaluates the rules against a notification.
+func (e *Engine) Handle(ctx context.Context, env *eventstream.Envelope) {
+	var doc map[string]any
+	if err := json.Unmarshal(env.Payload, &doc); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("src", env.Src).Str("component", env.Component).
+			Msg("decoding notification payload")
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := e.now()
+	ck := componentKey{src: env.Src, component: env.Component}
+	isEvent := env.Method == eventstream.MethodNotifyEvent
+	switch env.Method {
+	case eventstream.MethodNotifyFullStatus:
+		e.status[ck] = doc
+	case eventstream.MethodNotifyStatus:
+		// NotifyStatus only includes the fields which changed.
+		doc = jsonmerge.Merge(e.status[ck], doc)
+		e.status[ck] = doc
+	}
+	for _, r := range e.rules {
+		if !r.selects(env) {
+			continue
+		}
+		k := ruleKey{rule: r, componentKey: ck}
+		st := e.states[k]
+		if st == nil {
+			st = &ruleState{}
+			e.states[k] = st
+		}
+		f := &Firing{Rule: r.Name, Time: now, Notification: env, State: doc}
+		held := r.eval(doc)
+		if isEvent || len(r.conditions) == 0 {
+			// Events and unconditional status rules fire for every match, after any debounce.
+			if !held {
+				continue
+			}
+			if r.Debounce > 0 {
+				st.pending, st.pendingSince = f, now
+				continue
+			}
+			e.fire(ctx, r, st, f)
+			continue
+		}
+		// Status rules fire when their conditions become true.
+		switch {
+		case !held:
+			st.active, st.pending = false, nil
+		case st.active:
+		case st.pending != nil:
+			st.pending = f
+		case r.Debounce > 0:
+			st.pending, st.pendingSince = f, now
+		default:
+			st.active = true
+			e.fire(ctx, r, st, f)
+		}
+	}
+}
+
+// forget drops the status and rule state of a device which went offline, so state isn't held for
+// evicted devices and rules are evaluated afresh when the device reconnects.
+func (e *Engine) forget(pn discovery.PresenceNotification) {
+	srcs := map[string]bool{pn.Prefix: true}
+	if pn.Device != nil && pn.Device.ID != "" {
+		srcs[pn.Device.ID] = true
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for ck := range e.status {
+		if srcs[ck.src] {
+			delete(e.status, ck)
+		}
+	}
+	for k := range e.states {
+		if srcs[k.src] {
+			delete(e.states, k)
+		}
+	}
+}
+
+// checkPending fires debounced rules whose debounce has elapsed.
+func (e *Engine) checkPending(ctx context.Context) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := e.now()
+	for k, st := range e.states {
+		r := k.rule
+		if st.pending == nil || now.Sub(st.pendingSince) < time.Duration(r.Debounce) {
+			continue
+		}
+		f := st.pending
+		f.Time = now
+		st.pending = nil
+		st.active = f.Notification.Method != eventstream.MethodNotifyEvent && len(r.conditions) > 0
+		e.fire(ctx, r, st, f)
+	}
+}
+
+// fire runs the rule's actions unless the rule is outside its window or cooling down. The engine
+// lock must be held.
+func (e *Engine) fire(ctx context.Context, r *Rule, st *ruleState, f *Firing) {
+	ll := log.Ctx(ctx).With().
+		Str("rule", r.Name).
+		Str("src", f.Notification.Src).
+		Str("component", f.Notification.Component).
+		Logger()
+	if r.Window != nil && !r.Window.Contains(f.Time) {
+		ll.Debug().Msg("rule matched outside of its window")
+		return
+	}
+	if r.Cooldown > 0 && !st.lastFired.IsZero() && f.Time.Sub(st.lastFired) < time.Duration(r.Cooldown) {
+		ll.Debug().Msg("rule matched during cooldown")
+		return
+	}
+	st.lastFired = f.Time
+	ll.Info().Msg("rule fired")
+	e.actions.Add(1)
+	go func() {
+		defer e.actions.Done()
+		e.runActions(ll.WithContext(ctx), r, f)
+	}()
+}
+
+// selects returns true if the notification matches the rule's device, method, component and
+// event.
+func (r *Rule) selects(env *eventstream.Envelope) bool {
+	if r.Match.Device != "" && !selectorMatch(r.Match.Device, env.DeviceName, env.MAC, env.Src) {
+		return false
+	}
+	return r.filter.Match(env)
+}
+
+func (r *Rule) eval(doc map[string]any) bool {
+	for _, c := range r.conditions {
+		if !c.Eval(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectorMatch matches a case-insensitive shell pattern against device identifiers. Colons are
+// ignored so MAC addresses may be written in either format.
+func selectorMatch(pattern string, values ...string) bool {
+	pattern = strings.ToLower(strings.ReplaceAll(pattern, ":", ""))
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		if ok, _ := path.Match(pattern, strings.ToLower(strings.ReplaceAll(v, ":", ""))); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,207 @@
+package automation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookRecorder struct {
+	lock    sync.Mutex
+	firings []*Firing
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f := &Firing{}
+	if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.lock.Lock()
+	w.firings = append(w.firings, f)
+	w.lock.Unlock()
+}
+
+// take returns and clears the recorded firings' rule names.
+func (w *webhookRecorder) take() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var out []string
+	for _, f := range w.firings {
+		out = append(out, f.Rule)
+	}
+	w.firings = nil
+	return out
+}
+
+func statusEnvelope(method, payload string) *eventstream.Envelope {
+	return &eventstream.Envelope{
+		Src:        "shellyplus1pm-a8032abe5424",
+		MAC:        "A8032ABE5424",
+		DeviceName: "garage",
+		Method:     method,
+		Component:  "switch:0",
+		Payload:    json.RawMessage(payload),
+	}
+}
+
+func eventEnvelope(event string) *eventstream.Envelope {
+	return &eventstream.Envelope{
+		Src:       "shellyplusi4-c4d8d5567890",
+		MAC:       "C4D8D5567890",
+		Method:    eventstream.MethodNotifyEvent,
+		Component: "input:0",
+		Payload:   json.RawMessage(`{"component": "input:0", "id": 0, "event": "` + event + `"}`),
+	}
+}
+
+func TestEngine(t *testing.T) {
+	ctx := context.Background()
+	rec := &webhookRecorder{}
+	hook := httptest.NewServer(rec)
+	defer hook.Close()
+
+	c, err := Parse([]byte(`
+rules:
+- name: overload
+  match:
+    device: a8:03:2a:be:54:24
+    component: switch
+    conditions: ["apower > 2000"]
+  cooldown: 10m
+  actions: [{webhook: {url: "` + hook.URL + `"}}]
+- name: sustained
+  match:
+    device: garage
+    method: NotifyStatus
+    conditions: ["apower > 2000", "temperature.tC >= 40"]
+  debounce: 30s
+  actions: [{webhook: {url: "` + hook.URL + `"}}]
+- name: pushed
+  match: {device: shellyplusi4-*, event: single_push}
+  debounce: 2s
+  actions: [{webhook: {url: "` + hook.URL + `"}}]
+- name: night
+  match: {event: double_push}
+  window: {from: "22:00", to: "06:00"}
+  actions: [{webhook: {url: "` + hook.URL + `"}}]
+`))
+	require.NoError(t, err)
+	td := discovery.NewTestDiscoverer(t)
+	e := NewEngine(td.Discoverer, c)
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, time.Local)
+	e.now = func() time.Time { return now }
+	step := func(d time.Duration, envs ...*eventstream.Envelope) []string {
+		now = now.Add(d)
+		for _, env := range envs {
+			e.Handle(ctx, env)
+		}
+		e.checkPending(ctx)
+		e.actions.Wait()
+		return rec.take()
+	}
+
+	assert.Empty(t, step(0, statusEnvelope(eventstream.MethodNotifyFullStatus,
+		`{"id": 0, "output": true, "apower": 100, "temperature": {"tC": 45}}`)))
+	assert.Equal(t, []string{"overload"}, step(time.Second, statusEnvelope(eventstream.MethodNotifyStatus,
+		`{"id": 0, "apower": 2500}`)), "conditions became true")
+	assert.Empty(t, step(time.Second, statusEnvelope(eventstream.MethodNotifyStatus,
+		`{"id": 0, "apower": 2600}`)), "conditions still true")
+	assert.Empty(t, step(time.Second, statusEnvelope(eventstream.MethodNotifyStatus,
+		`{"id": 0, "apower": 1000}`)), "conditions became false")
+	assert.Empty(t, step(time.Second, statusEnvelope(eventstream.MethodNotifyStatus,
+		`{"id": 0, "apower": 2500}`)), "overload cooling down, sustained debouncing")
+	assert.Empty(t, step(20*time.Second))
+	assert.Equal(t, []string{"sustained"}, step(10*time.Second), "debounce elapsed")
+	assert.Empty(t, step(time.Minute))
+	assert.Empty(t, step(time.Second, statusEnvelope(eventstream.MethodNotifyStatus,
+		`{"id": 0, "temperature": {"tC": 30}}`)))
+	assert.Equal(t, []string{"overload"}, step(10*time.Minute, statusEnvelope(eventstream.MethodNotifyStatus,
+		`{"id": 0, "apower": 900}`), statusEnvelope(eventstream.MethodNotifyStatus,
+		`{"id": 0, "apower": 2100}`)), "cooldown elapsed")
+
+	// Bursts of events are collapsed by the debounce.
+	assert.Empty(t, step(0, eventEnvelope("single_push"), eventEnvelope("single_push")))
+	assert.Empty(t, step(time.Second, eventEnvelope("single_push")))
+	assert.Empty(t, step(time.Second))
+	assert.Equal(t, []string{"pushed"}, step(time.Second))
+	assert.Empty(t, step(time.Minute))
+
+	assert.Empty(t, step(0, eventEnvelope("double_push")), "outside of window")
+	now = time.Date(2024, 1, 5, 23, 0, 0, 0, time.Local)
+	assert.Equal(t, []string{"night"}, step(0, eventEnvelope("double_push")))
+	assert.Equal(t, []string{"night"}, step(time.Second, eventEnvelope("double_push")))
+}
+
+func TestEngineForgetsOfflineDevices(t *testing.T) {
+	ctx := context.Background()
+	c, err := Parse([]byte(`
+rules:
+- name: overload
+  match: {conditions: ["apower > 2000"]}
+  actions: [{command: {command: ["true"]}}]
+`))
+	require.NoError(t, err)
+	td := discovery.NewTestDiscoverer(t)
+	e := NewEngine(td.Discoverer, c)
+	e.Handle(ctx, statusEnvelope(eventstream.MethodNotifyFullStatus, `{"id": 0, "apower": 2500}`))
+	e.Handle(ctx, eventEnvelope("single_push"))
+	e.actions.Wait()
+	require.Len(t, e.status, 1)
+	require.Len(t, e.states, 2)
+
+	e.forget(discovery.PresenceNotification{Presence: discovery.Presence{Prefix: "shellyplusi4-c4d8d5567890"}})
+	assert.Len(t, e.status, 1, "only the offline device is forgotten")
+	assert.Len(t, e.states, 1, "only the offline device is forgotten")
+	e.forget(discovery.PresenceNotification{Presence: discovery.Presence{Prefix: "shellyplus1pm-a8032abe5424"}})
+	assert.Empty(t, e.status)
+	assert.Empty(t, e.states)
+}
+
+func TestEngineActions(t *testing.T) {
+	ctx := context.Background()
+	out := filepath.Join(t.TempDir(), "out")
+	td := discovery.NewTestDiscoverer(t)
+	dev := td.NewTestDevice(t, true)
+	dev.Name = "hallway"
+	called := make(chan json.RawMessage, 1)
+	dev.AddMockResponse("Switch.Set", func(t *testing.T, params json.RawMessage) bool {
+		called <- params
+		return true
+	}, json.RawMessage(`{"was_on": true}`))
+
+	c, err := Parse([]byte(`
+rules:
+- name: lights-off
+  match: {event: long_push}
+  actions:
+  - rpc: {device: hallway, method: Switch.Set, params: {id: 0, "on": false}}
+  - rpc: {device: missing, method: Switch.Set}
+  - command: {command: [sh, -c, 'echo "$SHELLYCTL_RULE $SHELLYCTL_EVENT" > ` + out + `']}
+`))
+	require.NoError(t, err)
+	e := NewEngine(td.Discoverer, c)
+	e.Handle(ctx, eventEnvelope("long_push"))
+	e.actions.Wait()
+
+	select {
+	case params := <-called:
+		assert.JSONEq(t, `{"id": 0, "on": false}`, string(params))
+	default:
+		t.Fatal("expected Switch.Set to be called")
+	}
+	b, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "lights-off long_push\n", string(b))
+}
@@ -0,0 +1,438 @@
+// Package automation runs rules which react to device notifications. Rules match status and
+// event notifications by device, component, event name and field conditions like
+// `apower > 2000`, and trigger actions: RPCs on other devices, webhooks, MQTT publishes, or
+// local commands.
+package automation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"sigs.k8s.io/yaml"
+)
+
+// Config describes a rules file.
+type Config struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// Rule triggers actions when matching notifications are received.
+type Rule struct {
+	Name  string `json:"name"`
+	Match Match  `json:"match"`
+	// Debounce delays firing. For status notifications the conditions must hold for the duration
+	// before the rule fires. For events, the rule fires once matching events have stopped
+	// arriving for the duration, so bursts of events fire once.
+	Debounce Duration `json:"debounce,omitempty"`
+	// Cooldown is the minimum time between firings for a device component.
+	Cooldown Duration `json:"cooldown,omitempty"`
+	// Window limits firing to certain days and times.
+	Window  *Window   `json:"window,omitempty"`
+	Actions []*Action `json:"actions"`
+
+	filter     eventstream.Filter
+	conditions []*Condition
+}
+
+// Match selects notifications. Empty fields match all notifications.
+type Match struct {
+	// Device matches the device's name, MAC address, or src (ex. `shellyplus1-a8032abe5424`).
+	// Shell style wildcards like `shellyplus1-*` are supported.
+	Device string `json:"device,omitempty"`
+	// Method matches the notification method. NotifyStatus also matches NotifyFullStatus.
+	Method string `json:"method,omitempty"`
+	// Component matches a component key like `switch:0`, or all components of a type like
+	// `switch`.
+	Component string `json:"component,omitempty"`
+	// Event matches an event name like `single_push`. Status notifications never match a rule
+	// with an event.
+	Event string `json:"event,omitempty"`
+	// Conditions compare fields of the component's status or event, ex. `apower > 2000` or
+	// `temperature.tC >= 30`. All conditions must be true.
+	Conditions []string `json:"conditions,omitempty"`
+}
+
+// Action describes something to do when a rule fires. Exactly one field must be set.
+type Action struct {
+	RPC     *RPCAction     `json:"rpc,omitempty"`
+	Webhook *WebhookAction `json:"webhook,omitempty"`
+	MQTT    *MQTTAction    `json:"mqtt,omitempty"`
+	Command *CommandAction `json:"command,omitempty"`
+}
+
+// RPCAction calls a method on one or more devices.
+type RPCAction struct {
+	// Device selects the devices to call, using the same syntax as Match.Device.
+	Device string          `json:"device"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// WebhookAction makes an HTTP request.
+type WebhookAction struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is a Go template. If empty, the firing is sent as JSON.
+	Body string `json:"body,omitempty"`
+
+	body *template.Template
+}
+
+// MQTTAction publishes a message to the MQTT broker used for discovery.
+type MQTTAction struct {
+	Topic string `json:"topic"`
+	// Payload is a Go template. If empty, the firing is sent as JSON.
+	Payload string `json:"payload,omitempty"`
+	QoS     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+
+	payload *template.Template
+}
+
+// CommandAction runs a local command. The firing is written to the command's stdin as JSON, and
+// described by SHELLYCTL_* environment variables.
+type CommandAction struct {
+	Command []string `json:"command"`
+}
+
+// Window limits firing to certain days and times in the local timezone.
+type Window struct {
+	// Days are day names like `mon` or `monday`. If empty, all days match.
+	Days []string `json:"days,omitempty"`
+	// From and To are times like `22:00`. If To is before From the window spans midnight.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+
+	days     map[time.Weekday]bool
+	from, to time.Duration
+}
+
+// Duration is a time.Duration which is parsed from strings like `30s`.
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Load reads a rules file.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules: %w", err)
+	}
+	c, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("parsing rules %q: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse parses and validates YAML or JSON rules.
+func Parse(b []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, err
+	}
+	if len(c.Rules) == 0 {
+		return nil, errors.New("no rules defined")
+	}
+	names := make(map[string]bool)
+	for i, r := range c.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule name %q", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+	}
+	return c, nil
+}
+
+func (r *Rule) compile() error {
+	if r.Match.Method != "" {
+		r.filter.Methods = []string{r.Match.Method}
+		if strings.EqualFold(r.Match.Method, eventstream.MethodNotifyStatus) {
+			r.filter.Methods = append(r.filter.Methods, eventstream.MethodNotifyFullStatus)
+		}
+	}
+	if r.Match.Component != "" {
+		r.filter.Components = []string{r.Match.Component}
+	}
+	if r.Match.Event != "" {
+		r.filter.Events = []string{r.Match.Event}
+	}
+	for _, s := range r.Match.Conditions {
+		c, err := ParseCondition(s)
+		if err != nil {
+			return err
+		}
+		r.conditions = append(r.conditions, c)
+	}
+	if r.Debounce < 0 || r.Cooldown < 0 {
+		return errors.New("debounce and cooldown must not be negative")
+	}
+	if r.Window != nil {
+		if err := r.Window.compile(); err != nil {
+			return fmt.Errorf("window: %w", err)
+		}
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("no actions defined")
+	}
+	for i, a := range r.Actions {
+		if err := a.compile(); err != nil {
+			return fmt.Errorf("action %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (a *Action) compile() error {
+	var set int
+	var err error
+	if a.RPC != nil {
+		set++
+		if a.RPC.Device == "" || a.RPC.Method == "" {
+			err = errors.New("rpc actions require a device and method")
+		}
+	}
+	if a.Webhook != nil {
+		set++
+		if a.Webhook.URL == "" {
+			err = errors.New("webhook actions require a url")
+		} else if a.Webhook.Body != "" {
+			a.Webhook.body, err = template.New("body").Parse(a.Webhook.Body)
+		}
+	}
+	if a.MQTT != nil {
+		set++
+		if a.MQTT.Topic == "" {
+			err = errors.New("mqtt actions require a topic")
+		} else if a.MQTT.QoS > 2 {
+			err = fmt.Errorf("invalid mqtt qos %d", a.MQTT.QoS)
+		} else if a.MQTT.Payload != "" {
+			a.MQTT.payload, err = template.New("payload").Parse(a.MQTT.Payload)
+		}
+	}
+	if a.Command != nil {
+		set++
+		if len(a.Command.Command) == 0 {
+			err = errors.New("command actions require a command")
+		}
+	}
+	if set != 1 {
+		return errors.New("exactly one of rpc, webhook, mqtt, or command must be set")
+	}
+	return err
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (w *Window) compile() error {
+	if len(w.Days) > 0 {
+		w.days = make(map[time.Weekday]bool)
+	}
+	for _, d := range w.Days {
+		day, ok := weekdays[strings.ToLower(d)]
+		if !ok {
+			for _, wd := range weekdays {
+				if strings.EqualFold(d, wd.String()) {
+					day, ok = wd, true
+				}
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unknown day %q", d)
+		}
+		w.days[day] = true
+	}
+	if (w.From == "") != (w.To == "") {
+		return errors.New("from and to must be specified together")
+	}
+	if w.From == "" {
+		return nil
+	}
+	var err error
+	if w.from, err = parseTimeOfDay(w.From); err != nil {
+		return err
+	}
+	if w.to, err = parseTimeOfDay(w.To); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("parsing time %q: expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains returns true if t falls within the window. Days refer to the day the window starts,
+// so a Friday window from 22:00 to 06:00 includes early Saturday morning.
+func (w *Window) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tod := t.Sub(midnight)
+	day := t.Weekday()
+	if w.from != w.to {
+		if w.from < w.to {
+			if tod < w.from || tod >= w.to {
+				return false
+			}
+		} else if tod < w.to {
+			day = (day + 6) % 7
+		} else if tod < w.from {
+			return false
+		}
+	}
+	return w.days == nil || w.days[day]
+}
+
+// Condition compares a field to a value.
+type Condition struct {
+	// Field is a dot separated path within the status or event, ex. `temperature.tC`.
+	Field string
+	Op    string
+	Value any
+}
+
+// operators are ordered so two character operators are found before their prefixes.
+var operators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// ParseCondition parses expressions like `apower > 2000`, `output == true`, or
+// `event == "single_push"`. Values are parsed as JSON where possible and otherwise treated as
+// strings.
+func ParseCondition(s string) (*Condition, error) {
+	for i := range s {
+		for _, op := range operators {
+			if !strings.HasPrefix(s[i:], op) {
+				continue
+			}
+			c := &Condition{
+				Field: strings.TrimSpace(s[:i]),
+				Op:    op,
+			}
+			raw := strings.TrimSpace(s[i+len(op):])
+			if c.Field == "" || raw == "" {
+				return nil, fmt.Errorf("invalid condition %q: expected `field op value`", s)
+			}
+			if err := json.Unmarshal([]byte(raw), &c.Value); err != nil {
+				c.Value = raw
+			}
+			switch c.Value.(type) {
+			case float64, string:
+			case bool, nil:
+				if op != "==" && op != "!=" {
+					return nil, fmt.Errorf("invalid condition %q: %s can't be compared with %s", s, raw, op)
+				}
+			default:
+				return nil, fmt.Errorf("invalid condition %q: unsupported value %s", s, raw)
+			}
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid condition %q: no operator found", s)
+}
+
+// String implements fmt.Stringer.
+func (c *Condition) String() string {
+	v, _ := json.Marshal(c.Value)
+	return fmt.Sprintf("%s %s %s", c.Field, c.Op, v)
+}
+
+// Eval returns true if the condition holds for the decoded status or event. Missing fields and
+// mismatched types never match.
+func (c *Condition) Eval(doc map[string]any) bool {
+	v, ok := lookup(doc, c.Field)
+	if !ok {
+		return false
+	}
+	switch want := c.Value.(type) {
+	case float64:
+		got, ok := v.(float64)
+		if !ok {
+			return false
+		}
+		return compare(got, want, c.Op)
+	case string:
+		got, ok := v.(string)
+		if !ok {
+			return false
+		}
+		return compare(got, want, c.Op)
+	default:
+		equal := v == want
+		if c.Op == "!=" {
+			return !equal
+		}
+		return equal
+	}
+}
+
+func compare[T float64 | string](got, want T, op string) bool {
+	switch op {
+	case ">":
+		return got > want
+	case ">=":
+		return got >= want
+	case "<":
+		return got < want
+	case "<=":
+		return got <= want
+	case "==":
+		return got == want
+	case "!=":
+		return got != want
+	}
+	return false
+}
+
+func lookup(doc map[string]any, path string) (any, bool) {
+	var v any = doc
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
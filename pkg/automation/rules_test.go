@@ -0,0 +1,139 @@
+package automation
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCondition(t *testing.T) {
+	tcs := []struct {
+		in     string
+		expect *Condition
+		err    string
+	}{
+		{in: "apower > 2000", expect: &Condition{Field: "apower", Op: ">", Value: 2000.0}},
+		{in: "temperature.tC>=30.5", expect: &Condition{Field: "temperature.tC", Op: ">=", Value: 30.5}},
+		{in: "output == true", expect: &Condition{Field: "output", Op: "==", Value: true}},
+		{in: `event != "single_push"`, expect: &Condition{Field: "event", Op: "!=", Value: "single_push"}},
+		{in: "state == open", expect: &Condition{Field: "state", Op: "==", Value: "open"}},
+		{in: "apower", err: "no operator found"},
+		{in: "> 5", err: "expected `field op value`"},
+		{in: "output > true", err: "can't be compared"},
+		{in: "x == [1]", err: "unsupported value"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.in, func(t *testing.T) {
+			c, err := ParseCondition(tc.in)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, c)
+		})
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	doc := map[string]any{
+		"apower":      2500.0,
+		"output":      true,
+		"state":       "open",
+		"temperature": map[string]any{"tC": 28.0},
+	}
+	tcs := []struct {
+		in     string
+		expect bool
+	}{
+		{in: "apower > 2000", expect: true},
+		{in: "apower <= 2000", expect: false},
+		{in: "temperature.tC < 30", expect: true},
+		{in: "temperature.tF < 30", expect: false},
+		{in: "output == true", expect: true},
+		{in: "output != true", expect: false},
+		{in: "state == open", expect: true},
+		{in: "state > 5", expect: false},
+		{in: "missing != 5", expect: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.in, func(t *testing.T) {
+			c, err := ParseCondition(tc.in)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, c.Eval(doc))
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	// 2024-01-05 is a Friday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+	tcs := []struct {
+		name   string
+		window Window
+		t      time.Time
+		expect bool
+	}{
+		{name: "daytime inside", window: Window{From: "08:00", To: "17:00"}, t: at(5, 12, 0), expect: true},
+		{name: "daytime end", window: Window{From: "08:00", To: "17:00"}, t: at(5, 17, 0), expect: false},
+		{name: "overnight late", window: Window{From: "22:00", To: "06:00"}, t: at(5, 23, 0), expect: true},
+		{name: "overnight early", window: Window{From: "22:00", To: "06:00"}, t: at(6, 5, 59), expect: true},
+		{name: "overnight outside", window: Window{From: "22:00", To: "06:00"}, t: at(6, 12, 0), expect: false},
+		{name: "days", window: Window{Days: []string{"sat", "Sunday"}}, t: at(6, 12, 0), expect: true},
+		{name: "other day", window: Window{Days: []string{"sat", "Sunday"}}, t: at(5, 12, 0), expect: false},
+		{name: "overnight starting friday", window: Window{Days: []string{"fri"}, From: "22:00", To: "06:00"}, t: at(6, 2, 0), expect: true},
+		{name: "overnight starting saturday", window: Window{Days: []string{"fri"}, From: "22:00", To: "06:00"}, t: at(7, 2, 0), expect: false},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.window.compile())
+			assert.Equal(t, tc.expect, tc.window.Contains(tc.t))
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`
+rules:
+- name: heater-overload
+  match:
+    device: garage
+    component: switch:0
+    conditions: ["apower > 2000"]
+  debounce: 30s
+  cooldown: 5m
+  window: {days: [mon], from: "22:00", to: "06:00"}
+  actions:
+  - rpc: {device: garage, method: Switch.Set, params: {id: 0, "on": false}}
+  - mqtt: {topic: alerts, payload: "{{.Rule}}"}
+- match: {event: single_push}
+  actions:
+  - command: {command: [notify-send, pushed]}
+`))
+	require.NoError(t, err)
+	require.Len(t, c.Rules, 2)
+	r := c.Rules[0]
+	assert.Equal(t, Duration(30*time.Second), r.Debounce)
+	assert.Equal(t, Duration(5*time.Minute), r.Cooldown)
+	assert.JSONEq(t, `{"id": 0, "on": false}`, string(r.Actions[0].RPC.Params))
+	assert.NotNil(t, r.Actions[1].MQTT.payload)
+	assert.Equal(t, "rule-2", c.Rules[1].Name)
+
+	for name, in := range map[string]string{
+		"no rules":        `rules: []`,
+		"unknown field":   `rules: [{actions: [{command: {command: [x]}}], bogus: 1}]`,
+		"bad condition":   `rules: [{match: {conditions: [apower]}, actions: [{command: {command: [x]}}]}]`,
+		"no actions":      `rules: [{name: a}]`,
+		"two actions":     `rules: [{actions: [{command: {command: [x]}, mqtt: {topic: t}}]}]`,
+		"bad duration":    `rules: [{debounce: 5, actions: [{command: {command: [x]}}]}]`,
+		"bad day":         `rules: [{window: {days: [someday]}, actions: [{command: {command: [x]}}]}]`,
+		"duplicate names": `rules: [{name: a, actions: [{command: {command: [x]}}]}, {name: a, actions: [{command: {command: [x]}}]}]`,
+	} {
+		_, err := Parse([]byte(in))
+		assert.Error(t, err, name)
+	}
+}
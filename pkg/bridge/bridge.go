@@ -0,0 +1,359 @@
+// Package bridge exposes devices found by a discovery.Discoverer to other systems over MQTT,
+// regardless of the transport used to reach them. Devices which are only reachable via HTTP or
+// BLE can then be monitored and controlled like devices connected to the broker.
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"github.com/jcodybaker/shellyctl/pkg/internal/jsonmerge"
+	"github.com/jcodybaker/shellyctl/pkg/internal/rawrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultPollInterval is the default interval at which device status is polled, and new
+	// devices are searched for.
+	DefaultPollInterval = time.Minute
+	// DefaultRPCTimeout is the default time limit for each request to a device.
+	DefaultRPCTimeout = 10 * time.Second
+	// DefaultConcurrency is the default number of devices polled concurrently.
+	DefaultConcurrency = 5
+)
+
+type options struct {
+	topicPrefix     string
+	discoveryPrefix string
+	pollInterval    time.Duration
+	rpcTimeout      time.Duration
+	concurrency     int
+}
+
+// Option provides optional parameters for bridges.
+type Option func(*options)
+
+// WithTopicPrefix sets the prefix of the topics published and subscribed by the bridge.
+func WithTopicPrefix(prefix string) Option {
+	return func(o *options) {
+		o.topicPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithDiscoveryPrefix sets the topic prefix Home Assistant watches for MQTT discovery configs.
+func WithDiscoveryPrefix(prefix string) Option {
+	return func(o *options) {
+		o.discoveryPrefix = strings.TrimSuffix(prefix, "/")
+	}
+}
+
+// WithPollInterval sets the interval at which device status is polled and new devices are
+// searched for.
+func WithPollInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = d
+	}
+}
+
+// WithRPCTimeout limits the time of each request to a device.
+func WithRPCTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.rpcTimeout = d
+	}
+}
+
+// WithConcurrency sets the number of devices polled concurrently.
+func WithConcurrency(n int) Option {
+	return func(o *options) {
+		o.concurrency = n
+	}
+}
+
+func newOptions(topicPrefix string, opts []Option) *options {
+	o := &options{
+		topicPrefix:     topicPrefix,
+		discoveryPrefix: DefaultDiscoveryPrefix,
+		pollInterval:    DefaultPollInterval,
+		rpcTimeout:      DefaultRPCTimeout,
+		concurrency:     DefaultConcurrency,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.concurrency < 1 {
+		o.concurrency = 1
+	}
+	return o
+}
+
+// nodeID identifies a device in topics. It's the device ID used as the src of notifications,
+// falling back to the MAC address for devices whose ID isn't known.
+func nodeID(dev *discovery.Device) string {
+	if dev.ID != "" {
+		return dev.ID
+	}
+	return strings.ToLower(dev.MACAddr)
+}
+
+// call sends a request to the device over its own transport, decoding the response into resp.
+func (o *options) call(ctx context.Context, dev *discovery.Device, req shelly.RPCRequestBody, resp any) error {
+	ll := dev.LogCtx(ctx)
+	ctx, cancel := context.WithTimeout(ctx, o.rpcTimeout)
+	defer cancel()
+	conn, err := dev.Open(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := conn.Disconnect(ctx); err != nil {
+			ll.Warn().Err(err).Msg("disconnecting from device")
+		}
+	}()
+	ll.Debug().Str("method", req.Method()).Any("request_body", req).Msg("sending request")
+	if _, err := shelly.Do(ctx, conn, dev.AuthCallback(ctx), req, resp); err != nil {
+		return fmt.Errorf("executing %s: %w", req.Method(), err)
+	}
+	return nil
+}
+
+// getStatus returns the status of each of the device's components, keyed by component.
+func (o *options) getStatus(ctx context.Context, dev *discovery.Device) (map[string]map[string]any, error) {
+	status := make(map[string]json.RawMessage)
+	if err := o.call(ctx, dev, rawrpc.NewRequest("Shelly.GetStatus", nil), &status); err != nil {
+		return nil, err
+	}
+	components := make(map[string]map[string]any, len(status))
+	for component, raw := range status {
+		var doc map[string]any
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			// Some keys, like `ts` on BLE devices, aren't components.
+			continue
+		}
+		components[component] = doc
+	}
+	return components, nil
+}
+
+// deviceState holds the state a bridge has published for a device.
+type deviceState struct {
+	dev *discovery.Device
+	// components holds the merged status of each component.
+	components map[string]map[string]any
+	// online is the availability last published, or nil if none has been.
+	online *bool
+	// configs holds the Home Assistant discovery config topics which have been published.
+	configs map[string]bool
+	// rpc receives the requests published to the device's rpc topic by the Republisher.
+	rpc codec.Codec
+}
+
+// merge records a component's status and returns it. NotifyStatus notifications only include the
+// fields which changed, so are merged with the last status unless replace is set.
+func (d *deviceState) merge(component string, doc map[string]any, replace bool) map[string]any {
+	if !replace {
+		doc = jsonmerge.Merge(d.components[component], doc)
+	}
+	d.components[component] = doc
+	return doc
+}
+
+// setOnline records the device's availability and reports whether it changed.
+func (d *deviceState) setOnline(online bool) bool {
+	changed := d.online == nil || *d.online != online
+	d.online = &online
+	return changed
+}
+
+// deviceStates holds the state of each device a bridge has published, keyed by topic.
+type deviceStates struct {
+	lock   sync.Mutex
+	states map[string]*deviceState
+}
+
+func newDeviceStates() deviceStates {
+	return deviceStates{states: make(map[string]*deviceState)}
+}
+
+// get returns the state of the device with the given key, creating it if needed, and reports
+// whether it was created. The lock must be held.
+func (s *deviceStates) get(key string, dev *discovery.Device) (*deviceState, bool) {
+	d, ok := s.states[key]
+	if !ok {
+		d = &deviceState{
+			components: make(map[string]map[string]any),
+			configs:    make(map[string]bool),
+		}
+		s.states[key] = d
+	}
+	d.dev = dev
+	return d, !ok
+}
+
+// device returns the device with the given key, or nil if it hasn't been published.
+func (s *deviceStates) device(key string) *discovery.Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d := s.states[key]; d != nil {
+		return d.dev
+	}
+	return nil
+}
+
+// markOffline records every online device as offline, and returns them by key so the bridge can
+// publish their new availability.
+func (s *deviceStates) markOffline() map[string]*discovery.Device {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	out := make(map[string]*discovery.Device)
+	for key, d := range s.states {
+		if d.online != nil && *d.online {
+			d.setOnline(false)
+			out[key] = d.dev
+		}
+	}
+	return out
+}
+
+// codecs returns the rpc codec of each device which has one.
+func (s *deviceStates) codecs() []codec.Codec {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var out []codec.Codec
+	for _, d := range s.states {
+		if d.rpc != nil {
+			out = append(out, d.rpc)
+		}
+	}
+	return out
+}
+
+// pollLoop searches for new devices and polls every device each poll interval until ctx is done.
+func (o *options) pollLoop(ctx context.Context, disc *discovery.Discoverer, poll func(context.Context, *discovery.Device)) {
+	l := log.Ctx(ctx)
+	t := time.NewTicker(o.pollInterval)
+	defer t.Stop()
+	for {
+		if _, err := disc.Search(ctx); err != nil {
+			l.Err(err).Msg("finding new devices")
+		}
+		var wg sync.WaitGroup
+		limit := make(chan struct{}, o.concurrency)
+		for _, dev := range disc.AllDevices() {
+			dev := dev
+			select {
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			case limit <- struct{}{}:
+			}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-limit
+					wg.Done()
+				}()
+				poll(ctx, dev)
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// notificationLoop passes each notification from a known device to handle until ctx is done,
+// along with the notification split into per-component envelopes. NotifyEvent notifications are
+// passed if events is true.
+func notificationLoop(
+	ctx context.Context,
+	disc *discovery.Discoverer,
+	events bool,
+	handle func(*discovery.Device, *frame.Frame, []*eventstream.Envelope),
+) {
+	l := log.Ctx(ctx)
+	fullStatus := disc.SubscribeFullStatus()
+	defer fullStatus.Unsubscribe()
+	status := disc.SubscribeStatus()
+	defer status.Unsubscribe()
+	var eventC <-chan discovery.EventNotification
+	if events {
+		ev := disc.SubscribeEvents()
+		defer ev.Unsubscribe()
+		eventC = ev.C()
+	}
+	for {
+		var envs []*eventstream.Envelope
+		var f *frame.Frame
+		var dev *discovery.Device
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case fsn := <-fullStatus.C():
+			f, dev = fsn.Frame, disc.DeviceBySrc(fsn.Frame.Src)
+			envs, err = eventstream.FromStatus(fsn, dev)
+		case sn := <-status.C():
+			f, dev = sn.Frame, disc.DeviceBySrc(sn.Frame.Src)
+			envs, err = eventstream.FromStatus(sn, dev)
+		case en := <-eventC:
+			f, dev = en.Frame, disc.DeviceBySrc(en.Frame.Src)
+			envs, err = eventstream.FromEvent(en, dev)
+		}
+		if err != nil {
+			l.Warn().Err(err).Msg("decoding notification")
+			continue
+		}
+		if dev == nil {
+			// Without the device there's nothing to relay requests to.
+			continue
+		}
+		handle(dev, f, envs)
+	}
+}
+
+// publish publishes a message and waits for it to be delivered to the broker.
+func publish(ctx context.Context, c mqtt.Client, topic string, retained bool, payload []byte) error {
+	token := c.Publish(topic, 1, retained, payload)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		return fmt.Errorf("publishing to %q: %w", topic, ctx.Err())
+	}
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("publishing to %q: %w", topic, err)
+	}
+	return nil
+}
+
+// subscribe subscribes to topics and waits for the broker to acknowledge. Each message is handled
+// in its own goroutine, as handlers make requests to devices which would block the MQTT client.
+func subscribe(c mqtt.Client, handler func(topic string, payload []byte), topics ...string) error {
+	filters := make(map[string]byte, len(topics))
+	for _, t := range topics {
+		filters[t] = 1
+	}
+	token := c.SubscribeMultiple(filters, func(_ mqtt.Client, m mqtt.Message) {
+		go handler(m.Topic(), m.Payload())
+	})
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("subscribing to %q: %w", topics, err)
+	}
+	return nil
+}
+
+var errNoMQTT = errors.New("not connected to an MQTT broker")
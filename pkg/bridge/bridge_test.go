@@ -0,0 +1,101 @@
+package bridge
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/require"
+)
+
+type published struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// testClient records published messages and subscriptions. Other mqtt.Client methods panic.
+type testClient struct {
+	mqtt.Client
+	lock       sync.Mutex
+	published  []published
+	subscribed map[string]mqtt.MessageHandler
+}
+
+func (c *testClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.subscribed == nil {
+		c.subscribed = make(map[string]mqtt.MessageHandler)
+	}
+	for topic := range filters {
+		c.subscribed[topic] = callback
+	}
+	return doneToken{}
+}
+
+func (c *testClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *testClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883")).OptionsReader()
+}
+
+// deliver passes a message to the handler subscribed to its topic.
+func (c *testClient) deliver(t *testing.T, topic, payload string) {
+	c.lock.Lock()
+	handler := c.subscribed[topic]
+	c.lock.Unlock()
+	require.NotNil(t, handler, "not subscribed to %q", topic)
+	handler(c, testMessage{topic: topic, payload: payload})
+}
+
+func (c *testClient) Unsubscribe(topics ...string) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, topic := range topics {
+		delete(c.subscribed, topic)
+	}
+	return doneToken{}
+}
+
+func (c *testClient) Publish(topic string, _ byte, retained bool, payload interface{}) mqtt.Token {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.published = append(c.published, published{topic: topic, retained: retained, payload: string(payload.([]byte))})
+	return doneToken{}
+}
+
+// last returns the last payload published to each topic.
+func (c *testClient) last() map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	out := make(map[string]string)
+	for _, p := range c.published {
+		out[p.topic] = p.payload
+	}
+	return out
+}
+
+// testMessage is a received message. Other mqtt.Message methods panic.
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload string
+}
+
+func (m testMessage) Topic() string   { return m.topic }
+func (m testMessage) Payload() []byte { return []byte(m.payload) }
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                       { return true }
+func (doneToken) WaitTimeout(_ time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+func (doneToken) Error() error { return nil }
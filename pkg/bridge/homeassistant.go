@@ -0,0 +1,311 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultDiscoveryPrefix is the topic prefix Home Assistant watches for MQTT discovery configs
+	// by default.
+	DefaultDiscoveryPrefix = "homeassistant"
+	// DefaultHomeAssistantTopicPrefix is the default prefix of the state, availability, and
+	// command topics of the Home Assistant bridge.
+	DefaultHomeAssistantTopicPrefix = "shellyctl"
+
+	haOnline  = "online"
+	haOffline = "offline"
+)
+
+// HomeAssistant publishes Home Assistant MQTT discovery configs for the components of each device,
+// keeps their state current from notifications and polling, and relays commands from Home
+// Assistant to the devices as RPCs.
+//
+// Each component's status is published as JSON, retained, to `<prefix>/<id>/<component>`, and
+// the device's availability to `<prefix>/<id>/availability`. Commands are received on
+// `<prefix>/<id>/<component>/set`, and `<prefix>/<id>/<component>/position/set` or
+// `.../brightness/set` for covers and lights.
+type HomeAssistant struct {
+	*options
+	disc   *discovery.Discoverer
+	client mqtt.Client
+
+	// devices is keyed by node ID.
+	devices deviceStates
+}
+
+// NewHomeAssistant creates a Home Assistant bridge for the discoverer's devices. Messages are
+// published with the discoverer's MQTT client.
+func NewHomeAssistant(disc *discovery.Discoverer, opts ...Option) *HomeAssistant {
+	return &HomeAssistant{
+		options: newOptions(DefaultHomeAssistantTopicPrefix, opts),
+		disc:    disc,
+		devices: newDeviceStates(),
+	}
+}
+
+// Run bridges devices until ctx is done. Each device is then marked unavailable.
+func (h *HomeAssistant) Run(ctx context.Context) error {
+	ll := log.Ctx(ctx).With().Str("component", "homeassistant").Logger()
+	ctx = ll.WithContext(ctx)
+	h.client = h.disc.MQTTClient()
+	if h.client == nil {
+		return errNoMQTT
+	}
+	defer h.stop(ctx)
+	commandTopics := []string{h.topicPrefix + "/+/+/set", h.topicPrefix + "/+/+/+/set"}
+	err := subscribe(h.client, func(topic string, payload []byte) {
+		h.handleCommand(ctx, topic, payload)
+	}, commandTopics...)
+	if err != nil {
+		return err
+	}
+	defer h.client.Unsubscribe(commandTopics...)
+	// Home Assistant publishes its birth message when it starts. Configs are republished then,
+	// in case the broker doesn't retain them.
+	statusTopic := h.discoveryPrefix + "/status"
+	err = subscribe(h.client, func(_ string, payload []byte) {
+		if string(payload) == haOnline {
+			h.republish(ctx)
+		}
+	}, statusTopic)
+	if err != nil {
+		return err
+	}
+	defer h.client.Unsubscribe(statusTopic)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.pollLoop(ctx, h.disc, h.poll)
+	}()
+	notificationLoop(ctx, h.disc, false, func(dev *discovery.Device, _ *frame.Frame, envs []*eventstream.Envelope) {
+		for _, env := range envs {
+			var doc map[string]any
+			if err := json.Unmarshal(env.Payload, &doc); err != nil {
+				ll.Warn().Err(err).Str("src", env.Src).Str("component", env.Component).
+					Msg("decoding notification payload")
+				continue
+			}
+			h.update(ctx, dev, env.Component, doc, env.Method == eventstream.MethodNotifyFullStatus)
+		}
+	})
+	return nil
+}
+
+// poll fetches the device's status and publishes it.
+func (h *HomeAssistant) poll(ctx context.Context, dev *discovery.Device) {
+	ll := dev.LogCtx(ctx)
+	status, err := h.getStatus(ctx, dev)
+	if err != nil {
+		ll.Warn().Err(err).Msg("polling device status")
+		h.setAvailable(ctx, dev, false)
+		return
+	}
+	h.setAvailable(ctx, dev, true)
+	for component, doc := range status {
+		h.update(ctx, dev, component, doc, true)
+	}
+}
+
+// update records a component's status, publishing discovery configs for any entities it
+// introduces, and then the merged status.
+func (h *HomeAssistant) update(ctx context.Context, dev *discovery.Device, component string, doc map[string]any, replace bool) {
+	ll := dev.LogCtx(ctx)
+	id := nodeID(dev)
+	h.devices.lock.Lock()
+	d, _ := h.devices.get(id, dev)
+	doc = d.merge(component, doc, replace)
+	var configs []haEntity
+	for _, e := range h.entities(dev, component, doc) {
+		if !d.configs[e.topic] {
+			d.configs[e.topic] = true
+			configs = append(configs, e)
+		}
+	}
+	h.devices.lock.Unlock()
+
+	for _, e := range configs {
+		if err := h.publishJSON(ctx, e.topic, e.config); err != nil {
+			ll.Err(err).Msg("publishing home assistant discovery config")
+		}
+	}
+	if err := h.publishJSON(ctx, h.stateTopic(id, component), doc); err != nil {
+		ll.Err(err).Str("component", component).Msg("publishing component state")
+	}
+}
+
+// setAvailable publishes the device's availability if it has changed.
+func (h *HomeAssistant) setAvailable(ctx context.Context, dev *discovery.Device, available bool) {
+	h.devices.lock.Lock()
+	d, _ := h.devices.get(nodeID(dev), dev)
+	changed := d.setOnline(available)
+	h.devices.lock.Unlock()
+	if !changed {
+		return
+	}
+	h.publishAvailability(ctx, dev, available)
+}
+
+func (h *HomeAssistant) publishAvailability(ctx context.Context, dev *discovery.Device, available bool) {
+	payload := haOffline
+	if available {
+		payload = haOnline
+	}
+	if err := publish(ctx, h.client, h.availabilityTopic(nodeID(dev)), true, []byte(payload)); err != nil {
+		ll := dev.LogCtx(ctx)
+		ll.Err(err).Msg("publishing device availability")
+	}
+}
+
+// republish publishes the configs, availability, and state of every known device.
+func (h *HomeAssistant) republish(ctx context.Context) {
+	type state struct {
+		dev        *discovery.Device
+		available  *bool
+		components map[string]map[string]any
+	}
+	h.devices.lock.Lock()
+	var states []state
+	for _, d := range h.devices.states {
+		components := make(map[string]map[string]any, len(d.components))
+		for c, doc := range d.components {
+			components[c] = doc
+		}
+		d.configs = make(map[string]bool)
+		states = append(states, state{dev: d.dev, available: d.online, components: components})
+	}
+	h.devices.lock.Unlock()
+	log.Ctx(ctx).Info().Int("devices", len(states)).Msg("home assistant started; republishing discovery configs")
+	for _, s := range states {
+		if s.available != nil {
+			h.publishAvailability(ctx, s.dev, *s.available)
+		}
+		for c, doc := range s.components {
+			h.update(ctx, s.dev, c, doc, true)
+		}
+	}
+}
+
+// stop marks every available device unavailable, so Home Assistant doesn't show stale state
+// while the bridge isn't running.
+func (h *HomeAssistant) stop(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), h.rpcTimeout)
+	defer cancel()
+	for _, dev := range h.devices.markOffline() {
+		h.publishAvailability(ctx, dev, false)
+	}
+}
+
+// handleCommand relays a command from a Home Assistant command topic to the device, then
+// publishes the device's new status.
+func (h *HomeAssistant) handleCommand(ctx context.Context, topic string, payload []byte) {
+	ll := log.Ctx(ctx).With().Str("topic", topic).Str("payload", string(payload)).Logger()
+	levels := strings.Split(strings.TrimPrefix(topic, h.topicPrefix+"/"), "/")
+	if len(levels) < 3 {
+		return
+	}
+	id, component, attr := levels[0], levels[1], strings.Join(levels[2:len(levels)-1], "/")
+	dev := h.devices.device(id)
+	if dev == nil {
+		ll.Warn().Msg("command for unknown device")
+		return
+	}
+	req, err := haCommand(component, attr, strings.TrimSpace(string(payload)))
+	if err != nil {
+		ll.Warn().Err(err).Msg("parsing home assistant command")
+		return
+	}
+	ctx = dev.Log(ll).WithContext(ctx)
+	if err := h.call(ctx, dev, req, req.NewResponse()); err != nil {
+		ll.Err(err).Msg("relaying home assistant command")
+		return
+	}
+	h.poll(ctx, dev)
+}
+
+// haCommand converts a Home Assistant command for a component attribute to an RPC. attr is
+// empty for the component's primary command topic.
+func haCommand(component, attr, payload string) (shelly.RPCRequestBody, error) {
+	typ, idStr, _ := strings.Cut(component, ":")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid component %q", component)
+	}
+	switch {
+	case typ == "switch" && attr == "":
+		on, err := haOnOff(payload)
+		if err != nil {
+			return nil, err
+		}
+		return &shelly.SwitchSetRequest{ID: id, On: on}, nil
+	case typ == "light" && attr == "":
+		on, err := haOnOff(payload)
+		if err != nil {
+			return nil, err
+		}
+		return &shelly.LightSetRequest{ID: id, On: &on}, nil
+	case typ == "light" && attr == "brightness":
+		b, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid brightness %q", payload)
+		}
+		return &shelly.LightSetRequest{ID: id, On: shelly.BoolPtr(b > 0), Brightness: &b}, nil
+	case typ == "cover" && attr == "":
+		switch payload {
+		case "OPEN":
+			return &shelly.CoverOpenRequest{ID: id}, nil
+		case "CLOSE":
+			return &shelly.CoverCloseRequest{ID: id}, nil
+		case "STOP":
+			return &shelly.CoverStopRequest{ID: id}, nil
+		}
+		return nil, fmt.Errorf("unknown cover command %q", payload)
+	case typ == "cover" && attr == "position":
+		pos, err := strconv.ParseFloat(payload, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid position %q", payload)
+		}
+		return &shelly.CoverGoToPositionRequest{ID: id, Pos: &pos}, nil
+	}
+	return nil, fmt.Errorf("unsupported command for %s", strings.TrimSuffix(component+" "+attr, " "))
+}
+
+func haOnOff(payload string) (bool, error) {
+	switch payload {
+	case "ON":
+		return true, nil
+	case "OFF":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected ON or OFF, got %q", payload)
+}
+
+func (h *HomeAssistant) stateTopic(id, component string) string {
+	return h.topicPrefix + "/" + id + "/" + component
+}
+
+func (h *HomeAssistant) availabilityTopic(id string) string {
+	return h.topicPrefix + "/" + id + "/availability"
+}
+
+func (h *HomeAssistant) publishJSON(ctx context.Context, topic string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %q: %w", topic, err)
+	}
+	return publish(ctx, h.client, topic, true, payload)
+}
@@ -0,0 +1,158 @@
+package bridge
+
+import (
+	"strings"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+)
+
+// haEntity is a Home Assistant MQTT discovery config.
+type haEntity struct {
+	topic  string
+	config map[string]any
+}
+
+// haSensor describes a numeric status field which is published as a sensor entity.
+type haSensor struct {
+	// path locates the field in the component's status.
+	path        []string
+	name        string
+	deviceClass string
+	unit        string
+	stateClass  string
+	diagnostic  bool
+}
+
+// haSensors are published for any component whose status includes the field.
+var haSensors = []haSensor{
+	{path: []string{"apower"}, name: "Power", deviceClass: "power", unit: "W", stateClass: "measurement"},
+	{path: []string{"voltage"}, name: "Voltage", deviceClass: "voltage", unit: "V", stateClass: "measurement"},
+	{path: []string{"current"}, name: "Current", deviceClass: "current", unit: "A", stateClass: "measurement"},
+	{path: []string{"aenergy", "total"}, name: "Energy", deviceClass: "energy", unit: "Wh", stateClass: "total_increasing"},
+	{path: []string{"temperature", "tC"}, name: "Temperature", deviceClass: "temperature", unit: "°C", stateClass: "measurement", diagnostic: true},
+	{path: []string{"tC"}, name: "Temperature", deviceClass: "temperature", unit: "°C", stateClass: "measurement"},
+	{path: []string{"rh"}, name: "Humidity", deviceClass: "humidity", unit: "%", stateClass: "measurement"},
+	{path: []string{"battery", "percent"}, name: "Battery", deviceClass: "battery", unit: "%", stateClass: "measurement"},
+	{path: []string{"rssi"}, name: "Signal Strength", deviceClass: "signal_strength", unit: "dBm", stateClass: "measurement", diagnostic: true},
+}
+
+// entities returns the discovery configs for a component's entities. The component's type
+// determines its primary entity; sensors are added for the numeric fields in its status.
+func (h *HomeAssistant) entities(dev *discovery.Device, component string, status map[string]any) []haEntity {
+	id := nodeID(dev)
+	typ, _, _ := strings.Cut(component, ":")
+	objectID := strings.ReplaceAll(component, ":", "_")
+	name := haComponentName(component)
+	stateTopic := h.stateTopic(id, component)
+	commandTopic := stateTopic + "/set"
+	base := func(platform, objectID, name string) haEntity {
+		return haEntity{
+			topic: strings.Join([]string{h.discoveryPrefix, platform, id, objectID, "config"}, "/"),
+			config: map[string]any{
+				"name":               name,
+				"unique_id":          id + "_" + objectID,
+				"state_topic":        stateTopic,
+				"availability_topic": h.availabilityTopic(id),
+				"device":             haDeviceConfig(dev),
+			},
+		}
+	}
+
+	var out []haEntity
+	switch typ {
+	case "switch":
+		e := base("switch", objectID, name)
+		e.config["command_topic"] = commandTopic
+		e.config["value_template"] = "{{ 'ON' if value_json.output else 'OFF' }}"
+		out = append(out, e)
+	case "light":
+		e := base("light", objectID, name)
+		e.config["command_topic"] = commandTopic
+		e.config["state_value_template"] = "{{ 'ON' if value_json.output else 'OFF' }}"
+		if _, ok := status["brightness"]; ok {
+			e.config["brightness_command_topic"] = stateTopic + "/brightness/set"
+			e.config["brightness_state_topic"] = stateTopic
+			e.config["brightness_value_template"] = "{{ value_json.brightness }}"
+			e.config["brightness_scale"] = 100
+		}
+		out = append(out, e)
+	case "cover":
+		e := base("cover", objectID, name)
+		e.config["command_topic"] = commandTopic
+		e.config["value_template"] = "{{ value_json.state }}"
+		if _, ok := status["current_pos"]; ok {
+			e.config["position_topic"] = stateTopic
+			e.config["position_template"] = "{{ value_json.current_pos }}"
+			e.config["set_position_topic"] = stateTopic + "/position/set"
+		}
+		out = append(out, e)
+	case "input":
+		// Button inputs have no state; only switch inputs are published.
+		if _, ok := status["state"].(bool); ok {
+			e := base("binary_sensor", objectID, name)
+			e.config["value_template"] = "{{ 'ON' if value_json.state else 'OFF' }}"
+			out = append(out, e)
+		}
+	}
+	for _, s := range haSensors {
+		if !hasNumber(status, s.path) {
+			continue
+		}
+		e := base("sensor", objectID+"_"+strings.Join(s.path, "_"), name+" "+s.name)
+		e.config["value_template"] = "{{ value_json." + strings.Join(s.path, ".") + " }}"
+		e.config["device_class"] = s.deviceClass
+		e.config["unit_of_measurement"] = s.unit
+		e.config["state_class"] = s.stateClass
+		if s.diagnostic {
+			e.config["entity_category"] = "diagnostic"
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// haComponentName names a component's entities, ex. `switch:0` is `Switch 0`.
+func haComponentName(component string) string {
+	typ, id, _ := strings.Cut(component, ":")
+	if typ == "" {
+		return component
+	}
+	name := strings.ToUpper(typ[:1]) + typ[1:]
+	if id != "" {
+		name += " " + id
+	}
+	return name
+}
+
+func haDeviceConfig(dev *discovery.Device) map[string]any {
+	name := dev.Name
+	if name == "" {
+		name = nodeID(dev)
+	}
+	c := map[string]any{
+		"identifiers":  []string{nodeID(dev)},
+		"name":         name,
+		"manufacturer": "Shelly",
+	}
+	if dev.Model != "" {
+		c["model"] = dev.Model
+	}
+	if dev.MACAddr != "" {
+		c["connections"] = [][]string{{"mac", strings.ToLower(dev.MACAddr)}}
+	}
+	return c
+}
+
+// hasNumber returns true if the status has a numeric field at path.
+func hasNumber(status map[string]any, path []string) bool {
+	var v any = status
+	for _, p := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return false
+		}
+		v = m[p]
+	}
+	_, ok := v.(float64)
+	return ok
+}
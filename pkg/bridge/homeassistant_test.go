@@ -0,0 +1,179 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHomeAssistantPoll(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	dev := td.NewTestDevice(t, true)
+	dev.ID = "shellyplus1pm-a8032abe5424"
+	dev.Name = "Garage"
+	dev.Model = "SNSW-001P16EU"
+	dev.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{
+		"switch:0": {"id": 0, "output": true, "apower": 12.5, "aenergy": {"total": 1000.5}},
+		"input:0": {"id": 0, "state": false},
+		"sys": {"uptime": 100}
+	}`))
+	c := &testClient{}
+	h := NewHomeAssistant(td.Discoverer)
+	h.client = c
+
+	h.poll(ctx, dev.Device)
+	msgs := c.last()
+	assert.Equal(t, "online", msgs["shellyctl/shellyplus1pm-a8032abe5424/availability"])
+	assert.JSONEq(t, `{"id": 0, "output": true, "apower": 12.5, "aenergy": {"total": 1000.5}}`,
+		msgs["shellyctl/shellyplus1pm-a8032abe5424/switch:0"])
+	assert.JSONEq(t, `{"uptime": 100}`, msgs["shellyctl/shellyplus1pm-a8032abe5424/sys"])
+
+	var sw map[string]any
+	require.NoError(t, json.Unmarshal([]byte(msgs["homeassistant/switch/shellyplus1pm-a8032abe5424/switch_0/config"]), &sw))
+	assert.Equal(t, "Switch 0", sw["name"])
+	assert.Equal(t, "shellyplus1pm-a8032abe5424_switch_0", sw["unique_id"])
+	assert.Equal(t, "shellyctl/shellyplus1pm-a8032abe5424/switch:0", sw["state_topic"])
+	assert.Equal(t, "shellyctl/shellyplus1pm-a8032abe5424/switch:0/set", sw["command_topic"])
+	assert.Equal(t, "shellyctl/shellyplus1pm-a8032abe5424/availability", sw["availability_topic"])
+	assert.Equal(t, map[string]any{
+		"identifiers":  []any{"shellyplus1pm-a8032abe5424"},
+		"name":         "Garage",
+		"manufacturer": "Shelly",
+		"model":        "SNSW-001P16EU",
+		"connections":  []any{[]any{"mac", strings.ToLower(dev.MACAddr)}},
+	}, sw["device"])
+
+	var energy map[string]any
+	require.NoError(t, json.Unmarshal([]byte(msgs["homeassistant/sensor/shellyplus1pm-a8032abe5424/switch_0_aenergy_total/config"]), &energy))
+	assert.Equal(t, "Switch 0 Energy", energy["name"])
+	assert.Equal(t, "{{ value_json.aenergy.total }}", energy["value_template"])
+	assert.Equal(t, "total_increasing", energy["state_class"])
+
+	assert.Contains(t, msgs, "homeassistant/sensor/shellyplus1pm-a8032abe5424/switch_0_apower/config")
+	assert.Contains(t, msgs, "homeassistant/binary_sensor/shellyplus1pm-a8032abe5424/input_0/config")
+	assert.NotContains(t, msgs, "homeassistant/sensor/shellyplus1pm-a8032abe5424/switch_0_voltage/config")
+
+	// Configs are only published once.
+	n := len(c.published)
+	h.poll(ctx, dev.Device)
+	assert.Len(t, c.published, n+3)
+
+	// Partial status notifications are merged.
+	h.update(ctx, dev.Device, "switch:0", map[string]any{"output": false}, false)
+	assert.JSONEq(t, `{"id": 0, "output": false, "apower": 12.5, "aenergy": {"total": 1000.5}}`,
+		c.last()["shellyctl/shellyplus1pm-a8032abe5424/switch:0"])
+
+	h.stop(ctx)
+	assert.Equal(t, "offline", c.last()["shellyctl/shellyplus1pm-a8032abe5424/availability"])
+}
+
+func TestHomeAssistantCommand(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	dev := td.NewTestDevice(t, true)
+	dev.ID = "shellyplus1-a8032abe5424"
+	var setOn *bool
+	dev.AddMockResponse("Switch.Set", func(t *testing.T, params json.RawMessage) bool {
+		req := &shelly.SwitchSetRequest{}
+		require.NoError(t, json.Unmarshal(params, req))
+		setOn = &req.On
+		return true
+	}, json.RawMessage(`{"was_on": false}`))
+	dev.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+	c := &testClient{}
+	h := NewHomeAssistant(td.Discoverer, WithTopicPrefix("bridge/"))
+	h.client = c
+
+	// Commands for devices which haven't been published are ignored.
+	h.handleCommand(ctx, "bridge/shellyplus1-a8032abe5424/switch:0/set", []byte("ON"))
+	assert.Nil(t, setOn)
+
+	h.poll(ctx, dev.Device)
+	h.handleCommand(ctx, "bridge/shellyplus1-a8032abe5424/switch:0/set", []byte("ON"))
+	require.NotNil(t, setOn)
+	assert.True(t, *setOn)
+}
+
+func TestHACommand(t *testing.T) {
+	tcs := []struct {
+		name      string
+		component string
+		attr      string
+		payload   string
+		expect    shelly.RPCRequestBody
+		expectErr string
+	}{
+		{
+			name:      "switch on",
+			component: "switch:1",
+			payload:   "ON",
+			expect:    &shelly.SwitchSetRequest{ID: 1, On: true},
+		},
+		{
+			name:      "switch invalid",
+			component: "switch:0",
+			payload:   "toggle",
+			expectErr: `expected ON or OFF, got "toggle"`,
+		},
+		{
+			name:      "light off",
+			component: "light:0",
+			payload:   "OFF",
+			expect:    &shelly.LightSetRequest{ID: 0, On: shelly.BoolPtr(false)},
+		},
+		{
+			name:      "light brightness",
+			component: "light:0",
+			attr:      "brightness",
+			payload:   "40",
+			expect:    &shelly.LightSetRequest{ID: 0, On: shelly.BoolPtr(true), Brightness: floatPtr(40)},
+		},
+		{
+			name:      "cover stop",
+			component: "cover:0",
+			payload:   "STOP",
+			expect:    &shelly.CoverStopRequest{ID: 0},
+		},
+		{
+			name:      "cover position",
+			component: "cover:0",
+			attr:      "position",
+			payload:   "25",
+			expect:    &shelly.CoverGoToPositionRequest{ID: 0, Pos: floatPtr(25)},
+		},
+		{
+			name:      "unsupported",
+			component: "input:0",
+			payload:   "ON",
+			expectErr: "unsupported command for input:0",
+		},
+		{
+			name:      "invalid component",
+			component: "sys",
+			payload:   "ON",
+			expectErr: `invalid component "sys"`,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := haCommand(tc.component, tc.attr, tc.payload)
+			if tc.expectErr != "" {
+				assert.EqualError(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, req)
+		})
+	}
+}
+
+func floatPtr(f float64) *float64 {
+	return &f
+}
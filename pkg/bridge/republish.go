@@ -0,0 +1,266 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"github.com/jcodybaker/shellyctl/pkg/internal/rawrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/rs/zerolog/log"
+)
+
+// Republisher gives devices which aren't connected to the broker an MQTT presence, using the
+// topic layout of Shelly Gen2 devices. For each device, with an optional topic prefix:
+//   - `<id>/online` is `true` while the device responds to polls, and `false` otherwise.
+//   - `<id>/status/<component>` holds the retained status of each component.
+//   - `<id>/events/rpc` carries the device's notifications.
+//   - Requests published to `<id>/rpc` are relayed to the device over its own transport, and
+//     the response is published to `<src>/rpc`.
+//
+// Devices which are already reached via MQTT are skipped.
+type Republisher struct {
+	*options
+	disc   *discovery.Discoverer
+	client mqtt.Client
+
+	// devices is keyed by the device's topic prefix.
+	devices deviceStates
+}
+
+// NewRepublisher creates a Republisher for the discoverer's devices. Messages are published with
+// the discoverer's MQTT client.
+func NewRepublisher(disc *discovery.Discoverer, opts ...Option) *Republisher {
+	return &Republisher{
+		options: newOptions("", opts),
+		disc:    disc,
+		devices: newDeviceStates(),
+	}
+}
+
+// Run republishes devices until ctx is done. Each device is then marked offline.
+func (r *Republisher) Run(ctx context.Context) error {
+	ll := log.Ctx(ctx).With().Str("component", "republisher").Logger()
+	ctx = ll.WithContext(ctx)
+	r.client = r.disc.MQTTClient()
+	if r.client == nil {
+		return errNoMQTT
+	}
+	defer r.stop(ctx)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.pollLoop(ctx, r.disc, r.poll)
+	}()
+	notificationLoop(ctx, r.disc, true, func(dev *discovery.Device, f *frame.Frame, envs []*eventstream.Envelope) {
+		r.handleNotification(ctx, dev, f, envs)
+	})
+	return nil
+}
+
+// poll fetches the device's status and publishes each component.
+func (r *Republisher) poll(ctx context.Context, dev *discovery.Device) {
+	if dev.MQTTPrefix() != "" {
+		return
+	}
+	ll := dev.LogCtx(ctx)
+	status, err := r.getStatus(ctx, dev)
+	if err != nil {
+		ll.Warn().Err(err).Msg("polling device status")
+		r.setOnline(ctx, dev, false)
+		return
+	}
+	if err := r.attach(ctx, dev); err != nil {
+		ll.Err(err).Msg("subscribing to device rpc topic")
+		return
+	}
+	r.setOnline(ctx, dev, true)
+	for component, doc := range status {
+		r.update(ctx, dev, component, doc, true)
+	}
+}
+
+// handleNotification publishes a device's notification to its events topic, and the status of
+// any components it changes.
+func (r *Republisher) handleNotification(ctx context.Context, dev *discovery.Device, f *frame.Frame, envs []*eventstream.Envelope) {
+	if dev.MQTTPrefix() != "" || fromBroker(f) {
+		return
+	}
+	ll := dev.LogCtx(ctx)
+	if err := r.attach(ctx, dev); err != nil {
+		ll.Err(err).Msg("subscribing to device rpc topic")
+		return
+	}
+	base := r.topic(dev)
+	out := *f
+	out.Src = nodeID(dev)
+	out.Dst = base + "/events"
+	if err := r.publishJSON(ctx, base+"/events/rpc", false, &out); err != nil {
+		ll.Err(err).Str("method", f.Method).Msg("publishing notification")
+	}
+	for _, env := range envs {
+		if env.Method == eventstream.MethodNotifyEvent {
+			continue
+		}
+		var doc map[string]any
+		if err := json.Unmarshal(env.Payload, &doc); err != nil {
+			continue
+		}
+		r.update(ctx, dev, env.Component, doc, env.Method == eventstream.MethodNotifyFullStatus)
+	}
+}
+
+// fromBroker reports whether a notification frame was received from the broker rather than the
+// device's own transport. Devices publish notifications to the broker with a dst of
+// `<prefix>/events`, as does the Republisher, and notifications synthesized from status topics
+// have no dst. Republishing these would echo the Republisher's own messages.
+func fromBroker(f *frame.Frame) bool {
+	return f.Dst == "" || strings.HasSuffix(f.Dst, "/events")
+}
+
+// attach records the device and subscribes to its rpc topic the first time it's seen.
+func (r *Republisher) attach(ctx context.Context, dev *discovery.Device) error {
+	base := r.topic(dev)
+	r.devices.lock.Lock()
+	_, created := r.devices.get(base, dev)
+	r.devices.lock.Unlock()
+	if !created {
+		return nil
+	}
+	c, err := discovery.NewMQTTResponder(ctx, base, nodeID(dev), r.client)
+	if err != nil {
+		return err
+	}
+	r.devices.lock.Lock()
+	r.devices.states[base].rpc = c
+	r.devices.lock.Unlock()
+	go r.serve(ctx, base, c)
+	return nil
+}
+
+// serve relays the requests received on a device's rpc codec until it's closed.
+func (r *Republisher) serve(ctx context.Context, base string, c codec.Codec) {
+	for {
+		req, err := c.Recv(ctx)
+		if err != nil {
+			return
+		}
+		if req.Method == "" {
+			// Responses and other frames aren't requests.
+			continue
+		}
+		// Requests may be slow, and mustn't hold up those which follow.
+		go r.handleRPC(ctx, base, c, req)
+	}
+}
+
+// update records a component's status and publishes it.
+func (r *Republisher) update(ctx context.Context, dev *discovery.Device, component string, doc map[string]any, replace bool) {
+	base := r.topic(dev)
+	r.devices.lock.Lock()
+	if d := r.devices.states[base]; d != nil {
+		doc = d.merge(component, doc, replace)
+	}
+	r.devices.lock.Unlock()
+	if err := r.publishJSON(ctx, base+"/status/"+component, true, doc); err != nil {
+		ll := dev.LogCtx(ctx)
+		ll.Err(err).Str("component", component).Msg("publishing component status")
+	}
+}
+
+// setOnline publishes the device's online state if it has changed.
+func (r *Republisher) setOnline(ctx context.Context, dev *discovery.Device, online bool) {
+	base := r.topic(dev)
+	r.devices.lock.Lock()
+	d := r.devices.states[base]
+	changed := d != nil && d.setOnline(online)
+	r.devices.lock.Unlock()
+	if !changed {
+		return
+	}
+	if err := r.publishJSON(ctx, base+"/online", true, online); err != nil {
+		ll := dev.LogCtx(ctx)
+		ll.Err(err).Msg("publishing device online state")
+	}
+}
+
+// handleRPC relays a request published to a device's rpc topic, and sends the response to the
+// requester's rpc topic.
+func (r *Republisher) handleRPC(ctx context.Context, base string, c codec.Codec, req *frame.Frame) {
+	ll := log.Ctx(ctx).With().Str("topic", base+"/rpc").Logger()
+	dev := r.devices.device(base)
+	if dev == nil {
+		return
+	}
+	ll = dev.Log(ll).With().Str("method", req.Method).Str("src", req.Src).Logger()
+	ctx = ll.WithContext(ctx)
+
+	resp := &frame.Frame{
+		ID:  req.ID,
+		Dst: req.Src,
+		Tag: req.Tag,
+	}
+	result := json.RawMessage{}
+	if err := r.call(ctx, dev, rawrpc.NewRequest(req.Method, req.Params), &result); err != nil {
+		ll.Warn().Err(err).Msg("relaying rpc request")
+		resp.Error = rpcError(err)
+	} else {
+		resp.Result = result
+	}
+	if req.Src == "" || req.NoResponse {
+		return
+	}
+	if err := c.Send(ctx, resp); err != nil {
+		ll.Err(err).Msg("publishing rpc response")
+	}
+}
+
+// rpcError describes a failed request as a frame error, preserving the device's error code.
+func rpcError(err error) *frame.Error {
+	var bse *shelly.BadStatusWithMessageError
+	if errors.As(err, &bse) {
+		return &frame.Error{Code: int(bse.Status), Message: bse.Msg}
+	}
+	return &frame.Error{Code: int(shelly.ErrRPCUnavailable), Message: err.Error()}
+}
+
+// stop marks every device offline and unsubscribes from their rpc topics.
+func (r *Republisher) stop(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.rpcTimeout)
+	defer cancel()
+	for base := range r.devices.markOffline() {
+		if err := r.publishJSON(ctx, base+"/online", true, false); err != nil {
+			log.Ctx(ctx).Err(err).Str("topic", base).Msg("publishing device online state")
+		}
+	}
+	for _, c := range r.devices.codecs() {
+		c.Close()
+	}
+}
+
+// topic returns the prefix of the device's topics.
+func (r *Republisher) topic(dev *discovery.Device) string {
+	if r.topicPrefix == "" {
+		return nodeID(dev)
+	}
+	return r.topicPrefix + "/" + nodeID(dev)
+}
+
+func (r *Republisher) publishJSON(ctx context.Context, topic string, retained bool, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding %q: %w", topic, err)
+	}
+	return publish(ctx, r.client, topic, retained, payload)
+}
@@ -0,0 +1,146 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/eventstream"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepublisherPoll(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	dev := td.NewTestDevice(t, true)
+	dev.ID = "shellyplus1-a8032abe5424"
+	dev.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{
+		"switch:0": {"id": 0, "output": true},
+		"sys": {"uptime": 100}
+	}`))
+	c := &testClient{}
+	r := NewRepublisher(td.Discoverer)
+	r.client = c
+
+	r.poll(ctx, dev.Device)
+	msgs := c.last()
+	assert.Equal(t, "true", msgs["shellyplus1-a8032abe5424/online"])
+	assert.JSONEq(t, `{"id": 0, "output": true}`, msgs["shellyplus1-a8032abe5424/status/switch:0"])
+	assert.JSONEq(t, `{"uptime": 100}`, msgs["shellyplus1-a8032abe5424/status/sys"])
+	for _, p := range c.published {
+		assert.True(t, p.retained, p.topic)
+	}
+	assert.Contains(t, c.subscribed, "shellyplus1-a8032abe5424/rpc")
+
+	// The online state is only published when it changes.
+	n := len(c.published)
+	r.poll(ctx, dev.Device)
+	assert.Len(t, c.published, n+2)
+
+	r.stop(ctx)
+	assert.Equal(t, "false", c.last()["shellyplus1-a8032abe5424/online"])
+	assert.Empty(t, c.subscribed)
+}
+
+func TestRepublisherNotification(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	dev := td.NewTestDevice(t, true)
+	dev.ID = "shellyplus1-a8032abe5424"
+	c := &testClient{}
+	r := NewRepublisher(td.Discoverer, WithTopicPrefix("bridged"))
+	r.client = c
+
+	f := &frame.Frame{
+		Src:    "shellyplus1-a8032abe5424",
+		Dst:    "shellyctl-1234",
+		Method: "NotifyFullStatus",
+		Params: json.RawMessage(`{"ts": 1700000000.5, "switch:0": {"id": 0, "output": true, "apower": 5}}`),
+	}
+	envs, err := eventstream.FromStatus(discovery.StatusNotification{Frame: f}, dev.Device)
+	require.NoError(t, err)
+	r.handleNotification(ctx, dev.Device, f, envs)
+
+	f = &frame.Frame{
+		Src:    "shellyplus1-a8032abe5424",
+		Dst:    "shellyctl-1234",
+		Method: "NotifyStatus",
+		Params: json.RawMessage(`{"ts": 1700000001.5, "switch:0": {"id": 0, "output": false}}`),
+	}
+	envs, err = eventstream.FromStatus(discovery.StatusNotification{Frame: f}, dev.Device)
+	require.NoError(t, err)
+	r.handleNotification(ctx, dev.Device, f, envs)
+
+	msgs := c.last()
+	assert.JSONEq(t, `{"id": 0, "output": false, "apower": 5}`, msgs["bridged/shellyplus1-a8032abe5424/status/switch:0"])
+	assert.JSONEq(t, `{
+		"src": "shellyplus1-a8032abe5424",
+		"dst": "bridged/shellyplus1-a8032abe5424/events",
+		"method": "NotifyStatus",
+		"params": {"ts": 1700000001.5, "switch:0": {"id": 0, "output": false}}
+	}`, msgs["bridged/shellyplus1-a8032abe5424/events/rpc"])
+
+	// Notifications received from the broker, including those the Republisher published, are
+	// ignored.
+	n := len(c.published)
+	for _, dst := range []string{"", "bridged/shellyplus1-a8032abe5424/events"} {
+		f.Dst = dst
+		r.handleNotification(ctx, dev.Device, f, envs)
+	}
+	assert.Len(t, c.published, n)
+}
+
+func TestRepublisherRPC(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	dev := td.NewTestDevice(t, true)
+	dev.ID = "shellyplus1-a8032abe5424"
+	dev.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": false}}`))
+	dev.AddMockResponse("Switch.Set", func(t *testing.T, params json.RawMessage) bool {
+		assert.JSONEq(t, `{"id": 0, "on": true}`, string(params))
+		return true
+	}, json.RawMessage(`{"was_on": false}`))
+	dev.AddMockErrorResponse("Switch.Toggle", nil, int(shelly.ErrRPCUnknownComponentID), "component not found")
+	c := &testClient{}
+	r := NewRepublisher(td.Discoverer)
+	r.client = c
+	r.poll(ctx, dev.Device)
+
+	defer r.stop(ctx)
+
+	c.deliver(t, "shellyplus1-a8032abe5424/rpc",
+		`{"id": 7, "src": "client/rpc-resp/abc", "method": "Switch.Set", "params": {"id": 0, "on": true}}`,
+	)
+	require.Eventually(t, func() bool { return c.last()["client/rpc-resp/abc/rpc"] != "" }, time.Second, time.Millisecond)
+	assert.JSONEq(t, `{
+		"id": 7,
+		"src": "shellyplus1-a8032abe5424",
+		"dst": "client/rpc-resp/abc",
+		"result": {"was_on": false}
+	}`, c.last()["client/rpc-resp/abc/rpc"])
+
+	c.deliver(t, "shellyplus1-a8032abe5424/rpc",
+		`{"id": 8, "src": "client", "tag": "t", "method": "Switch.Toggle", "params": {"id": 3}}`,
+	)
+	require.Eventually(t, func() bool { return c.last()["client/rpc"] != "" }, time.Second, time.Millisecond)
+	assert.JSONEq(t, `{
+		"id": 8,
+		"src": "shellyplus1-a8032abe5424",
+		"dst": "client",
+		"tag": "t",
+		"error": {"code": -105, "message": "component not found"}
+	}`, c.last()["client/rpc"])
+
+	// Responses published to the topic aren't requests, so only the request which follows is
+	// answered.
+	n := len(c.published)
+	c.deliver(t, "shellyplus1-a8032abe5424/rpc", `{"id": 9, "src": "client", "result": {}}`)
+	c.deliver(t, "shellyplus1-a8032abe5424/rpc", `{"id": 10, "src": "other", "method": "Switch.Set", "params": {"id": 0, "on": true}}`)
+	require.Eventually(t, func() bool { return c.last()["other/rpc"] != "" }, time.Second, time.Millisecond)
+	assert.Len(t, c.published, n+1)
+}
@@ -0,0 +1,245 @@
+// Package bthome decodes BTHome v2 advertisements, which are broadcast by Shelly BLU devices
+// (buttons, door/window, H&T, and motion sensors) and other battery powered BLE sensors. Readings
+// are decoded passively from the advertisement's service data without connecting to the device or
+// relaying through a gateway. Encrypted advertisements are decoded with the device's AES key.
+package bthome
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ServiceUUID is the 16-bit service UUID whose service data holds BTHome advertisements.
+const ServiceUUID uint16 = 0xFCD2
+
+const (
+	deviceInfoEncrypted    = 0x01
+	deviceInfoTriggerBased = 0x04
+	deviceInfoVersionShift = 5
+
+	// KeySize is the size of encryption keys, in bytes.
+	KeySize = 16
+	// Encrypted payloads are followed by a 4 byte counter and a 4 byte message integrity check.
+	counterSize = 4
+	micSize     = 4
+)
+
+var (
+	// ErrKeyRequired indicates the advertisement is encrypted, but no key was provided.
+	ErrKeyRequired = errors.New("advertisement is encrypted; a key is required")
+	// ErrDecrypt indicates an encrypted advertisement couldn't be decrypted with the key.
+	ErrDecrypt = errors.New("decrypting advertisement; the key may be wrong")
+)
+
+// Packet is a decoded BTHome advertisement.
+type Packet struct {
+	Encrypted bool `json:"encrypted"`
+	// TriggerBased devices, like buttons, advertise when something happens rather than at
+	// regular intervals.
+	TriggerBased bool `json:"trigger_based"`
+	// PacketID is incremented for each new packet; retransmissions share the same ID. It's nil if
+	// the device doesn't send one.
+	PacketID     *uint8        `json:"packet_id,omitempty"`
+	Measurements []Measurement `json:"measurements,omitempty"`
+	Events       []Event       `json:"events,omitempty"`
+}
+
+// Measurement is a sensor value. Binary sensors, like motion or window, are 0 or 1.
+type Measurement struct {
+	Name string `json:"name"`
+	// Index counts previous measurements with the same name in the packet, ex. the
+	// temperature of a second probe.
+	Index  int     `json:"index"`
+	Value  float64 `json:"value"`
+	Unit   string  `json:"unit,omitempty"`
+	Binary bool    `json:"binary,omitempty"`
+}
+
+// MetricName returns the measurement name with its unit spelled out, ex. `temperature_celsius`.
+func (m Measurement) MetricName() string {
+	if u := unitNames[m.Unit]; u != "" && u != m.Name {
+		return m.Name + "_" + u
+	}
+	return m.Name
+}
+
+// Event is a button press or dimmer rotation.
+type Event struct {
+	// Name is `button` or `dimmer`.
+	Name string `json:"name"`
+	// Index counts previous events with the same name in the packet, ex. the second button of a
+	// multi-button remote.
+	Index int `json:"index"`
+	// Type is the button event, ex. `press` or `long_press`, or the dimmer direction. It's empty
+	// if the button or dimmer wasn't used.
+	Type string `json:"type,omitempty"`
+	// Steps is the number of steps a dimmer rotated.
+	Steps int `json:"steps,omitempty"`
+}
+
+// ParseKey parses a hex encoded encryption key.
+func ParseKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("parsing BTHome key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("parsing BTHome key: expected %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// Parse decodes the service data of a BTHome advertisement from the device with MAC address mac.
+// The key is only required for encrypted advertisements.
+func Parse(mac string, data, key []byte) (*Packet, error) {
+	if len(data) < 1 {
+		return nil, errors.New("empty advertisement")
+	}
+	info := data[0]
+	if v := info >> deviceInfoVersionShift; v != 2 {
+		return nil, fmt.Errorf("unsupported BTHome version %d", v)
+	}
+	p := &Packet{
+		Encrypted:    info&deviceInfoEncrypted != 0,
+		TriggerBased: info&deviceInfoTriggerBased != 0,
+	}
+	payload := data[1:]
+	if p.Encrypted {
+		var err error
+		if payload, err = decrypt(mac, info, payload, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.decode(payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// decrypt decrypts an encrypted payload. The nonce is the device's MAC address, the service UUID,
+// the device info byte, and the counter.
+func decrypt(mac string, info byte, payload, key []byte) ([]byte, error) {
+	if key == nil {
+		return nil, ErrKeyRequired
+	}
+	if len(payload) < counterSize+micSize {
+		return nil, errors.New("encrypted advertisement is too short")
+	}
+	addr, err := hex.DecodeString(normalizeMAC(mac))
+	if err != nil || len(addr) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q", mac)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing BTHome key: %w", err)
+	}
+	ciphertext := payload[:len(payload)-counterSize-micSize]
+	counter := payload[len(ciphertext) : len(ciphertext)+counterSize]
+	mic := payload[len(ciphertext)+counterSize:]
+	nonce := binary.LittleEndian.AppendUint16(addr, ServiceUUID)
+	nonce = append(nonce, info)
+	nonce = append(nonce, counter...)
+	plaintext, err := ccmOpen(block, nonce, ciphertext, mic, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// decode decodes the objects of the payload.
+func (p *Packet) decode(payload []byte) error {
+	seen := make(map[string]int)
+	for len(payload) > 0 {
+		id := payload[0]
+		payload = payload[1:]
+		obj, ok := objects[id]
+		if !ok {
+			// The size of unknown objects isn't known, so the rest of the packet can't be decoded.
+			return fmt.Errorf("unsupported BTHome object id 0x%02x", id)
+		}
+		size := obj.size
+		if obj.kind == kindLengthPrefixed {
+			if len(payload) < 1 {
+				return fmt.Errorf("truncated BTHome %s object", obj.name)
+			}
+			size = 1 + int(payload[0])
+		}
+		if len(payload) < size {
+			return fmt.Errorf("truncated BTHome %s object", obj.name)
+		}
+		value := payload[:size]
+		payload = payload[size:]
+
+		index := seen[obj.name]
+		seen[obj.name]++
+		switch obj.kind {
+		case kindMeasurement, kindBinary:
+			p.Measurements = append(p.Measurements, Measurement{
+				Name:   obj.name,
+				Index:  index,
+				Value:  round(float64(decodeInt(value, obj.signed))*obj.factor, obj.factor),
+				Unit:   obj.unit,
+				Binary: obj.kind == kindBinary,
+			})
+		case kindButton:
+			e := Event{Name: obj.name, Index: index}
+			switch v := int(value[0]); {
+			case v == 0x80:
+				e.Type = "hold_press"
+			case v < len(buttonEvents):
+				e.Type = buttonEvents[v]
+			default:
+				e.Type = fmt.Sprintf("unknown_%d", v)
+			}
+			p.Events = append(p.Events, e)
+		case kindDimmer:
+			e := Event{Name: obj.name, Index: index, Steps: int(value[1])}
+			if v := int(value[0]); v < len(dimmerEvents) {
+				e.Type = dimmerEvents[v]
+			} else {
+				e.Type = fmt.Sprintf("unknown_%d", v)
+			}
+			p.Events = append(p.Events, e)
+		case kindSkip:
+			if id == objectPacketID {
+				pid := value[0]
+				p.PacketID = &pid
+			}
+		}
+	}
+	return nil
+}
+
+// decodeInt decodes a little-endian integer of up to 4 bytes.
+func decodeInt(b []byte, signed bool) int64 {
+	var buf [4]byte
+	copy(buf[:], b)
+	u := binary.LittleEndian.Uint32(buf[:])
+	if !signed {
+		return int64(u)
+	}
+	shift := 32 - 8*len(b)
+	return int64(int32(u<<shift) >> shift)
+}
+
+// round removes floating point noise introduced by the factor, ex. 2345*0.01 = 23.450000000000003.
+func round(v, factor float64) float64 {
+	if factor >= 1 {
+		return v
+	}
+	// Scale by the factor's decimal places; 1/factor is inexact for factors like 0.35.
+	decimals := len(strconv.FormatFloat(factor, 'f', -1, 64)) - len("0.")
+	scale := math.Pow10(decimals)
+	return math.Round(v*scale) / scale
+}
+
+// normalizeMAC returns mac in upper case without separators, ex. 3C2EF5001122.
+func normalizeMAC(mac string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(mac)))
+}
@@ -0,0 +1,192 @@
+package bthome
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err)
+	return b
+}
+
+func uint8Ptr(v uint8) *uint8 {
+	return &v
+}
+
+func TestParse(t *testing.T) {
+	tcs := []struct {
+		name      string
+		data      string
+		expect    *Packet
+		expectErr string
+	}{
+		{
+			name: "h&t",
+			// packet id 1, battery 100%, temperature 27.3°C, humidity 44%, button press
+			data: "44" + "0001" + "0164" + "451101" + "2e2c" + "3a01",
+			expect: &Packet{
+				TriggerBased: true,
+				PacketID:     uint8Ptr(1),
+				Measurements: []Measurement{
+					{Name: "battery", Value: 100, Unit: "%"},
+					{Name: "temperature", Value: 27.3, Unit: "°C"},
+					{Name: "humidity", Value: 44, Unit: "%"},
+				},
+				Events: []Event{{Name: "button", Type: "press"}},
+			},
+		},
+		{
+			name: "door window",
+			// battery 87%, illuminance 123.45 lux, window open, rotation -12.5°
+			data: "40" + "0157" + "05393000" + "2d01" + "3f83ff",
+			expect: &Packet{
+				Measurements: []Measurement{
+					{Name: "battery", Value: 87, Unit: "%"},
+					{Name: "illuminance", Value: 123.45, Unit: "lux"},
+					{Name: "window", Value: 1, Binary: true},
+					{Name: "rotation", Value: -12.5, Unit: "°"},
+				},
+			},
+		},
+		{
+			name: "newer objects",
+			// conductivity 1000µS/cm, temperature 1.05°C, power -1234.56W, speed 1.5m/s
+			data: "40" + "56e803" + "5803" + "5cc01dfeff" + "6260e31600",
+			expect: &Packet{
+				Measurements: []Measurement{
+					{Name: "conductivity", Value: 1000, Unit: "µS/cm"},
+					{Name: "temperature", Value: 1.05, Unit: "°C"},
+					{Name: "power", Value: -1234.56, Unit: "W"},
+					{Name: "speed", Value: 1.5, Unit: "m/s"},
+				},
+			},
+		},
+		{
+			name: "repeated objects",
+			// temperature -23.58°C and 21.0°C, first button unused, second long press, dimmer
+			data: "40" + "02caf6" + "023408" + "3a00" + "3a04" + "3c0103",
+			expect: &Packet{
+				Measurements: []Measurement{
+					{Name: "temperature", Value: -23.58, Unit: "°C"},
+					{Name: "temperature", Index: 1, Value: 21, Unit: "°C"},
+				},
+				Events: []Event{
+					{Name: "button"},
+					{Name: "button", Index: 1, Type: "long_press"},
+					{Name: "dimmer", Type: "rotate_left", Steps: 3},
+				},
+			},
+		},
+		{
+			name: "skipped objects",
+			// text "hi", firmware version, hold press
+			data: "40" + "53026869" + "f1" + "01020304" + "3a80",
+			expect: &Packet{
+				Events: []Event{{Name: "button", Type: "hold_press"}},
+			},
+		},
+		{
+			name:      "unsupported version",
+			data:      "20" + "0164",
+			expectErr: "unsupported BTHome version 1",
+		},
+		{
+			name:      "unknown object",
+			data:      "40" + "0164" + "ee01",
+			expectErr: "unsupported BTHome object id 0xee",
+		},
+		{
+			name:      "truncated",
+			data:      "40" + "0211",
+			expectErr: "truncated BTHome temperature object",
+		},
+		{
+			name:      "encrypted without key",
+			data:      "41" + "0102030405060708",
+			expectErr: ErrKeyRequired.Error(),
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := Parse("3C:2E:F5:00:11:22", unhex(t, tc.data), nil)
+			if tc.expectErr != "" {
+				assert.EqualError(t, err, tc.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expect, p)
+		})
+	}
+}
+
+func TestParseEncrypted(t *testing.T) {
+	key := unhex(t, "231d39c1d7cc1ab1aee224cd096db932")
+	mac := "54:48:E6:8F:80:A5"
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+
+	// Seal battery 50% and motion detected as the device would.
+	info := byte(0x41)
+	plaintext := unhex(t, "0132"+"2101")
+	counter := unhex(t, "00112233")
+	nonce := append(unhex(t, "5448e68f80a5"), 0xd2, 0xfc, info)
+	nonce = append(nonce, counter...)
+	data := []byte{info}
+	data = append(data, ccmCTR(block, nonce, plaintext)...)
+	data = append(data, counter...)
+	data = append(data, ccmTag(block, nonce, plaintext, nil, micSize)...)
+
+	p, err := Parse(mac, data, key)
+	require.NoError(t, err)
+	assert.Equal(t, &Packet{
+		Encrypted: true,
+		Measurements: []Measurement{
+			{Name: "battery", Value: 50, Unit: "%"},
+			{Name: "motion", Value: 1, Binary: true},
+		},
+	}, p)
+
+	_, err = Parse(mac, data, unhex(t, "00000000000000000000000000000000"))
+	assert.ErrorIs(t, err, ErrDecrypt)
+	// The MAC address is part of the nonce.
+	_, err = Parse("54:48:E6:8F:80:A6", data, key)
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+// TestCCM checks the CCM implementation against packet vector #1 of RFC 3610.
+func TestCCM(t *testing.T) {
+	block, err := aes.NewCipher(unhex(t, "c0c1c2c3c4c5c6c7c8c9cacbcccdcecf"))
+	require.NoError(t, err)
+	nonce := unhex(t, "00000003020100a0a1a2a3a4a5")
+	aad := unhex(t, "0001020304050607")
+	ciphertext := unhex(t, "588c979a61c663d2f066d0c2c0f989806d5f6b61dac384")
+	tag := unhex(t, "17e8d12cfdf926e0")
+
+	plaintext, err := ccmOpen(block, nonce, ciphertext, tag, aad)
+	require.NoError(t, err)
+	assert.Equal(t, unhex(t, "08090a0b0c0d0e0f101112131415161718191a1b1c1d1e"), plaintext)
+
+	tag[0] ^= 1
+	_, err = ccmOpen(block, nonce, ciphertext, tag, aad)
+	assert.ErrorIs(t, err, errAuthentication)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := ParseKey("231d39c1d7cc1ab1aee224cd096db932")
+	require.NoError(t, err)
+	assert.Len(t, key, KeySize)
+	_, err = ParseKey("231d39")
+	assert.EqualError(t, err, "parsing BTHome key: expected 16 bytes, got 3")
+}
+
+func TestMeasurementMetricName(t *testing.T) {
+	assert.Equal(t, "temperature_celsius", Measurement{Name: "temperature", Unit: "°C"}.MetricName())
+	assert.Equal(t, "illuminance_lux", Measurement{Name: "illuminance", Unit: "lux"}.MetricName())
+	assert.Equal(t, "motion", Measurement{Name: "motion", Binary: true}.MetricName())
+}
@@ -0,0 +1,87 @@
+package bthome
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// errAuthentication indicates the message integrity check failed, usually because the key is
+// wrong.
+var errAuthentication = errors.New("message authentication failed")
+
+// ccmOpen decrypts and authenticates a message sealed with AES-CCM (RFC 3610). The length of the
+// tag and nonce determine the CCM M and L parameters.
+func ccmOpen(block cipher.Block, nonce, ciphertext, tag, aad []byte) ([]byte, error) {
+	plaintext := ccmCTR(block, nonce, ciphertext)
+	expected := ccmTag(block, nonce, plaintext, aad, len(tag))
+	if subtle.ConstantTimeCompare(expected, tag) != 1 {
+		return nil, errAuthentication
+	}
+	return plaintext, nil
+}
+
+// ccmBlock builds a block with the flags byte, the nonce, and n in the remaining bytes.
+func ccmBlock(flags byte, nonce []byte, n int) []byte {
+	b := make([]byte, 16)
+	b[0] = flags
+	copy(b[1:], nonce)
+	for i := 15; i > len(nonce); i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	return b
+}
+
+// ccmCTR encrypts or decrypts a message with counter blocks starting at 1.
+func ccmCTR(block cipher.Block, nonce, in []byte) []byte {
+	l := byte(15 - len(nonce))
+	out := make([]byte, len(in))
+	s := make([]byte, 16)
+	for i := 0; i*16 < len(in); i++ {
+		block.Encrypt(s, ccmBlock(l-1, nonce, i+1))
+		end := min(len(in), (i+1)*16)
+		subtle.XORBytes(out[i*16:end], in[i*16:end], s)
+	}
+	return out
+}
+
+// ccmTag computes the encrypted CBC-MAC of the plaintext and additional data.
+func ccmTag(block cipher.Block, nonce, plaintext, aad []byte, size int) []byte {
+	l := byte(15 - len(nonce))
+	flags := byte((size-2)/2)<<3 | (l - 1)
+	if len(aad) > 0 {
+		flags |= 0x40
+	}
+	x := make([]byte, 16)
+	block.Encrypt(x, ccmBlock(flags, nonce, len(plaintext)))
+	mac := func(data []byte) {
+		for len(data) > 0 {
+			n := subtle.XORBytes(x, x, data)
+			data = data[n:]
+			block.Encrypt(x, x)
+		}
+	}
+	if len(aad) > 0 {
+		// Additional data shorter than 0xFF00 bytes is prefixed with its 2 byte length; the
+		// prefixed data is padded to the block size.
+		a := binary.BigEndian.AppendUint16(nil, uint16(len(aad)))
+		a = append(a, aad...)
+		mac(pad(a))
+	}
+	mac(pad(plaintext))
+
+	s0 := make([]byte, 16)
+	block.Encrypt(s0, ccmBlock(l-1, nonce, 0))
+	subtle.XORBytes(x, x, s0)
+	return x[:size]
+}
+
+// pad returns b padded with zeros to a multiple of the block size.
+func pad(b []byte) []byte {
+	if len(b)%16 == 0 {
+		return b
+	}
+	return append(append([]byte{}, b...), make([]byte, 16-len(b)%16)...)
+}
@@ -0,0 +1,184 @@
+package bthome
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/rs/zerolog/log"
+)
+
+// Reading is a BTHome advertisement decoded by a Listener.
+type Reading struct {
+	MACAddr    string    `json:"mac"`
+	Name       string    `json:"name,omitempty"`
+	RSSI       int16     `json:"rssi"`
+	ReceivedAt time.Time `json:"received_at"`
+	*Packet
+}
+
+// DeviceState holds the latest readings of a device.
+type DeviceState struct {
+	MACAddr  string
+	Name     string
+	RSSI     int16
+	LastSeen time.Time
+	// Measurements holds the latest value of each measurement.
+	Measurements []Measurement
+	// EventCounts counts the events received, by name, index, and type.
+	EventCounts map[Event]uint64
+}
+
+// Listener decodes BTHome advertisements received by a discoverer, and keeps the latest readings
+// of each device.
+type Listener struct {
+	disc     *discovery.Discoverer
+	keys     map[string][]byte
+	handlers []func(*Reading)
+
+	lock    sync.Mutex
+	devices map[string]*listenerDevice
+}
+
+type listenerDevice struct {
+	state DeviceState
+	// last is the last service data received, to skip retransmissions and repeated scan results.
+	last []byte
+	// warned is set once a decoding error has been logged for the device.
+	warned bool
+}
+
+// Option provides optional parameters for the Listener.
+type Option func(*Listener)
+
+// WithKey sets the encryption key of the device with MAC address mac. Case and ":" or "-"
+// separators are ignored.
+func WithKey(mac string, key []byte) Option {
+	return func(l *Listener) {
+		l.keys[normalizeMAC(mac)] = key
+	}
+}
+
+// WithHandler calls h with each new reading.
+func WithHandler(h func(*Reading)) Option {
+	return func(l *Listener) {
+		l.handlers = append(l.handlers, h)
+	}
+}
+
+// NewListener creates a Listener for advertisements received by disc.
+func NewListener(disc *discovery.Discoverer, opts ...Option) *Listener {
+	l := &Listener{
+		disc:    disc,
+		keys:    make(map[string][]byte),
+		devices: make(map[string]*listenerDevice),
+	}
+	for _, o := range opts {
+		o(l)
+	}
+	return l
+}
+
+// Run listens for advertisements until ctx is done.
+func (l *Listener) Run(ctx context.Context) error {
+	return l.disc.ListenBLE(ctx, func(adv *discovery.BLEAdvertisement) {
+		l.handleAdvertisement(ctx, adv)
+	})
+}
+
+// handleAdvertisement decodes an advertisement's BTHome service data, if any.
+func (l *Listener) handleAdvertisement(ctx context.Context, adv *discovery.BLEAdvertisement) {
+	data, ok := adv.ServiceData[ServiceUUID]
+	if !ok {
+		return
+	}
+	l.lock.Lock()
+	d := l.devices[adv.MACAddr]
+	if d == nil {
+		d = &listenerDevice{state: DeviceState{MACAddr: adv.MACAddr, EventCounts: make(map[Event]uint64)}}
+		l.devices[adv.MACAddr] = d
+	}
+	d.state.RSSI = adv.RSSI
+	d.state.LastSeen = adv.ReceivedAt
+	if adv.LocalName != "" {
+		d.state.Name = adv.LocalName
+	}
+	if bytes.Equal(d.last, data) {
+		// Devices retransmit each packet several times.
+		l.lock.Unlock()
+		return
+	}
+	d.last = data
+	p, err := Parse(adv.MACAddr, data, l.keys[normalizeMAC(adv.MACAddr)])
+	if err != nil {
+		warn := !d.warned
+		d.warned = true
+		l.lock.Unlock()
+		ll := log.Ctx(ctx).With().Str("mac", adv.MACAddr).Str("ble_local_name", adv.LocalName).Logger()
+		if !warn {
+			ll.Debug().Err(err).Msg("decoding BTHome advertisement")
+		} else if errors.Is(err, ErrKeyRequired) {
+			ll.Warn().Err(err).Msg("decoding BTHome advertisement; specify the device's key with --bthome-key")
+		} else {
+			ll.Warn().Err(err).Msg("decoding BTHome advertisement")
+		}
+		return
+	}
+	for _, m := range p.Measurements {
+		d.state.Measurements = setMeasurement(d.state.Measurements, m)
+	}
+	for _, e := range p.Events {
+		if e.Type != "" {
+			d.state.EventCounts[Event{Name: e.Name, Index: e.Index, Type: e.Type}]++
+		}
+	}
+	r := &Reading{
+		MACAddr:    adv.MACAddr,
+		Name:       d.state.Name,
+		RSSI:       adv.RSSI,
+		ReceivedAt: adv.ReceivedAt,
+		Packet:     p,
+	}
+	l.lock.Unlock()
+	for _, h := range l.handlers {
+		h(r)
+	}
+}
+
+// setMeasurement replaces the measurement with the same name, index, and unit, or appends it.
+func setMeasurement(ms []Measurement, m Measurement) []Measurement {
+	for i, old := range ms {
+		if old.Name == m.Name && old.Index == m.Index && old.Unit == m.Unit {
+			ms[i] = m
+			return ms
+		}
+	}
+	return append(ms, m)
+}
+
+// Devices returns the state of each device which has sent a BTHome advertisement, sorted by MAC
+// address.
+func (l *Listener) Devices() []DeviceState {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	out := make([]DeviceState, 0, len(l.devices))
+	for _, d := range l.devices {
+		if d.state.Measurements == nil && len(d.state.EventCounts) == 0 {
+			// Nothing has been decoded.
+			continue
+		}
+		s := d.state
+		s.Measurements = append([]Measurement{}, d.state.Measurements...)
+		s.EventCounts = make(map[Event]uint64, len(d.state.EventCounts))
+		for k, v := range d.state.EventCounts {
+			s.EventCounts[k] = v
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MACAddr < out[j].MACAddr })
+	return out
+}
@@ -0,0 +1,64 @@
+package bthome
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListener(t *testing.T) {
+	ctx := context.Background()
+	var readings []*Reading
+	l := NewListener(nil, WithHandler(func(r *Reading) {
+		readings = append(readings, r)
+	}))
+	now := time.Date(2024, 11, 5, 12, 0, 0, 0, time.UTC)
+	adv := func(data string) *discovery.BLEAdvertisement {
+		return &discovery.BLEAdvertisement{
+			MACAddr:     "3C:2E:F5:00:11:22",
+			LocalName:   "SBHT-003C",
+			RSSI:        -70,
+			ServiceData: map[uint16][]byte{ServiceUUID: unhex(t, data)},
+			ReceivedAt:  now,
+		}
+	}
+
+	l.handleAdvertisement(ctx, adv("44"+"0001"+"0164"+"451101"+"3a01"))
+	// Retransmissions are skipped.
+	l.handleAdvertisement(ctx, adv("44"+"0001"+"0164"+"451101"+"3a01"))
+	l.handleAdvertisement(ctx, adv("44"+"0002"+"0163"+"3a01"))
+	// Other advertisements are ignored.
+	l.handleAdvertisement(ctx, &discovery.BLEAdvertisement{MACAddr: "AA:BB:CC:DD:EE:FF"})
+	// Encrypted devices without a key aren't reported.
+	l.handleAdvertisement(ctx, &discovery.BLEAdvertisement{
+		MACAddr:     "AA:BB:CC:DD:EE:00",
+		ServiceData: map[uint16][]byte{ServiceUUID: unhex(t, "410102030405060708")},
+	})
+
+	require.Len(t, readings, 2)
+	assert.Equal(t, "SBHT-003C", readings[0].Name)
+	assert.Equal(t, uint8(2), *readings[1].PacketID)
+	assert.Equal(t, []DeviceState{{
+		MACAddr:  "3C:2E:F5:00:11:22",
+		Name:     "SBHT-003C",
+		RSSI:     -70,
+		LastSeen: now,
+		Measurements: []Measurement{
+			{Name: "battery", Value: 99, Unit: "%"},
+			{Name: "temperature", Value: 27.3, Unit: "°C"},
+		},
+		EventCounts: map[Event]uint64{{Name: "button", Type: "press"}: 2},
+	}}, l.Devices())
+}
+
+func TestListenerKeyMAC(t *testing.T) {
+	key := unhex(t, "231d39c1d7cc1ab1aee224cd096db932")
+	for _, mac := range []string{"54:48:e6:8f:80:a5", "54-48-E6-8F-80-A5", "5448E68F80A5", " 54:48:E6:8F:80:A5 "} {
+		l := NewListener(nil, WithKey(mac, key))
+		assert.Equal(t, key, l.keys[normalizeMAC("54:48:E6:8F:80:A5")], mac)
+	}
+}
@@ -0,0 +1,168 @@
+package bthome
+
+// objectKind describes how an object's value is decoded.
+type objectKind int
+
+const (
+	kindMeasurement objectKind = iota
+	// kindBinary is a measurement of 0 or 1, ex. an open window or detected motion.
+	kindBinary
+	kindButton
+	kindDimmer
+	// kindLengthPrefixed objects, like text and raw data, are prefixed with their length and skipped.
+	kindLengthPrefixed
+	// kindSkip objects, like the packet ID and firmware version, aren't measurements.
+	kindSkip
+)
+
+// object describes a BTHome v2 object ID.
+// https://bthome.io/format/
+type object struct {
+	name   string
+	kind   objectKind
+	size   int
+	signed bool
+	factor float64
+	unit   string
+}
+
+func measurement(name string, size int, signed bool, factor float64, unit string) object {
+	return object{name: name, kind: kindMeasurement, size: size, signed: signed, factor: factor, unit: unit}
+}
+
+func binarySensor(name string) object {
+	return object{name: name, kind: kindBinary, size: 1, factor: 1}
+}
+
+// objectPacketID identifies retransmissions of the same packet.
+const objectPacketID = 0x00
+
+var objects = map[byte]object{
+	objectPacketID: {name: "packet_id", kind: kindSkip, size: 1},
+	0x01:           measurement("battery", 1, false, 1, "%"),
+	0x02:           measurement("temperature", 2, true, 0.01, "°C"),
+	0x03:           measurement("humidity", 2, false, 0.01, "%"),
+	0x04:           measurement("pressure", 3, false, 0.01, "hPa"),
+	0x05:           measurement("illuminance", 3, false, 0.01, "lux"),
+	0x06:           measurement("mass", 2, false, 0.01, "kg"),
+	0x07:           measurement("mass", 2, false, 0.01, "lb"),
+	0x08:           measurement("dewpoint", 2, true, 0.01, "°C"),
+	0x09:           measurement("count", 1, false, 1, ""),
+	0x0A:           measurement("energy", 3, false, 0.001, "kWh"),
+	0x0B:           measurement("power", 3, false, 0.01, "W"),
+	0x0C:           measurement("voltage", 2, false, 0.001, "V"),
+	0x0D:           measurement("pm2_5", 2, false, 1, "ug/m3"),
+	0x0E:           measurement("pm10", 2, false, 1, "ug/m3"),
+	0x0F:           binarySensor("generic_boolean"),
+	0x10:           binarySensor("power_on"),
+	0x11:           binarySensor("opening"),
+	0x12:           measurement("co2", 2, false, 1, "ppm"),
+	0x13:           measurement("tvoc", 2, false, 1, "ug/m3"),
+	0x14:           measurement("moisture", 2, false, 0.01, "%"),
+	0x15:           binarySensor("battery_low"),
+	0x16:           binarySensor("battery_charging"),
+	0x17:           binarySensor("carbon_monoxide"),
+	0x18:           binarySensor("cold"),
+	0x19:           binarySensor("connectivity"),
+	0x1A:           binarySensor("door"),
+	0x1B:           binarySensor("garage_door"),
+	0x1C:           binarySensor("gas_detected"),
+	0x1D:           binarySensor("heat"),
+	0x1E:           binarySensor("light"),
+	0x1F:           binarySensor("lock"),
+	0x20:           binarySensor("moisture_detected"),
+	0x21:           binarySensor("motion"),
+	0x22:           binarySensor("moving"),
+	0x23:           binarySensor("occupancy"),
+	0x24:           binarySensor("plug"),
+	0x25:           binarySensor("presence"),
+	0x26:           binarySensor("problem"),
+	0x27:           binarySensor("running"),
+	0x28:           binarySensor("safety"),
+	0x29:           binarySensor("smoke"),
+	0x2A:           binarySensor("sound"),
+	0x2B:           binarySensor("tamper"),
+	0x2C:           binarySensor("vibration"),
+	0x2D:           binarySensor("window"),
+	0x2E:           measurement("humidity", 1, false, 1, "%"),
+	0x2F:           measurement("moisture", 1, false, 1, "%"),
+	0x3A:           {name: "button", kind: kindButton, size: 1},
+	0x3C:           {name: "dimmer", kind: kindDimmer, size: 2},
+	0x3D:           measurement("count", 2, false, 1, ""),
+	0x3E:           measurement("count", 4, false, 1, ""),
+	0x3F:           measurement("rotation", 2, true, 0.1, "°"),
+	0x40:           measurement("distance", 2, false, 1, "mm"),
+	0x41:           measurement("distance", 2, false, 0.1, "m"),
+	0x42:           measurement("duration", 3, false, 0.001, "s"),
+	0x43:           measurement("current", 2, false, 0.001, "A"),
+	0x44:           measurement("speed", 2, false, 0.01, "m/s"),
+	0x45:           measurement("temperature", 2, true, 0.1, "°C"),
+	0x46:           measurement("uv_index", 1, false, 0.1, ""),
+	0x47:           measurement("volume", 2, false, 0.1, "L"),
+	0x48:           measurement("volume", 2, false, 1, "mL"),
+	0x49:           measurement("volume_flow_rate", 2, false, 0.001, "m3/hr"),
+	0x4A:           measurement("voltage", 2, false, 0.1, "V"),
+	0x4B:           measurement("gas", 3, false, 0.001, "m3"),
+	0x4C:           measurement("gas", 4, false, 0.001, "m3"),
+	0x4D:           measurement("energy", 4, false, 0.001, "kWh"),
+	0x4E:           measurement("volume", 4, false, 0.001, "L"),
+	0x4F:           measurement("water", 4, false, 0.001, "L"),
+	0x50:           measurement("timestamp", 4, false, 1, "s"),
+	0x51:           measurement("acceleration", 2, false, 0.001, "m/s²"),
+	0x52:           measurement("gyroscope", 2, false, 0.001, "°/s"),
+	0x53:           {name: "text", kind: kindLengthPrefixed},
+	0x54:           {name: "raw", kind: kindLengthPrefixed},
+	0x55:           measurement("volume_storage", 4, false, 0.001, "L"),
+	0x56:           measurement("conductivity", 2, false, 1, "µS/cm"),
+	0x57:           measurement("temperature", 1, true, 1, "°C"),
+	0x58:           measurement("temperature", 1, true, 0.35, "°C"),
+	0x59:           measurement("count", 1, true, 1, ""),
+	0x5A:           measurement("count", 2, true, 1, ""),
+	0x5B:           measurement("count", 4, true, 1, ""),
+	0x5C:           measurement("power", 4, true, 0.01, "W"),
+	0x5D:           measurement("current", 2, true, 0.001, "A"),
+	0x5E:           measurement("direction", 2, false, 0.01, "°"),
+	0x5F:           measurement("precipitation", 2, false, 0.1, "mm"),
+	0x60:           measurement("channel", 1, false, 1, ""),
+	0x61:           measurement("rotational_speed", 2, false, 1, "rpm"),
+	0x62:           measurement("speed", 4, true, 0.000001, "m/s"),
+	0x63:           measurement("acceleration", 4, true, 0.000001, "m/s²"),
+	0xF0:           {name: "device_type_id", kind: kindSkip, size: 2},
+	0xF1:           {name: "firmware_version", kind: kindSkip, size: 4},
+	0xF2:           {name: "firmware_version", kind: kindSkip, size: 3},
+}
+
+// buttonEvents are the button event types, indexed by their value. Hold press is 0x80.
+var buttonEvents = []string{"", "press", "double_press", "triple_press", "long_press", "long_double_press", "long_triple_press"}
+
+// dimmerEvents are the dimmer event types, indexed by their value.
+var dimmerEvents = []string{"", "rotate_left", "rotate_right"}
+
+// unitNames spell out units for use in metric names.
+var unitNames = map[string]string{
+	"%":     "percent",
+	"°C":    "celsius",
+	"hPa":   "hectopascals",
+	"lux":   "lux",
+	"kg":    "kilograms",
+	"lb":    "pounds",
+	"kWh":   "kilowatt_hours",
+	"W":     "watts",
+	"V":     "volts",
+	"ug/m3": "micrograms_per_cubic_meter",
+	"ppm":   "ppm",
+	"°":     "degrees",
+	"mm":    "millimeters",
+	"m":     "meters",
+	"s":     "seconds",
+	"A":     "amperes",
+	"m/s":   "meters_per_second",
+	"L":     "liters",
+	"mL":    "milliliters",
+	"m3/hr": "cubic_meters_per_hour",
+	"m3":    "cubic_meters",
+	"m/s²":  "meters_per_second_squared",
+	"°/s":   "degrees_per_second",
+	"µS/cm": "microsiemens_per_centimeter",
+	"rpm":   "rpm",
+}
@@ -0,0 +1,248 @@
+// Package devicepoll queries discovered devices in the background. Each device is polled on its
+// own schedule, failing devices back off exponentially, and devices stop being polled once they're
+// removed from the discoverer or report they've gone offline.
+package devicepoll
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultConcurrency is the default number of devices which may be polled concurrently.
+	DefaultConcurrency = 10
+	// DefaultMaxBackoff is the default maximum delay between polls of a failing device.
+	DefaultMaxBackoff = 5 * time.Minute
+)
+
+// PollFunc queries a device once.
+type PollFunc func(ctx context.Context) error
+
+// StartFunc is called when a device begins being polled. It returns the func called for each
+// poll, and a func called once polling has stopped, after the last poll has returned. removed is
+// true if the device was removed or went offline, and false if the Poller itself stopped. The
+// stop func may be nil.
+type StartFunc func(dev *discovery.Device) (poll PollFunc, stop func(removed bool))
+
+// Poller polls each device known to a discoverer.
+type Poller struct {
+	disc       *discovery.Discoverer
+	start      StartFunc
+	interval   time.Duration
+	jitter     time.Duration
+	maxBackoff time.Duration
+
+	// limiter bounds the number of concurrent device queries.
+	limiter chan struct{}
+
+	lock sync.Mutex
+	// polling holds the func which stops each device's polling loop, keyed by MAC.
+	polling map[string]context.CancelFunc
+	// offline holds the MQTT devices which last reported they were offline.
+	offline map[string]bool
+}
+
+// Option provides optional parameters for the Poller.
+type Option func(*Poller)
+
+// WithJitter sets the maximum random offset added to or subtracted from each poll interval. This
+// spreads requests over time when many devices are discovered at once. Jitter is disabled by
+// default.
+func WithJitter(jitter time.Duration) Option {
+	return func(p *Poller) {
+		p.jitter = jitter
+	}
+}
+
+// WithMaxBackoff sets the upper bound on the delay between polls of a device which is failing.
+func WithMaxBackoff(maxBackoff time.Duration) Option {
+	return func(p *Poller) {
+		p.maxBackoff = maxBackoff
+	}
+}
+
+// WithConcurrency sets the maximum number of devices which will be polled concurrently. Values
+// less than 1 are treated as 1.
+func WithConcurrency(concurrency int) Option {
+	return func(p *Poller) {
+		p.limiter = make(chan struct{}, max(concurrency, 1))
+	}
+}
+
+// New creates a Poller which polls each device known to disc at roughly the given interval.
+func New(disc *discovery.Discoverer, interval time.Duration, start StartFunc, opts ...Option) (*Poller, error) {
+	if interval <= 0 {
+		return nil, errors.New("poll interval must be positive")
+	}
+	p := &Poller{
+		disc:       disc,
+		start:      start,
+		interval:   interval,
+		maxBackoff: DefaultMaxBackoff,
+		limiter:    make(chan struct{}, DefaultConcurrency),
+		polling:    make(map[string]context.CancelFunc),
+		offline:    make(map[string]bool),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = DefaultMaxBackoff
+	}
+	return p, nil
+}
+
+// Run searches for new devices every poll interval and starts a polling loop for each, until ctx
+// is done. Devices which are no longer known, or which report they've gone offline, stop being
+// polled.
+func (p *Poller) Run(ctx context.Context) {
+	l := log.Ctx(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	presence := p.disc.SubscribePresence()
+	defer presence.Unsubscribe()
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	search := true
+	for {
+		if search {
+			if _, err := p.disc.Search(ctx); err != nil {
+				l.Err(err).Msg("finding new devices")
+			}
+		}
+		p.reconcile(ctx, &wg)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			search = true
+		case pn := <-presence.C():
+			search = false
+			if pn.Device == nil {
+				continue
+			}
+			p.lock.Lock()
+			if pn.Online {
+				delete(p.offline, pn.Device.MACAddr)
+			} else {
+				p.offline[pn.Device.MACAddr] = true
+			}
+			p.lock.Unlock()
+		}
+	}
+}
+
+// Polling reports whether the device with the given MAC is being polled.
+func (p *Poller) Polling(mac string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.polling[mac] != nil
+}
+
+// reconcile starts polling known devices which aren't being polled, and stops polling devices
+// which have been removed or are offline.
+func (p *Poller) reconcile(ctx context.Context, wg *sync.WaitGroup) {
+	known := make(map[string]*discovery.Device)
+	for _, dev := range p.disc.AllDevices() {
+		known[dev.MACAddr] = dev
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for mac, stop := range p.polling {
+		if _, ok := known[mac]; ok && !p.offline[mac] {
+			continue
+		}
+		log.Ctx(ctx).Debug().Str("mac", mac).Msg("stopped polling removed device")
+		stop()
+		delete(p.polling, mac)
+	}
+	for mac, dev := range known {
+		if p.polling[mac] != nil || p.offline[mac] {
+			continue
+		}
+		devCtx, stop := context.WithCancel(ctx)
+		p.polling[mac] = stop
+		dev := dev
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.pollDevice(ctx, devCtx, dev)
+		}()
+	}
+}
+
+// pollDevice queries a device until ctx is done. Successive failures back off exponentially up
+// to the configured maximum. runCtx is the context of Run, used to tell whether polling stopped
+// because the device was removed.
+func (p *Poller) pollDevice(runCtx, ctx context.Context, dev *discovery.Device) {
+	l := log.Ctx(ctx).With().
+		Str("mac", dev.MACAddr).
+		Str("uri", dev.Instance()).
+		Logger()
+	ctx = l.WithContext(ctx)
+	poll, stop := p.start(dev)
+	if stop != nil {
+		defer func() { stop(runCtx.Err() == nil) }()
+	}
+	var failures int
+	// Start each device at a random point within its first interval so a freshly discovered
+	// fleet isn't queried all at once.
+	delay := time.Duration(rand.Int63n(int64(p.interval)))
+	for {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case p.limiter <- struct{}{}:
+		}
+		err := poll(ctx)
+		<-p.limiter
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			failures++
+			delay = p.Backoff(failures)
+			l.Warn().Err(err).Int("failures", failures).Dur("retry_in", delay).Msg("polling device")
+			continue
+		}
+		failures = 0
+		delay = p.withJitter(p.interval)
+	}
+}
+
+// Backoff returns the delay before the next poll of a device which has failed the given number
+// of successive polls.
+func (p *Poller) Backoff(failures int) time.Duration {
+	d := p.interval
+	for i := 1; i < failures && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return p.withJitter(d)
+}
+
+func (p *Poller) withJitter(d time.Duration) time.Duration {
+	if p.jitter <= 0 {
+		return d
+	}
+	d += time.Duration(rand.Int63n(int64(2*p.jitter))) - p.jitter
+	if d <= 0 {
+		return p.interval
+	}
+	return d
+}
@@ -0,0 +1,93 @@
+package devicepoll
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	td := discovery.NewTestDiscoverer(t)
+	start := func(dev *discovery.Device) (PollFunc, func(bool)) { return nil, nil }
+	_, err := New(td.Discoverer, 0, start)
+	assert.Error(t, err)
+	_, err = New(td.Discoverer, -time.Second, start)
+	assert.Error(t, err)
+
+	// Concurrency is at least 1, so polls can't deadlock.
+	p, err := New(td.Discoverer, time.Second, start, WithConcurrency(0))
+	require.NoError(t, err)
+	assert.Equal(t, 1, cap(p.limiter))
+}
+
+func TestBackoff(t *testing.T) {
+	td := discovery.NewTestDiscoverer(t)
+	p, err := New(td.Discoverer, time.Second, nil, WithMaxBackoff(5*time.Second))
+	require.NoError(t, err)
+	for i, expect := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		assert.Equal(t, expect, p.Backoff(i+1))
+	}
+}
+
+func TestRunStopsOfflineDevices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.ID = "shellyplus1-test"
+
+	var lock sync.Mutex
+	var polls, stops, removals int
+	p, err := New(td.Discoverer, 10*time.Millisecond, func(dev *discovery.Device) (PollFunc, func(bool)) {
+		poll := func(ctx context.Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			polls++
+			return nil
+		}
+		stop := func(removed bool) {
+			lock.Lock()
+			defer lock.Unlock()
+			stops++
+			if removed {
+				removals++
+			}
+		}
+		return poll, stop
+	})
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx)
+	}()
+	count := func() (int, int) {
+		lock.Lock()
+		defer lock.Unlock()
+		return polls, removals
+	}
+	require.Eventually(t, func() bool {
+		n, _ := count()
+		return n > 0 && p.Polling(d1.MACAddr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	td.SetPresence(ctx, d1.ID, false, time.Now())
+	require.Eventually(t, func() bool {
+		_, n := count()
+		return n == 1 && !p.Polling(d1.MACAddr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	td.SetPresence(ctx, d1.ID, true, time.Now())
+	require.Eventually(t, func() bool { return p.Polling(d1.MACAddr) }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 2, stops)
+	assert.Equal(t, 1, removals)
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/mongoose-os/mos/common/mgrpc"
 	"github.com/mongoose-os/mos/common/mgrpc/codec"
 	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"tinygo.org/x/bluetooth"
 )
@@ -115,6 +116,7 @@ func (d *Discoverer) searchBLE(ctx context.Context, stop chan struct{}) ([]*Devi
 				Name:          scanResult.LocalName(),
 				MACAddr:       macStr,
 				uri:           (&url.URL{Scheme: "ble", Host: macStr}).String(),
+				source:        sourceBLE,
 				authCallback:  d.authCallback,
 				notifications: &d.notifications,
 			}
@@ -223,6 +225,10 @@ func (d *Discoverer) AddBLE(ctx context.Context, mac string) (*Device, error) {
 type BLEDevice struct {
 	*options
 	lock sync.Mutex
+	// callLock serializes calls and notification polls, which share the GATT characteristics.
+	callLock sync.Mutex
+
+	handlers map[string]mgrpc.Handler
 
 	device    *bluetooth.Device
 	service   bluetooth.DeviceService
@@ -352,6 +358,8 @@ func (b *BLEDevice) Call(
 		Str("component", "discovery").
 		Str("subcomponent", "ble").
 		Str("method", cmd.Cmd).Logger()
+	b.callLock.Lock()
+	defer b.callLock.Unlock()
 	cmd.ID = atomic.AddInt64(&bleMGRPCID, 1)
 	reqFrame := frame.NewRequestFrame(localID(), "", "", cmd, false)
 	reqFrameBytes, err := json.Marshal(reqFrame)
@@ -389,43 +397,98 @@ func (b *BLEDevice) Call(
 		Uint16("mtu", mtu).
 		Msg("sent frame")
 	t := time.NewTicker(250 * time.Millisecond)
-	respFrameLenRaw := make([]byte, 4)
-	var respFrameLen uint32
+	defer t.Stop()
 	for {
 		select {
 		case <-t.C:
 		case <-ctx.Done():
 			return nil, errors.New("nope")
 		}
-		_, err := b.rxChar.Read(respFrameLenRaw)
+		respFrame, err := b.readFrame(ll)
 		if err != nil {
-			ll.Err(err).Msg("reading response length")
+			return nil, err
+		}
+		if respFrame == nil {
+			continue
+		}
+		if respFrame.Method != "" {
+			// Notifications may be queued ahead of the response.
+			b.dispatch(ll, respFrame)
 			continue
 		}
-		respFrameLen = binary.BigEndian.Uint32(respFrameLenRaw)
-		ll.Debug().Uint32("response_length", respFrameLen).Hex("response_len", respFrameLenRaw).Msg("got response length")
-		break
+		return frame.NewResponseFromFrame(respFrame), nil
 	}
+}
+
+// readFrame reads a frame the device has queued for us. It returns nil if the device hasn't
+// queued a frame. Read errors are returned, since they generally mean the link has dropped.
+func (b *BLEDevice) readFrame(ll zerolog.Logger) (*frame.Frame, error) {
+	respFrameLenRaw := make([]byte, 4)
+	if _, err := b.rxChar.Read(respFrameLenRaw); err != nil {
+		return nil, fmt.Errorf("reading response length: %w", err)
+	}
+	respFrameLen := binary.BigEndian.Uint32(respFrameLenRaw)
+	if respFrameLen == 0 {
+		return nil, nil
+	}
+	ll.Debug().Uint32("response_length", respFrameLen).Hex("response_len", respFrameLenRaw).Msg("got response length")
 	respBuf := make([]byte, respFrameLen)
 	for readBytes := 0; readBytes < int(respFrameLen); {
 		n, err := b.frameChar.Read(respBuf[readBytes:])
 		if err != nil {
-			ll.Err(err).Msg("reading response")
-			continue
+			return nil, fmt.Errorf("reading response: %w", err)
 		}
 		readBytes += n
 		ll.Debug().Str("resp", string(respBuf[0:readBytes])).Msg("got partial message")
 	}
 	ll.Debug().Str("resp", string(respBuf)).Msg("ble response frame is complete")
 	respFrame := &frame.Frame{}
-	if err = json.Unmarshal(respBuf, &respFrame); err != nil {
+	if err := json.Unmarshal(respBuf, &respFrame); err != nil {
 		return nil, fmt.Errorf("parsing response message: %w", err)
 	}
-	resp := frame.NewResponseFromFrame(respFrame)
-	return resp, nil
+	return respFrame, nil
+}
+
+// dispatch passes a device initiated frame, like a NotifyStatus, to its registered handler.
+func (b *BLEDevice) dispatch(ll zerolog.Logger, f *frame.Frame) {
+	b.lock.Lock()
+	h := b.handlers[f.Method]
+	b.lock.Unlock()
+	if h == nil {
+		ll.Debug().Str("method", f.Method).Msg("no handler for BLE frame")
+		return
+	}
+	h(b, f)
+}
+
+// poll reads and dispatches any frames the device has queued, like notifications. The BLE RPC
+// channel has no unsolicited delivery, so subscribers must poll.
+func (b *BLEDevice) poll(ctx context.Context) error {
+	ll := log.Ctx(ctx).With().
+		Str("component", "discovery").
+		Str("subcomponent", "ble").
+		Logger()
+	b.callLock.Lock()
+	defer b.callLock.Unlock()
+	if !b.IsConnected() {
+		return errors.New("BLE device is disconnected")
+	}
+	for {
+		f, err := b.readFrame(ll)
+		if err != nil || f == nil {
+			return err
+		}
+		b.dispatch(ll, f)
+	}
 }
 
 func (b *BLEDevice) AddHandler(method string, handler mgrpc.Handler) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.handlers == nil {
+		b.handlers = make(map[string]mgrpc.Handler)
+	}
+	b.handlers[method] = handler
 }
 
 func (b *BLEDevice) Disconnect(ctx context.Context) error {
@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"tinygo.org/x/bluetooth"
+)
+
+// adTypeServiceData16 is the advertising data type of service data for a 16-bit UUID.
+const adTypeServiceData16 = 0x16
+
+// BLEAdvertisement is an advertisement received by ListenBLE.
+type BLEAdvertisement struct {
+	MACAddr   string
+	LocalName string
+	RSSI      int16
+	// ServiceData holds the data advertised for each 16-bit service UUID.
+	ServiceData      map[uint16][]byte
+	ManufacturerData map[uint16][]byte
+	ReceivedAt       time.Time
+}
+
+// ListenBLE passively scans for BLE advertisements, passing each to handle until ctx is done.
+// Devices aren't connected or added to the discoverer. The adapter can only run one scan at a
+// time, so BLE searches and connections to devices added with AddBLE wait until listening stops.
+func (d *Discoverer) ListenBLE(ctx context.Context, handle func(*BLEAdvertisement)) error {
+	d.bleLock.Lock()
+	defer d.bleLock.Unlock()
+	if err := d.enableBLEAdapter(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Scan returns once stopped.
+			_ = d.bleAdapter.StopScan()
+		case <-done:
+		}
+	}()
+	err := d.bleAdapter.Scan(func(a *bluetooth.Adapter, sr bluetooth.ScanResult) {
+		handle(&BLEAdvertisement{
+			MACAddr:          strings.ToUpper(sr.Address.String()),
+			LocalName:        sr.LocalName(),
+			RSSI:             sr.RSSI,
+			ServiceData:      bleServiceData(sr),
+			ManufacturerData: sr.ManufacturerData(),
+			ReceivedAt:       d.now(),
+		})
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// serviceDataFromPayload returns the 16-bit UUID service data of a raw advertisement payload.
+func serviceDataFromPayload(raw []byte) map[uint16][]byte {
+	out := make(map[uint16][]byte)
+	for len(raw) > 0 {
+		l := int(raw[0])
+		if l == 0 || 1+l > len(raw) {
+			break
+		}
+		field := raw[1 : 1+l]
+		raw = raw[1+l:]
+		if field[0] == adTypeServiceData16 && len(field) >= 3 {
+			out[binary.LittleEndian.Uint16(field[1:3])] = append([]byte{}, field[3:]...)
+		}
+	}
+	return out
+}
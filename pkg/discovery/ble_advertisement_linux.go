@@ -0,0 +1,56 @@
+//go:build linux
+
+package discovery
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/muka/go-bluetooth/api"
+	"tinygo.org/x/bluetooth"
+)
+
+// bluezAdapterPath returns the object path of the default bluez adapter, which is the adapter
+// used by bluetooth.DefaultAdapter.
+var bluezAdapterPath = sync.OnceValues(func() (dbus.ObjectPath, error) {
+	a, err := api.GetDefaultAdapter()
+	if err != nil {
+		return "", err
+	}
+	return a.Path(), nil
+})
+
+// bleServiceData returns the 16-bit UUID service data of a scan result. bluez scan results don't
+// include the raw advertisement and the bluetooth package doesn't expose the bluez ServiceData
+// property, so it's read from the bluez device object.
+func bleServiceData(sr bluetooth.ScanResult) map[uint16][]byte {
+	if raw := sr.Bytes(); raw != nil {
+		return serviceDataFromPayload(raw)
+	}
+	out := make(map[uint16][]byte)
+	adapterPath, err := bluezAdapterPath()
+	if err != nil {
+		return out
+	}
+	bus, err := dbus.SystemBus()
+	if err != nil {
+		return out
+	}
+	path := dbus.ObjectPath(string(adapterPath) + "/dev_" + strings.ReplaceAll(sr.Address.MAC.String(), ":", "_"))
+	v, err := bus.Object("org.bluez", path).GetProperty("org.bluez.Device1.ServiceData")
+	if err != nil {
+		return out
+	}
+	data, _ := v.Value().(map[string]dbus.Variant)
+	for k, val := range data {
+		uuid, err := bluetooth.ParseUUID(k)
+		if err != nil || !uuid.Is16Bit() {
+			continue
+		}
+		if b, ok := val.Value().([]byte); ok {
+			out[uuid.Get16Bit()] = b
+		}
+	}
+	return out
+}
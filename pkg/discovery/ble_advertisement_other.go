@@ -0,0 +1,11 @@
+//go:build !linux
+
+package discovery
+
+import "tinygo.org/x/bluetooth"
+
+// bleServiceData returns the 16-bit UUID service data of a scan result. It's only available on
+// platforms which provide the raw advertisement.
+func bleServiceData(sr bluetooth.ScanResult) map[uint16][]byte {
+	return serviceDataFromPayload(sr.Bytes())
+}
@@ -0,0 +1,19 @@
+package discovery
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceDataFromPayload(t *testing.T) {
+	// flags, BTHome service data, manufacturer data, and a truncated field.
+	raw, err := hex.DecodeString("020106" + "0716d2fc4401640b" + "05ffa90b0102" + "09ff")
+	require.NoError(t, err)
+	assert.Equal(t, map[uint16][]byte{
+		0xfcd2: {0x44, 0x01, 0x64, 0x0b},
+	}, serviceDataFromPayload(raw))
+	assert.Empty(t, serviceDataFromPayload(nil))
+}
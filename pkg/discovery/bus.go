@@ -0,0 +1,167 @@
+package discovery
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSubscriptionBuffer is the default number of notifications buffered for a subscriber.
+const DefaultSubscriptionBuffer = 100
+
+// Policy determines what happens when a notification is published to a subscriber whose buffer is
+// full.
+type Policy int
+
+const (
+	// DropOldest discards the oldest buffered notification to make room for the new one.
+	DropOldest Policy = iota
+	// DropNewest discards the new notification.
+	DropNewest
+	// Block waits for the subscriber to receive the notification. A slow subscriber will stall
+	// the connection which delivered the notification, and all other subscribers.
+	Block
+)
+
+func (p Policy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case Block:
+		return "block"
+	default:
+		return "unknown"
+	}
+}
+
+type subscribeOptions struct {
+	buffer int
+	policy Policy
+}
+
+// SubscribeOption configures a subscription.
+type SubscribeOption func(*subscribeOptions)
+
+// WithBuffer sets the number of notifications buffered for the subscriber.
+func WithBuffer(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.buffer = n
+	}
+}
+
+// WithPolicy sets the policy applied when the subscriber's buffer is full. Defaults to DropOldest.
+func WithPolicy(p Policy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.policy = p
+	}
+}
+
+// bus delivers published values to each of its subscribers.
+type bus[T any] struct {
+	lock        sync.RWMutex
+	subscribers map[*Subscription[T]]struct{}
+}
+
+func (b *bus[T]) subscribe(opts ...SubscribeOption) *Subscription[T] {
+	o := subscribeOptions{buffer: DefaultSubscriptionBuffer}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.buffer < 1 && o.policy != Block {
+		// Dropping requires somewhere to drop from.
+		o.buffer = 1
+	}
+	s := &Subscription[T]{
+		c:      make(chan T, o.buffer),
+		done:   make(chan struct{}),
+		policy: o.policy,
+		bus:    b,
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[*Subscription[T]]struct{})
+	}
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+func (b *bus[T]) publish(v T) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for s := range b.subscribers {
+		s.send(v)
+	}
+}
+
+func (b *bus[T]) unsubscribe(s *Subscription[T]) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.subscribers[s]; !ok {
+		return
+	}
+	delete(b.subscribers, s)
+	// Publishers only send while holding the read lock, so none can be sending now.
+	close(s.c)
+}
+
+// Subscription receives notifications published after it was created.
+type Subscription[T any] struct {
+	c         chan T
+	done      chan struct{}
+	closeOnce sync.Once
+	policy    Policy
+	dropped   atomic.Uint64
+	bus       *bus[T]
+}
+
+// C returns the channel which delivers notifications. It's closed by Unsubscribe.
+func (s *Subscription[T]) C() <-chan T {
+	return s.c
+}
+
+// Dropped returns the number of notifications discarded because the subscriber's buffer was full.
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe stops delivery and closes the channel. It's safe to call more than once.
+func (s *Subscription[T]) Unsubscribe() {
+	s.closeOnce.Do(func() {
+		// Release any publisher blocked on this subscriber before waiting for the bus lock.
+		close(s.done)
+		s.bus.unsubscribe(s)
+	})
+}
+
+func (s *Subscription[T]) send(v T) {
+	switch s.policy {
+	case Block:
+		select {
+		case s.c <- v:
+		case <-s.done:
+		}
+		return
+	case DropNewest:
+		select {
+		case s.c <- v:
+		default:
+			s.dropped.Add(1)
+		}
+		return
+	}
+	for {
+		select {
+		case s.c <- v:
+			return
+		default:
+		}
+		select {
+		case <-s.c:
+			s.dropped.Add(1)
+		default:
+			// The subscriber made room for us.
+		}
+	}
+}
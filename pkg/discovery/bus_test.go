@@ -0,0 +1,90 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func drain[T any](s *Subscription[T]) []T {
+	var out []T
+	for {
+		select {
+		case v := <-s.C():
+			out = append(out, v)
+		default:
+			return out
+		}
+	}
+}
+
+func TestBusPolicies(t *testing.T) {
+	var b bus[int]
+	oldest := b.subscribe(WithBuffer(2))
+	newest := b.subscribe(WithBuffer(2), WithPolicy(DropNewest))
+	roomy := b.subscribe(WithBuffer(10))
+	for i := 1; i <= 4; i++ {
+		b.publish(i)
+	}
+	assert.Equal(t, []int{3, 4}, drain(oldest))
+	assert.Equal(t, uint64(2), oldest.Dropped())
+	assert.Equal(t, []int{1, 2}, drain(newest))
+	assert.Equal(t, uint64(2), newest.Dropped())
+	assert.Equal(t, []int{1, 2, 3, 4}, drain(roomy))
+	assert.Equal(t, uint64(0), roomy.Dropped())
+}
+
+func TestBusUnsubscribe(t *testing.T) {
+	var b bus[int]
+	s := b.subscribe()
+	other := b.subscribe()
+	b.publish(1)
+	s.Unsubscribe()
+	s.Unsubscribe()
+	b.publish(2)
+
+	// Buffered values are still delivered before the channel is closed.
+	v, ok := <-s.C()
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+	_, ok = <-s.C()
+	assert.False(t, ok)
+	assert.Equal(t, []int{1, 2}, drain(other))
+}
+
+func TestBusBlock(t *testing.T) {
+	var b bus[int]
+	s := b.subscribe(WithBuffer(1), WithPolicy(Block))
+	b.publish(1)
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		b.publish(2)
+	}()
+	select {
+	case <-published:
+		t.Fatal("publish should block while the subscriber's buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Equal(t, 1, <-s.C())
+	require.Equal(t, 2, <-s.C())
+	<-published
+
+	// Unsubscribing releases a blocked publisher.
+	b.publish(3)
+	published = make(chan struct{})
+	go func() {
+		defer close(published)
+		b.publish(4)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Unsubscribe()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish remained blocked after unsubscribe")
+	}
+	assert.Equal(t, uint64(0), s.Dropped())
+}
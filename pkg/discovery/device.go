@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -16,28 +18,36 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type AuthCallback func(ctx context.Context, desc string) (pw string, err error)
 
 // Device describes one shelly device.
 type Device struct {
-	uri          string
-	MACAddr      string
+	uri     string
+	MACAddr string
+	// ID is the device's identifier (ex. `shellyplus1-a8032abe5424`), which it uses as the src of
+	// notifications. It's populated when the device's specs are resolved.
+	ID           string
 	Name         string
+	Model        string
 	Specs        shelly.DeviceSpecs
 	lastSeen     time.Time
 	source       discoverySource
 	ble          *BLEDevice
 	authCallback AuthCallback
 
+	// prefixLock guards mqttPrefix, which FollowMQTT may set while the device is in use.
+	prefixLock sync.Mutex
 	mqttPrefix string
 	mqttClient mqtt.Client
 
 	notifications *notifications
 }
 
-// Open creates an mongoose rpc channel to the device.
+// Open creates an mongoose rpc channel to the device. Calls on the channel are traced with the
+// global otel TracerProvider.
 func (d *Device) Open(ctx context.Context) (mgrpc.MgRPC, error) {
 	ll := d.LogCtx(ctx)
 	ctx = ll.WithContext(ctx)
@@ -46,36 +56,33 @@ func (d *Device) Open(ctx context.Context) (mgrpc.MgRPC, error) {
 			return nil, err
 		}
 		d.notifications.register(d.ble)
-		return d.ble, nil
+		t := newTracedRPC(d, transportBLE)
+		t.MgRPC = d.ble
+		return t, nil
 	}
-	if d.mqttClient != nil && d.mqttPrefix != "" {
-		c, err := newMQTTCodec(ctx, d.mqttPrefix, d.mqttClient)
+	if prefix := d.topicPrefix(); d.mqttClient != nil && prefix != "" {
+		c, err := newMQTTCodec(ctx, prefix, d.mqttClient)
 		if err != nil {
 			return nil, fmt.Errorf("establishing mqtt rpc channel: %w", err)
 		}
 		m := mgrpc.Serve(ctx, c)
 		d.notifications.register(m)
-		return m, nil
+		t := newTracedRPC(d, transportMQTT)
+		t.MgRPC = m
+		return t, nil
 	}
 	if strings.HasPrefix(d.uri, "ws://") || strings.HasPrefix(d.uri, "wss://") {
-		m, err := mgrpc.New(ctx, d.uri,
-			mgrpc.UseWebSocket(),
-			mgrpc.LocalID(localID()),
-		)
-		if err != nil {
-			return nil, fmt.Errorf("establishing rpc channel: %w", err)
-		}
-		ll.Info().Str("channel_protocol", "ws").Msg("connected to device")
-		d.notifications.register(m)
-		return m, nil
+		return d.openWebsocket(ctx, d.uri)
 	}
+	t := newTracedRPC(d, transportHTTP)
 	m, err := mgrpc.New(ctx, d.uri,
 		mgrpc.UseHTTPPost(),
 		mgrpc.LocalID(localID()),
 		mgrpc.CodecOptions(
 			codec.Options{
 				HTTPOut: codec.OutboundHTTPCodecOptions{
-					GetCredsCallback: d.AuthCallback(ctx),
+					// The HTTP codec handles digest auth itself, so count its retries here.
+					GetCredsCallback: t.countAuth(d.AuthCallback(ctx)),
 				},
 			},
 		))
@@ -84,10 +91,31 @@ func (d *Device) Open(ctx context.Context) (mgrpc.MgRPC, error) {
 	}
 	d.notifications.register(m)
 	ll.Info().Str("channel_protocol", "http").Msg("connected to device")
-	return m, nil
+	t.MgRPC = m
+	return t, nil
 }
 
-func (d *Device) resolveSpecs(ctx context.Context) error {
+// openWebsocket creates an rpc channel to the device over a websocket. Unlike HTTP, devices send
+// notifications to websocket peers.
+func (d *Device) openWebsocket(ctx context.Context, uri string) (mgrpc.MgRPC, error) {
+	m, err := mgrpc.New(ctx, uri,
+		mgrpc.UseWebSocket(),
+		mgrpc.LocalID(localID()),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("establishing rpc channel: %w", err)
+	}
+	ll := d.LogCtx(ctx)
+	ll.Info().Str("channel_protocol", "ws").Msg("connected to device")
+	d.notifications.register(m)
+	t := newTracedRPC(d, transportWS)
+	t.MgRPC = m
+	return t, nil
+}
+
+func (d *Device) resolveSpecs(ctx context.Context) (err error) {
+	ctx, end := startSpan(ctx, "discovery.resolveSpecs", d.spanAttributes()...)
+	defer func() { end(err) }()
 	c, err := d.Open(ctx)
 	if err != nil {
 		return fmt.Errorf("connecting to device to resolve specs: %w", err)
@@ -103,6 +131,9 @@ func (d *Device) resolveSpecs(ctx context.Context) error {
 		return fmt.Errorf("resolving device info to spec: %w", err)
 	}
 	d.MACAddr = resp.MAC
+	d.ID = resp.ID
+	d.Model = resp.Model
+	trace.SpanFromContext(ctx).SetAttributes(d.spanAttributes()...)
 	return nil
 }
 
@@ -110,6 +141,51 @@ func (d *Device) Instance() string {
 	return d.uri
 }
 
+// Address returns the network address of the device. For HTTP and websocket devices this is
+// the `host:port` from the device URI. BLE devices are addressed by MAC and MQTT devices by
+// their topic prefix.
+func (d *Device) Address() string {
+	if prefix := d.topicPrefix(); d.mqttClient != nil && prefix != "" {
+		return prefix
+	}
+	if d.ble != nil {
+		return d.MACAddr
+	}
+	u, err := url.Parse(d.uri)
+	if err != nil || u.Host == "" {
+		return d.uri
+	}
+	return u.Host
+}
+
+// MQTTPrefix returns the topic prefix of a device reached via MQTT, or an empty string if the
+// device uses another transport.
+func (d *Device) MQTTPrefix() string {
+	if d.mqttClient == nil {
+		return ""
+	}
+	return d.topicPrefix()
+}
+
+// topicPrefix returns the device's MQTT topic prefix, which is set for devices reached via MQTT
+// and devices followed with FollowMQTT.
+func (d *Device) topicPrefix() string {
+	d.prefixLock.Lock()
+	defer d.prefixLock.Unlock()
+	return d.mqttPrefix
+}
+
+func (d *Device) setTopicPrefix(prefix string) {
+	d.prefixLock.Lock()
+	defer d.prefixLock.Unlock()
+	d.mqttPrefix = prefix
+}
+
+// Source describes how the device was found (ex. `mdns`, `ble`, `mqtt`, `manual`).
+func (d *Device) Source() string {
+	return string(d.source)
+}
+
 func (d *Device) LogCtx(ctx context.Context) zerolog.Logger {
 	ll := log.Ctx(ctx)
 	return d.Log(*ll)
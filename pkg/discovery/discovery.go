@@ -13,6 +13,7 @@ import (
 	"github.com/jcodybaker/go-shelly"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 	"tinygo.org/x/bluetooth"
 )
@@ -30,6 +31,7 @@ const (
 func NewDiscoverer(opts ...DiscovererOption) *Discoverer {
 	d := &Discoverer{
 		knownDevices: make(map[string]*Device),
+		presence:     make(map[string]Presence),
 		options: &options{
 			bleAdapter:    bluetooth.DefaultAdapter,
 			now:           time.Now,
@@ -62,6 +64,23 @@ type Discoverer struct {
 	ioLock sync.Mutex
 
 	notifications
+
+	// presence holds the last reported presence of MQTT devices, keyed by topic prefix. It's
+	// guarded by lock.
+	presence map[string]Presence
+
+	// added delivers devices as they're added.
+	added bus[*Device]
+
+	// announces delivers the device info published on the MQTT announce topic.
+	announces bus[*shelly.ShellyGetDeviceInfoResponse]
+
+	// mqttSubscribed holds the MQTT topic filters subscribed for notifications. It's guarded by
+	// lock.
+	mqttSubscribed []topicSubscription
+
+	// mqttSession wraps mqttClient once MQTTConnect has been called.
+	mqttSession *mqttSession
 }
 
 // AddDeviceByAddress attempts to parse a user-provided URI and add the device.
@@ -167,6 +186,14 @@ func (d *Discoverer) addDevice(ctx context.Context, dev *Device, opts ...DeviceO
 	}
 	d.knownDevices[strings.ToUpper(dev.MACAddr)] = dev
 	ll.Info().Msg("new device added")
+	d.added.publish(dev)
+	if d.mqttFollow && d.mqttClient != nil {
+		go func() {
+			if err := d.FollowMQTT(ctx, dev); err != nil {
+				ll.Warn().Err(err).Msg("following device mqtt topics")
+			}
+		}()
+	}
 	return dev, true
 }
 
@@ -177,6 +204,12 @@ func (d *Discoverer) isKnownDevice(mac string) bool {
 	return ok
 }
 
+// SubscribeDevices subscribes to devices added after the call, ex. by a search or an MQTT
+// announcement. Use AllDevices for devices which are already known.
+func (d *Discoverer) SubscribeDevices(opts ...SubscribeOption) *Subscription[*Device] {
+	return d.added.subscribe(opts...)
+}
+
 // AllDevices returns all known devices.
 func (d *Discoverer) AllDevices() []*Device {
 	var out []*Device
@@ -188,10 +221,24 @@ func (d *Discoverer) AllDevices() []*Device {
 	return out
 }
 
+// DeviceBySrc returns the known device which sends notifications with the given src, or nil if
+// no known device matches.
+func (d *Discoverer) DeviceBySrc(src string) *Device {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, dev := range d.knownDevices {
+		if (dev.ID != "" && strings.EqualFold(dev.ID, src)) || (src != "" && dev.topicPrefix() == src) {
+			return dev
+		}
+	}
+	return nil
+}
+
 func (d *Discoverer) Search(ctx context.Context) ([]*Device, error) {
 	if !d.bleSearchEnabled && !d.mdnsSearchEnabled && !d.mqttSearchEnabled {
 		return nil, nil
 	}
+	ctx, end := startSpan(ctx, "discovery.search")
 	var l sync.Mutex
 	var allDevs []*Device
 	eg, ctx := errgroup.WithContext(ctx)
@@ -210,7 +257,7 @@ func (d *Discoverer) Search(ctx context.Context) ([]*Device, error) {
 	}()
 	if d.bleSearchEnabled {
 		eg.Go(func() error {
-			devs, err := d.searchBLE(ctx, stop)
+			devs, err := d.traceSearch(ctx, "discovery.ble.scan", sourceBLE, stop, d.searchBLE)
 			l.Lock()
 			defer l.Unlock()
 			allDevs = append(allDevs, devs...)
@@ -219,7 +266,7 @@ func (d *Discoverer) Search(ctx context.Context) ([]*Device, error) {
 	}
 	if d.mdnsSearchEnabled {
 		eg.Go(func() error {
-			devs, err := d.searchMDNS(ctx, stop)
+			devs, err := d.traceSearch(ctx, "discovery.mdns.query", sourceMDNS, stop, d.searchMDNS)
 			l.Lock()
 			defer l.Unlock()
 			allDevs = append(allDevs, devs...)
@@ -228,14 +275,32 @@ func (d *Discoverer) Search(ctx context.Context) ([]*Device, error) {
 	}
 	if d.mqttSearchEnabled {
 		eg.Go(func() error {
-			devs, err := d.searchMQTT(ctx, stop)
+			devs, err := d.traceSearch(ctx, "discovery.mqtt.announce", sourceMQTT, stop, d.searchMQTT)
 			l.Lock()
 			defer l.Unlock()
 			allDevs = append(allDevs, devs...)
 			return err
 		})
 	}
-	return allDevs, eg.Wait()
+	err := eg.Wait()
+	end(err)
+	return allDevs, err
+}
+
+// traceSearch records a span for a single discovery mechanism's search.
+func (d *Discoverer) traceSearch(
+	ctx context.Context,
+	name string,
+	source discoverySource,
+	stop chan struct{},
+	search func(context.Context, chan struct{}) ([]*Device, error),
+) (devs []*Device, err error) {
+	ctx, end := startSpan(ctx, name, attrDiscoverySource.String(string(source)))
+	defer func() {
+		trace.SpanFromContext(ctx).SetAttributes(attrDevicesFound.Int(len(devs)))
+		end(err)
+	}()
+	return search(ctx, stop)
 }
 
 func (d *Discoverer) logCtx(ctx context.Context, sub string) zerolog.Logger {
@@ -0,0 +1,25 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribeDevices(t *testing.T) {
+	ctx := context.Background()
+	d := NewDiscoverer()
+	added := d.SubscribeDevices()
+	defer added.Unsubscribe()
+
+	dev, isNew := d.addDevice(ctx, &Device{MACAddr: "A8032ABE5424"})
+	require.True(t, isNew)
+	// Rediscovered devices aren't announced again.
+	_, isNew = d.addDevice(ctx, &Device{MACAddr: "A8032ABE5424"})
+	require.False(t, isNew)
+
+	require.Len(t, added.C(), 1)
+	assert.Same(t, dev, <-added.C())
+}
@@ -3,25 +3,46 @@ package discovery
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/jcodybaker/go-shelly"
-	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/jcodybaker/shellyctl/pkg/internal/mqtt5"
 )
 
+// announceTopic receives the device info of each device asked to announce itself with an
+// `announce` message on `shellies/command`.
+const announceTopic = "shellies/announce"
+
 func (d *Discoverer) MQTTConnect(ctx context.Context) error {
 	ll := d.logCtx(ctx, "mqtt")
 	if d.mqttClientOptions == nil {
 		ll.Debug().Msg("no MQTT servers defined; skipping mqtt connect")
 		return nil
 	}
-	// opts.SetConnectionLostHandler(c.onConnectionLost)
+	session := newMQTTSession(d.now)
+	d.mqttClientOptions.SetAutoReconnect(true)
+	d.mqttClientOptions.SetOnConnectHandler(func(mqtt.Client) {
+		session.onConnect(ll)
+	})
+	d.mqttClientOptions.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		session.onConnectionLost(ll, err)
+	})
+	d.mqttClientOptions.SetReconnectingHandler(func(mqtt.Client, *mqtt.ClientOptions) {
+		ll.Debug().Msg("reconnecting to MQTT broker")
+	})
 	ll.Info().Str("broker", d.mqttClientOptions.Servers[0].String()).Msg("connecting to MQTT Broker")
-	d.mqttClient = mqtt.NewClient(d.mqttClientOptions)
+	if d.mqttClientOptions.ProtocolVersion == 5 {
+		session.Client = mqtt5.NewClient(d.mqttClientOptions)
+	} else {
+		session.Client = mqtt.NewClient(d.mqttClientOptions)
+	}
+	d.mqttSession = session
+	d.mqttClient = session
 
 	token := d.mqttClient.Connect()
 	token.Wait()
@@ -29,59 +50,32 @@ func (d *Discoverer) MQTTConnect(ctx context.Context) error {
 		return fmt.Errorf("MQTT connect error: %w", err)
 	}
 
-	for _, t := range d.mqttTopicSubs {
-		c, err := newMQTTConsumer(ctx, t, d.mqttClient)
-		if err != nil {
+	for _, t := range append([]string{announceTopic, presenceTopic}, d.mqttTopicSubs...) {
+		if err := d.subscribeMQTTTopic(ctx, t); err != nil {
 			return fmt.Errorf("subscribing to MQTT topic %q: %w", t, err)
 		}
-		s := mgrpc.Serve(ctx, c)
-		d.notifications.register(s)
 	}
 	return nil
 }
 
+// MQTTClient returns the client connected by MQTTConnect, or nil if MQTT isn't configured.
+func (d *Discoverer) MQTTClient() mqtt.Client {
+	return d.mqttClient
+}
+
 // searchMQTT finds new devices via MQTT.
 func (d *Discoverer) searchMQTT(ctx context.Context, stop chan struct{}) ([]*Device, error) {
-	// 1) Subscribe to /shellies/announce
-	// 2) Subscribe to +/online
-	// 3)
-
-	// 1) Subscribe to '+/status'
-	// 2) Subscribe to '+/online'; remove 'off' devices when lost
-	// 3) wait discovery timeout EXACTLY once
-	// 3) return current known device list.
-	stopSearch := new(atomic.Bool)
+	// Devices which connect or disconnect later are added and evicted by their `+/online`
+	// presence messages, which are subscribed by MQTTConnect.
 	ll := d.logCtx(ctx, "mqtt")
 	if !d.mqttSearchEnabled {
 		return nil, nil
 	}
 
-	c := make(chan *shelly.ShellyGetDeviceInfoResponse, mdnsSearchBuffer)
-
-	d.mqttClient.Subscribe("shellies/announce", 1, func(_ mqtt.Client, m mqtt.Message) {
-		var deviceInfo shelly.ShellyGetDeviceInfoResponse
-		if err := json.Unmarshal(m.Payload(), &deviceInfo); err != nil {
-			ll.Err(err).
-				Uint16("message_id", m.MessageID()).
-				Str("topic", m.Topic()).
-				Msg("parsing MQTT message as device info")
-			return
-		}
-		if stopSearch.Load() {
-			ll.Warn().
-				Uint16("message_id", m.MessageID()).
-				Str("topic", m.Topic()).
-				Str("device_id", deviceInfo.ID).
-				Msg("discarding late MQTT search response")
-			return
-		}
-		ll.Debug().
-			Uint16("message_id", m.MessageID()).
-			Str("topic", m.Topic()).
-			Str("device_id", deviceInfo.ID).
-			Msg("got MQTT search response")
-		c <- &deviceInfo
-	})
+	// Announcements are delivered by the handler MQTTConnect subscribes, so concurrent searches
+	// and AwaitMQTTAnnounce each receive every announcement.
+	announces := d.announces.subscribe(WithBuffer(mdnsSearchBuffer))
+	defer announces.Unsubscribe()
 
 	approver := newApprover[*shelly.ShellyGetDeviceInfoResponse](d, stop)
 	defer approver.done()
@@ -96,7 +90,8 @@ func (d *Discoverer) searchMQTT(ctx context.Context, stop chan struct{}) ([]*Dev
 	go func() {
 		defer wg.Done()
 		defer approver.done()
-		for deviceInfo := range c {
+		for deviceInfo := range announces.C() {
+			ll.Debug().Str("device_id", deviceInfo.ID).Msg("got MQTT search response")
 			desc := fmt.Sprintf(
 				"mqtt device %q (%s/%s)",
 				deviceInfo.ID,
@@ -150,20 +145,17 @@ func (d *Discoverer) searchMQTT(ctx context.Context, stop chan struct{}) ([]*Dev
 	case <-time.After(d.searchTimeout):
 	}
 
-	// We can't guarantee that the mqtt has coallesed and processed all incoming messages. So it's difficult
-	// be certain we can close the channel. The atomic stopSearch makes this safer, but it's not a guarantee.
-	stopSearch.Store(true)
-	token = d.mqttClient.Unsubscribe("shellies/announce")
-	token.Wait()
-	if err := token.Error(); err != nil {
-		return nil, fmt.Errorf("unsubscribing from mqtt search message responses: %w", err)
-	}
-	close(c)
+	// Closes the channel, ending the approver's input.
+	announces.Unsubscribe()
 
 	wg.Wait()
 	return output, nil
 }
 
+func sourceIsMQTT(dev *Device) {
+	dev.source = sourceMQTT
+}
+
 func (d *Discoverer) processMQTTAnnounceResponse(ctx context.Context, deviceInfo *shelly.ShellyGetDeviceInfoResponse) *Device {
 	ll := d.logCtx(ctx, "mqtt").With().
 		Str("mqtt_id", deviceInfo.ID).
@@ -177,9 +169,66 @@ func (d *Discoverer) processMQTTAnnounceResponse(ctx context.Context, deviceInfo
 		return nil
 	}
 
-	dev, err := d.AddMQTTDevice(ctx, deviceInfo.ID)
+	dev, err := d.AddMQTTDevice(ctx, deviceInfo.ID, sourceIsMQTT)
 	if err != nil {
 		ll.Warn().Err(err).Msg("failed to add mqtt device")
 	}
 	return dev
 }
+
+// AwaitMQTTAnnounce asks the devices on the broker to announce themselves every interval until
+// each of the device IDs has announced or ctx is done. It reports whether each ID announced.
+func (d *Discoverer) AwaitMQTTAnnounce(ctx context.Context, ids []string, interval time.Duration) (map[string]bool, error) {
+	if d.mqttClient == nil {
+		return nil, errors.New("not connected to an MQTT broker")
+	}
+	ll := d.logCtx(ctx, "mqtt")
+	announced := make(map[string]bool)
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[strings.ToLower(id)] = true
+	}
+	announces := d.announces.subscribe()
+	defer announces.Unsubscribe()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	publish := true
+	for len(announced) < len(want) && ctx.Err() == nil {
+		if publish {
+			token := d.mqttClient.Publish("shellies/command", 1, false, []byte("announce"))
+			token.Wait()
+			if err := token.Error(); err != nil {
+				return nil, fmt.Errorf("publishing announce request to mqtt: %w", err)
+			}
+			publish = false
+		}
+		select {
+		case deviceInfo := <-announces.C():
+			id := strings.ToLower(deviceInfo.ID)
+			if want[id] && !announced[id] {
+				ll.Debug().Str("device_id", deviceInfo.ID).Msg("device announced")
+				announced[id] = true
+			}
+		case <-ctx.Done():
+		case <-t.C:
+			publish = true
+		}
+	}
+	out := make(map[string]bool, len(announced))
+	for _, id := range ids {
+		out[id] = announced[strings.ToLower(id)]
+	}
+	return out, nil
+}
+
+// handleAnnounce publishes a message on the announce topic to the subscribers of announcements.
+func (d *Discoverer) handleAnnounce(ctx context.Context, payload []byte) {
+	var deviceInfo shelly.ShellyGetDeviceInfoResponse
+	if err := json.Unmarshal(payload, &deviceInfo); err != nil {
+		ll := d.logCtx(ctx, "mqtt")
+		ll.Warn().Err(err).Str("topic", announceTopic).Msg("parsing MQTT message as device info")
+		return
+	}
+	d.announces.publish(&deviceInfo)
+}
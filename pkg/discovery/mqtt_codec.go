@@ -3,6 +3,8 @@
 // It has been modified to:
 // - Support using a single MQTT client connection for multiple devices.
 // - Use zerolog
+// - Support receiving requests on behalf of a device, for bridging devices to a broker.
+// - Match RPC responses by MQTT v5 response-topic and correlation-data when connected with v5.
 //
 // Original License:
 //
@@ -28,8 +30,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
 
+	"github.com/jcodybaker/shellyctl/pkg/internal/mqtt5"
 	"github.com/mongoose-os/mos/common/mgrpc/codec"
 	"github.com/mongoose-os/mos/common/mgrpc/frame"
 	"github.com/rs/zerolog"
@@ -52,6 +56,30 @@ type mqttCodec struct {
 	subTopics   map[string]bool
 	mu          sync.Mutex
 	log         *zerolog.Logger
+	// responder codecs answer requests, so sent frames keep the Dst of the request they answer.
+	responder bool
+	// requests holds the correlation data of requests sent over MQTT v5 which are awaiting a
+	// response. It's nil for codecs which don't send requests.
+	requests map[string]struct{}
+	// replyTo maps the IDs of requests received over MQTT v5 to where their responses go.
+	replyTo map[int64]mqttReplyTo
+}
+
+// mqttReplyTo is the response topic and correlation data of a request received over MQTT v5.
+type mqttReplyTo struct {
+	topic       string
+	correlation []byte
+}
+
+// mqttV5Client returns the MQTT v5 client underlying cli, or nil if cli speaks MQTT 3.1.1.
+func mqttV5Client(cli mqtt.Client) *mqtt5.Client {
+	switch c := cli.(type) {
+	case *mqtt5.Client:
+		return c
+	case *mqttSession:
+		return mqttV5Client(c.Client)
+	}
+	return nil
 }
 
 func newMQTTCodec(ctx context.Context, dst string, mqttClient mqtt.Client) (codec.Codec, error) {
@@ -69,6 +97,7 @@ func newMQTTCodec(ctx context.Context, dst string, mqttClient mqtt.Client) (code
 		subTopics:   make(map[string]bool),
 		cli:         mqttClient,
 		log:         log.Ctx(ctx),
+		requests:    make(map[string]struct{}),
 	}
 
 	if err := c.subscribe(c.subTopic + "/rpc"); err != nil {
@@ -95,6 +124,31 @@ func newMQTTConsumer(ctx context.Context, topic string, mqttClient mqtt.Client)
 	return c, nil
 }
 
+// NewMQTTResponder returns a codec which receives the RPC requests published to `<prefix>/rpc`,
+// as a device connected to the broker would. Frames sent on it, like responses, are published to
+// `<dst>/rpc` with the given src.
+func NewMQTTResponder(ctx context.Context, prefix, src string, mqttClient mqtt.Client) (codec.Codec, error) {
+	co := mqttClient.OptionsReader()
+	c := &mqttCodec{
+		src:         src,
+		dst:         prefix,
+		closeNotify: make(chan struct{}),
+		ready:       make(chan struct{}),
+		rchan:       make(chan frame.Frame),
+		isTLS:       (co.Servers()[0].Scheme == "tcps"),
+		subTopics:   make(map[string]bool),
+		cli:         mqttClient,
+		log:         log.Ctx(ctx),
+		responder:   true,
+		replyTo:     make(map[int64]mqttReplyTo),
+	}
+
+	if err := c.subscribe(prefix + "/rpc"); err != nil {
+		return nil, fmt.Errorf("subscribing to mqtt %q: %w", prefix+"/rpc", err)
+	}
+	return c, nil
+}
+
 func (c *mqttCodec) subscribe(topic string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -124,7 +178,42 @@ func (c *mqttCodec) onMessage(cli mqtt.Client, msg mqtt.Message) {
 			Msg("invalid json payload received via mqtt")
 		return
 	}
-	c.rchan <- *f
+	if m, ok := msg.(*mqtt5.Message); ok && !c.correlate(f, m) {
+		return
+	}
+	select {
+	case c.rchan <- *f:
+	case <-c.closeNotify:
+	}
+}
+
+// correlate applies the MQTT v5 properties of a received frame. Requests record where their
+// response goes. Responses carrying correlation data are matched to a request this codec sent,
+// and false is returned for those answering another client's request on a shared topic. Devices
+// which don't echo correlation data are matched by frame ID as with MQTT 3.1.1.
+func (c *mqttCodec) correlate(f *frame.Frame, m *mqtt5.Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.replyTo != nil && m.ResponseTopic() != "" && f.ID != 0 {
+		c.replyTo[f.ID] = mqttReplyTo{topic: m.ResponseTopic(), correlation: m.CorrelationData()}
+		return true
+	}
+	if c.requests == nil || m.CorrelationData() == nil {
+		return true
+	}
+	correlation := string(m.CorrelationData())
+	if _, ok := c.requests[correlation]; !ok {
+		c.log.Debug().
+			Str("topic", m.Topic()).
+			Str("correlation_data", correlation).
+			Msg("ignoring mqtt response to another request")
+		return false
+	}
+	delete(c.requests, correlation)
+	if f.ID == 0 {
+		f.ID, _ = strconv.ParseInt(correlation, 10, 64)
+	}
+	return true
 }
 
 func (c *mqttCodec) Close() {
@@ -174,8 +263,10 @@ func (c *mqttCodec) Recv(ctx context.Context) (*frame.Frame, error) {
 }
 
 func (c *mqttCodec) Send(ctx context.Context, f *frame.Frame) error {
-	f.Src = c.subTopic
-	f.Dst = c.dst
+	f.Src = c.src
+	if !c.responder {
+		f.Dst = c.dst
+	}
 	msg, err := json.Marshal(f)
 	if err != nil {
 		return fmt.Errorf("marshalling JSON payload for mqtt: %w", err)
@@ -188,7 +279,12 @@ func (c *mqttCodec) Send(ctx context.Context, f *frame.Frame) error {
 		Str("topic", topic).
 		Str("payload", string(msg)).
 		Msg("sending rpc via mqtt")
-	token := c.cli.Publish(topic, 1 /* qos */, false /* retained */, msg)
+	var token mqtt.Token
+	if v5 := mqttV5Client(c.cli); v5 != nil {
+		token = v5.PublishWithProperties(c.publication(topic, f, msg))
+	} else {
+		token = c.cli.Publish(topic, 1 /* qos */, false /* retained */, msg)
+	}
 	token.Wait()
 	if err := token.Error(); err != nil {
 		return fmt.Errorf("mqtt publish error: %w", err)
@@ -197,6 +293,28 @@ func (c *mqttCodec) Send(ctx context.Context, f *frame.Frame) error {
 	return nil
 }
 
+// publication builds the MQTT v5 message for a frame. Requests ask for their response on the
+// codec's response topic, correlated by frame ID. Responses go to the topic their request asked
+// for, with its correlation data.
+func (c *mqttCodec) publication(topic string, f *frame.Frame, msg []byte) *mqtt5.Publication {
+	p := &mqtt5.Publication{Topic: topic, QoS: 1, Payload: msg}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r, ok := c.replyTo[f.ID]; ok {
+		delete(c.replyTo, f.ID)
+		p.Topic = r.topic
+		p.CorrelationData = r.correlation
+		return p
+	}
+	if c.requests != nil && f.ID != 0 {
+		correlation := strconv.FormatInt(f.ID, 10)
+		c.requests[correlation] = struct{}{}
+		p.ResponseTopic = c.subTopic + "/rpc"
+		p.CorrelationData = []byte(correlation)
+	}
+	return p
+}
+
 func (c *mqttCodec) SetOptions(opts *codec.Options) error {
 	return errors.New("SetOptions not implemented")
 }
@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jcodybaker/shellyctl/pkg/internal/mqtt5"
+	"github.com/mongoose-os/mos/common/mgrpc/codec"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recvFrame(t *testing.T, c codec.Codec) *frame.Frame {
+	t.Helper()
+	frames := make(chan *frame.Frame, 1)
+	go func() {
+		f, err := c.Recv(context.Background())
+		assert.NoError(t, err)
+		frames <- f
+	}()
+	select {
+	case f := <-frames:
+		return f
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for frame")
+		return nil
+	}
+}
+
+func TestMQTTCodecV5Correlation(t *testing.T) {
+	ctx := context.Background()
+	b := mqtt5.NewTestBroker(t)
+	opts := mqtt.NewClientOptions()
+	opts.Servers = append(opts.Servers, b.URL())
+	opts.ClientID = "shellyctl-test"
+	opts.ProtocolVersion = 5
+
+	td := NewTestDiscoverer(t, WithMQTTConnectOptions(opts))
+	require.NoError(t, td.MQTTConnect(ctx))
+	defer td.MQTTClient().Disconnect(0)
+	v5 := mqttV5Client(td.MQTTClient())
+	require.NotNil(t, v5, "ProtocolVersion 5 should connect with the MQTT v5 client")
+
+	responder, err := NewMQTTResponder(ctx, "device", "device", td.MQTTClient())
+	require.NoError(t, err)
+	defer responder.Close()
+	requester, err := newMQTTCodec(ctx, "device", td.MQTTClient())
+	require.NoError(t, err)
+	defer requester.Close()
+	responseTopic := "device/rpc-resp/shellyctl-test/rpc"
+
+	require.NoError(t, requester.Send(ctx, &frame.Frame{ID: 7, Method: "Shelly.GetStatus"}))
+	req := recvFrame(t, responder)
+	assert.Equal(t, int64(7), req.ID)
+	assert.Equal(t, "Shelly.GetStatus", req.Method)
+
+	// A response to another client's request on the same topic is ignored.
+	stray := v5.PublishWithProperties(&mqtt5.Publication{
+		Topic:           responseTopic,
+		QoS:             1,
+		Payload:         []byte(`{"id":99,"result":{}}`),
+		CorrelationData: []byte("99"),
+	})
+	stray.Wait()
+	require.NoError(t, stray.Error())
+
+	// The responder answers on the response topic with the request's correlation data.
+	require.NoError(t, responder.Send(ctx, &frame.Frame{ID: req.ID, Dst: req.Src, Result: json.RawMessage(`{}`)}))
+	resp := recvFrame(t, requester)
+	assert.Equal(t, int64(7), resp.ID)
+	assert.JSONEq(t, `{}`, string(resp.Result))
+
+	// Devices which don't echo correlation data are matched by topic.
+	plain := v5.Publish(responseTopic, 1, false, []byte(`{"id":8,"result":{}}`))
+	plain.Wait()
+	require.NoError(t, plain.Error())
+	assert.Equal(t, int64(8), recvFrame(t, requester).ID)
+}
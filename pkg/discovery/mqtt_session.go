@@ -0,0 +1,124 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+)
+
+// MQTTConnectionState describes the shared MQTT client's connection to the broker.
+type MQTTConnectionState struct {
+	Connected bool
+	// Connects counts successful connections to the broker, including reconnects.
+	Connects int
+	// ConnectionsLost counts unexpected disconnections from the broker.
+	ConnectionsLost int
+	// Since is the time of the last connect or disconnect.
+	Since time.Time
+}
+
+type mqttSubscription struct {
+	qos     byte
+	handler mqtt.MessageHandler
+}
+
+// mqttSession wraps the shared MQTT client, recording its subscriptions so they can be restored
+// when the client reconnects. The broker forgets the subscriptions of a clean session when the
+// connection is lost, which would otherwise leave codecs, consumers, and presence tracking
+// waiting on topics which no longer deliver messages.
+type mqttSession struct {
+	mqtt.Client
+	now func() time.Time
+
+	lock  sync.Mutex
+	subs  map[string]mqttSubscription
+	state MQTTConnectionState
+}
+
+func newMQTTSession(now func() time.Time) *mqttSession {
+	return &mqttSession{
+		now:  now,
+		subs: make(map[string]mqttSubscription),
+	}
+}
+
+// Subscribe implements mqtt.Client.
+func (s *mqttSession) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	s.lock.Lock()
+	s.subs[topic] = mqttSubscription{qos: qos, handler: callback}
+	s.lock.Unlock()
+	return s.Client.Subscribe(topic, qos, callback)
+}
+
+// SubscribeMultiple implements mqtt.Client.
+func (s *mqttSession) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	s.lock.Lock()
+	for topic, qos := range filters {
+		s.subs[topic] = mqttSubscription{qos: qos, handler: callback}
+	}
+	s.lock.Unlock()
+	return s.Client.SubscribeMultiple(filters, callback)
+}
+
+// Unsubscribe implements mqtt.Client.
+func (s *mqttSession) Unsubscribe(topics ...string) mqtt.Token {
+	s.lock.Lock()
+	for _, topic := range topics {
+		delete(s.subs, topic)
+	}
+	s.lock.Unlock()
+	return s.Client.Unsubscribe(topics...)
+}
+
+// onConnect records the connection and, if it's a reconnect, restores all subscriptions. paho
+// invokes it in its own goroutine, so it may wait on the subscribe tokens.
+func (s *mqttSession) onConnect(ll zerolog.Logger) {
+	s.lock.Lock()
+	s.state.Connected = true
+	s.state.Connects++
+	s.state.Since = s.now()
+	reconnect := s.state.Connects > 1
+	subs := make(map[string]mqttSubscription, len(s.subs))
+	for topic, sub := range s.subs {
+		subs[topic] = sub
+	}
+	s.lock.Unlock()
+	if !reconnect {
+		ll.Debug().Msg("connected to MQTT broker")
+		return
+	}
+	ll.Info().Int("topics", len(subs)).Msg("reconnected to MQTT broker; restoring subscriptions")
+	for topic, sub := range subs {
+		token := s.Client.Subscribe(topic, sub.qos, sub.handler)
+		token.Wait()
+		if err := token.Error(); err != nil {
+			ll.Err(err).Str("topic", topic).Msg("resubscribing to MQTT topic")
+		}
+	}
+}
+
+func (s *mqttSession) onConnectionLost(ll zerolog.Logger, err error) {
+	s.lock.Lock()
+	s.state.Connected = false
+	s.state.ConnectionsLost++
+	s.state.Since = s.now()
+	s.lock.Unlock()
+	ll.Warn().Err(err).Msg("lost connection to MQTT broker; reconnecting")
+}
+
+func (s *mqttSession) connectionState() MQTTConnectionState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state
+}
+
+// MQTTConnectionState returns the state of the connection made by MQTTConnect. ok is false if
+// MQTT isn't configured.
+func (d *Discoverer) MQTTConnectionState() (state MQTTConnectionState, ok bool) {
+	if d.mqttSession == nil {
+		return state, false
+	}
+	return d.mqttSession.connectionState(), true
+}
@@ -0,0 +1,87 @@
+package discovery
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSubscriber records the subscriptions made through an mqttSession. Other mqtt.Client methods
+// panic.
+type testSubscriber struct {
+	mqtt.Client
+	subscribed   []string
+	unsubscribed []string
+}
+
+func (c *testSubscriber) Subscribe(topic string, _ byte, _ mqtt.MessageHandler) mqtt.Token {
+	c.subscribed = append(c.subscribed, topic)
+	return doneToken{}
+}
+
+func (c *testSubscriber) SubscribeMultiple(filters map[string]byte, _ mqtt.MessageHandler) mqtt.Token {
+	for topic := range filters {
+		c.subscribed = append(c.subscribed, topic)
+	}
+	return doneToken{}
+}
+
+func (c *testSubscriber) Unsubscribe(topics ...string) mqtt.Token {
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	return doneToken{}
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                       { return true }
+func (doneToken) WaitTimeout(_ time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+func (doneToken) Error() error { return nil }
+
+func TestMQTTSessionResubscribes(t *testing.T) {
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+	sub := &testSubscriber{}
+	s := newMQTTSession(func() time.Time { return now })
+	s.Client = sub
+	ll := zerolog.Nop()
+
+	s.onConnect(ll)
+	assert.Equal(t, MQTTConnectionState{Connected: true, Connects: 1, Since: now}, s.connectionState())
+
+	s.Subscribe("+/online", 1, nil)
+	s.SubscribeMultiple(map[string]byte{"a/events/rpc": 1, "b/events/rpc": 1}, nil)
+	s.Unsubscribe("a/events/rpc")
+	sub.subscribed = nil
+
+	// Reconnecting restores the subscriptions which are still active.
+	s.onConnect(ll)
+	require.NotEmpty(t, sub.subscribed)
+	sort.Strings(sub.subscribed)
+	assert.Equal(t, []string{"+/online", "b/events/rpc"}, sub.subscribed)
+	assert.Equal(t, []string{"a/events/rpc"}, sub.unsubscribed)
+
+	now = now.Add(time.Minute)
+	s.onConnectionLost(ll, errors.New("EOF"))
+	assert.Equal(t, MQTTConnectionState{Connects: 2, ConnectionsLost: 1, Since: now}, s.connectionState())
+}
+
+func TestMQTTConnectionState(t *testing.T) {
+	td := NewTestDiscoverer(t)
+	_, ok := td.MQTTConnectionState()
+	assert.False(t, ok)
+
+	td.mqttSession = newMQTTSession(time.Now)
+	state, ok := td.MQTTConnectionState()
+	assert.True(t, ok)
+	assert.False(t, state.Connected)
+}
@@ -0,0 +1,228 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jcodybaker/go-shelly"
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// statusTopicLevel separates the topic prefix from the component in the retained
+// `<prefix>/status/<component>` topics devices publish when generic status updates are enabled.
+const statusTopicLevel = "/status/"
+
+// MQTTPrefixTopics returns the topics a device with the given topic prefix publishes
+// notifications on: RPC notification frames on `<prefix>/events/rpc` and component status on
+// `<prefix>/status/<component>`. A prefix of `+` matches every device with a single level prefix.
+func MQTTPrefixTopics(prefix string) []string {
+	return []string{prefix + "/events/rpc", prefix + statusTopicLevel + "+"}
+}
+
+// FollowMQTT subscribes to a device's MQTT notification, status, and presence topics. Devices
+// connected by other transports are asked for their topic prefix with MQTT.GetConfig, and are
+// skipped if MQTT isn't enabled on the device. Topics already matched by an earlier subscription
+// of the same kind aren't subscribed again.
+func (d *Discoverer) FollowMQTT(ctx context.Context, dev *Device) error {
+	if d.mqttClient == nil {
+		return errors.New("not connected to an MQTT broker")
+	}
+	prefix := dev.topicPrefix()
+	if prefix == "" {
+		var err error
+		if prefix, err = dev.resolveMQTTPrefix(ctx); err != nil {
+			return err
+		}
+		if prefix == "" {
+			ll := d.logCtx(ctx, "mqtt")
+			ll.Debug().Str("instance", dev.Instance()).Msg("mqtt is disabled on device; not following")
+			return nil
+		}
+		// The prefix identifies the device's notifications. It doesn't change the device's
+		// transport, which requires an MQTT client.
+		dev.setTopicPrefix(prefix)
+	}
+	for _, t := range append(MQTTPrefixTopics(prefix), prefix+"/online") {
+		if err := d.subscribeMQTTTopic(ctx, t); err != nil {
+			return fmt.Errorf("subscribing to MQTT topic %q: %w", t, err)
+		}
+	}
+	return nil
+}
+
+// resolveMQTTPrefix returns the device's configured MQTT topic prefix, or an empty string if MQTT
+// is disabled. Devices without a custom prefix use their ID.
+func (d *Device) resolveMQTTPrefix(ctx context.Context) (string, error) {
+	c, err := d.Open(ctx)
+	if err != nil {
+		return "", fmt.Errorf("connecting to device to resolve mqtt prefix: %w", err)
+	}
+	defer c.Disconnect(ctx)
+	req := shelly.MQTTGetConfigRequest{}
+	resp, _, err := req.Do(ctx, c, d.AuthCallback(ctx))
+	if err != nil {
+		return "", fmt.Errorf("requesting mqtt config: %w", err)
+	}
+	if resp.Enable == nil || !*resp.Enable {
+		return "", nil
+	}
+	if resp.TopicPrefix != nil && resp.TopicPrefix.String() != "" {
+		return resp.TopicPrefix.String(), nil
+	}
+	return d.ID, nil
+}
+
+// mqttTopicKind identifies how the messages of a subscribed topic filter are handled.
+type mqttTopicKind int
+
+const (
+	mqttTopicRPC mqttTopicKind = iota
+	mqttTopicAnnounce
+	mqttTopicPresence
+	mqttTopicStatus
+)
+
+// topicSubscription is a topic filter subscribed for notifications.
+type topicSubscription struct {
+	filter string
+	kind   mqttTopicKind
+}
+
+// topicKind returns the kind of messages a topic filter is subscribed for: announcements on
+// `shellies/announce`, presence on `<prefix>/online`, component status on
+// `<prefix>/status/<component>`, and RPC frames otherwise.
+func topicKind(filter string) mqttTopicKind {
+	switch {
+	case filter == announceTopic:
+		return mqttTopicAnnounce
+	case strings.HasSuffix(filter, "/online"):
+		return mqttTopicPresence
+	case isStatusTopic(filter):
+		return mqttTopicStatus
+	default:
+		return mqttTopicRPC
+	}
+}
+
+// subscribeMQTTTopic subscribes to a topic filter and routes its messages by kind. Filters covered
+// by an earlier subscription of the same kind are skipped; a filter covered by one of another
+// kind, like `#` subscribed for RPC frames, is still subscribed so its messages are handled.
+func (d *Discoverer) subscribeMQTTTopic(ctx context.Context, filter string) error {
+	kind := topicKind(filter)
+	d.lock.Lock()
+	for _, s := range d.mqttSubscribed {
+		if s.kind == kind && mqttTopicMatch(s.filter, filter) {
+			d.lock.Unlock()
+			return nil
+		}
+	}
+	d.mqttSubscribed = append(d.mqttSubscribed, topicSubscription{filter: filter, kind: kind})
+	d.lock.Unlock()
+
+	var handler mqtt.MessageHandler
+	switch kind {
+	case mqttTopicAnnounce:
+		handler = func(_ mqtt.Client, m mqtt.Message) {
+			d.handleAnnounce(ctx, m.Payload())
+		}
+	case mqttTopicPresence:
+		handler = func(_ mqtt.Client, m mqtt.Message) {
+			d.handlePresence(ctx, m.Topic(), m.Payload())
+		}
+	case mqttTopicStatus:
+		handler = func(_ mqtt.Client, m mqtt.Message) {
+			d.handleStatusTopic(ctx, m.Topic(), m.Payload())
+		}
+	default:
+		c, err := newMQTTConsumer(ctx, filter, d.mqttClient)
+		if err != nil {
+			d.unsubscribed(filter)
+			return err
+		}
+		d.notifications.register(mgrpc.Serve(ctx, c))
+		return nil
+	}
+	token := d.mqttClient.Subscribe(filter, 1, handler)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		d.unsubscribed(filter)
+		return err
+	}
+	return nil
+}
+
+func (d *Discoverer) unsubscribed(filter string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, s := range d.mqttSubscribed {
+		if s.filter == filter {
+			d.mqttSubscribed = append(d.mqttSubscribed[:i], d.mqttSubscribed[i+1:]...)
+			return
+		}
+	}
+}
+
+// handleStatusTopic publishes a message on a `<prefix>/status/<component>` topic as a
+// NotifyStatus of the single component. The notification's src is the device's ID when the
+// prefix belongs to a known device, and the prefix otherwise.
+func (d *Discoverer) handleStatusTopic(ctx context.Context, topic string, payload []byte) {
+	ll := d.logCtx(ctx, "mqtt").With().Str("topic", topic).Logger()
+	i := strings.LastIndex(topic, statusTopicLevel)
+	if i <= 0 {
+		return
+	}
+	prefix, component := topic[:i], topic[i+len(statusTopicLevel):]
+	if component == "" || strings.Contains(component, "/") {
+		return
+	}
+	if len(payload) == 0 {
+		// Clearing a retained message publishes an empty payload.
+		return
+	}
+	var status map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &status); err != nil {
+		ll.Warn().Err(err).Str("payload", string(payload)).Msg("parsing mqtt component status")
+		return
+	}
+	src := prefix
+	if dev := d.DeviceBySrc(prefix); dev != nil && dev.ID != "" {
+		src = dev.ID
+	}
+	params, err := json.Marshal(map[string]json.RawMessage{component: payload})
+	if err != nil {
+		ll.Warn().Err(err).Msg("encoding mqtt component status")
+		return
+	}
+	d.notifications.dispatch(&frame.Frame{
+		Src:    src,
+		Method: "NotifyStatus",
+		Params: params,
+	}, d.now())
+}
+
+// isStatusTopic reports if a topic filter matches `<prefix>/status/<component>` topics.
+func isStatusTopic(filter string) bool {
+	levels := strings.Split(filter, "/")
+	return len(levels) >= 3 && levels[len(levels)-2] == "status"
+}
+
+// mqttTopicMatch reports if an MQTT topic filter matches a topic. Wildcards in the topic are
+// matched literally, so a filter also reports whether it covers another filter.
+func mqttTopicMatch(filter, topic string) bool {
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) || (f != "+" && f != tl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
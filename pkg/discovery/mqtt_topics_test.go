@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jcodybaker/go-shelly"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTTopicMatch(t *testing.T) {
+	tcs := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{filter: "+/events/rpc", topic: "shellyplus1-a8032abe5424/events/rpc", match: true},
+		{filter: "+/events/rpc", topic: "home/garage/events/rpc"},
+		{filter: "+/status/+", topic: "garage/status/switch:0", match: true},
+		{filter: "+/status/+", topic: "garage/status/+", match: true},
+		{filter: "+/status/+", topic: "garage/status"},
+		{filter: "home/#", topic: "home/garage/status/+", match: true},
+		{filter: "home/garage/online", topic: "home/garage/online", match: true},
+		{filter: "home/garage/online", topic: "home/garage/online/extra"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.filter+" "+tc.topic, func(t *testing.T) {
+			assert.Equal(t, tc.match, mqttTopicMatch(tc.filter, tc.topic))
+		})
+	}
+}
+
+func TestHandleStatusTopic(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+	td := NewTestDiscoverer(t, func(d *Discoverer) {
+		d.now = func() time.Time { return now }
+	})
+	dev := td.NewTestDevice(t, true)
+	dev.ID = "shellyplus1-a8032abe5424"
+	dev.mqttPrefix = "home/garage"
+
+	sub := td.SubscribeStatus()
+	defer sub.Unsubscribe()
+
+	td.handleStatusTopic(ctx, "home/garage/status/switch:0", []byte(`{"id":0,"output":true}`))
+	sn := <-sub.C()
+	assert.Equal(t, "shellyplus1-a8032abe5424", sn.Frame.Src)
+	assert.Equal(t, "NotifyStatus", sn.Frame.Method)
+	assert.JSONEq(t, `{"switch:0":{"id":0,"output":true}}`, string(sn.Frame.Params))
+	assert.Equal(t, now, sn.ReceivedAt)
+
+	// Unknown prefixes are reported as the src.
+	td.handleStatusTopic(ctx, "shellyplugus-0123456789ab/status/sys", []byte(`{"uptime":10}`))
+	sn = <-sub.C()
+	assert.Equal(t, "shellyplugus-0123456789ab", sn.Frame.Src)
+
+	// Cleared retained messages and invalid payloads are ignored.
+	td.handleStatusTopic(ctx, "garage/status/switch:0", nil)
+	td.handleStatusTopic(ctx, "garage/status/switch:0", []byte(`true`))
+	select {
+	case sn := <-sub.C():
+		t.Fatalf("unexpected status notification %s", sn.Frame.Params)
+	default:
+	}
+}
+
+func TestResolveMQTTPrefix(t *testing.T) {
+	ctx := context.Background()
+	td := NewTestDiscoverer(t)
+	tcs := []struct {
+		name   string
+		config string
+		prefix string
+	}{
+		{name: "custom", config: `{"enabled":true,"topic_prefix":"home/garage"}`, prefix: "home/garage"},
+		{name: "default", config: `{"enabled":true,"topic_prefix":null}`, prefix: "shellyplus1-a8032abe5424"},
+		{name: "disabled", config: `{"enabled":false,"topic_prefix":"home/garage"}`},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dev := td.NewTestDevice(t, false)
+			dev.ID = "shellyplus1-a8032abe5424"
+			dev.AddMockResponse("MQTT.GetConfig", nil, json.RawMessage(tc.config))
+			prefix, err := dev.resolveMQTTPrefix(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, tc.prefix, prefix)
+		})
+	}
+}
+
+func TestHandleAnnounce(t *testing.T) {
+	ctx := context.Background()
+	td := NewTestDiscoverer(t)
+
+	// A search and AwaitMQTTAnnounce may run concurrently, and each receives every announcement.
+	search := td.announces.subscribe()
+	defer search.Unsubscribe()
+	await := td.announces.subscribe()
+	defer await.Unsubscribe()
+
+	td.handleAnnounce(ctx, []byte(`{"id":"shellyplus1-a8032abe5424","gen":2}`))
+	td.handleAnnounce(ctx, []byte(`not json`))
+	for _, sub := range []*Subscription[*shelly.ShellyGetDeviceInfoResponse]{search, await} {
+		deviceInfo := <-sub.C()
+		assert.Equal(t, "shellyplus1-a8032abe5424", deviceInfo.ID)
+		select {
+		case deviceInfo := <-sub.C():
+			t.Fatalf("unexpected announcement %q", deviceInfo.ID)
+		default:
+		}
+	}
+}
+
+// testConsumerClient records subscriptions, and has the options newMQTTConsumer reads.
+type testConsumerClient struct {
+	testSubscriber
+}
+
+func (c *testConsumerClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://localhost:1883")).OptionsReader()
+}
+
+func TestSubscribeMQTTTopicKinds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := NewTestDiscoverer(t)
+	c := &testConsumerClient{}
+	td.mqttClient = c
+
+	// A user's RPC consumer for every topic doesn't handle status or presence messages, so those
+	// are still subscribed.
+	require.NoError(t, td.subscribeMQTTTopic(ctx, "#"))
+	dev := &Device{}
+	dev.setTopicPrefix("garage")
+	require.NoError(t, td.FollowMQTT(ctx, dev))
+	assert.Equal(t, []string{"#", "garage/status/+", "garage/online"}, c.subscribed)
+
+	// Filters covered by a subscription of the same kind are skipped.
+	require.NoError(t, td.subscribeMQTTTopic(ctx, "+/status/+"))
+	require.NoError(t, td.FollowMQTT(ctx, dev))
+	assert.Equal(t, []string{"#", "garage/status/+", "garage/online", "+/status/+"}, c.subscribed)
+}
@@ -2,7 +2,7 @@ package discovery
 
 import (
 	"encoding/json"
-	"sync"
+	"time"
 
 	"github.com/jcodybaker/go-shelly"
 	"github.com/mongoose-os/mos/common/mgrpc"
@@ -11,11 +11,11 @@ import (
 )
 
 type notifications struct {
-	statusChan     chan StatusNotification
-	fullStatusChan chan StatusNotification
-	eventChan      chan EventNotification
-
-	lock sync.Mutex
+	status     bus[StatusNotification]
+	fullStatus bus[StatusNotification]
+	events     bus[EventNotification]
+	// presence is shared with devices so MQTT watches can follow their device's presence.
+	presence bus[PresenceNotification]
 }
 
 func (n *notifications) register(s mgrpc.MgRPC) {
@@ -29,114 +29,113 @@ func (n *notifications) register(s mgrpc.MgRPC) {
 type StatusNotification struct {
 	Status *shelly.NotifyStatus
 	Frame  *frame.Frame
+	// ReceivedAt is the local time the notification was received.
+	ReceivedAt time.Time
 }
 
+// EventNotification carries an event notification and metadata.
 type EventNotification struct {
 	Event *shelly.NotifyEvent
 	Frame *frame.Frame
+	// ReceivedAt is the local time the notification was received.
+	ReceivedAt time.Time
+}
+
+// SubscribeFullStatus subscribes to NotifyFullStatus messages received after the call. Each
+// subscriber receives every message, subject to its buffer and Policy.
+func (d *Discoverer) SubscribeFullStatus(opts ...SubscribeOption) *Subscription[StatusNotification] {
+	return d.fullStatus.subscribe(opts...)
+}
+
+// SubscribeStatus subscribes to NotifyStatus messages received after the call. Each subscriber
+// receives every message, subject to its buffer and Policy.
+func (d *Discoverer) SubscribeStatus(opts ...SubscribeOption) *Subscription[StatusNotification] {
+	return d.status.subscribe(opts...)
+}
+
+// SubscribeEvents subscribes to NotifyEvent messages received after the call. Each subscriber
+// receives every message, subject to its buffer and Policy.
+func (d *Discoverer) SubscribeEvents(opts ...SubscribeOption) *Subscription[EventNotification] {
+	return d.events.subscribe(opts...)
 }
 
 // GetFullStatusNotifications returns a channel which provides NotifyFullStatus messages.
 // Messages received before the first invocation of GetFullStatusNotifications will be discarded.
-// Consumers MUST be responsive or ther MQTT channel may drop messages.
+// Each call creates a new subscription which is never unsubscribed; prefer SubscribeFullStatus.
 func (d *Discoverer) GetFullStatusNotifications(buffer int) <-chan StatusNotification {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	if d.fullStatusChan == nil {
-		d.fullStatusChan = make(chan StatusNotification, buffer)
-	}
-	return d.fullStatusChan
+	return d.SubscribeFullStatus(WithBuffer(buffer)).C()
 }
 
 // GetStatusNotifications returns a channel which provides NotifyStatus messages.
 // Messages received before the first invocation of GetStatusNotifications will be discarded.
-// Consumers MUST be responsive or ther MQTT channel may drop messages.
+// Each call creates a new subscription which is never unsubscribed; prefer SubscribeStatus.
 func (d *Discoverer) GetStatusNotifications(buffer int) <-chan StatusNotification {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	if d.statusChan == nil {
-		d.statusChan = make(chan StatusNotification, buffer)
-	}
-	return d.statusChan
+	return d.SubscribeStatus(WithBuffer(buffer)).C()
 }
 
 // GetEventNotifications returns a channel which provides events.
 // Messages received before the first invocation of GetEventNotifications will be discarded.
-// Consumers MUST be responsive or ther MQTT channel may drop messages.
+// Each call creates a new subscription which is never unsubscribed; prefer SubscribeEvents.
 func (d *Discoverer) GetEventNotifications(buffer int) <-chan EventNotification {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	if d.eventChan == nil {
-		d.eventChan = make(chan EventNotification, buffer)
-	}
-	return d.eventChan
+	return d.SubscribeEvents(WithBuffer(buffer)).C()
 }
 
 func (n *notifications) statusNotificationHandler(mr mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
-	n.lock.Lock()
-	defer n.lock.Unlock()
-	if n.statusChan == nil {
-		return nil
-	}
-	s := &shelly.NotifyStatus{}
-	if err := json.Unmarshal(f.Params, &s); err != nil {
-		log.Err(err).
-			Str("src", f.Src).
-			Str("dst", f.Dst).
-			Int64("id", f.ID).
-			Str("method", f.Method).
-			Str("payload", string(f.Params)).
-			Msg("unmarshalling NotifyStatus frame")
-	}
-	n.statusChan <- StatusNotification{
-		Status: s,
-		Frame:  f,
-	}
+	n.dispatch(f, time.Now())
 	return nil
 }
 
 func (n *notifications) fullStatusNotificationHandler(mr mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
-	n.lock.Lock()
-	defer n.lock.Unlock()
-	if n.fullStatusChan == nil {
-		return nil
-	}
-	s := &shelly.NotifyStatus{}
-	if err := json.Unmarshal(f.Params, &s); err != nil {
-		log.Err(err).
-			Str("src", f.Src).
-			Str("dst", f.Dst).
-			Int64("id", f.ID).
-			Str("method", f.Method).
-			Str("payload", string(f.Params)).
-			Msg("unmarshalling NotifyFullStatus frame")
-	}
-	n.fullStatusChan <- StatusNotification{
-		Status: s,
-		Frame:  f,
-	}
+	n.dispatch(f, time.Now())
 	return nil
 }
 
 func (n *notifications) eventNotificationHandler(mr mgrpc.MgRPC, f *frame.Frame) *frame.Frame {
-	n.lock.Lock()
-	defer n.lock.Unlock()
-	if n.eventChan == nil {
-		return nil
-	}
-	e := &shelly.NotifyEvent{}
-	if err := json.Unmarshal(f.Params, &e); err != nil {
-		log.Err(err).
-			Str("src", f.Src).
-			Str("dst", f.Dst).
-			Int64("id", f.ID).
-			Str("method", f.Method).
-			Str("payload", string(f.Params)).
-			Msg("unmarshalling NotifyFullStatus frame")
-	}
-	n.eventChan <- EventNotification{
-		Event: e,
-		Frame: f,
-	}
+	n.dispatch(f, time.Now())
 	return nil
 }
+
+// dispatch publishes a notification frame to subscribers of its method. It returns false if the
+// frame isn't a notification.
+func (n *notifications) dispatch(f *frame.Frame, receivedAt time.Time) bool {
+	switch f.Method {
+	case "NotifyStatus", "NotifyFullStatus":
+		s := &shelly.NotifyStatus{}
+		if err := json.Unmarshal(f.Params, &s); err != nil {
+			logFrameErr(err, f)
+		}
+		sn := StatusNotification{
+			Status:     s,
+			Frame:      f,
+			ReceivedAt: receivedAt,
+		}
+		if f.Method == "NotifyFullStatus" {
+			n.fullStatus.publish(sn)
+		} else {
+			n.status.publish(sn)
+		}
+	case "NotifyEvent":
+		e := &shelly.NotifyEvent{}
+		if err := json.Unmarshal(f.Params, &e); err != nil {
+			logFrameErr(err, f)
+		}
+		n.events.publish(EventNotification{
+			Event:      e,
+			Frame:      f,
+			ReceivedAt: receivedAt,
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+func logFrameErr(err error, f *frame.Frame) {
+	log.Err(err).
+		Str("src", f.Src).
+		Str("dst", f.Dst).
+		Int64("id", f.ID).
+		Str("method", f.Method).
+		Str("payload", string(f.Params)).
+		Msgf("unmarshalling %s frame", f.Method)
+}
@@ -30,6 +30,7 @@ type options struct {
 	mqttClient        mqtt.Client
 	mqttSearchEnabled bool
 	mqttTopicSubs     []string
+	mqttFollow        bool
 
 	searchStrictTimeout bool
 	searchTimeout       time.Duration
@@ -142,7 +143,8 @@ func WithSearchStrictTimeout(strictTimeoutMode bool) DiscovererOption {
 	}
 }
 
-// WithMQTTConnectOptions sets connection parameters for MQTT.
+// WithMQTTConnectOptions sets connection parameters for MQTT. A ProtocolVersion of 5 connects with
+// MQTT v5, which matches RPC responses by response-topic and correlation-data.
 func WithMQTTConnectOptions(c *mqtt.ClientOptions) DiscovererOption {
 	return func(d *Discoverer) {
 		d.mqttClientOptions = c
@@ -156,11 +158,20 @@ func WithMQTTSearchEnabled(enable bool) DiscovererOption {
 	}
 }
 
-// WithMQTTTopicSubscriptions sets a list of topics to subscribe to for events.
+// WithMQTTTopicSubscriptions sets a list of topics to subscribe to for events. Topics of the
+// form `<prefix>/status/<component>` are read as retained component status, other topics as RPC
+// notification frames.
 func WithMQTTTopicSubscriptions(topics []string) DiscovererOption {
 	return func(d *Discoverer) {
 		d.mqttTopicSubs = topics
 	}
 }
 
+// WithMQTTFollow subscribes to the MQTT topics of devices added by any means, see FollowMQTT.
+func WithMQTTFollow(follow bool) DiscovererOption {
+	return func(d *Discoverer) {
+		d.mqttFollow = follow
+	}
+}
+
 type DeviceOption func(*Device)
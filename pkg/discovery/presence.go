@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// presenceTopic matches the `<prefix>/online` topic which devices publish `true` to when they
+// connect, and which their last-will sets to `false` when they disconnect.
+const presenceTopic = "+/online"
+
+// Presence describes the connection state an MQTT device last reported to the broker.
+type Presence struct {
+	// Prefix is the device's MQTT topic prefix, which defaults to its ID.
+	Prefix string
+	Online bool
+	// Since is the local time the state was received.
+	Since time.Time
+}
+
+// PresenceNotification carries a change in an MQTT device's presence.
+type PresenceNotification struct {
+	Presence
+	// Device is the known device with the prefix, or nil if the device isn't known.
+	Device *Device
+}
+
+// SubscribePresence subscribes to changes in MQTT device presence received after the call.
+func (d *Discoverer) SubscribePresence(opts ...SubscribeOption) *Subscription[PresenceNotification] {
+	return d.notifications.presence.subscribe(opts...)
+}
+
+// Presence returns the last reported presence of each MQTT device, ordered by prefix.
+func (d *Discoverer) Presence() []Presence {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	out := make([]Presence, 0, len(d.presence))
+	for _, p := range d.presence {
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Prefix < out[j].Prefix
+	})
+	return out
+}
+
+// handlePresence records a message on a device's online topic. Devices which come online are
+// added if MQTT search is enabled, and devices found by MQTT search are evicted when they go
+// offline. Devices added explicitly are kept while offline.
+func (d *Discoverer) handlePresence(ctx context.Context, topic string, payload []byte) {
+	ll := d.logCtx(ctx, "mqtt").With().Str("topic", topic).Logger()
+	prefix, ok := strings.CutSuffix(topic, "/online")
+	if !ok || prefix == "" {
+		return
+	}
+	var online bool
+	switch strings.TrimSpace(string(payload)) {
+	case "true":
+		online = true
+	case "false":
+	default:
+		ll.Warn().Str("payload", string(payload)).Msg("unexpected device presence payload")
+		return
+	}
+	p := Presence{Prefix: prefix, Online: online, Since: d.now()}
+	dev := d.DeviceBySrc(prefix)
+
+	d.lock.Lock()
+	if last, ok := d.presence[prefix]; ok && last.Online == online {
+		d.lock.Unlock()
+		return
+	}
+	d.presence[prefix] = p
+	evict := !online && dev != nil && dev.source == sourceMQTT
+	if evict {
+		delete(d.knownDevices, strings.ToUpper(dev.MACAddr))
+	}
+	d.lock.Unlock()
+
+	ll = ll.With().Str("prefix", prefix).Bool("online", online).Logger()
+	ll.Info().Msg("device presence changed")
+	if evict {
+		ll.Info().Msg("evicted offline device")
+	}
+	d.notifications.presence.publish(PresenceNotification{Presence: p, Device: dev})
+
+	if online && dev == nil && d.mqttSearchEnabled {
+		// Resolving the device makes an RPC over MQTT, which can't complete until this message
+		// handler returns.
+		go func() {
+			if _, err := d.AddMQTTDevice(ctx, prefix, sourceIsMQTT); err != nil {
+				ll.Warn().Err(err).Msg("adding online mqtt device")
+			}
+		}()
+	}
+}
@@ -0,0 +1,61 @@
+package discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlePresence(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+	td := NewTestDiscoverer(t, func(d *Discoverer) {
+		d.now = func() time.Time { return now }
+	})
+	searched := td.NewTestDevice(t, true)
+	searched.mqttPrefix = "shellyplus1-a8032abe5424"
+	searched.source = sourceMQTT
+	manual := td.NewTestDevice(t, true)
+	manual.mqttPrefix = "garage"
+	manual.source = sourceManual
+
+	sub := td.SubscribePresence()
+	defer sub.Unsubscribe()
+
+	td.handlePresence(ctx, "shellyplus1-a8032abe5424/online", []byte("true"))
+	td.handlePresence(ctx, "garage/online", []byte("true"))
+	assert.Equal(t, []Presence{
+		{Prefix: "garage", Online: true, Since: now},
+		{Prefix: "shellyplus1-a8032abe5424", Online: true, Since: now},
+	}, td.Presence())
+	pn := <-sub.C()
+	assert.True(t, pn.Online)
+	assert.Same(t, searched.Device, pn.Device)
+	<-sub.C()
+
+	// Repeated states aren't notified.
+	td.handlePresence(ctx, "garage/online", []byte("true"))
+	td.handlePresence(ctx, "garage/online", []byte("bogus"))
+	td.handlePresence(ctx, "garage/status", []byte("false"))
+
+	now = now.Add(time.Minute)
+	td.handlePresence(ctx, "shellyplus1-a8032abe5424/online", []byte("false"))
+	td.handlePresence(ctx, "garage/online", []byte("false"))
+	pn = <-sub.C()
+	assert.Equal(t, Presence{Prefix: "shellyplus1-a8032abe5424", Since: now}, pn.Presence)
+	pn = <-sub.C()
+	assert.Equal(t, Presence{Prefix: "garage", Since: now}, pn.Presence)
+	select {
+	case pn := <-sub.C():
+		t.Fatalf("unexpected presence notification %+v", pn)
+	default:
+	}
+
+	// Devices found by MQTT search are evicted when they go offline, but explicitly added devices
+	// are kept.
+	require.Len(t, td.AllDevices(), 1)
+	assert.Same(t, manual.Device, td.AllDevices()[0])
+}
@@ -0,0 +1,138 @@
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+// maxRecordSize limits the size of a single recorded frame. Full statuses of large devices can
+// exceed bufio.Scanner's default limit.
+const maxRecordSize = 4 << 20
+
+// RecordedFrame is a single line of a notification recording.
+type RecordedFrame struct {
+	// ReceivedAt is the local time the frame was received.
+	ReceivedAt time.Time    `json:"received_at"`
+	Frame      *frame.Frame `json:"frame"`
+}
+
+// Recorder writes notification frames as newline delimited JSON, which can be fed back through
+// the Discoverer with Replay.
+type Recorder struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+// NewRecorder creates a Recorder which writes to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Record writes a frame and the time it was received. Credentials are omitted from the recording.
+func (r *Recorder) Record(receivedAt time.Time, f *frame.Frame) error {
+	fc := *f
+	fc.Key = ""
+	fc.Auth = nil
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.enc.Encode(RecordedFrame{ReceivedAt: receivedAt, Frame: &fc}); err != nil {
+		return fmt.Errorf("recording frame: %w", err)
+	}
+	return nil
+}
+
+type replayOptions struct {
+	speed        float64
+	originalTime bool
+}
+
+// ReplayOption provides optional parameters for Replay.
+type ReplayOption func(*replayOptions)
+
+// WithReplaySpeed scales the delay between replayed frames. A speed of 2 replays twice as fast as
+// the frames were recorded, and 0 replays frames as fast as they can be consumed.
+func WithReplaySpeed(speed float64) ReplayOption {
+	return func(o *replayOptions) {
+		o.speed = speed
+	}
+}
+
+// WithReplayOriginalTime reports the recorded receive times on replayed notifications, rather
+// than the time they were replayed.
+func WithReplayOriginalTime() ReplayOption {
+	return func(o *replayOptions) {
+		o.originalTime = true
+	}
+}
+
+// Replay reads a recording written by a Recorder and publishes its notifications to subscribers,
+// as if they were received from devices. Frames are replayed with their recorded spacing, adjusted
+// by WithReplaySpeed. Replay returns when the recording is exhausted or ctx is done.
+func (d *Discoverer) Replay(ctx context.Context, r io.Reader, opts ...ReplayOption) error {
+	o := replayOptions{speed: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.speed < 0 {
+		return errors.New("replay speed must not be negative")
+	}
+	ll := d.logCtx(ctx, "replay")
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxRecordSize)
+	var first time.Time
+	start := d.now()
+	var line, replayed int
+	for s.Scan() {
+		line++
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var rec RecordedFrame
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return fmt.Errorf("decoding recording line %d: %w", line, err)
+		}
+		if rec.Frame == nil {
+			return fmt.Errorf("decoding recording line %d: missing frame", line)
+		}
+		if first.IsZero() {
+			first = rec.ReceivedAt
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if o.speed > 0 {
+			due := start.Add(time.Duration(float64(rec.ReceivedAt.Sub(first)) / o.speed))
+			if wait := due.Sub(d.now()); wait > 0 {
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					return ctx.Err()
+				case <-t.C:
+				}
+			}
+		}
+		receivedAt := d.now()
+		if o.originalTime {
+			receivedAt = rec.ReceivedAt
+		}
+		if !d.notifications.dispatch(rec.Frame, receivedAt) {
+			ll.Debug().Int("line", line).Str("method", rec.Frame.Method).Msg("skipping non-notification frame")
+			continue
+		}
+		replayed++
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("reading recording: %w", err)
+	}
+	ll.Info().Int("frames", replayed).Msg("finished replaying notifications")
+	return nil
+}
@@ -0,0 +1,72 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordReplay(t *testing.T) {
+	t0 := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+	var b bytes.Buffer
+	r := NewRecorder(&b)
+	require.NoError(t, r.Record(t0, &frame.Frame{
+		Src:    "shellyplus1pm-a8032abe5424",
+		Method: "NotifyFullStatus",
+		Key:    "secret",
+		Params: json.RawMessage(`{"ts": 1704456000, "switch:0": {"id": 0, "apower": 10}}`),
+	}))
+	require.NoError(t, r.Record(t0.Add(time.Second), &frame.Frame{
+		Src:    "shellyplus1pm-a8032abe5424",
+		Method: "NotifyStatus",
+		Params: json.RawMessage(`{"ts": 1704456001, "switch:0": {"id": 0, "apower": 20}}`),
+	}))
+	require.NoError(t, r.Record(t0.Add(2*time.Second), &frame.Frame{
+		Src:    "shellyplusi4-c4d8d5567890",
+		Method: "NotifyEvent",
+		Params: json.RawMessage(`{"ts": 1704456002, "events": [{"component": "input:0", "event": "single_push"}]}`),
+	}))
+	assert.NotContains(t, b.String(), "secret")
+
+	td := NewTestDiscoverer(t)
+	fullStatus := td.SubscribeFullStatus()
+	defer fullStatus.Unsubscribe()
+	status := td.SubscribeStatus()
+	defer status.Unsubscribe()
+	events := td.SubscribeEvents()
+	defer events.Unsubscribe()
+
+	recording := b.String()
+	start := time.Now()
+	require.NoError(t, td.Replay(context.Background(), strings.NewReader(recording), WithReplaySpeed(100)))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond, "frames are spaced by their recorded times")
+
+	fsn := <-fullStatus.C()
+	assert.Equal(t, "shellyplus1pm-a8032abe5424", fsn.Frame.Src)
+	assert.Equal(t, float64(1704456000), fsn.Status.TS)
+	assert.WithinDuration(t, time.Now(), fsn.ReceivedAt, time.Minute)
+	sn := <-status.C()
+	assert.JSONEq(t, `{"ts": 1704456001, "switch:0": {"id": 0, "apower": 20}}`, string(sn.Frame.Params))
+	en := <-events.C()
+	require.Len(t, en.Event.Events, 1)
+	assert.Equal(t, "single_push", en.Event.Events[0].Event)
+
+	require.NoError(t, td.Replay(context.Background(), strings.NewReader(recording), WithReplaySpeed(0), WithReplayOriginalTime()))
+	assert.Equal(t, t0, (<-fullStatus.C()).ReceivedAt)
+	assert.Equal(t, t0.Add(time.Second), (<-status.C()).ReceivedAt)
+	assert.Equal(t, t0.Add(2*time.Second), (<-events.C()).ReceivedAt)
+
+	err := td.Replay(context.Background(), strings.NewReader(recording+"{bogus\n"), WithReplaySpeed(0))
+	assert.ErrorContains(t, err, "decoding recording line 4")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, td.Replay(ctx, strings.NewReader(recording)), context.Canceled)
+}
@@ -3,6 +3,7 @@ package discovery
 type discoverySource string
 
 const (
+	sourceBLE    discoverySource = "ble"
 	sourceMDNS   discoverySource = "mdns"
 	sourceManual discoverySource = "manual"
 	sourceMQTT   discoverySource = "mqtt"
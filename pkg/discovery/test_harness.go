@@ -8,9 +8,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/mdns"
 	"github.com/jcodybaker/go-shelly"
@@ -43,6 +45,24 @@ func (td *TestDiscoverer) SetMDNSQueryFunc(q func(context.Context, *mdns.QueryPa
 	td.mdnsQueryFunc = q
 }
 
+// SetPresence simulates a device publishing to its `<prefix>/online` MQTT topic at t.
+func (td *TestDiscoverer) SetPresence(ctx context.Context, prefix string, online bool, t time.Time) {
+	now := td.now
+	td.now = func() time.Time { return t }
+	defer func() { td.now = now }()
+	td.handlePresence(ctx, prefix+"/online", []byte(strconv.FormatBool(online)))
+}
+
+// SetMQTTConnectionState simulates the state of a connection to the MQTT broker.
+func (td *TestDiscoverer) SetMQTTConnectionState(state MQTTConnectionState) {
+	if td.mqttSession == nil {
+		td.mqttSession = newMQTTSession(td.now)
+	}
+	td.mqttSession.lock.Lock()
+	defer td.mqttSession.lock.Unlock()
+	td.mqttSession.state = state
+}
+
 // TestDevice wraps Device with functionality for mocking a Device.
 type TestDevice struct {
 	s *httptest.Server
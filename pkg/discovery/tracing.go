@@ -0,0 +1,127 @@
+package discovery
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TracerName is the instrumentation scope of discovery and RPC spans.
+	TracerName = "github.com/jcodybaker/shellyctl/pkg/discovery"
+
+	transportHTTP = "http"
+	transportWS   = "ws"
+	transportMQTT = "mqtt"
+	transportBLE  = "ble"
+)
+
+// Span attribute keys.
+const (
+	attrRPCSystem       = attribute.Key("rpc.system")
+	attrRPCMethod       = attribute.Key("rpc.method")
+	attrRPCStatusCode   = attribute.Key("rpc.status_code")
+	attrDeviceMAC       = attribute.Key("shelly.device.mac")
+	attrDeviceInstance  = attribute.Key("shelly.device.instance")
+	attrDeviceName      = attribute.Key("shelly.device.name")
+	attrTransport       = attribute.Key("shelly.transport")
+	attrAuthRetries     = attribute.Key("shelly.auth_retries")
+	attrDiscoverySource = attribute.Key("shelly.discovery.source")
+	attrDevicesFound    = attribute.Key("shelly.discovery.devices_found")
+)
+
+// tracer uses the global TracerProvider, which is a no-op until the caller installs one with
+// otel.SetTracerProvider.
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// startSpan starts a discovery span and returns a function which ends it, recording err if
+// it's non-nil.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	ctx, span := tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (d *Device) spanAttributes() []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attrDeviceInstance.String(d.Instance()),
+	}
+	if d.MACAddr != "" {
+		attrs = append(attrs, attrDeviceMAC.String(d.MACAddr))
+	}
+	if d.Name != "" {
+		attrs = append(attrs, attrDeviceName.String(d.Name))
+	}
+	return attrs
+}
+
+// tracedRPC wraps an rpc channel to record a span for each call.
+type tracedRPC struct {
+	mgrpc.MgRPC
+	dev       *Device
+	transport string
+
+	// authRetries counts invocations of credential callbacks, including those made by the HTTP
+	// codec which aren't visible to Call.
+	authRetries atomic.Int64
+}
+
+func newTracedRPC(dev *Device, transport string) *tracedRPC {
+	return &tracedRPC{dev: dev, transport: transport}
+}
+
+// countAuth wraps a credential callback so its invocations are counted as auth retries.
+func (t *tracedRPC) countAuth(cb mgrpc.GetCredsCallback) mgrpc.GetCredsCallback {
+	if cb == nil {
+		return nil
+	}
+	return func() (string, string, error) {
+		t.authRetries.Add(1)
+		return cb()
+	}
+}
+
+// Call implements mgrpc.MgRPC.
+func (t *tracedRPC) Call(
+	ctx context.Context, dst string, cmd *frame.Command, getCreds mgrpc.GetCredsCallback,
+) (*frame.Response, error) {
+	attrs := append(t.dev.spanAttributes(),
+		attrRPCSystem.String("shelly"),
+		attrRPCMethod.String(cmd.Cmd),
+		attrTransport.String(t.transport),
+	)
+	ctx, span := tracer().Start(ctx, cmd.Cmd,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+	// Concurrent calls on one channel may count each other's retries. That's rare enough in
+	// practice to accept rather than threading state through the codec.
+	before := t.authRetries.Load()
+	resp, err := t.MgRPC.Call(ctx, dst, cmd, t.countAuth(getCreds))
+	span.SetAttributes(attrAuthRetries.Int64(t.authRetries.Load() - before))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return resp, err
+	}
+	if resp != nil {
+		span.SetAttributes(attrRPCStatusCode.Int(resp.Status))
+		if resp.Status != 0 {
+			span.SetStatus(codes.Error, resp.StatusMsg)
+		}
+	}
+	return resp, nil
+}
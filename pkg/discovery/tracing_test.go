@@ -0,0 +1,101 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/mdns"
+	"github.com/jcodybaker/go-shelly"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func testSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return sr
+}
+
+func spanAttrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	out := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		out[kv.Key] = kv.Value
+	}
+	return out
+}
+
+func TestTraceRPC(t *testing.T) {
+	sr := testSpanRecorder(t)
+	ctx := context.Background()
+	td := NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, false)
+	d1.AddMockResponse("Shelly.GetDeviceInfo", nil, json.RawMessage(`{
+		"id": "shellypro3-`+d1.MACAddr+`",
+		"mac": "`+d1.MACAddr+`",
+		"model": "SPSW-003XE16EU",
+		"gen": 2,
+		"app": "Pro3"
+	}`))
+	d1.AddMockErrorResponse("Shelly.GetStatus", nil, -103, "invalid argument")
+
+	dev, err := td.AddDeviceByAddress(ctx, d1.Instance())
+	require.NoError(t, err)
+
+	c, err := dev.Open(ctx)
+	require.NoError(t, err)
+	defer c.Disconnect(ctx)
+	_, _, err = (&shelly.ShellyGetStatusRequest{}).Do(ctx, c, dev.AuthCallback(ctx))
+	require.Error(t, err)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 3)
+
+	info, resolve, status := spans[0], spans[1], spans[2]
+	assert.Equal(t, "Shelly.GetDeviceInfo", info.Name())
+	assert.Equal(t, "discovery.resolveSpecs", resolve.Name())
+	assert.Equal(t, resolve.SpanContext().SpanID(), info.Parent().SpanID())
+	assert.Equal(t, d1.MACAddr, spanAttrs(resolve)[attrDeviceMAC].AsString())
+
+	attrs := spanAttrs(info)
+	assert.Equal(t, "Shelly.GetDeviceInfo", attrs[attrRPCMethod].AsString())
+	assert.Equal(t, transportHTTP, attrs[attrTransport].AsString())
+	assert.Equal(t, d1.Instance(), attrs[attrDeviceInstance].AsString())
+	assert.Equal(t, int64(0), attrs[attrRPCStatusCode].AsInt64())
+	assert.Equal(t, int64(0), attrs[attrAuthRetries].AsInt64())
+	assert.Equal(t, codes.Unset, info.Status().Code)
+
+	attrs = spanAttrs(status)
+	assert.Equal(t, "Shelly.GetStatus", status.Name())
+	assert.Equal(t, d1.MACAddr, attrs[attrDeviceMAC].AsString())
+	assert.Equal(t, int64(-103), attrs[attrRPCStatusCode].AsInt64())
+	assert.Equal(t, codes.Error, status.Status().Code)
+}
+
+func TestTraceSearch(t *testing.T) {
+	sr := testSpanRecorder(t)
+	td := NewTestDiscoverer(t, WithMDNSSearchEnabled(true))
+	td.SetMDNSQueryFunc(func(context.Context, *mdns.QueryParam) error { return nil })
+
+	devs, err := td.Search(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, devs)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 2)
+	query, search := spans[0], spans[1]
+	assert.Equal(t, "discovery.mdns.query", query.Name())
+	assert.Equal(t, "discovery.search", search.Name())
+	assert.Equal(t, search.SpanContext().SpanID(), query.Parent().SpanID())
+	attrs := spanAttrs(query)
+	assert.Equal(t, "mdns", attrs[attrDiscoverySource].AsString())
+	assert.Equal(t, int64(0), attrs[attrDevicesFound].AsInt64())
+}
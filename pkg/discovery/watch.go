@@ -0,0 +1,214 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/mongoose-os/mos/common/mgrpc"
+)
+
+const (
+	// DefaultWatchMaxBackoff is the default upper bound on the delay between attempts to
+	// resubscribe to a device's notifications.
+	DefaultWatchMaxBackoff = time.Minute
+
+	watchMinBackoff = time.Second
+	// watchCheckInterval is how often the connection is checked, and BLE devices are polled for
+	// queued notifications.
+	watchCheckInterval = time.Second
+	// watchPingInterval is how often a request is sent to detect connections which have silently
+	// dropped. MQTT devices aren't pinged.
+	watchPingInterval = 30 * time.Second
+	watchPingTimeout  = 10 * time.Second
+)
+
+// WatchOption configures Watch.
+type WatchOption func(*watchOptions)
+
+type watchOptions struct {
+	retryInitial bool
+}
+
+// WithWatchRetryInitial retries the first subscription with backoff if it fails. By default, Watch
+// returns the error, so callers can stop on devices which were never reachable.
+func WithWatchRetryInitial(retry bool) WatchOption {
+	return func(o *watchOptions) {
+		o.retryInitial = retry
+	}
+}
+
+// Watch subscribes to the device's notifications until ctx is done. Notifications are delivered
+// to the Discoverer's notification channels. Devices don't send notifications over HTTP, so HTTP
+// devices are upgraded to a websocket on the same host. Dropped connections are reopened with
+// exponential backoff up to maxBackoff. An error is only returned if the first subscription
+// fails, unless WithWatchRetryInitial is set.
+func (d *Device) Watch(ctx context.Context, maxBackoff time.Duration, opts ...WatchOption) error {
+	var o watchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ll := d.LogCtx(ctx)
+	ctx = ll.WithContext(ctx)
+	everSubscribed := false
+	failures := 0
+	for {
+		subscribed, err := d.watchOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if subscribed {
+			everSubscribed = true
+			failures = 0
+		} else if !everSubscribed && !o.retryInitial {
+			return err
+		}
+		failures++
+		delay := watchBackoff(failures, maxBackoff)
+		ll.Warn().Err(err).Dur("retry_in", delay).Msg("notification subscription dropped")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// watchOnce opens a connection and holds it until it fails or ctx is done. subscribed is true if
+// the device accepted the subscription.
+func (d *Device) watchOnce(ctx context.Context) (subscribed bool, err error) {
+	if d.isMQTT() {
+		return d.watchMQTT(ctx)
+	}
+	ll := d.LogCtx(ctx)
+	c, err := d.openNotifications(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.Disconnect(context.Background())
+	// Devices only send notifications to a websocket peer once it has made a request.
+	if err := d.ping(ctx, c); err != nil {
+		return false, fmt.Errorf("subscribing to notifications: %w", err)
+	}
+	ll.Info().Msg("subscribed to notifications")
+
+	check := time.NewTicker(watchCheckInterval)
+	defer check.Stop()
+	ping := time.NewTicker(watchPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case <-check.C:
+			if d.ble != nil {
+				if err := d.ble.poll(ctx); err != nil {
+					return true, err
+				}
+			} else if !c.IsConnected() {
+				return true, errors.New("connection closed")
+			}
+		case <-ping.C:
+			if err := d.ping(ctx, c); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// watchMQTT subscribes to an MQTT device's notification topics. Battery powered devices sleep
+// between connections and can't answer pings, so liveness is taken from the device's
+// `<prefix>/online` presence, which its last-will sets when it disconnects.
+func (d *Device) watchMQTT(ctx context.Context) (subscribed bool, err error) {
+	ll := d.LogCtx(ctx)
+	presence := d.notifications.presence.subscribe()
+	defer presence.Unsubscribe()
+	c, err := d.Open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.Disconnect(context.Background())
+	ll.Info().Msg("subscribed to notifications")
+
+	check := time.NewTicker(watchCheckInterval)
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case <-check.C:
+			if !c.IsConnected() {
+				return true, errors.New("connection to MQTT broker closed")
+			}
+		case pn := <-presence.C():
+			if pn.Device != d {
+				continue
+			}
+			if pn.Online {
+				ll.Info().Msg("device is online")
+			} else {
+				ll.Info().Msg("device is offline; waiting for it to reconnect")
+			}
+		}
+	}
+}
+
+// isMQTT reports whether the device is reached through the MQTT broker.
+func (d *Device) isMQTT() bool {
+	return d.ble == nil && d.mqttClient != nil && d.topicPrefix() != ""
+}
+
+// openNotifications opens an rpc channel which receives notifications.
+func (d *Device) openNotifications(ctx context.Context) (mgrpc.MgRPC, error) {
+	if d.ble == nil && !d.isMQTT() {
+		if uri, ok := websocketURI(d.uri); ok {
+			return d.openWebsocket(ctx, uri)
+		}
+	}
+	return d.Open(ctx)
+}
+
+func (d *Device) ping(ctx context.Context, c mgrpc.MgRPC) error {
+	ctx, cancel := context.WithTimeout(ctx, watchPingTimeout)
+	defer cancel()
+	_, _, err := (&shelly.ShellyGetDeviceInfoRequest{}).Do(ctx, c, d.AuthCallback(ctx))
+	return err
+}
+
+// websocketURI returns the websocket rpc URI for an HTTP device URI.
+func websocketURI(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", false
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	default:
+		return "", false
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/rpc"
+	}
+	// The websocket codec would send credentials as a bearer token. Devices authenticate each
+	// request instead, via the device's AuthCallback.
+	u.User = nil
+	return u.String(), true
+}
+
+// watchBackoff returns the delay before the next subscription attempt after consecutive failures.
+func watchBackoff(failures int, maxBackoff time.Duration) time.Duration {
+	delay := watchMinBackoff
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if maxBackoff > 0 && delay > maxBackoff {
+		return maxBackoff
+	}
+	return delay
+}
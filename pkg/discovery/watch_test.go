@@ -0,0 +1,117 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func TestWatchWebsocketReconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var conns atomic.Int32
+	fakeDevServer := httptest.NewServer(websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			n := conns.Add(1)
+			defer ws.Close()
+			reqFrame := &frame.Frame{}
+			if err := websocket.JSON.Receive(ws, reqFrame); err != nil {
+				return
+			}
+			assert.Equal(t, "Shelly.GetDeviceInfo", reqFrame.Method)
+			resp := frame.NewResponseFromFrame(reqFrame)
+			resp.Response = json.RawMessage(`{"id": "shellyplus1-a8032abe5424", "mac": "A8032ABE5424", "app": "Plus1"}`)
+			assert.NoError(t, websocket.JSON.Send(ws, frame.NewResponseFrame(reqFrame.Dst, reqFrame.Src, reqFrame.Key, resp)))
+			assert.NoError(t, websocket.JSON.Send(ws, &frame.Frame{
+				Src:    "shellyplus1-a8032abe5424",
+				Dst:    reqFrame.Src,
+				Method: "NotifyStatus",
+				Params: json.RawMessage(`{"ts": 1700000000, "switch:0": {"id": 0, "output": true}}`),
+			}))
+			if n > 1 {
+				// Hold later connections open until the test is done.
+				<-ctx.Done()
+			}
+			// The first connection drops, and the subscription should be reestablished.
+		},
+	})
+	t.Cleanup(fakeDevServer.Close)
+
+	d := NewDiscoverer()
+	snc := d.GetStatusNotifications(10)
+	dev := &Device{
+		uri:           fakeDevServer.URL + "/rpc",
+		notifications: &d.notifications,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dev.Watch(ctx, 10*time.Millisecond)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case sn := <-snc:
+			assert.Equal(t, "shellyplus1-a8032abe5424", sn.Frame.Src)
+			require.Len(t, sn.Status.Switches, 1)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for notification %d", i)
+		}
+	}
+	assert.Equal(t, int32(2), conns.Load())
+	cancel()
+	<-done
+}
+
+func TestWebsocketURI(t *testing.T) {
+	for in, expect := range map[string]string{
+		"http://192.168.1.10/rpc":           "ws://192.168.1.10/rpc",
+		"https://admin:pw@shelly.local/rpc": "wss://shelly.local/rpc",
+		"http://192.168.1.10":               "ws://192.168.1.10/rpc",
+	} {
+		got, ok := websocketURI(in)
+		assert.True(t, ok, in)
+		assert.Equal(t, expect, got, in)
+	}
+	_, ok := websocketURI("ble://A8:03:2A:BE:54:24")
+	assert.False(t, ok)
+}
+
+func TestWatchBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, watchBackoff(1, time.Minute))
+	assert.Equal(t, 2*time.Second, watchBackoff(2, time.Minute))
+	assert.Equal(t, 8*time.Second, watchBackoff(4, time.Minute))
+	assert.Equal(t, time.Minute, watchBackoff(10, time.Minute))
+	assert.Equal(t, 10*time.Millisecond, watchBackoff(1, 10*time.Millisecond))
+}
+
+func TestWatchInitialFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fakeDevServer := httptest.NewServer(websocket.Server{
+		Handler: func(ws *websocket.Conn) {
+			ws.Close()
+		},
+	})
+	t.Cleanup(fakeDevServer.Close)
+	d := NewDiscoverer()
+	dev := &Device{
+		uri:           fakeDevServer.URL + "/rpc",
+		notifications: &d.notifications,
+	}
+	assert.Error(t, dev.Watch(ctx, 10*time.Millisecond))
+
+	// With retries, Watch continues until ctx is done.
+	retryCtx, retryCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer retryCancel()
+	assert.NoError(t, dev.Watch(retryCtx, 10*time.Millisecond, WithWatchRetryInitial(true)))
+}
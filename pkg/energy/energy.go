@@ -0,0 +1,259 @@
+// Package energy accumulates the energy counters reported by devices into monotonic totals.
+// Shelly devices reset their `aenergy.total` counters on reboot and firmware update, which
+// breaks rate calculations on the raw values. An Accumulator detects those resets and carries
+// the previous total forward, optionally persisting its state so totals also survive restarts
+// of shellyctl.
+package energy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultSaveInterval is the default interval at which accumulated totals are persisted.
+	DefaultSaveInterval = time.Minute
+
+	stateVersion = 1
+)
+
+// Key identifies a single energy counter.
+type Key struct {
+	// Device is the device's MAC address normalized by DeviceKey, or another stable identifier if
+	// the MAC is unknown.
+	Device string `json:"device"`
+	// Component identifies the counter within the device, ex. `switch:0`.
+	Component string `json:"component"`
+	// Returned is true for counters of energy returned to the grid.
+	Returned bool `json:"returned,omitempty"`
+}
+
+// Counter is the accumulated state of a counter.
+type Counter struct {
+	// Total is the monotonic energy total in watt-hours.
+	Total float64
+	// Resets is the number of device counter resets observed.
+	Resets int
+}
+
+type counterState struct {
+	Key
+	// Last is the most recent total reported by the device.
+	Last float64 `json:"last"`
+	// LastTS is the time of the most recent observation. Older observations are ignored.
+	LastTS time.Time `json:"last_ts"`
+	// Offset is the sum of the device totals prior to each reset.
+	Offset float64 `json:"offset"`
+	Resets int     `json:"resets"`
+}
+
+func (c *counterState) counter() Counter {
+	return Counter{Total: c.Offset + c.Last, Resets: c.Resets}
+}
+
+type stateFile struct {
+	Version  int             `json:"version"`
+	Counters []*counterState `json:"counters"`
+}
+
+// Accumulator tracks energy counters across device resets.
+type Accumulator struct {
+	path string
+
+	lock     sync.Mutex
+	counters map[Key]*counterState
+	dirty    bool
+}
+
+// NewAccumulator creates an Accumulator which persists its state to path. The existing state is
+// loaded if the file exists. If path is empty, state is only held in memory.
+func NewAccumulator(path string) (*Accumulator, error) {
+	a := &Accumulator{
+		path:     path,
+		counters: make(map[Key]*counterState),
+	}
+	if path == "" {
+		return a, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading energy state: %w", err)
+	}
+	var sf stateFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		return nil, fmt.Errorf("parsing energy state %q: %w", path, err)
+	}
+	if sf.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported energy state version %d in %q", sf.Version, path)
+	}
+	for _, c := range sf.Counters {
+		// Earlier versions keyed devices by the MAC as reported, which differed in case between
+		// polls and notifications. Merge them, keeping the most recently observed.
+		if reMAC.MatchString(c.Device) {
+			c.Device = DeviceKey(c.Device)
+		}
+		if prev, ok := a.counters[c.Key]; ok && prev.LastTS.After(c.LastTS) {
+			continue
+		}
+		a.counters[c.Key] = c
+	}
+	return a, nil
+}
+
+// DeviceKey normalizes a MAC address for use as Key.Device, so a device's counters match whether
+// it was observed by polling, which reports `A8032ABE5424`, or through notifications whose source
+// is like `shellyplus1-a8032abe5424`.
+func DeviceKey(mac string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", "-", "").Replace(mac))
+}
+
+var reMAC = regexp.MustCompile(`^[0-9a-fA-F]{2}([:-]?[0-9a-fA-F]{2}){5}$`)
+
+// BootTime returns when a device booted, given its uptime in seconds at ts. It returns the zero
+// time if the uptime is unknown.
+func BootTime(ts time.Time, uptime float64) time.Time {
+	if uptime <= 0 {
+		return time.Time{}
+	}
+	return ts.Add(-time.Duration(uptime * float64(time.Second)))
+}
+
+// Observe records a total reported by a device at ts and returns the accumulated counter. A total
+// lower than the last observed total is treated as a device counter reset, as is a boot after the
+// last observation, since the device may have counted past its previous total by now. boot may be
+// zero if it isn't known. Observations older than the most recent observation are ignored, since
+// notifications and polls may arrive out of order.
+func (a *Accumulator) Observe(k Key, total float64, ts, boot time.Time) Counter {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c, ok := a.counters[k]
+	if !ok {
+		c = &counterState{Key: k, Last: total, LastTS: ts}
+		a.counters[k] = c
+		a.dirty = true
+		return c.counter()
+	}
+	if ts.Before(c.LastTS) {
+		return c.counter()
+	}
+	if total < c.Last || boot.After(c.LastTS) {
+		c.Offset += c.Last
+		c.Resets++
+	}
+	if total != c.Last || !ts.Equal(c.LastTS) {
+		a.dirty = true
+	}
+	c.Last = total
+	c.LastTS = ts
+	return c.counter()
+}
+
+// Counters returns the accumulated state of all counters.
+func (a *Accumulator) Counters() map[Key]Counter {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	out := make(map[Key]Counter, len(a.counters))
+	for k, c := range a.counters {
+		out[k] = c.counter()
+	}
+	return out
+}
+
+// Save persists the accumulated state if it has changed since the last save. The file is
+// replaced atomically so a crash can't leave a partially written state.
+func (a *Accumulator) Save() error {
+	if a.path == "" {
+		return nil
+	}
+	a.lock.Lock()
+	if !a.dirty {
+		a.lock.Unlock()
+		return nil
+	}
+	sf := stateFile{Version: stateVersion}
+	for _, c := range a.counters {
+		cc := *c
+		sf.Counters = append(sf.Counters, &cc)
+	}
+	a.dirty = false
+	a.lock.Unlock()
+	sort.Slice(sf.Counters, func(i, j int) bool {
+		ki, kj := sf.Counters[i].Key, sf.Counters[j].Key
+		if ki.Device != kj.Device {
+			return ki.Device < kj.Device
+		}
+		if ki.Component != kj.Component {
+			return ki.Component < kj.Component
+		}
+		return !ki.Returned && kj.Returned
+	})
+
+	b, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding energy state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return a.saveFailed(fmt.Errorf("creating energy state: %w", err))
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return a.saveFailed(fmt.Errorf("writing energy state: %w", err))
+	}
+	if err := tmp.Close(); err != nil {
+		return a.saveFailed(fmt.Errorf("writing energy state: %w", err))
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return a.saveFailed(fmt.Errorf("replacing energy state: %w", err))
+	}
+	return nil
+}
+
+// saveFailed marks the state dirty so the next Save retries.
+func (a *Accumulator) saveFailed(err error) error {
+	a.lock.Lock()
+	a.dirty = true
+	a.lock.Unlock()
+	return err
+}
+
+// Run saves the accumulated state every interval until ctx is done, then saves a final time.
+func (a *Accumulator) Run(ctx context.Context, interval time.Duration) {
+	l := log.Ctx(ctx)
+	defer func() {
+		if err := a.Save(); err != nil {
+			l.Err(err).Msg("saving energy state")
+		}
+	}()
+	if a.path == "" {
+		<-ctx.Done()
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := a.Save(); err != nil {
+				l.Err(err).Msg("saving energy state")
+			}
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package energy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserve(t *testing.T) {
+	k := Key{Device: "a8032abe5424", Component: "switch:0"}
+	t0 := time.Unix(1700000000, 0)
+	tcs := []struct {
+		name   string
+		total  float64
+		ts     time.Time
+		boot   time.Time
+		expect Counter
+	}{
+		{name: "first", total: 100, ts: t0, expect: Counter{Total: 100}},
+		{name: "increase", total: 150, ts: t0.Add(time.Minute), expect: Counter{Total: 150}},
+		{name: "reset", total: 2, ts: t0.Add(2 * time.Minute), expect: Counter{Total: 152, Resets: 1}},
+		{name: "stale", total: 140, ts: t0.Add(90 * time.Second), expect: Counter{Total: 152, Resets: 1}},
+		{name: "after reset", total: 10, ts: t0.Add(3 * time.Minute), expect: Counter{Total: 160, Resets: 1}},
+		{name: "second reset", total: 0, ts: t0.Add(4 * time.Minute), expect: Counter{Total: 160, Resets: 2}},
+		{name: "unchanged", total: 0, ts: t0.Add(5 * time.Minute), expect: Counter{Total: 160, Resets: 2}},
+		{name: "known boot", total: 30, ts: t0.Add(6 * time.Minute), boot: t0, expect: Counter{Total: 190, Resets: 2}},
+		// The device rebooted and counted past its previous total before it was observed again.
+		{name: "reboot", total: 40, ts: t0.Add(20 * time.Minute), boot: t0.Add(10 * time.Minute), expect: Counter{Total: 230, Resets: 3}},
+		{name: "same boot", total: 45, ts: t0.Add(21 * time.Minute), boot: t0.Add(10 * time.Minute), expect: Counter{Total: 235, Resets: 3}},
+	}
+	a, err := NewAccumulator("")
+	require.NoError(t, err)
+	for _, tc := range tcs {
+		assert.Equal(t, tc.expect, a.Observe(k, tc.total, tc.ts, tc.boot), tc.name)
+	}
+
+	// Returned energy is tracked independently.
+	returned := Key{Device: k.Device, Component: k.Component, Returned: true}
+	assert.Equal(t, Counter{Total: 5}, a.Observe(returned, 5, t0, time.Time{}))
+	assert.Equal(t, map[Key]Counter{
+		k:        {Total: 235, Resets: 3},
+		returned: {Total: 5},
+	}, a.Counters())
+}
+
+func TestBootTime(t *testing.T) {
+	t0 := time.Unix(1700000000, 0)
+	assert.Equal(t, t0.Add(-90*time.Second), BootTime(t0, 90))
+	assert.True(t, BootTime(t0, 0).IsZero())
+}
+
+func TestDeviceKey(t *testing.T) {
+	for _, mac := range []string{"a8032abe5424", "A8:03:2A:BE:54:24", "a8-03-2a-be-54-24"} {
+		assert.Equal(t, "A8032ABE5424", DeviceKey(mac), mac)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "energy.json")
+	k := Key{Device: "A8032ABE5424", Component: "cover:0"}
+	t0 := time.Unix(1700000000, 0)
+
+	a, err := NewAccumulator(path)
+	require.NoError(t, err)
+	a.Observe(k, 100, t0, time.Time{})
+	a.Observe(k, 20, t0.Add(time.Minute), time.Time{})
+	require.NoError(t, a.Save())
+
+	a, err = NewAccumulator(path)
+	require.NoError(t, err)
+	assert.Equal(t, Counter{Total: 120, Resets: 1}, a.Counters()[k])
+	// The device reset again while shellyctl was stopped.
+	assert.Equal(t, Counter{Total: 125, Resets: 2}, a.Observe(k, 5, t0.Add(time.Hour), time.Time{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx, time.Hour)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	a, err = NewAccumulator(path)
+	require.NoError(t, err)
+	assert.Equal(t, Counter{Total: 125, Resets: 2}, a.Counters()[k])
+
+	// Devices keyed by the MAC as reported are merged, keeping the latest observation.
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 1, "counters": [
+		{"device": "a8032abe5424", "component": "cover:0", "last": 5, "last_ts": "2023-11-14T22:13:20Z", "offset": 10},
+		{"device": "A8032ABE5424", "component": "cover:0", "last": 7, "last_ts": "2023-11-14T22:14:20Z", "offset": 20, "resets": 1},
+		{"device": "shelly1-a8032abe5424.local", "component": "switch:0", "last": 1, "last_ts": "2023-11-14T22:13:20Z"}
+	]}`), 0o644))
+	a, err = NewAccumulator(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[Key]Counter{
+		k: {Total: 27, Resets: 1},
+		{Device: "shelly1-a8032abe5424.local", Component: "switch:0"}: {Total: 1},
+	}, a.Counters())
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 2}`), 0o644))
+	_, err = NewAccumulator(path)
+	assert.ErrorContains(t, err, "unsupported energy state version")
+}
@@ -0,0 +1,189 @@
+// Package eventstream describes device notifications as self-contained envelopes, carrying
+// which device sent them, the notification type and when they arrived. Each envelope describes a
+// single component's status or a single event, so streams can be filtered and processed one line
+// at a time.
+package eventstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/labels"
+)
+
+const (
+	MethodNotifyStatus     = "NotifyStatus"
+	MethodNotifyFullStatus = "NotifyFullStatus"
+	MethodNotifyEvent      = "NotifyEvent"
+	// MethodPresence describes a change in an MQTT device's online state. It isn't a device
+	// notification, but is derived from the device's `<prefix>/online` topic.
+	MethodPresence = "Presence"
+)
+
+// Envelope describes a single component status or event from a device notification.
+type Envelope struct {
+	// TS is the device's timestamp for the notification or event, in seconds since the epoch.
+	TS float64 `json:"ts,omitempty"`
+	// ReceivedAt is the local time the notification was received.
+	ReceivedAt time.Time `json:"received_at"`
+	Src        string    `json:"src"`
+	MAC        string    `json:"mac,omitempty"`
+	DeviceName string    `json:"device_name,omitempty"`
+	Method     string    `json:"method"`
+	// Component is the component key, ex. `switch:0`.
+	Component string `json:"component,omitempty"`
+	// Payload is the component's status, or the event.
+	Payload json.RawMessage `json:"payload"`
+}
+
+// EventName returns the name of the event carried by a NotifyEvent envelope, or an empty string.
+func (e *Envelope) EventName() string {
+	if e.Method != MethodNotifyEvent {
+		return ""
+	}
+	var ev struct {
+		Event string `json:"event"`
+	}
+	if err := json.Unmarshal(e.Payload, &ev); err != nil {
+		return ""
+	}
+	return ev.Event
+}
+
+// newEnvelope describes the device which sent a notification. dev may be nil if the device isn't
+// known to discovery, in which case the MAC is parsed from the src when possible.
+func newEnvelope(src, method string, receivedAt time.Time, dev *discovery.Device) Envelope {
+	e := Envelope{
+		ReceivedAt: receivedAt,
+		Src:        src,
+		MAC:        labels.SrcDevice(src).MAC,
+		Method:     method,
+	}
+	if dev != nil {
+		if dev.MACAddr != "" {
+			e.MAC = dev.MACAddr
+		}
+		e.DeviceName = dev.Name
+	}
+	return e
+}
+
+// FromStatus splits a NotifyStatus or NotifyFullStatus notification into an envelope per
+// component, ordered by component key.
+func FromStatus(sn discovery.StatusNotification, dev *discovery.Device) ([]*Envelope, error) {
+	var components map[string]json.RawMessage
+	if err := json.Unmarshal(sn.Frame.Params, &components); err != nil {
+		return nil, fmt.Errorf("decoding %s params: %w", sn.Frame.Method, err)
+	}
+	method := sn.Frame.Method
+	if method == "" {
+		method = MethodNotifyStatus
+	}
+	base := newEnvelope(sn.Frame.Src, method, sn.ReceivedAt, dev)
+	if sn.Status != nil {
+		base.TS = sn.Status.TS
+	}
+	var out []*Envelope
+	for k, raw := range components {
+		if k == "ts" {
+			continue
+		}
+		e := base
+		e.Component = k
+		e.Payload = raw
+		out = append(out, &e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Component < out[j].Component
+	})
+	return out, nil
+}
+
+// FromEvent splits a NotifyEvent notification into an envelope per event. Events without their
+// own timestamp use the notification's.
+func FromEvent(en discovery.EventNotification, dev *discovery.Device) ([]*Envelope, error) {
+	var params struct {
+		TS     float64           `json:"ts"`
+		Events []json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(en.Frame.Params, &params); err != nil {
+		return nil, fmt.Errorf("decoding %s params: %w", MethodNotifyEvent, err)
+	}
+	base := newEnvelope(en.Frame.Src, MethodNotifyEvent, en.ReceivedAt, dev)
+	var out []*Envelope
+	for _, raw := range params.Events {
+		var ev struct {
+			Component string  `json:"component"`
+			TS        float64 `json:"ts"`
+		}
+		if err := json.Unmarshal(raw, &ev); err != nil {
+			return nil, fmt.Errorf("decoding %s event: %w", MethodNotifyEvent, err)
+		}
+		e := base
+		e.TS = params.TS
+		if ev.TS != 0 {
+			e.TS = ev.TS
+		}
+		e.Component = ev.Component
+		e.Payload = raw
+		out = append(out, &e)
+	}
+	return out, nil
+}
+
+// FromPresence describes a change in an MQTT device's presence. The payload is like
+// `{"online": true}`.
+func FromPresence(pn discovery.PresenceNotification) (*Envelope, error) {
+	payload, err := json.Marshal(struct {
+		Online bool `json:"online"`
+	}{pn.Online})
+	if err != nil {
+		return nil, err
+	}
+	e := newEnvelope(pn.Prefix, MethodPresence, pn.Since, pn.Device)
+	e.Payload = payload
+	return &e, nil
+}
+
+// Filter selects envelopes. Empty fields match all envelopes.
+type Filter struct {
+	// Methods matches the notification method, ex. `NotifyEvent`.
+	Methods []string
+	// Components matches component keys like `switch:0`, or all components of a type like `switch`.
+	Components []string
+	// Events matches event names. Status envelopes never match a filter with events.
+	Events []string
+}
+
+// Match returns true if the envelope is selected by the filter.
+func (f *Filter) Match(e *Envelope) bool {
+	if len(f.Methods) > 0 && !containsFold(f.Methods, e.Method) {
+		return false
+	}
+	if len(f.Components) > 0 {
+		componentType, _, _ := strings.Cut(e.Component, ":")
+		if !containsFold(f.Components, e.Component) && !containsFold(f.Components, componentType) {
+			return false
+		}
+	}
+	if len(f.Events) > 0 && !containsFold(f.Events, e.EventName()) {
+		return false
+	}
+	return true
+}
+
+func containsFold(values []string, v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package eventstream
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromStatus(t *testing.T) {
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.Name = "garage"
+	receivedAt := time.Unix(1700000001, 0).UTC()
+
+	envs, err := FromStatus(discovery.StatusNotification{
+		Status: &shelly.NotifyStatus{TS: 1700000000.5},
+		Frame: &frame.Frame{
+			Src:    "shellyplus2pm-a8032abe5424",
+			Method: MethodNotifyFullStatus,
+			Params: json.RawMessage(`{"ts": 1700000000.5, "switch:0": {"id": 0, "output": true}, "input:0": {"id": 0, "state": false}}`),
+		},
+		ReceivedAt: receivedAt,
+	}, d1.Device)
+	require.NoError(t, err)
+	require.Len(t, envs, 2)
+	assert.Equal(t, &Envelope{
+		TS:         1700000000.5,
+		ReceivedAt: receivedAt,
+		Src:        "shellyplus2pm-a8032abe5424",
+		MAC:        d1.MACAddr,
+		DeviceName: "garage",
+		Method:     MethodNotifyFullStatus,
+		Component:  "input:0",
+		Payload:    json.RawMessage(`{"id": 0, "state": false}`),
+	}, envs[0])
+	assert.Equal(t, "switch:0", envs[1].Component)
+	assert.Equal(t, "", envs[1].EventName())
+
+	// Without a known device, the MAC is parsed from the src.
+	envs, err = FromStatus(discovery.StatusNotification{
+		Frame: &frame.Frame{
+			Src:    "shellyplus2pm-a8032abe5424",
+			Params: json.RawMessage(`{"switch:0": {"id": 0}}`),
+		},
+	}, nil)
+	require.NoError(t, err)
+	require.Len(t, envs, 1)
+	assert.Equal(t, "a8032abe5424", envs[0].MAC)
+	assert.Equal(t, MethodNotifyStatus, envs[0].Method)
+}
+
+func TestFromEvent(t *testing.T) {
+	envs, err := FromEvent(discovery.EventNotification{
+		Frame: &frame.Frame{
+			Src:    "shellyplusi4-a8032abe5424",
+			Method: MethodNotifyEvent,
+			Params: json.RawMessage(`{"ts": 1700000000.5, "events": [
+				{"component": "input:1", "id": 1, "event": "single_push", "ts": 1700000000.25},
+				{"component": "sys", "event": "scheduled_restart"}
+			]}`),
+		},
+	}, nil)
+	require.NoError(t, err)
+	require.Len(t, envs, 2)
+	assert.Equal(t, "input:1", envs[0].Component)
+	assert.Equal(t, 1700000000.25, envs[0].TS)
+	assert.Equal(t, "single_push", envs[0].EventName())
+	assert.Equal(t, "sys", envs[1].Component)
+	assert.Equal(t, 1700000000.5, envs[1].TS)
+	assert.Equal(t, "scheduled_restart", envs[1].EventName())
+}
+
+func TestFromPresence(t *testing.T) {
+	since := time.Unix(1700000000, 0).UTC()
+	e, err := FromPresence(discovery.PresenceNotification{
+		Presence: discovery.Presence{Prefix: "shellyplus1-a8032abe5424", Since: since},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &Envelope{
+		ReceivedAt: since,
+		Src:        "shellyplus1-a8032abe5424",
+		MAC:        "a8032abe5424",
+		Method:     MethodPresence,
+		Payload:    json.RawMessage(`{"online":false}`),
+	}, e)
+}
+
+func TestFilter(t *testing.T) {
+	status := &Envelope{Method: MethodNotifyStatus, Component: "switch:0", Payload: json.RawMessage(`{"id": 0}`)}
+	event := &Envelope{Method: MethodNotifyEvent, Component: "input:1", Payload: json.RawMessage(`{"event": "single_push"}`)}
+	tcs := []struct {
+		name   string
+		filter Filter
+		status bool
+		event  bool
+	}{
+		{name: "empty", status: true, event: true},
+		{name: "method", filter: Filter{Methods: []string{"notifyevent"}}, event: true},
+		{name: "component key", filter: Filter{Components: []string{"switch:0"}}, status: true},
+		{name: "component type", filter: Filter{Components: []string{"input", "cover"}}, event: true},
+		{name: "event", filter: Filter{Events: []string{"single_push"}}, event: true},
+		{name: "other event", filter: Filter{Events: []string{"long_push"}}},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.status, tc.filter.Match(status))
+			assert.Equal(t, tc.event, tc.filter.Match(event))
+		})
+	}
+}
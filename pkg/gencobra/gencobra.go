@@ -22,6 +22,9 @@ import (
 type Baggage struct {
 	Discoverer *discovery.Discoverer
 	Output     outputter.Outputter
+	// Queue, if set, is offered each request before it's sent to devices. If it reports the
+	// request as queued, the request isn't sent.
+	Queue func(ctx context.Context, req shelly.RPCRequestBody) (queued bool, err error)
 }
 
 type Component struct {
@@ -52,6 +55,11 @@ func RequestToCmd(req shelly.RPCRequestBody, baggage *Baggage) (*cobra.Command,
 		if _, err := forEachStructField(reflect.ValueOf(req), "", newFlagReader(c.Flags(), req.Method())); err != nil {
 			return err
 		}
+		if baggage.Queue != nil {
+			if queued, err := baggage.Queue(ctx, req); queued || err != nil {
+				return err
+			}
+		}
 
 		if _, err := baggage.Discoverer.Search(ctx); err != nil {
 			return err
@@ -0,0 +1,21 @@
+// Package jsonmerge merges decoded JSON objects, like the partial status sent by NotifyStatus
+// into the full status of a component.
+package jsonmerge
+
+// Merge returns a copy of dst with the fields of src applied recursively. Neither map is modified.
+func Merge(dst, src map[string]any) map[string]any {
+	out := make(map[string]any, len(dst)+len(src))
+	for k, v := range dst {
+		out[k] = v
+	}
+	for k, v := range src {
+		if sm, ok := v.(map[string]any); ok {
+			if dm, ok := out[k].(map[string]any); ok {
+				out[k] = Merge(dm, sm)
+				continue
+			}
+		}
+		out[k] = v
+	}
+	return out
+}
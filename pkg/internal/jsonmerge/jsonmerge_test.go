@@ -0,0 +1,14 @@
+package jsonmerge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerge(t *testing.T) {
+	dst := map[string]any{"output": true, "aenergy": map[string]any{"total": 1.0, "by_minute": []any{1.0}}}
+	got := Merge(dst, map[string]any{"output": false, "aenergy": map[string]any{"total": 2.0}})
+	assert.Equal(t, map[string]any{"output": false, "aenergy": map[string]any{"total": 2.0, "by_minute": []any{1.0}}}, got)
+	assert.Equal(t, true, dst["output"], "Merge mustn't modify dst")
+}
@@ -0,0 +1,738 @@
+// Package mqtt5 is a minimal MQTT v5 client implementing paho's mqtt.Client interface, so it can
+// stand in for the MQTT 3.1.1 client wherever a broker connection is shared. Beyond 3.1.1 it
+// carries the response-topic and correlation-data properties, which match RPC responses to their
+// requests. It supports QoS 0 and 1 over TCP and TLS; will messages and websockets aren't
+// supported.
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var _ mqtt.Client = (*Client)(nil)
+
+var errDisconnected = errors.New("disconnected")
+
+// Publication is a message to publish, with its MQTT v5 request/response properties.
+type Publication struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  []byte
+	// ResponseTopic asks the receiver to publish its response to this topic.
+	ResponseTopic string
+	// CorrelationData is returned with the response, identifying the request it answers.
+	CorrelationData []byte
+}
+
+// Message is a message received from the broker. It implements mqtt.Message.
+type Message struct {
+	topic           string
+	payload         []byte
+	qos             byte
+	retained        bool
+	duplicate       bool
+	id              uint16
+	responseTopic   string
+	correlationData []byte
+}
+
+var _ mqtt.Message = (*Message)(nil)
+
+func (m *Message) Duplicate() bool   { return m.duplicate }
+func (m *Message) Qos() byte         { return m.qos }
+func (m *Message) Retained() bool    { return m.retained }
+func (m *Message) Topic() string     { return m.topic }
+func (m *Message) MessageID() uint16 { return m.id }
+func (m *Message) Payload() []byte   { return m.payload }
+
+// Ack is a no-op; QoS 1 messages are acknowledged when they're received.
+func (m *Message) Ack() {}
+
+// ResponseTopic returns the topic the sender asked for a response on, if any.
+func (m *Message) ResponseTopic() string { return m.responseTopic }
+
+// CorrelationData returns the sender's correlation data, if any.
+func (m *Message) CorrelationData() []byte { return m.correlationData }
+
+// token implements mqtt.Token.
+type token struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+}
+
+func newToken() *token {
+	return &token{done: make(chan struct{})}
+}
+
+func (t *token) complete(err error) *token {
+	t.once.Do(func() {
+		t.err = err
+		close(t.done)
+	})
+	return t
+}
+
+func (t *token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+type route struct {
+	filter  string
+	handler mqtt.MessageHandler
+}
+
+type pending struct {
+	t *token
+	// inflight is set for QoS 1 publishes, which hold a slot of the broker's receive maximum.
+	inflight bool
+}
+
+// session is a single network connection to the broker.
+type session struct {
+	conn      net.Conn
+	keepAlive time.Duration
+	stop      chan struct{}
+	// inflight limits unacknowledged QoS 1 publishes to the broker's receive maximum.
+	inflight        chan struct{}
+	pingOutstanding atomic.Bool
+
+	writeLock sync.Mutex
+
+	// pending and nextID are guarded by the client's lock. pending is nil once the connection is lost.
+	pending map[uint16]*pending
+	nextID  uint16
+}
+
+func (s *session) write(kind, flags byte, body []byte, timeout time.Duration) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	return writePacket(s.conn, kind, flags, body)
+}
+
+// Client is an MQTT v5 client. It's configured by paho's mqtt.ClientOptions, using the servers,
+// credentials, TLS config, client ID, keep alive, timeouts, message ordering, and handlers.
+type Client struct {
+	opts   mqtt.ClientOptions
+	reader mqtt.ClientOptionsReader
+
+	messages     chan *Message
+	dispatchOnce sync.Once
+	done         chan struct{}
+
+	lock   sync.Mutex
+	sess   *session
+	routes []route
+	closed bool
+}
+
+// NewClient creates a client. It doesn't connect until Connect is called.
+func NewClient(o *mqtt.ClientOptions) *Client {
+	return &Client{
+		opts:     *o,
+		reader:   mqtt.NewClient(o).OptionsReader(),
+		messages: make(chan *Message, 100),
+		done:     make(chan struct{}),
+	}
+}
+
+// IsConnected implements mqtt.Client.
+func (c *Client) IsConnected() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sess != nil
+}
+
+// IsConnectionOpen implements mqtt.Client.
+func (c *Client) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+// OptionsReader implements mqtt.Client.
+func (c *Client) OptionsReader() mqtt.ClientOptionsReader {
+	return c.reader
+}
+
+// Connect implements mqtt.Client. Once connected, a lost connection is reestablished if
+// AutoReconnect is set.
+func (c *Client) Connect() mqtt.Token {
+	t := newToken()
+	go func() {
+		s, r, err := c.dial()
+		if err != nil {
+			t.complete(err)
+			return
+		}
+		c.start(s, r)
+		t.complete(nil)
+	}()
+	return t
+}
+
+// Disconnect implements mqtt.Client. The client can't be reconnected. Acknowledgements which
+// are still pending fail rather than waiting for quiesce.
+func (c *Client) Disconnect(quiesce uint) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.done)
+	s := c.sess
+	c.sess = nil
+	c.lock.Unlock()
+	if s != nil {
+		s.write(packetDisconnect, 0, nil, c.opts.WriteTimeout)
+		c.connectionLost(s, errDisconnected)
+	}
+}
+
+// Publish implements mqtt.Client. QoS 2 isn't supported.
+func (c *Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p := &Publication{Topic: topic, QoS: qos, Retained: retained}
+	switch v := payload.(type) {
+	case string:
+		p.Payload = []byte(v)
+	case []byte:
+		p.Payload = v
+	case bytes.Buffer:
+		p.Payload = v.Bytes()
+	case *bytes.Buffer:
+		p.Payload = v.Bytes()
+	default:
+		return newToken().complete(fmt.Errorf("unknown payload type %T", payload))
+	}
+	return c.PublishWithProperties(p)
+}
+
+// PublishWithProperties publishes p, including its MQTT v5 properties.
+func (c *Client) PublishWithProperties(p *Publication) mqtt.Token {
+	t := newToken()
+	if p.QoS > 1 {
+		return t.complete(errors.New("QoS 2 isn't supported"))
+	}
+	pp := &publishPacket{
+		topic:    p.Topic,
+		qos:      p.QoS,
+		retained: p.Retained,
+		props:    properties{responseTopic: p.ResponseTopic, correlationData: p.CorrelationData},
+		payload:  p.Payload,
+	}
+	if p.QoS == 0 {
+		s := c.session()
+		if s == nil {
+			return t.complete(mqtt.ErrNotConnected)
+		}
+		flags, body := pp.encode()
+		if err := s.write(packetPublish, flags, body, c.opts.WriteTimeout); err != nil {
+			c.connectionLost(s, err)
+			return t.complete(err)
+		}
+		return t.complete(nil)
+	}
+	c.request(t, packetPublish, true, func(id uint16) (byte, []byte) {
+		pp.id = id
+		return pp.encode()
+	})
+	return t
+}
+
+// Subscribe implements mqtt.Client. QoS 2 subscriptions are downgraded to QoS 1.
+func (c *Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+// SubscribeMultiple implements mqtt.Client. QoS 2 subscriptions are downgraded to QoS 1.
+func (c *Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	sp := &subscribePacket{}
+	for f := range filters {
+		sp.filters = append(sp.filters, f)
+	}
+	sort.Strings(sp.filters)
+	for _, f := range sp.filters {
+		sp.qos = append(sp.qos, min(filters[f], 1))
+		if callback != nil {
+			c.AddRoute(f, callback)
+		}
+	}
+	t := newToken()
+	c.request(t, packetSubscribe, false, func(id uint16) (byte, []byte) {
+		sp.id = id
+		return 0x02, sp.encode(packetSubscribe)
+	})
+	return t
+}
+
+// Unsubscribe implements mqtt.Client.
+func (c *Client) Unsubscribe(topics ...string) mqtt.Token {
+	c.lock.Lock()
+	routes := c.routes[:0]
+	for _, r := range c.routes {
+		if !slices.Contains(topics, r.filter) {
+			routes = append(routes, r)
+		}
+	}
+	c.routes = routes
+	c.lock.Unlock()
+	t := newToken()
+	c.request(t, packetUnsubscribe, false, func(id uint16) (byte, []byte) {
+		return 0x02, (&subscribePacket{id: id, filters: topics}).encode(packetUnsubscribe)
+	})
+	return t
+}
+
+// AddRoute implements mqtt.Client.
+func (c *Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, r := range c.routes {
+		if r.filter == topic {
+			c.routes[i].handler = callback
+			return
+		}
+	}
+	c.routes = append(c.routes, route{filter: topic, handler: callback})
+}
+
+func (c *Client) session() *session {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.sess
+}
+
+// request sends a packet which the broker acknowledges, completing t with the acknowledgement.
+// encode is passed the packet identifier and returns the packet's flags and body.
+func (c *Client) request(t *token, kind byte, inflight bool, encode func(id uint16) (byte, []byte)) {
+	s := c.session()
+	if s == nil {
+		t.complete(mqtt.ErrNotConnected)
+		return
+	}
+	if inflight {
+		select {
+		case s.inflight <- struct{}{}:
+		case <-s.stop:
+			t.complete(mqtt.ErrNotConnected)
+			return
+		}
+	}
+	c.lock.Lock()
+	if s.pending == nil {
+		c.lock.Unlock()
+		t.complete(mqtt.ErrNotConnected)
+		return
+	}
+	for s.nextID++; s.nextID == 0 || s.pending[s.nextID] != nil; s.nextID++ {
+	}
+	id := s.nextID
+	s.pending[id] = &pending{t: t, inflight: inflight}
+	c.lock.Unlock()
+	flags, body := encode(id)
+	if err := s.write(kind, flags, body, c.opts.WriteTimeout); err != nil {
+		c.connectionLost(s, err)
+	}
+}
+
+// acknowledge completes the request identified by id.
+func (c *Client) acknowledge(s *session, id uint16, err error) {
+	c.lock.Lock()
+	p := s.pending[id]
+	delete(s.pending, id)
+	c.lock.Unlock()
+	if p == nil {
+		return
+	}
+	if p.inflight {
+		<-s.inflight
+	}
+	p.t.complete(err)
+}
+
+// dial connects to the first server which accepts the connection.
+func (c *Client) dial() (*session, *bufio.Reader, error) {
+	var errs []error
+	for _, u := range c.opts.Servers {
+		s, r, err := c.dialServer(u)
+		if err == nil {
+			return s, r, nil
+		}
+		errs = append(errs, fmt.Errorf("connecting to %s: %w", u.Redacted(), err))
+	}
+	if len(errs) == 0 {
+		return nil, nil, errors.New("no MQTT servers are configured")
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func (c *Client) dialServer(u *url.URL) (*session, *bufio.Reader, error) {
+	if c.opts.WillEnabled {
+		return nil, nil, errors.New("will messages aren't supported by the MQTT v5 client")
+	}
+	dialer := &net.Dialer{Timeout: c.opts.ConnectTimeout}
+	var conn net.Conn
+	var err error
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", u.Host)
+	case "tcps", "ssl", "tls", "mqtts":
+		cfg := c.opts.TLSConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", u.Host, cfg)
+	default:
+		return nil, nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.opts.ConnectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.opts.ConnectTimeout))
+	}
+	s, r, err := c.handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return s, r, nil
+}
+
+// handshake sends CONNECT and waits for the broker's CONNACK.
+func (c *Client) handshake(conn net.Conn, u *url.URL) (*session, *bufio.Reader, error) {
+	cp := &connectPacket{
+		clientID:   c.opts.ClientID,
+		username:   c.opts.Username,
+		password:   c.opts.Password,
+		keepAlive:  uint16(c.opts.KeepAlive),
+		cleanStart: c.opts.CleanSession,
+	}
+	if u.User != nil {
+		cp.username = u.User.Username()
+		if pwd, ok := u.User.Password(); ok {
+			cp.password = pwd
+		}
+	}
+	if c.opts.CredentialsProvider != nil {
+		cp.username, cp.password = c.opts.CredentialsProvider()
+	}
+	if !c.opts.CleanSession {
+		// MQTT 3.1.1 sessions which aren't clean last until they're cleaned.
+		cp.props.sessionExpiry = 0xffffffff
+	}
+	if err := writePacket(conn, packetConnect, 0, cp.encode()); err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if p.kind != packetConnack {
+		return nil, nil, fmt.Errorf("expected CONNACK, got packet type %d", p.kind)
+	}
+	ack, err := decodeConnack(p.body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding CONNACK: %w", err)
+	}
+	if ack.reason >= 0x80 {
+		return nil, nil, reasonError("connection refused", ack.reason, ack.props)
+	}
+	s := &session{
+		conn:      conn,
+		keepAlive: time.Duration(c.opts.KeepAlive) * time.Second,
+		stop:      make(chan struct{}),
+		inflight:  make(chan struct{}, 65535),
+		pending:   make(map[uint16]*pending),
+	}
+	if ack.props.serverKeepAlive != nil {
+		s.keepAlive = time.Duration(*ack.props.serverKeepAlive) * time.Second
+	}
+	if ack.props.receiveMaximum > 0 {
+		s.inflight = make(chan struct{}, ack.props.receiveMaximum)
+	}
+	return s, r, nil
+}
+
+// start makes s the client's session and begins reading from it.
+func (c *Client) start(s *session, r *bufio.Reader) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		s.conn.Close()
+		return
+	}
+	c.sess = s
+	c.lock.Unlock()
+	if c.opts.Order {
+		c.dispatchOnce.Do(func() {
+			go c.dispatchLoop()
+		})
+	}
+	go c.readLoop(s, r)
+	go c.keepAlive(s)
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c)
+	}
+}
+
+// connectionLost closes s, failing its pending requests, and reconnects if s was the client's
+// session.
+func (c *Client) connectionLost(s *session, err error) {
+	c.lock.Lock()
+	if s.pending == nil {
+		c.lock.Unlock()
+		return
+	}
+	pending := s.pending
+	s.pending = nil
+	close(s.stop)
+	current := c.sess == s
+	if current {
+		c.sess = nil
+	}
+	closed := c.closed
+	c.lock.Unlock()
+	s.conn.Close()
+	for _, p := range pending {
+		p.t.complete(fmt.Errorf("MQTT connection lost: %w", err))
+	}
+	if closed || !current {
+		return
+	}
+	if c.opts.OnConnectionLost != nil {
+		go c.opts.OnConnectionLost(c, err)
+	}
+	if c.opts.AutoReconnect {
+		go c.reconnect()
+	}
+}
+
+// reconnect retries the connection, backing off exponentially up to MaxReconnectInterval.
+func (c *Client) reconnect() {
+	var delay time.Duration
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(delay):
+		}
+		if c.opts.OnReconnecting != nil {
+			c.opts.OnReconnecting(c, &c.opts)
+		}
+		s, r, err := c.dial()
+		if err == nil {
+			c.start(s, r)
+			return
+		}
+		delay = max(delay*2, time.Second)
+		if c.opts.MaxReconnectInterval > 0 {
+			delay = min(delay, c.opts.MaxReconnectInterval)
+		}
+	}
+}
+
+// keepAlive pings the broker each keep alive interval. The connection is lost if the previous
+// ping wasn't answered.
+func (c *Client) keepAlive(s *session) {
+	if s.keepAlive <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		if s.pingOutstanding.Swap(true) {
+			c.connectionLost(s, errors.New("MQTT broker didn't answer ping"))
+			return
+		}
+		if err := s.write(packetPingreq, 0, nil, c.opts.WriteTimeout); err != nil {
+			c.connectionLost(s, err)
+			return
+		}
+	}
+}
+
+func (c *Client) readLoop(s *session, r *bufio.Reader) {
+	for {
+		p, err := readPacket(r)
+		if err == nil {
+			err = c.handle(s, p)
+		}
+		if err != nil {
+			c.connectionLost(s, err)
+			return
+		}
+	}
+}
+
+func (c *Client) handle(s *session, p packet) error {
+	switch p.kind {
+	case packetPublish:
+		pp, err := decodePublish(p.flags, p.body)
+		if err != nil {
+			return fmt.Errorf("decoding PUBLISH: %w", err)
+		}
+		switch pp.qos {
+		case 0:
+		case 1:
+			ack := &ackPacket{id: pp.id}
+			if err := s.write(packetPuback, 0, ack.encode(packetPuback), c.opts.WriteTimeout); err != nil {
+				return err
+			}
+		default:
+			return errors.New("received unsupported QoS 2 message")
+		}
+		c.deliver(&Message{
+			topic:           pp.topic,
+			payload:         pp.payload,
+			qos:             pp.qos,
+			retained:        pp.retained,
+			duplicate:       pp.dup,
+			id:              pp.id,
+			responseTopic:   pp.props.responseTopic,
+			correlationData: pp.props.correlationData,
+		})
+	case packetPuback, packetSuback, packetUnsuback:
+		ack, err := decodeAck(p.kind, p.body)
+		if err != nil {
+			return fmt.Errorf("decoding acknowledgement: %w", err)
+		}
+		var ackErr error
+		for _, reason := range ack.reasons {
+			if reason >= 0x80 {
+				ackErr = reasonError("request refused", reason, ack.props)
+				break
+			}
+		}
+		c.acknowledge(s, ack.id, ackErr)
+	case packetPingresp:
+		s.pingOutstanding.Store(false)
+	case packetDisconnect:
+		dp, err := decodeDisconnect(p.body)
+		if err != nil {
+			return fmt.Errorf("decoding DISCONNECT: %w", err)
+		}
+		return reasonError("disconnected by MQTT broker", dp.reason, dp.props)
+	default:
+		return fmt.Errorf("unexpected MQTT packet type %d", p.kind)
+	}
+	return nil
+}
+
+// deliver passes m to its handlers, in order on a single goroutine if the options require it.
+func (c *Client) deliver(m *Message) {
+	if !c.opts.Order {
+		go c.dispatch(m)
+		return
+	}
+	select {
+	case c.messages <- m:
+	case <-c.done:
+	}
+}
+
+func (c *Client) dispatchLoop() {
+	for {
+		select {
+		case m := <-c.messages:
+			c.dispatch(m)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// dispatch calls each handler whose route matches m's topic, or the default handler if none do.
+func (c *Client) dispatch(m *Message) {
+	var handlers []mqtt.MessageHandler
+	c.lock.Lock()
+	for _, r := range c.routes {
+		if match(r.filter, m.topic) {
+			handlers = append(handlers, r.handler)
+		}
+	}
+	c.lock.Unlock()
+	if len(handlers) == 0 && c.opts.DefaultPublishHandler != nil {
+		handlers = append(handlers, c.opts.DefaultPublishHandler)
+	}
+	for _, h := range handlers {
+		h(c, m)
+	}
+}
+
+// match reports whether the topic filter matches topic. Shared subscriptions match as their
+// underlying filter.
+func match(filter, topic string) bool {
+	if rest, ok := strings.CutPrefix(filter, "$share/"); ok {
+		if _, f, ok := strings.Cut(rest, "/"); ok {
+			filter = f
+		}
+	}
+	fl := strings.Split(filter, "/")
+	tl := strings.Split(topic, "/")
+	// Wildcards at the first level don't match topics like `$SYS/...`.
+	if strings.HasPrefix(topic, "$") && (fl[0] == "+" || fl[0] == "#") {
+		return false
+	}
+	for i, f := range fl {
+		if f == "#" {
+			return true
+		}
+		if i >= len(tl) || (f != "+" && f != tl[i]) {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
@@ -0,0 +1,144 @@
+package mqtt5
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testClientOptions(b *TestBroker, id string) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	opts.Servers = append(opts.Servers, b.URL())
+	opts.ClientID = id
+	opts.KeepAlive = 1
+	return opts
+}
+
+func connect(t *testing.T, c *Client) {
+	token := c.Connect()
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+	t.Cleanup(func() { c.Disconnect(0) })
+}
+
+func wait(t *testing.T, token mqtt.Token) {
+	require.True(t, token.WaitTimeout(5*time.Second))
+	require.NoError(t, token.Error())
+}
+
+func TestRequestResponse(t *testing.T) {
+	b := NewTestBroker(t)
+	requester := NewClient(testClientOptions(b, "requester"))
+	responder := NewClient(testClientOptions(b, "responder"))
+	connect(t, requester)
+	connect(t, responder)
+
+	wait(t, responder.Subscribe("device/rpc", 1, func(c mqtt.Client, m mqtt.Message) {
+		req := m.(*Message)
+		c.(*Client).PublishWithProperties(&Publication{
+			Topic:           req.ResponseTopic(),
+			QoS:             1,
+			Payload:         []byte("response"),
+			CorrelationData: req.CorrelationData(),
+		})
+	}))
+	responses := make(chan *Message, 1)
+	wait(t, requester.Subscribe("requester/rpc", 1, func(_ mqtt.Client, m mqtt.Message) {
+		responses <- m.(*Message)
+	}))
+
+	wait(t, requester.PublishWithProperties(&Publication{
+		Topic:           "device/rpc",
+		QoS:             1,
+		Payload:         []byte("request"),
+		ResponseTopic:   "requester/rpc",
+		CorrelationData: []byte("42"),
+	}))
+	select {
+	case m := <-responses:
+		assert.Equal(t, "requester/rpc", m.Topic())
+		assert.Equal(t, []byte("response"), m.Payload())
+		assert.Equal(t, []byte("42"), m.CorrelationData())
+		assert.Equal(t, byte(1), m.Qos())
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for response")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	b := NewTestBroker(t)
+	c := NewClient(testClientOptions(b, "routes"))
+	connect(t, c)
+
+	all := make(chan string, 10)
+	status := make(chan string, 10)
+	wait(t, c.Subscribe("#", 0, func(_ mqtt.Client, m mqtt.Message) { all <- m.Topic() }))
+	wait(t, c.Subscribe("+/status/+", 0, func(_ mqtt.Client, m mqtt.Message) { status <- m.Topic() }))
+
+	wait(t, c.Publish("garage/status/switch:0", 0, false, "{}"))
+	assert.Equal(t, "garage/status/switch:0", <-all)
+	assert.Equal(t, "garage/status/switch:0", <-status)
+
+	wait(t, c.Unsubscribe("+/status/+"))
+	wait(t, c.Publish("garage/status/switch:0", 1, false, []byte("{}")))
+	assert.Equal(t, "garage/status/switch:0", <-all)
+	select {
+	case topic := <-status:
+		t.Fatalf("unexpected message on unsubscribed route: %s", topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	b := NewTestBroker(t)
+	opts := testClientOptions(b, "reconnect")
+	connects := make(chan struct{}, 10)
+	lost := make(chan error, 10)
+	opts.SetAutoReconnect(true)
+	opts.SetOnConnectHandler(func(mqtt.Client) { connects <- struct{}{} })
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) { lost <- err })
+	c := NewClient(opts)
+	connect(t, c)
+	<-connects
+
+	b.DropConnections()
+	select {
+	case err := <-lost:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for connection loss")
+	}
+	select {
+	case <-connects:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reconnect")
+	}
+	assert.True(t, c.IsConnected())
+
+	c.Disconnect(0)
+	assert.False(t, c.IsConnected())
+	assert.ErrorIs(t, c.Publish("topic", 1, false, "").Error(), mqtt.ErrNotConnected)
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"#", "$SYS/uptime", false},
+		{"+/status/+", "garage/status/switch:0", true},
+		{"$share/group/a/+", "a/b", true},
+	} {
+		assert.Equal(t, tc.want, match(tc.filter, tc.topic), "%s %s", tc.filter, tc.topic)
+	}
+}
@@ -0,0 +1,528 @@
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types, from section 2.1.2 of the MQTT v5 specification.
+const (
+	packetConnect     byte = 1
+	packetConnack     byte = 2
+	packetPublish     byte = 3
+	packetPuback      byte = 4
+	packetSubscribe   byte = 8
+	packetSuback      byte = 9
+	packetUnsubscribe byte = 10
+	packetUnsuback    byte = 11
+	packetPingreq     byte = 12
+	packetPingresp    byte = 13
+	packetDisconnect  byte = 14
+)
+
+// Property identifiers, from section 2.2.2.2 of the MQTT v5 specification.
+const (
+	propPayloadFormat      byte = 0x01
+	propMessageExpiry      byte = 0x02
+	propContentType        byte = 0x03
+	propResponseTopic      byte = 0x08
+	propCorrelationData    byte = 0x09
+	propSubscriptionID     byte = 0x0b
+	propSessionExpiry      byte = 0x11
+	propAssignedClientID   byte = 0x12
+	propServerKeepAlive    byte = 0x13
+	propAuthMethod         byte = 0x15
+	propAuthData           byte = 0x16
+	propRequestProblemInfo byte = 0x17
+	propWillDelay          byte = 0x18
+	propRequestRespInfo    byte = 0x19
+	propResponseInfo       byte = 0x1a
+	propServerReference    byte = 0x1c
+	propReasonString       byte = 0x1f
+	propReceiveMaximum     byte = 0x21
+	propTopicAliasMaximum  byte = 0x22
+	propTopicAlias         byte = 0x23
+	propMaximumQoS         byte = 0x24
+	propRetainAvailable    byte = 0x25
+	propUserProperty       byte = 0x26
+	propMaximumPacketSize  byte = 0x27
+	propWildcardSubAvail   byte = 0x28
+	propSubIDAvailable     byte = 0x29
+	propSharedSubAvailable byte = 0x2a
+)
+
+// maxRemainingLength is the largest remaining length a variable byte integer can encode.
+const maxRemainingLength = 268435455
+
+var errMalformed = errors.New("malformed MQTT packet")
+
+// properties holds the MQTT v5 properties this package uses. Others are skipped when decoding.
+type properties struct {
+	responseTopic    string
+	correlationData  []byte
+	sessionExpiry    uint32
+	serverKeepAlive  *uint16
+	receiveMaximum   uint16
+	reasonString     string
+	assignedClientID string
+}
+
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads a control packet: its fixed header and remaining length, then its body.
+func readPacket(r *bufio.Reader) (packet, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	n, err := readVarInt(r)
+	if err != nil {
+		return packet{}, err
+	}
+	p := packet{kind: h >> 4, flags: h & 0x0f, body: make([]byte, n)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return packet{}, err
+	}
+	return p, nil
+}
+
+func writePacket(w io.Writer, kind, flags byte, body []byte) error {
+	if len(body) > maxRemainingLength {
+		return fmt.Errorf("MQTT packet of %d bytes is too large", len(body))
+	}
+	b := make([]byte, 0, len(body)+5)
+	b = append(b, kind<<4|flags&0x0f)
+	b = appendVarInt(b, len(body))
+	b = append(b, body...)
+	_, err := w.Write(b)
+	return err
+}
+
+func readVarInt(r io.ByteReader) (int, error) {
+	var n int
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			return n, nil
+		}
+	}
+	return 0, errMalformed
+}
+
+func appendVarInt(b []byte, n int) []byte {
+	for {
+		d := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// encoder builds a packet body.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func (e *encoder) binary(b []byte) {
+	e.uint16(uint16(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) string(s string) {
+	e.uint16(uint16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) properties(p properties) {
+	var pe encoder
+	if p.sessionExpiry > 0 {
+		pe.WriteByte(propSessionExpiry)
+		pe.uint32(p.sessionExpiry)
+	}
+	if p.serverKeepAlive != nil {
+		pe.WriteByte(propServerKeepAlive)
+		pe.uint16(*p.serverKeepAlive)
+	}
+	if p.receiveMaximum > 0 {
+		pe.WriteByte(propReceiveMaximum)
+		pe.uint16(p.receiveMaximum)
+	}
+	if p.assignedClientID != "" {
+		pe.WriteByte(propAssignedClientID)
+		pe.string(p.assignedClientID)
+	}
+	if p.responseTopic != "" {
+		pe.WriteByte(propResponseTopic)
+		pe.string(p.responseTopic)
+	}
+	if p.correlationData != nil {
+		pe.WriteByte(propCorrelationData)
+		pe.binary(p.correlationData)
+	}
+	if p.reasonString != "" {
+		pe.WriteByte(propReasonString)
+		pe.string(p.reasonString)
+	}
+	e.Write(appendVarInt(nil, pe.Len()))
+	e.Write(pe.Bytes())
+}
+
+// decoder reads a packet body. The first error is kept, and later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err = errMalformed
+		return nil
+	}
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) varInt() int {
+	if d.err != nil {
+		return 0
+	}
+	r := bytes.NewReader(d.b)
+	n, err := readVarInt(r)
+	if err != nil {
+		d.err = errMalformed
+		return 0
+	}
+	d.b = d.b[len(d.b)-r.Len():]
+	return n
+}
+
+func (d *decoder) binary() []byte {
+	return d.next(int(d.uint16()))
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) properties() properties {
+	var p properties
+	pd := decoder{b: d.next(d.varInt())}
+	for d.err == nil && pd.err == nil && len(pd.b) > 0 {
+		switch id := pd.byte(); id {
+		case propResponseTopic:
+			p.responseTopic = pd.string()
+		case propCorrelationData:
+			p.correlationData = pd.binary()
+		case propSessionExpiry:
+			p.sessionExpiry = pd.uint32()
+		case propServerKeepAlive:
+			v := pd.uint16()
+			p.serverKeepAlive = &v
+		case propReceiveMaximum:
+			p.receiveMaximum = pd.uint16()
+		case propReasonString:
+			p.reasonString = pd.string()
+		case propAssignedClientID:
+			p.assignedClientID = pd.string()
+		case propPayloadFormat, propRequestProblemInfo, propRequestRespInfo, propMaximumQoS,
+			propRetainAvailable, propWildcardSubAvail, propSubIDAvailable, propSharedSubAvailable:
+			pd.byte()
+		case propTopicAliasMaximum, propTopicAlias:
+			pd.uint16()
+		case propMessageExpiry, propWillDelay, propMaximumPacketSize:
+			pd.uint32()
+		case propSubscriptionID:
+			pd.varInt()
+		case propContentType, propAuthMethod, propResponseInfo, propServerReference:
+			pd.string()
+		case propAuthData:
+			pd.binary()
+		case propUserProperty:
+			pd.string()
+			pd.string()
+		default:
+			pd.err = fmt.Errorf("%w: unknown property 0x%02x", errMalformed, id)
+		}
+	}
+	if d.err == nil {
+		d.err = pd.err
+	}
+	return p
+}
+
+type connectPacket struct {
+	clientID   string
+	username   string
+	password   string
+	keepAlive  uint16
+	cleanStart bool
+	props      properties
+}
+
+func (p *connectPacket) encode() []byte {
+	var e encoder
+	e.string("MQTT")
+	e.WriteByte(5)
+	var flags byte
+	if p.cleanStart {
+		flags |= 0x02
+	}
+	if p.username != "" {
+		flags |= 0x80
+		if p.password != "" {
+			flags |= 0x40
+		}
+	}
+	e.WriteByte(flags)
+	e.uint16(p.keepAlive)
+	e.properties(p.props)
+	e.string(p.clientID)
+	if p.username != "" {
+		e.string(p.username)
+		if p.password != "" {
+			e.string(p.password)
+		}
+	}
+	return e.Bytes()
+}
+
+func decodeConnect(body []byte) (*connectPacket, error) {
+	d := decoder{b: body}
+	if name, version := d.string(), d.byte(); d.err == nil && (name != "MQTT" || version != 5) {
+		return nil, fmt.Errorf("unsupported MQTT protocol %q version %d", name, version)
+	}
+	flags := d.byte()
+	p := &connectPacket{cleanStart: flags&0x02 != 0, keepAlive: d.uint16()}
+	p.props = d.properties()
+	p.clientID = d.string()
+	if flags&0x04 != 0 {
+		return nil, errors.New("will messages aren't supported")
+	}
+	if flags&0x80 != 0 {
+		p.username = d.string()
+	}
+	if flags&0x40 != 0 {
+		p.password = d.string()
+	}
+	return p, d.err
+}
+
+type connackPacket struct {
+	sessionPresent bool
+	reason         byte
+	props          properties
+}
+
+func (p *connackPacket) encode() []byte {
+	var e encoder
+	if p.sessionPresent {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+	e.WriteByte(p.reason)
+	e.properties(p.props)
+	return e.Bytes()
+}
+
+func decodeConnack(body []byte) (*connackPacket, error) {
+	d := decoder{b: body}
+	p := &connackPacket{sessionPresent: d.byte()&0x01 != 0, reason: d.byte()}
+	p.props = d.properties()
+	return p, d.err
+}
+
+type publishPacket struct {
+	topic    string
+	qos      byte
+	retained bool
+	dup      bool
+	id       uint16
+	props    properties
+	payload  []byte
+}
+
+func (p *publishPacket) encode() (flags byte, body []byte) {
+	flags = p.qos << 1
+	if p.retained {
+		flags |= 0x01
+	}
+	if p.dup {
+		flags |= 0x08
+	}
+	var e encoder
+	e.string(p.topic)
+	if p.qos > 0 {
+		e.uint16(p.id)
+	}
+	e.properties(p.props)
+	e.Write(p.payload)
+	return flags, e.Bytes()
+}
+
+func decodePublish(flags byte, body []byte) (*publishPacket, error) {
+	d := decoder{b: body}
+	p := &publishPacket{
+		qos:      (flags >> 1) & 0x03,
+		retained: flags&0x01 != 0,
+		dup:      flags&0x08 != 0,
+		topic:    d.string(),
+	}
+	if p.qos > 0 {
+		p.id = d.uint16()
+	}
+	p.props = d.properties()
+	p.payload = d.b
+	return p, d.err
+}
+
+// ackPacket is a PUBACK, SUBACK, or UNSUBACK. PUBACK carries a single reason code.
+type ackPacket struct {
+	id      uint16
+	props   properties
+	reasons []byte
+}
+
+func (p *ackPacket) encode(kind byte) []byte {
+	var e encoder
+	e.uint16(p.id)
+	if kind == packetPuback {
+		if len(p.reasons) == 0 {
+			return e.Bytes()
+		}
+		e.WriteByte(p.reasons[0])
+		e.properties(p.props)
+		return e.Bytes()
+	}
+	e.properties(p.props)
+	e.Write(p.reasons)
+	return e.Bytes()
+}
+
+func decodeAck(kind byte, body []byte) (*ackPacket, error) {
+	d := decoder{b: body}
+	p := &ackPacket{id: d.uint16()}
+	if kind == packetPuback {
+		// The reason code and properties are omitted on success.
+		if len(d.b) > 0 {
+			p.reasons = []byte{d.byte()}
+		}
+		if len(d.b) > 0 {
+			p.props = d.properties()
+		}
+		return p, d.err
+	}
+	p.props = d.properties()
+	p.reasons = d.b
+	return p, d.err
+}
+
+// subscribePacket is a SUBSCRIBE or UNSUBSCRIBE. UNSUBSCRIBE has no QoS.
+type subscribePacket struct {
+	id      uint16
+	filters []string
+	qos     []byte
+}
+
+func (p *subscribePacket) encode(kind byte) []byte {
+	var e encoder
+	e.uint16(p.id)
+	e.properties(properties{})
+	for i, f := range p.filters {
+		e.string(f)
+		if kind == packetSubscribe {
+			e.WriteByte(p.qos[i])
+		}
+	}
+	return e.Bytes()
+}
+
+func decodeSubscribe(kind byte, body []byte) (*subscribePacket, error) {
+	d := decoder{b: body}
+	p := &subscribePacket{id: d.uint16()}
+	d.properties()
+	for d.err == nil && len(d.b) > 0 {
+		p.filters = append(p.filters, d.string())
+		if kind == packetSubscribe {
+			p.qos = append(p.qos, d.byte()&0x03)
+		}
+	}
+	return p, d.err
+}
+
+// disconnectPacket is sent by either side to close the connection. An empty body means a
+// normal disconnection.
+type disconnectPacket struct {
+	reason byte
+	props  properties
+}
+
+func decodeDisconnect(body []byte) (*disconnectPacket, error) {
+	d := decoder{b: body}
+	p := &disconnectPacket{}
+	if len(d.b) > 0 {
+		p.reason = d.byte()
+	}
+	if len(d.b) > 0 {
+		p.props = d.properties()
+	}
+	return p, d.err
+}
+
+// reasonError describes a failure reason code, with the broker's reason string if it sent one.
+func reasonError(op string, reason byte, props properties) error {
+	if props.reasonString != "" {
+		return fmt.Errorf("%s: reason code 0x%02x: %s", op, reason, props.reasonString)
+	}
+	return fmt.Errorf("%s: reason code 0x%02x", op, reason)
+}
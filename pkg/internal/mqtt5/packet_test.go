@@ -0,0 +1,98 @@
+package mqtt5
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVarInt(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, maxRemainingLength} {
+		b := appendVarInt(nil, n)
+		got, err := readVarInt(bytes.NewReader(b))
+		require.NoError(t, err)
+		assert.Equal(t, n, got)
+	}
+	_, err := readVarInt(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x01}))
+	assert.ErrorIs(t, err, errMalformed)
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	in := &publishPacket{
+		topic:    "shellyplugus-0123456789ab/rpc",
+		qos:      1,
+		retained: true,
+		id:       42,
+		props: properties{
+			responseTopic:   "shellyctl/rpc",
+			correlationData: []byte("7"),
+		},
+		payload: []byte(`{"id":7,"method":"Shelly.GetStatus"}`),
+	}
+	flags, body := in.encode()
+	var buf bytes.Buffer
+	require.NoError(t, writePacket(&buf, packetPublish, flags, body))
+	p, err := readPacket(bufio.NewReader(&buf))
+	require.NoError(t, err)
+	require.Equal(t, packetPublish, p.kind)
+	out, err := decodePublish(p.flags, p.body)
+	require.NoError(t, err)
+	assert.Equal(t, in, out)
+}
+
+func TestDecodeSkipsUnknownProperties(t *testing.T) {
+	var pe encoder
+	pe.WriteByte(propUserProperty)
+	pe.string("key")
+	pe.string("value")
+	pe.WriteByte(propMessageExpiry)
+	pe.uint32(60)
+	pe.WriteByte(propContentType)
+	pe.string("application/json")
+	pe.WriteByte(propCorrelationData)
+	pe.binary([]byte("abc"))
+
+	var e encoder
+	e.string("topic")
+	e.Write(appendVarInt(nil, pe.Len()))
+	e.Write(pe.Bytes())
+	e.WriteString("payload")
+
+	p, err := decodePublish(0, e.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, "topic", p.topic)
+	assert.Equal(t, []byte("abc"), p.props.correlationData)
+	assert.Equal(t, []byte("payload"), p.payload)
+
+	_, err = decodePublish(0, []byte{0, 5, 't'})
+	assert.ErrorIs(t, err, errMalformed)
+}
+
+func TestConnectRoundTrip(t *testing.T) {
+	in := &connectPacket{
+		clientID:   "shellyctl-1",
+		username:   "user",
+		password:   "pass",
+		keepAlive:  10,
+		cleanStart: true,
+	}
+	out, err := decodeConnect(in.encode())
+	require.NoError(t, err)
+	assert.Equal(t, in, out)
+}
+
+func TestAckRoundTrip(t *testing.T) {
+	for _, kind := range []byte{packetPuback, packetSuback, packetUnsuback} {
+		in := &ackPacket{id: 9, reasons: []byte{0x87}, props: properties{reasonString: "not authorized"}}
+		out, err := decodeAck(kind, in.encode(kind))
+		require.NoError(t, err)
+		assert.Equal(t, in, out)
+	}
+	// A successful PUBACK may omit its reason code.
+	out, err := decodeAck(packetPuback, (&ackPacket{id: 3}).encode(packetPuback))
+	require.NoError(t, err)
+	assert.Equal(t, &ackPacket{id: 3}, out)
+}
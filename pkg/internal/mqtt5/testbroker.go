@@ -0,0 +1,193 @@
+package mqtt5
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// TestBroker is an in-process MQTT v5 broker for tests. It routes QoS 0 and 1 messages between
+// its clients with their properties, sending each client one copy of a message however many of
+// its subscriptions match. Messages aren't retained and sessions aren't persisted.
+type TestBroker struct {
+	l net.Listener
+
+	lock  sync.Mutex
+	conns map[*brokerConn]struct{}
+}
+
+type brokerConn struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+	// subs and nextID are guarded by the broker's lock.
+	subs   map[string]byte
+	nextID uint16
+}
+
+func (bc *brokerConn) write(kind, flags byte, body []byte) error {
+	bc.writeLock.Lock()
+	defer bc.writeLock.Unlock()
+	return writePacket(bc.conn, kind, flags, body)
+}
+
+// NewTestBroker starts a broker listening on the loopback interface. It's closed when the test
+// ends.
+func NewTestBroker(t testing.TB) *TestBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening for mqtt: %v", err)
+	}
+	b := &TestBroker{l: l, conns: make(map[*brokerConn]struct{})}
+	go b.serve()
+	t.Cleanup(func() {
+		l.Close()
+		b.DropConnections()
+	})
+	return b
+}
+
+// URL returns the broker's address.
+func (b *TestBroker) URL() *url.URL {
+	return &url.URL{Scheme: "tcp", Host: b.l.Addr().String()}
+}
+
+// DropConnections closes every client connection, as if the network failed.
+func (b *TestBroker) DropConnections() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for bc := range b.conns {
+		bc.conn.Close()
+		delete(b.conns, bc)
+	}
+}
+
+func (b *TestBroker) serve() {
+	for {
+		conn, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *TestBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil || p.kind != packetConnect {
+		return
+	}
+	bc := &brokerConn{conn: conn, subs: make(map[string]byte)}
+	if _, err := decodeConnect(p.body); err != nil {
+		bc.write(packetConnack, 0, (&connackPacket{reason: 0x84}).encode())
+		return
+	}
+	b.lock.Lock()
+	b.conns[bc] = struct{}{}
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		delete(b.conns, bc)
+		b.lock.Unlock()
+	}()
+	if bc.write(packetConnack, 0, (&connackPacket{}).encode()) != nil {
+		return
+	}
+	for {
+		p, err := readPacket(r)
+		if err == nil {
+			err = b.handlePacket(bc, p)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+var errClientDisconnected = errors.New("client disconnected")
+
+func (b *TestBroker) handlePacket(bc *brokerConn, p packet) error {
+	switch p.kind {
+	case packetSubscribe, packetUnsubscribe:
+		sp, err := decodeSubscribe(p.kind, p.body)
+		if err != nil {
+			return err
+		}
+		ack := &ackPacket{id: sp.id, reasons: make([]byte, len(sp.filters))}
+		b.lock.Lock()
+		for i, f := range sp.filters {
+			if p.kind == packetSubscribe {
+				bc.subs[f] = sp.qos[i]
+				ack.reasons[i] = sp.qos[i]
+			} else {
+				delete(bc.subs, f)
+			}
+		}
+		b.lock.Unlock()
+		if p.kind == packetSubscribe {
+			return bc.write(packetSuback, 0, ack.encode(packetSuback))
+		}
+		return bc.write(packetUnsuback, 0, ack.encode(packetUnsuback))
+	case packetPublish:
+		pp, err := decodePublish(p.flags, p.body)
+		if err != nil {
+			return err
+		}
+		if pp.qos > 0 {
+			if err := bc.write(packetPuback, 0, (&ackPacket{id: pp.id}).encode(packetPuback)); err != nil {
+				return err
+			}
+		}
+		b.route(pp)
+	case packetPingreq:
+		return bc.write(packetPingresp, 0, nil)
+	case packetDisconnect:
+		return errClientDisconnected
+	}
+	return nil
+}
+
+// route sends pp to each client with a matching subscription, at the lower of their QoS.
+func (b *TestBroker) route(pp *publishPacket) {
+	type delivery struct {
+		bc    *brokerConn
+		flags byte
+		body  []byte
+	}
+	var deliveries []delivery
+	b.lock.Lock()
+	for bc := range b.conns {
+		matched := false
+		var qos byte
+		for f, subQoS := range bc.subs {
+			if match(f, pp.topic) {
+				matched = true
+				qos = max(qos, min(subQoS, pp.qos))
+			}
+		}
+		if !matched {
+			continue
+		}
+		out := *pp
+		out.qos = qos
+		out.retained = false
+		out.dup = false
+		if qos > 0 {
+			bc.nextID++
+			if bc.nextID == 0 {
+				bc.nextID++
+			}
+			out.id = bc.nextID
+		}
+		flags, body := out.encode()
+		deliveries = append(deliveries, delivery{bc: bc, flags: flags, body: body})
+	}
+	b.lock.Unlock()
+	for _, d := range deliveries {
+		d.bc.write(packetPublish, d.flags, d.body)
+	}
+}
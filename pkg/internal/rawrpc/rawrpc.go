@@ -0,0 +1,40 @@
+// Package rawrpc builds RPC requests for methods which are only known at runtime, like those
+// configured by users or relayed from MQTT.
+package rawrpc
+
+import (
+	"encoding/json"
+
+	"github.com/jcodybaker/go-shelly"
+)
+
+// Request is an RPC request body for an arbitrary method. Its response is decoded as raw JSON.
+type Request struct {
+	method string
+	params json.RawMessage
+}
+
+var _ shelly.RPCRequestBody = (*Request)(nil)
+
+// NewRequest creates a request for method. Empty params are sent as an empty object.
+func NewRequest(method string, params json.RawMessage) *Request {
+	return &Request{method: method, params: params}
+}
+
+// Method implements shelly.RPCRequestBody.
+func (r *Request) Method() string {
+	return r.method
+}
+
+// NewResponse implements shelly.RPCRequestBody.
+func (r *Request) NewResponse() any {
+	return &json.RawMessage{}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *Request) MarshalJSON() ([]byte, error) {
+	if len(r.params) == 0 {
+		return []byte("{}"), nil
+	}
+	return r.params, nil
+}
@@ -0,0 +1,22 @@
+package rawrpc
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequest(t *testing.T) {
+	r := NewRequest("Switch.Set", json.RawMessage(`{"id":0,"on":true}`))
+	assert.Equal(t, "Switch.Set", r.Method())
+	b, err := json.Marshal(r)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":0,"on":true}`, string(b))
+
+	b, err = json.Marshal(NewRequest("Shelly.GetStatus", nil))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{}`, string(b))
+	assert.IsType(t, &json.RawMessage{}, r.NewResponse())
+}
@@ -0,0 +1,245 @@
+// Package labels maps devices to the set of labels attached to exported metrics. It's shared by
+// the prometheus and otel exporters so both report devices consistently.
+package labels
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jcodybaker/go-shelly"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// LocationTZ is the label name for the device's configured timezone.
+	LocationTZ = "location_tz"
+	// LocationLat is the label name for the device's configured latitude.
+	LocationLat = "location_lat"
+	// LocationLon is the label name for the device's configured longitude.
+	LocationLon = "location_lon"
+)
+
+var (
+	reLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// reservedNames are label names used by the exporters for device and component labels.
+	reservedNames = map[string]struct{}{
+		"instance":       {},
+		"mac":            {},
+		"device_name":    {},
+		"component_name": {},
+		"component":      {},
+		"id":             {},
+		"state":          {},
+		"error":          {},
+		"type":           {},
+		LocationTZ:       {},
+		LocationLat:      {},
+		LocationLon:      {},
+	}
+)
+
+// Device describes the properties of a device which may be mapped to labels.
+type Device struct {
+	Instance string
+	MAC      string
+	Name     string
+	// Location is the device's configured location from Sys.GetConfig, if known.
+	Location *shelly.SysLocationConfig
+}
+
+var reMACFromSrc = regexp.MustCompile(`^shelly.+-([A-Za-z0-9]{12})$`)
+
+// SrcDevice describes a device known only by the src of its notifications, ex.
+// `shellyplus1-a8032abe5424`. The MAC is parsed from the src when possible.
+func SrcDevice(src string) Device {
+	d := Device{
+		Instance: src,
+		Name:     src,
+	}
+	if m := reMACFromSrc.FindStringSubmatch(src); len(m) == 2 {
+		d.MAC = m[1]
+	}
+	return d
+}
+
+// Mapper builds the labels for a device.
+type Mapper struct {
+	static       map[string]string
+	devices      map[string]map[string]string
+	dropInstance bool
+	location     bool
+
+	// extra is the sorted list of static and per-device label names.
+	extra []string
+}
+
+// Option configures a Mapper.
+type Option func(*Mapper)
+
+// WithStaticLabels adds labels to every device.
+func WithStaticLabels(labels map[string]string) Option {
+	return func(m *Mapper) {
+		for k, v := range labels {
+			m.static[k] = v
+		}
+	}
+}
+
+// WithDeviceLabels adds labels to a single device. The device may be identified by its MAC
+// address, name, or instance. Device labels take precedence over static labels of the same name.
+func WithDeviceLabels(device string, labels map[string]string) Option {
+	return func(m *Mapper) {
+		key := deviceKey(device)
+		if m.devices[key] == nil {
+			m.devices[key] = make(map[string]string)
+		}
+		for k, v := range labels {
+			m.devices[key][k] = v
+		}
+	}
+}
+
+// WithDropInstance omits the instance label. The instance identifies the device's address and
+// transport, so it may change independently of the device and inflate cardinality.
+func WithDropInstance(drop bool) Option {
+	return func(m *Mapper) {
+		m.dropInstance = drop
+	}
+}
+
+// WithLocation adds location_tz, location_lat and location_lon labels from the device's
+// configured location.
+func WithLocation(enabled bool) Option {
+	return func(m *Mapper) {
+		m.location = enabled
+	}
+}
+
+// Location reports whether location labels are enabled, so callers can skip fetching the
+// device's location when they aren't.
+func (m *Mapper) Location() bool {
+	return m.location
+}
+
+// NewMapper creates a Mapper. Without options it produces the default instance, mac and
+// device_name labels.
+func NewMapper(opts ...Option) (*Mapper, error) {
+	m := &Mapper{
+		static:  make(map[string]string),
+		devices: make(map[string]map[string]string),
+	}
+	for _, o := range opts {
+		o(m)
+	}
+	names := make(map[string]struct{})
+	for k := range m.static {
+		names[k] = struct{}{}
+	}
+	for _, labels := range m.devices {
+		for k := range labels {
+			names[k] = struct{}{}
+		}
+	}
+	for k := range names {
+		if !reLabelName.MatchString(k) {
+			return nil, fmt.Errorf("invalid label name %q", k)
+		}
+		if _, ok := reservedNames[k]; ok {
+			return nil, fmt.Errorf("label name %q is reserved", k)
+		}
+		m.extra = append(m.extra, k)
+	}
+	sort.Strings(m.extra)
+	return m, nil
+}
+
+// Names returns the device label names in the order values are returned by Values.
+func (m *Mapper) Names() []string {
+	var names []string
+	if !m.dropInstance {
+		names = append(names, "instance")
+	}
+	names = append(names, "mac", "device_name")
+	if m.location {
+		names = append(names, LocationTZ, LocationLat, LocationLon)
+	}
+	return append(names, m.extra...)
+}
+
+// Values returns the label values for a device, aligned with Names. Labels which don't apply
+// to the device have an empty value.
+func (m *Mapper) Values(d Device) []string {
+	var values []string
+	if !m.dropInstance {
+		values = append(values, d.Instance)
+	}
+	values = append(values, d.MAC, d.Name)
+	if m.location {
+		var tz, lat, lon string
+		if d.Location != nil {
+			if d.Location.TZ != nil {
+				tz = *d.Location.TZ
+			}
+			if d.Location.Lat != nil {
+				lat = strconv.FormatFloat(*d.Location.Lat, 'f', -1, 64)
+			}
+			if d.Location.Lon != nil {
+				lon = strconv.FormatFloat(*d.Location.Lon, 'f', -1, 64)
+			}
+		}
+		values = append(values, tz, lat, lon)
+	}
+	deviceLabels := m.deviceLabels(d)
+	for _, k := range m.extra {
+		v, ok := deviceLabels[k]
+		if !ok {
+			v = m.static[k]
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// Attributes returns the device labels as otel attributes. Labels with empty values are omitted.
+func (m *Mapper) Attributes(d Device) []attribute.KeyValue {
+	names := m.Names()
+	values := m.Values(d)
+	attrs := make([]attribute.KeyValue, 0, len(names))
+	for i, k := range names {
+		if values[i] == "" {
+			continue
+		}
+		attrs = append(attrs, attribute.String(k, values[i]))
+	}
+	return attrs
+}
+
+func (m *Mapper) deviceLabels(d Device) map[string]string {
+	if len(m.devices) == 0 {
+		return nil
+	}
+	for _, id := range []string{d.MAC, d.Name, d.Instance} {
+		if id == "" {
+			continue
+		}
+		if labels, ok := m.devices[deviceKey(id)]; ok {
+			return labels
+		}
+	}
+	return nil
+}
+
+// deviceKey normalizes a device identifier so MAC addresses match regardless of case or separators.
+func deviceKey(id string) string {
+	id = strings.ToLower(id)
+	if reMAC.MatchString(id) {
+		id = strings.NewReplacer(":", "", "-", "").Replace(id)
+	}
+	return id
+}
+
+var reMAC = regexp.MustCompile(`^[0-9a-f]{2}([:-]?[0-9a-f]{2}){5}$`)
@@ -0,0 +1,108 @@
+package labels
+
+import (
+	"testing"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+func TestMapper(t *testing.T) {
+	kitchen := Device{
+		Instance: "http://192.168.1.2/rpc",
+		MAC:      "A8032ABE5424",
+		Name:     "kitchen",
+		Location: &shelly.SysLocationConfig{
+			TZ:  shelly.StrPtr("America/New_York"),
+			Lat: shelly.Float64Ptr(40.7),
+			Lon: shelly.Float64Ptr(-74),
+		},
+	}
+	garage := Device{
+		Instance: "http://192.168.1.3/rpc",
+		MAC:      "A8032ABE5425",
+		Name:     "garage",
+	}
+
+	tcs := []struct {
+		name          string
+		opts          []Option
+		expectNames   []string
+		expectKitchen []string
+		expectGarage  []string
+	}{
+		{
+			name:          "default",
+			expectNames:   []string{"instance", "mac", "device_name"},
+			expectKitchen: []string{"http://192.168.1.2/rpc", "A8032ABE5424", "kitchen"},
+			expectGarage:  []string{"http://192.168.1.3/rpc", "A8032ABE5425", "garage"},
+		},
+		{
+			name:          "drop instance",
+			opts:          []Option{WithDropInstance(true)},
+			expectNames:   []string{"mac", "device_name"},
+			expectKitchen: []string{"A8032ABE5424", "kitchen"},
+			expectGarage:  []string{"A8032ABE5425", "garage"},
+		},
+		{
+			name: "static and device labels",
+			opts: []Option{
+				WithStaticLabels(map[string]string{"site": "home", "floor": "1"}),
+				WithDeviceLabels("a8:03:2a:be:54:24", map[string]string{"room": "kitchen"}),
+				WithDeviceLabels("garage", map[string]string{"floor": "0"}),
+			},
+			expectNames:   []string{"instance", "mac", "device_name", "floor", "room", "site"},
+			expectKitchen: []string{"http://192.168.1.2/rpc", "A8032ABE5424", "kitchen", "1", "kitchen", "home"},
+			expectGarage:  []string{"http://192.168.1.3/rpc", "A8032ABE5425", "garage", "0", "", "home"},
+		},
+		{
+			name:          "location",
+			opts:          []Option{WithLocation(true), WithDropInstance(true)},
+			expectNames:   []string{"mac", "device_name", LocationTZ, LocationLat, LocationLon},
+			expectKitchen: []string{"A8032ABE5424", "kitchen", "America/New_York", "40.7", "-74"},
+			expectGarage:  []string{"A8032ABE5425", "garage", "", "", ""},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewMapper(tc.opts...)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectNames, m.Names())
+			assert.Equal(t, tc.expectKitchen, m.Values(kitchen))
+			assert.Equal(t, tc.expectGarage, m.Values(garage))
+		})
+	}
+}
+
+func TestMapperInvalidNames(t *testing.T) {
+	_, err := NewMapper(WithStaticLabels(map[string]string{"instance": "x"}))
+	require.Error(t, err)
+	_, err = NewMapper(WithDeviceLabels("garage", map[string]string{"my-label": "x"}))
+	require.Error(t, err)
+}
+
+func TestMapperAttributes(t *testing.T) {
+	m, err := NewMapper(WithStaticLabels(map[string]string{"site": "home"}), WithLocation(true))
+	require.NoError(t, err)
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.String("instance", "shellyplus1-a8032abe5425"),
+		attribute.String("mac", "A8032ABE5425"),
+		attribute.String("device_name", "garage"),
+		attribute.String("site", "home"),
+	}, m.Attributes(Device{
+		Instance: "shellyplus1-a8032abe5425",
+		MAC:      "A8032ABE5425",
+		Name:     "garage",
+	}))
+}
+
+func TestSrcDevice(t *testing.T) {
+	assert.Equal(t, Device{
+		Instance: "shellyplus1-a8032abe5424",
+		MAC:      "a8032abe5424",
+		Name:     "shellyplus1-a8032abe5424",
+	}, SrcDevice("shellyplus1-a8032abe5424"))
+	assert.Equal(t, Device{Instance: "custom", Name: "custom"}, SrcDevice("custom"))
+}
@@ -0,0 +1,134 @@
+package otelserver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// accumulatedEnergy reports energy totals which remain monotonic across device counter resets.
+type accumulatedEnergy struct {
+	accumulator *energy.Accumulator
+
+	total         metric.Float64ObservableCounter
+	totalReturned metric.Float64ObservableCounter
+	resets        metric.Int64ObservableCounter
+
+	// attrSets holds the most recent attributes of each counter. Counters loaded from the state
+	// file aren't reported until their device is seen again.
+	lock     sync.Mutex
+	attrSets map[energy.Key]attribute.Set
+	// boots holds when each device last booted, keyed like energy.Key.Device.
+	boots map[string]time.Time
+}
+
+func (a *accumulatedEnergy) init(meter metric.Meter) error {
+	var err error
+	a.attrSets = make(map[energy.Key]attribute.Set)
+	a.boots = make(map[string]time.Time)
+	a.total, err = meter.Float64ObservableCounter("energy.accumulated",
+		metric.WithUnit("Wh"),
+		metric.WithDescription("Total energy consumed, accumulated across device counter resets."))
+	if err != nil {
+		return fmt.Errorf("failed to create energy.accumulated metric: %w", err)
+	}
+	a.totalReturned, err = meter.Float64ObservableCounter("energy.accumulated_returned",
+		metric.WithUnit("Wh"),
+		metric.WithDescription("Total energy returned, accumulated across device counter resets."))
+	if err != nil {
+		return fmt.Errorf("failed to create energy.accumulated_returned metric: %w", err)
+	}
+	a.resets, err = meter.Int64ObservableCounter("energy.counter_resets",
+		metric.WithDescription(`Number of times the device's energy counter was observed to reset. The "direction" attribute is either "consumed" or "returned".`))
+	if err != nil {
+		return fmt.Errorf("failed to create energy.counter_resets metric: %w", err)
+	}
+	if _, err := meter.RegisterCallback(a.observe, a.total, a.totalReturned, a.resets); err != nil {
+		return fmt.Errorf("failed to register accumulated energy callback: %w", err)
+	}
+	return nil
+}
+
+// setBoot records when the device described by attrSet booted, so counters observed afterward
+// are known to have reset.
+func (a *accumulatedEnergy) setBoot(attrSet attribute.Set, boot time.Time) {
+	device, ok := deviceKey(attrSet)
+	if !ok || boot.IsZero() {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.boots[device] = boot
+}
+
+// record observes a device energy total in watt-hours.
+func (a *accumulatedEnergy) record(total float64, returned bool, attrSet attribute.Set) {
+	k, ok := energyKey(attrSet, returned)
+	if !ok {
+		return
+	}
+	a.lock.Lock()
+	boot := a.boots[k.Device]
+	a.lock.Unlock()
+	a.accumulator.Observe(k, total, time.Now(), boot)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.attrSets[k] = attrSet
+}
+
+func (a *accumulatedEnergy) observe(_ context.Context, o metric.Observer) error {
+	counters := a.accumulator.Counters()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for k, attrSet := range a.attrSets {
+		c, ok := counters[k]
+		if !ok {
+			continue
+		}
+		total, direction := a.total, "consumed"
+		if k.Returned {
+			total, direction = a.totalReturned, "returned"
+		}
+		o.ObserveFloat64(total, c.Total, metric.WithAttributeSet(attrSet))
+		o.ObserveInt64(a.resets, int64(c.Resets), metric.WithAttributes(
+			append(attrSet.ToSlice(), attribute.String("direction", direction))...))
+	}
+	return nil
+}
+
+// energyKey identifies a counter by its device's MAC address (or instance, if the MAC is
+// unknown) and its component type, id and phase, so it's stable if other labels change.
+func energyKey(attrSet attribute.Set, returned bool) (energy.Key, bool) {
+	device, ok := deviceKey(attrSet)
+	if !ok {
+		return energy.Key{}, false
+	}
+	componentType, _ := attrSet.Value("type")
+	id, _ := attrSet.Value("id")
+	component := componentType.Emit() + ":" + id.Emit()
+	if phase, ok := attrSet.Value("phase"); ok {
+		component += ":" + phase.Emit()
+	}
+	return energy.Key{
+		Device:    device,
+		Component: component,
+		Returned:  returned,
+	}, true
+}
+
+// deviceKey identifies a device by its MAC address, or instance if the MAC is unknown.
+func deviceKey(attrSet attribute.Set) (string, bool) {
+	if mac, ok := attrSet.Value("mac"); ok {
+		return energy.DeviceKey(mac.AsString()), true
+	}
+	device, ok := attrSet.Value("instance")
+	if !ok {
+		return "", false
+	}
+	return device.AsString(), true
+}
@@ -0,0 +1,155 @@
+package otelserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/rs/zerolog/log"
+	otelLog "go.opentelemetry.io/otel/log"
+)
+
+// eventSeverities maps event names which don't follow the naming patterns in eventSeverity.
+var eventSeverities = map[string]otelLog.Severity{
+	"ota_progress":      otelLog.SeverityDebug,
+	"scheduled_restart": otelLog.SeverityWarn,
+	"sleep":             otelLog.SeverityInfo,
+}
+
+// eventSeverity maps a device event name to a log severity. Physical interactions (button
+// pushes, toggles) and routine system events are informational, while alarms and failures are
+// errors.
+func eventSeverity(name string) otelLog.Severity {
+	if s, ok := eventSeverities[name]; ok {
+		return s
+	}
+	switch {
+	case strings.Contains(name, "error"), strings.Contains(name, "fail"), strings.Contains(name, "alarm"):
+		return otelLog.SeverityError
+	case strings.HasPrefix(name, "over"), strings.HasPrefix(name, "under"), strings.Contains(name, "warn"):
+		return otelLog.SeverityWarn
+	}
+	return otelLog.SeverityInfo
+}
+
+// recordEvents emits a log record for each event in a NotifyEvent notification. dev is the
+// sending device, or nil if it isn't known to discovery.
+func (s *Server) recordEvents(ctx context.Context, en discovery.EventNotification, dev *discovery.Device) {
+	// Events carry component specific fields (ex. script event `data`) which aren't part of the
+	// typed model, so they're decoded from the raw params.
+	var params struct {
+		TS     float64                      `json:"ts"`
+		Events []map[string]json.RawMessage `json:"events"`
+	}
+	if err := json.Unmarshal(en.Frame.Params, &params); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("src", en.Frame.Src).Msg("decoding event notification")
+		return
+	}
+	s.recordLock.Lock()
+	device := s.labelMapper.Attributes(s.labelDevice(en.Frame.Src, dev))
+	s.recordLock.Unlock()
+
+	now := time.Now()
+	for _, event := range params.Events {
+		var r otelLog.Record
+		r.SetObservedTimestamp(now)
+		r.SetTimestamp(now)
+		if ts := params.TS; ts > 0 {
+			r.SetTimestamp(eventTime(ts))
+		}
+		attrs := make([]otelLog.KeyValue, 0, len(device)+len(event)+2)
+		for _, kv := range device {
+			attrs = append(attrs, otelLog.String(string(kv.Key), kv.Value.Emit()))
+		}
+		for k, raw := range event {
+			switch k {
+			case "event":
+				var name string
+				if err := json.Unmarshal(raw, &name); err != nil {
+					continue
+				}
+				severity := eventSeverity(name)
+				r.SetBody(otelLog.StringValue(name))
+				r.SetSeverity(severity)
+				r.SetSeverityText(severity.String())
+				attrs = append(attrs, otelLog.String("event", name))
+			case "component":
+				var component string
+				if err := json.Unmarshal(raw, &component); err != nil {
+					continue
+				}
+				attrs = append(attrs, componentLogAttributes(component)...)
+			case "ts":
+				var ts float64
+				if err := json.Unmarshal(raw, &ts); err == nil && ts > 0 {
+					r.SetTimestamp(eventTime(ts))
+				}
+			case "id":
+				// The id is taken from the component key.
+			default:
+				attrs = append(attrs, otelLog.KeyValue{Key: "event." + k, Value: jsonLogValue(raw)})
+			}
+		}
+		r.AddAttributes(attrs...)
+		s.logger.Emit(ctx, r)
+	}
+}
+
+// componentLogAttributes describes a component key like `input:0` with the same type and id
+// attributes used for metrics.
+func componentLogAttributes(component string) []otelLog.KeyValue {
+	attrs := []otelLog.KeyValue{otelLog.String("component", component)}
+	componentType, id, ok := strings.Cut(component, ":")
+	attrs = append(attrs, otelLog.String("type", componentType))
+	if ok {
+		if i, err := strconv.Atoi(id); err == nil {
+			attrs = append(attrs, otelLog.Int("id", i))
+		}
+	}
+	return attrs
+}
+
+// jsonLogValue converts an arbitrary JSON value to a log value.
+func jsonLogValue(raw json.RawMessage) otelLog.Value {
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return otelLog.StringValue(string(raw))
+	}
+	return anyLogValue(v)
+}
+
+func anyLogValue(v any) otelLog.Value {
+	switch v := v.(type) {
+	case nil:
+		return otelLog.Value{}
+	case bool:
+		return otelLog.BoolValue(v)
+	case float64:
+		return otelLog.Float64Value(v)
+	case string:
+		return otelLog.StringValue(v)
+	case []any:
+		values := make([]otelLog.Value, 0, len(v))
+		for _, e := range v {
+			values = append(values, anyLogValue(e))
+		}
+		return otelLog.SliceValue(values...)
+	case map[string]any:
+		kvs := make([]otelLog.KeyValue, 0, len(v))
+		for k, e := range v {
+			kvs = append(kvs, otelLog.KeyValue{Key: k, Value: anyLogValue(e)})
+		}
+		return otelLog.MapValue(kvs...)
+	}
+	return otelLog.StringValue(fmt.Sprint(v))
+}
+
+// eventTime converts a notification's fractional unix timestamp.
+func eventTime(ts float64) time.Time {
+	sec := int64(ts)
+	return time.Unix(sec, int64((ts-float64(sec))*float64(time.Second)))
+}
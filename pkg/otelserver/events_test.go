@@ -0,0 +1,117 @@
+package otelserver
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	otelLog "go.opentelemetry.io/otel/log"
+	sdkLog "go.opentelemetry.io/otel/sdk/log"
+	sdkMetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// testLogExporter collects exported log records in memory.
+type testLogExporter struct {
+	lock    sync.Mutex
+	records []sdkLog.Record
+}
+
+func (e *testLogExporter) Export(_ context.Context, records []sdkLog.Record) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, r := range records {
+		e.records = append(e.records, r.Clone())
+	}
+	return nil
+}
+
+func (e *testLogExporter) Shutdown(context.Context) error   { return nil }
+func (e *testLogExporter) ForceFlush(context.Context) error { return nil }
+
+func logAttrs(r sdkLog.Record) map[string]otelLog.Value {
+	out := make(map[string]otelLog.Value)
+	r.WalkAttributes(func(kv otelLog.KeyValue) bool {
+		out[kv.Key] = kv.Value
+		return true
+	})
+	return out
+}
+
+func TestRecordEvents(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.ID = "shellyplusi4-a8032abe5424"
+	d1.Name = "hallway"
+
+	exporter := &testLogExporter{}
+	s, err := NewServer(ctx, td.Discoverer,
+		WithMetricsReader(sdkMetric.NewManualReader()),
+		WithLogsProcessor(sdkLog.NewSimpleProcessor(exporter)))
+	require.NoError(t, err)
+
+	s.recordEvents(ctx, discovery.EventNotification{
+		Frame: &frame.Frame{
+			Src: d1.ID,
+			Params: json.RawMessage(`{
+				"ts": 1700000000.5,
+				"events": [
+					{"component": "input:1", "id": 1, "event": "single_push", "ts": 1700000000.25},
+					{"component": "script:2", "id": 2, "event": "alarm", "data": {"zone": "garage"}},
+					{"component": "sys", "event": "ota_progress", "progress_percent": 40}
+				]
+			}`),
+		},
+	}, d1.Device)
+
+	require.Len(t, exporter.records, 3)
+	push, alarm, ota := exporter.records[0], exporter.records[1], exporter.records[2]
+
+	assert.Equal(t, "single_push", push.Body().AsString())
+	assert.Equal(t, otelLog.SeverityInfo, push.Severity())
+	assert.Equal(t, "INFO", push.SeverityText())
+	assert.Equal(t, time.Unix(1700000000, 250000000), push.Timestamp())
+	attrs := logAttrs(push)
+	assert.Equal(t, "hallway", attrs["device_name"].AsString())
+	assert.Equal(t, d1.MACAddr, attrs["mac"].AsString())
+	assert.Equal(t, "input:1", attrs["component"].AsString())
+	assert.Equal(t, "input", attrs["type"].AsString())
+	assert.Equal(t, int64(1), attrs["id"].AsInt64())
+	assert.Equal(t, "single_push", attrs["event"].AsString())
+
+	assert.Equal(t, otelLog.SeverityError, alarm.Severity())
+	// Events without their own ts use the notification's.
+	assert.Equal(t, time.Unix(1700000000, 500000000), alarm.Timestamp())
+	data := logAttrs(alarm)["event.data"].AsMap()
+	require.Len(t, data, 1)
+	assert.Equal(t, "zone", data[0].Key)
+	assert.Equal(t, "garage", data[0].Value.AsString())
+
+	assert.Equal(t, otelLog.SeverityDebug, ota.Severity())
+	attrs = logAttrs(ota)
+	assert.Equal(t, "sys", attrs["type"].AsString())
+	assert.Equal(t, 40.0, attrs["event.progress_percent"].AsFloat64())
+	_, hasID := attrs["id"]
+	assert.False(t, hasID)
+}
+
+func TestEventSeverity(t *testing.T) {
+	for name, expect := range map[string]otelLog.Severity{
+		"single_push":       otelLog.SeverityInfo,
+		"btn_down":          otelLog.SeverityInfo,
+		"config_changed":    otelLog.SeverityInfo,
+		"ota_error":         otelLog.SeverityError,
+		"smoke_alarm":       otelLog.SeverityError,
+		"overtemp":          otelLog.SeverityWarn,
+		"scheduled_restart": otelLog.SeverityWarn,
+		"ota_progress":      otelLog.SeverityDebug,
+	} {
+		assert.Equal(t, expect, eventSeverity(name), name)
+	}
+}
@@ -0,0 +1,99 @@
+package otelserver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/mongoose-os/mos/common/mgrpc"
+)
+
+// locationRetryInterval is the delay before a device whose location couldn't be fetched is
+// queried again.
+const locationRetryInterval = 5 * time.Minute
+
+// deviceLocation is a device's configured location. Unlike the prometheus exporter, which reads
+// the device's config on each scrape, notifications don't include config, so it's fetched once.
+type deviceLocation struct {
+	location *shelly.SysLocationConfig
+	// failedAt is set if the location couldn't be fetched.
+	failedAt time.Time
+}
+
+// resolveLocation fetches dev's location with Sys.GetConfig if location labels are enabled and it
+// isn't already known. c is an open connection to the device, or nil to open one.
+func (s *Server) resolveLocation(ctx context.Context, dev *discovery.Device, c mgrpc.MgRPC) {
+	if s.startLocationFetch(dev) {
+		s.storeLocation(ctx, dev, c)
+	}
+}
+
+// resolveLocationAsync fetches dev's location in the background, like resolveLocation, so a slow
+// or unreachable device doesn't hold up notifications from other devices. Until the fetch
+// completes, the device is recorded with its cached location, if any.
+func (s *Server) resolveLocationAsync(ctx context.Context, dev *discovery.Device) {
+	if !s.startLocationFetch(dev) {
+		return
+	}
+	s.locationFetches.Add(1)
+	go func() {
+		defer s.locationFetches.Done()
+		s.storeLocation(ctx, dev, nil)
+	}()
+}
+
+// startLocationFetch reports whether dev's location should be fetched, and if so marks a fetch
+// in progress so only one runs for each device.
+func (s *Server) startLocationFetch(dev *discovery.Device) bool {
+	if dev == nil || dev.MACAddr == "" || !s.labelMapper.Location() {
+		return false
+	}
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+	if _, ok := s.fetchingLocations[dev.MACAddr]; ok {
+		return false
+	}
+	l, ok := s.locations[dev.MACAddr]
+	if ok && (l.failedAt.IsZero() || time.Since(l.failedAt) < locationRetryInterval) {
+		return false
+	}
+	s.fetchingLocations[dev.MACAddr] = struct{}{}
+	return true
+}
+
+// storeLocation fetches and caches dev's location, completing a fetch started by
+// startLocationFetch.
+func (s *Server) storeLocation(ctx context.Context, dev *discovery.Device, c mgrpc.MgRPC) {
+	var l deviceLocation
+	loc, err := s.fetchLocation(ctx, dev, c)
+	if err != nil {
+		ll := dev.LogCtx(ctx)
+		ll.Warn().Err(err).Msg("fetching device location")
+		l = deviceLocation{failedAt: time.Now()}
+	} else {
+		l = deviceLocation{location: loc}
+	}
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+	delete(s.fetchingLocations, dev.MACAddr)
+	s.locations[dev.MACAddr] = l
+}
+
+func (s *Server) fetchLocation(ctx context.Context, dev *discovery.Device, c mgrpc.MgRPC) (*shelly.SysLocationConfig, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.pollTimeout)
+	defer cancel()
+	if c == nil {
+		var err error
+		if c, err = dev.Open(ctx); err != nil {
+			return nil, fmt.Errorf("connecting to device: %w", err)
+		}
+		defer c.Disconnect(ctx)
+	}
+	config, _, err := (&shelly.SysGetConfigRequest{}).Do(ctx, c, dev.AuthCallback(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("querying Sys.GetConfig: %w", err)
+	}
+	return config.Location, nil
+}
@@ -0,0 +1,159 @@
+package otelserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// go-shelly doesn't yet model the energy meter components, so we decode the fields we report
+// directly from the notification params.
+
+// pm1Status is the status of a PM1 (single channel power meter) component.
+type pm1Status struct {
+	ID         int            `json:"id"`
+	Voltage    *float64       `json:"voltage"`
+	Current    *float64       `json:"current"`
+	APower     *float64       `json:"apower"`
+	Freq       *float64       `json:"freq"`
+	AEnergy    *energyCounter `json:"aenergy"`
+	RetAEnergy *energyCounter `json:"ret_aenergy"`
+}
+
+type energyCounter struct {
+	Total float64 `json:"total"`
+}
+
+func (c *energyCounter) total() *float64 {
+	if c == nil {
+		return nil
+	}
+	return &c.Total
+}
+
+// em1Status is the status of an EM1 (single phase energy meter) component.
+type em1Status struct {
+	ID        int      `json:"id"`
+	Voltage   *float64 `json:"voltage"`
+	Current   *float64 `json:"current"`
+	ActPower  *float64 `json:"act_power"`
+	AprtPower *float64 `json:"aprt_power"`
+	PF        *float64 `json:"pf"`
+	Freq      *float64 `json:"freq"`
+}
+
+// em1DataStatus holds the energy totals of an EM1 component.
+type em1DataStatus struct {
+	ID                int      `json:"id"`
+	TotalActEnergy    *float64 `json:"total_act_energy"`
+	TotalActRetEnergy *float64 `json:"total_act_ret_energy"`
+}
+
+// setMeters records PM1, EM1, EM (three phase) and their energy data components.
+func (m *metrics) setMeters(ctx context.Context, params json.RawMessage, device []attribute.KeyValue) error {
+	var components map[string]json.RawMessage
+	if err := json.Unmarshal(params, &components); err != nil {
+		return fmt.Errorf("decoding notification params: %w", err)
+	}
+	for key, raw := range components {
+		componentType, idStr, ok := strings.Cut(key, ":")
+		if !ok {
+			continue
+		}
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		attrs := append([]attribute.KeyValue{
+			attribute.Int("id", id),
+			attribute.String("type", componentType),
+		}, device...)
+		switch componentType {
+		case "pm1":
+			var pm pm1Status
+			if err := json.Unmarshal(raw, &pm); err != nil {
+				return fmt.Errorf("decoding %s: %w", key, err)
+			}
+			m.setPower(ctx, powerReading{
+				activePower:   pm.APower,
+				voltage:       pm.Voltage,
+				current:       pm.Current,
+				freq:          pm.Freq,
+				total:         pm.AEnergy.total(),
+				totalReturned: pm.RetAEnergy.total(),
+			}, attribute.NewSet(attrs...))
+		case "em1":
+			var em em1Status
+			if err := json.Unmarshal(raw, &em); err != nil {
+				return fmt.Errorf("decoding %s: %w", key, err)
+			}
+			m.setPower(ctx, powerReading{
+				activePower:   em.ActPower,
+				apparentPower: em.AprtPower,
+				voltage:       em.Voltage,
+				current:       em.Current,
+				pf:            em.PF,
+				freq:          em.Freq,
+			}, attribute.NewSet(attrs...))
+		case "em1data":
+			var data em1DataStatus
+			if err := json.Unmarshal(raw, &data); err != nil {
+				return fmt.Errorf("decoding %s: %w", key, err)
+			}
+			m.setPower(ctx, powerReading{
+				total:         data.TotalActEnergy,
+				totalReturned: data.TotalActRetEnergy,
+			}, attribute.NewSet(attrs...))
+		case "em", "emdata":
+			// Three phase meters prefix per-phase fields with the phase, ex. `a_voltage`.
+			var rawFields map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &rawFields); err != nil {
+				return fmt.Errorf("decoding %s: %w", key, err)
+			}
+			// Non-numeric fields like `errors` are ignored.
+			fields := make(map[string]*float64, len(rawFields))
+			for k, v := range rawFields {
+				var f float64
+				if err := json.Unmarshal(v, &f); err == nil {
+					fields[k] = &f
+				}
+			}
+			for _, phase := range []string{"a", "b", "c"} {
+				phaseAttrs := attribute.NewSet(append(attrs, attribute.String("phase", phase))...)
+				if componentType == "em" {
+					m.setPower(ctx, powerReading{
+						activePower:   fields[phase+"_act_power"],
+						apparentPower: fields[phase+"_aprt_power"],
+						voltage:       fields[phase+"_voltage"],
+						current:       fields[phase+"_current"],
+						pf:            fields[phase+"_pf"],
+						freq:          fields[phase+"_freq"],
+					}, phaseAttrs)
+				} else {
+					m.setPower(ctx, powerReading{
+						total:         fields[phase+"_total_act_energy"],
+						totalReturned: fields[phase+"_total_act_ret_energy"],
+					}, phaseAttrs)
+				}
+			}
+			totalAttrs := attribute.NewSet(append(attrs, attribute.String("phase", "total"))...)
+			if componentType == "em" {
+				m.setPower(ctx, powerReading{
+					activePower:   fields["total_act_power"],
+					apparentPower: fields["total_aprt_power"],
+					current:       fields["total_current"],
+				}, totalAttrs)
+			} else {
+				m.setPower(ctx, powerReading{
+					total:         fields["total_act"],
+					totalReturned: fields["total_act_ret"],
+				}, totalAttrs)
+			}
+		}
+	}
+	return nil
+}
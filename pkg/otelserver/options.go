@@ -3,6 +3,9 @@ package otelserver
 import (
 	"time"
 
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"github.com/jcodybaker/shellyctl/pkg/labels"
+	sdkLog "go.opentelemetry.io/otel/sdk/log"
 	sdkMetric "go.opentelemetry.io/otel/sdk/metric"
 )
 
@@ -39,3 +42,68 @@ func WithMetricsReader(r sdkMetric.Reader) Option {
 			sdkMetric.WithReader(r))
 	}
 }
+
+// WithLogsExporter enables exporting device events (NotifyEvent) as log records.
+func WithLogsExporter(e sdkLog.Exporter) Option {
+	return WithLogsProcessor(sdkLog.NewBatchProcessor(e))
+}
+
+// WithLogsProcessor enables processing device events (NotifyEvent) as log records.
+func WithLogsProcessor(p sdkLog.Processor) Option {
+	return func(s *Server) {
+		s.loggerProviderOptions = append(s.loggerProviderOptions, sdkLog.WithProcessor(p))
+	}
+}
+
+// WithLabelMapper configures the device attributes attached to each metric.
+func WithLabelMapper(m *labels.Mapper) Option {
+	return func(s *Server) {
+		s.labelMapper = m
+	}
+}
+
+// WithPollInterval enables active polling of all known devices with Shelly.GetStatus at the
+// given interval. This allows metrics to be collected from devices which don't push
+// notifications. Polling is disabled if the interval is 0.
+func WithPollInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.pollInterval = interval
+	}
+}
+
+// WithPollTimeout sets the maximum time a device may take to respond to a poll.
+func WithPollTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.pollTimeout = timeout
+	}
+}
+
+// WithPollConcurrency sets the maximum number of devices which will be polled concurrently.
+func WithPollConcurrency(concurrency int) Option {
+	return func(s *Server) {
+		s.pollConcurrency = concurrency
+	}
+}
+
+// WithPollMaxBackoff sets the maximum delay between polls of a device which is failing to respond.
+func WithPollMaxBackoff(maxBackoff time.Duration) Option {
+	return func(s *Server) {
+		s.pollMaxBackoff = maxBackoff
+	}
+}
+
+// WithReady sets a function which is called once Run has subscribed to the discoverer's
+// notifications, so they can be replayed without loss.
+func WithReady(ready func()) Option {
+	return func(s *Server) {
+		s.ready = ready
+	}
+}
+
+// WithEnergyAccumulator enables the `energy.accumulated`, `energy.accumulated_returned`, and
+// `energy.counter_resets` metrics, which remain monotonic when a device resets its energy counters.
+func WithEnergyAccumulator(a *energy.Accumulator) Option {
+	return func(s *Server) {
+		s.metrics.accumulated = &accumulatedEnergy{accumulator: a}
+	}
+}
@@ -0,0 +1,97 @@
+package otelserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/devicepoll"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/mongoose-os/mos/common/mgrpc"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+)
+
+const (
+	// DefaultPollTimeout is the default maximum time for a device to respond to a poll.
+	DefaultPollTimeout = 5 * time.Second
+	// DefaultPollConcurrency is the default number of devices which may be polled concurrently.
+	DefaultPollConcurrency = devicepoll.DefaultConcurrency
+	// DefaultPollMaxBackoff is the default maximum delay between polls of a failing device.
+	DefaultPollMaxBackoff = devicepoll.DefaultMaxBackoff
+)
+
+// startPoll returns funcs which record each poll of dev exactly like a NotifyFullStatus
+// notification. The device's connection is released once it stops being polled, and its cached
+// state once it's removed.
+func (s *Server) startPoll(dev *discovery.Device) (devicepoll.PollFunc, func(bool)) {
+	// The connection is reused across polls; opening a channel we immediately disconnect leaks
+	// mgrpc's read-ahead goroutine on HTTP transports.
+	var c mgrpc.MgRPC
+	poll := func(ctx context.Context) error {
+		var err error
+		c, err = s.pollOnce(ctx, dev, c)
+		return err
+	}
+	stop := func(removed bool) {
+		if c != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), s.pollTimeout)
+			defer cancel()
+			c.Disconnect(ctx)
+		}
+		if removed {
+			s.forgetDevice(pollSrc(dev), dev.MACAddr)
+		}
+	}
+	return poll, stop
+}
+
+// pollOnce queries and records a device's status. It returns the connection to reuse for the
+// next poll, which is nil if the connection failed.
+func (s *Server) pollOnce(ctx context.Context, dev *discovery.Device, c mgrpc.MgRPC) (mgrpc.MgRPC, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.pollTimeout)
+	defer cancel()
+	if c == nil {
+		var err error
+		if c, err = dev.Open(ctx); err != nil {
+			return nil, fmt.Errorf("connecting to device: %w", err)
+		}
+	}
+	s.resolveLocation(ctx, dev, c)
+	status, raw, err := (&shelly.ShellyGetStatusRequest{}).Do(ctx, c, dev.AuthCallback(ctx))
+	if err != nil {
+		c.Disconnect(ctx)
+		return nil, fmt.Errorf("querying device status: %w", err)
+	}
+	s.recordStatus(ctx, discovery.StatusNotification{
+		Status: &shelly.NotifyStatus{ShellyGetStatusResponse: *status},
+		Frame: &frame.Frame{
+			Src:    pollSrc(dev),
+			Params: raw.Response,
+		},
+	}, dev, true)
+	return c, nil
+}
+
+// pollSrc returns the src polled statuses are recorded with. Devices identify themselves by ID in
+// notifications; prefer it so polled and pushed metrics for the same device share attributes.
+func pollSrc(dev *discovery.Device) string {
+	if dev.ID != "" {
+		return dev.ID
+	}
+	return dev.Instance()
+}
+
+// forgetDevice drops the state cached for the device with the given src and MAC.
+func (s *Server) forgetDevice(src, mac string) {
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+	delete(s.macs, src)
+	delete(s.locations, mac)
+	for key := range s.componentErrors {
+		if strings.HasPrefix(key, src+"/") {
+			delete(s.componentErrors, key)
+		}
+	}
+}
@@ -3,16 +3,25 @@ package otelserver
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/devicepoll"
 	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"github.com/jcodybaker/shellyctl/pkg/labels"
 	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel/attribute"
+	otelLog "go.opentelemetry.io/otel/log"
 	"go.opentelemetry.io/otel/metric"
+	sdkLog "go.opentelemetry.io/otel/sdk/log"
 	sdkMetric "go.opentelemetry.io/otel/sdk/metric"
 )
 
+// coverStates describe the documented cover component state.
+var coverStates = []string{"open", "closed", "opening", "closing", "stopped", "calibrating"}
+
 const (
 	// DefaultStopWait is the maximum duration we're willing to wait a clean shutdown.
 	DefaultStopWait time.Duration = 5 * time.Second
@@ -29,20 +38,60 @@ type Server struct {
 	meter                metric.Meter
 	metrics              metrics
 	meterProviderOptions []sdkMetric.Option
+	labelMapper          *labels.Mapper
+
+	// logger is nil unless a logs exporter or processor is configured.
+	logger                otelLog.Logger
+	loggerProviderOptions []sdkLog.LoggerProviderOption
+
+	pollInterval    time.Duration
+	pollTimeout     time.Duration
+	pollConcurrency int
+	pollMaxBackoff  time.Duration
+
+	// ready, if set, is called once Run has subscribed to notifications.
+	ready func()
+
+	// macs caches MAC addresses reported in full status notifications, keyed by src, since
+	// deltas don't include the sys component.
+	macs map[string]string
+	// locations caches the configured location of known devices, keyed by MAC.
+	locations map[string]deviceLocation
+	// fetchingLocations holds the MACs of devices whose location is being fetched.
+	fetchingLocations map[string]struct{}
+	// locationFetches tracks background location fetches started by Run.
+	locationFetches sync.WaitGroup
+	// recordLock guards macs, locations, fetchingLocations, and componentErrors, which are shared
+	// by notifications and the poller.
+	recordLock sync.Mutex
+	// componentErrors tracks the errors seen on each component, keyed by src and component, so
+	// they can be reported as cleared.
+	componentErrors map[string]map[string]struct{}
 }
 
 func NewServer(
 	ctx context.Context,
 	discoverer *discovery.Discoverer,
 	opts ...Option,
-) *Server {
+) (*Server, error) {
 	s := &Server{
-		discoverer: discoverer,
-		stopWait:   DefaultStopWait,
+		discoverer:        discoverer,
+		stopWait:          DefaultStopWait,
+		pollTimeout:       DefaultPollTimeout,
+		pollConcurrency:   DefaultPollConcurrency,
+		pollMaxBackoff:    DefaultPollMaxBackoff,
+		macs:              make(map[string]string),
+		locations:         make(map[string]deviceLocation),
+		componentErrors:   make(map[string]map[string]struct{}),
+		fetchingLocations: make(map[string]struct{}),
 	}
 	for _, o := range opts {
 		o(s)
 	}
+	if s.labelMapper == nil {
+		// The default mapper has no options which can fail validation.
+		s.labelMapper, _ = labels.NewMapper()
+	}
 	s.meterP = sdkMetric.NewMeterProvider(s.meterProviderOptions...)
 	s.onStop = append(s.onStop, s.meterP.Shutdown)
 
@@ -50,8 +99,18 @@ func NewServer(
 		s.meter = s.meterP.Meter(DefeaultMeterName)
 	}
 
-	s.metrics.initMeters(s.meter)
-	return s
+	if err := s.metrics.initMeters(s.meter); err != nil {
+		// The exporter may already be running.
+		s.meterP.Shutdown(ctx)
+		return nil, err
+	}
+
+	if len(s.loggerProviderOptions) > 0 {
+		loggerP := sdkLog.NewLoggerProvider(s.loggerProviderOptions...)
+		s.onStop = append(s.onStop, loggerP.Shutdown)
+		s.logger = loggerP.Logger(DefeaultMeterName)
+	}
+	return s, nil
 }
 
 func (m *metrics) initMeters(meter metric.Meter) error {
@@ -74,11 +133,15 @@ func (m *metrics) initMeters(meter metric.Meter) error {
 	if err != nil {
 		return fmt.Errorf("failed to create cover.position metric: %w", err)
 	}
-	m.input.enabled, err = meter.Int64Gauge("input.enabled",
-		metric.WithUnit("enabled"),
-		metric.WithDescription("1 if the input is enabled; 0 otherwise."))
+	m.covers.state, err = meter.Int64Gauge("cover.state",
+		metric.WithDescription("1 if the cover is in the state described by the state attribute; 0 otherwise."))
 	if err != nil {
-		return fmt.Errorf("failed to create input.enabled metric: %w", err)
+		return fmt.Errorf("failed to create cover.state metric: %w", err)
+	}
+	m.input.state, err = meter.Int64Gauge("input.state",
+		metric.WithDescription("1 if the input is active; 0 if it is off."))
+	if err != nil {
+		return fmt.Errorf("failed to create input.state metric: %w", err)
 	}
 	m.input.percent, err = meter.Float64Gauge("input.percent",
 		metric.WithUnit("%"),
@@ -147,32 +210,231 @@ func (m *metrics) initMeters(meter metric.Meter) error {
 	if err != nil {
 		return fmt.Errorf("failed to create humidity.relative metric: %w", err)
 	}
+	m.energy.instantaneousActivePower, err = meter.Float64Gauge("energy.active_power",
+		metric.WithUnit("W"),
+		metric.WithDescription("Last measured instantaneous active power delivered to the attached load."))
+	if err != nil {
+		return fmt.Errorf("failed to create energy.active_power metric: %w", err)
+	}
+	m.energy.apparentPower, err = meter.Float64Gauge("energy.apparent_power",
+		metric.WithUnit("VA"),
+		metric.WithDescription("Last measured apparent power."))
+	if err != nil {
+		return fmt.Errorf("failed to create energy.apparent_power metric: %w", err)
+	}
+	m.devicePower.batteryVoltage, err = meter.Float64Gauge("device_power.battery.voltage",
+		metric.WithUnit("V"),
+		metric.WithDescription("Battery voltage."))
+	if err != nil {
+		return fmt.Errorf("failed to create device_power.battery.voltage metric: %w", err)
+	}
+	m.devicePower.batteryPercent, err = meter.Float64Gauge("device_power.battery.percent",
+		metric.WithUnit("%"),
+		metric.WithDescription("Battery charge level in percent."))
+	if err != nil {
+		return fmt.Errorf("failed to create device_power.battery.percent metric: %w", err)
+	}
+	m.devicePower.externalPresent, err = meter.Int64Gauge("device_power.external.present",
+		metric.WithDescription("1 if external power is present; 0 otherwise."))
+	if err != nil {
+		return fmt.Errorf("failed to create device_power.external.present metric: %w", err)
+	}
+	m.sys.uptime, err = meter.Float64Gauge("sys.uptime",
+		metric.WithUnit("s"),
+		metric.WithDescription("Time since the device last booted."))
+	if err != nil {
+		return fmt.Errorf("failed to create sys.uptime metric: %w", err)
+	}
+	m.sys.ramSize, err = meter.Int64Gauge("sys.ram.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Total RAM."))
+	if err != nil {
+		return fmt.Errorf("failed to create sys.ram.size metric: %w", err)
+	}
+	m.sys.ramFree, err = meter.Int64Gauge("sys.ram.free",
+		metric.WithUnit("By"),
+		metric.WithDescription("Available RAM."))
+	if err != nil {
+		return fmt.Errorf("failed to create sys.ram.free metric: %w", err)
+	}
+	m.sys.fsSize, err = meter.Int64Gauge("sys.fs.size",
+		metric.WithUnit("By"),
+		metric.WithDescription("Total filesystem size."))
+	if err != nil {
+		return fmt.Errorf("failed to create sys.fs.size metric: %w", err)
+	}
+	m.sys.fsFree, err = meter.Int64Gauge("sys.fs.free",
+		metric.WithUnit("By"),
+		metric.WithDescription("Available filesystem space."))
+	if err != nil {
+		return fmt.Errorf("failed to create sys.fs.free metric: %w", err)
+	}
+	m.sys.restartRequired, err = meter.Int64Gauge("sys.restart_required",
+		metric.WithDescription("1 if the device must be restarted to apply configuration changes; 0 otherwise."))
+	if err != nil {
+		return fmt.Errorf("failed to create sys.restart_required metric: %w", err)
+	}
+	m.componentError, err = meter.Int64Gauge("component.error",
+		metric.WithDescription(`1 if the error condition ("error" attribute) is active; 0 if the error has cleared.`))
+	if err != nil {
+		return fmt.Errorf("failed to create component.error metric: %w", err)
+	}
+	if m.accumulated != nil {
+		return m.accumulated.init(meter)
+	}
 	return nil
 }
 
 func (s *Server) Run(ctx context.Context) error {
 	defer s.stop(ctx)
-	snc := s.discoverer.GetStatusNotifications(100)
-	fsnc := s.discoverer.GetStatusNotifications(100)
+	defer s.locationFetches.Wait()
+	if s.pollInterval != 0 {
+		p, err := devicepoll.New(s.discoverer, s.pollInterval, s.startPoll,
+			devicepoll.WithConcurrency(s.pollConcurrency),
+			devicepoll.WithMaxBackoff(s.pollMaxBackoff),
+		)
+		if err != nil {
+			return err
+		}
+		var wg sync.WaitGroup
+		defer wg.Wait()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Run(ctx)
+		}()
+	}
+	status := s.discoverer.SubscribeStatus()
+	defer status.Unsubscribe()
+	fullStatus := s.discoverer.SubscribeFullStatus()
+	defer fullStatus.Unsubscribe()
+	// Events are only consumed if they'll be exported. A nil channel is never selected.
+	var enc <-chan discovery.EventNotification
+	if s.logger != nil {
+		events := s.discoverer.SubscribeEvents()
+		defer events.Unsubscribe()
+		enc = events.C()
+	}
+	if s.ready != nil {
+		s.ready()
+	}
 	for ctx.Err() == nil {
 		var sn discovery.StatusNotification
+		var full bool
 		select {
 		case <-ctx.Done():
 			return nil
-		case sn = <-snc:
-		case sn = <-fsnc:
+		case en := <-enc:
+			dev := s.discoverer.DeviceBySrc(en.Frame.Src)
+			s.resolveLocationAsync(ctx, dev)
+			s.recordEvents(ctx, en, dev)
+			continue
+		case sn = <-status.C():
+		case sn = <-fullStatus.C():
+			full = true
 		}
-		for _, sw := range sn.Status.Switches {
-			s.metrics.setSwitch(ctx, sw, sn.Frame.Src)
+		dev := s.discoverer.DeviceBySrc(sn.Frame.Src)
+		s.resolveLocationAsync(ctx, dev)
+		s.recordStatus(ctx, sn, dev, full)
+	}
+	return nil
+}
+
+// recordStatus records all components reported by a status notification. dev is the sending
+// device, or nil if it isn't known to discovery. Sys metrics are only recorded from full statuses,
+// since a delta's sys component only includes the changed fields.
+func (s *Server) recordStatus(ctx context.Context, sn discovery.StatusNotification, dev *discovery.Device, full bool) {
+	s.recordLock.Lock()
+	defer s.recordLock.Unlock()
+	src := sn.Frame.Src
+	if sys := sn.Status.System; sys != nil && sys.Mac != "" {
+		s.macs[src] = sys.Mac
+	}
+	device := s.labelMapper.Attributes(s.labelDevice(src, dev))
+	if sys := sn.Status.System; sys != nil && s.metrics.accumulated != nil {
+		// Recorded first, so energy counters in this status which have reset are detected.
+		receivedAt := sn.ReceivedAt
+		if receivedAt.IsZero() {
+			receivedAt = time.Now()
 		}
-		for _, t := range sn.Status.Temperatures {
-			s.metrics.setTemperature(ctx, t, sn.Frame.Src)
+		s.metrics.accumulated.setBoot(attribute.NewSet(device...), energy.BootTime(receivedAt, sys.Uptime))
+	}
+	for _, sw := range sn.Status.Switches {
+		s.metrics.setSwitch(ctx, sw, device)
+		s.setComponentErrors(ctx, src, "switch", sw.ID, sw.Errors, device)
+	}
+	for _, c := range sn.Status.Covers {
+		s.metrics.setCover(ctx, c, device)
+	}
+	for _, in := range sn.Status.Inputs {
+		s.metrics.setInput(ctx, in, device)
+		s.setComponentErrors(ctx, src, "input", in.ID, in.Errors, device)
+	}
+	for _, t := range sn.Status.Temperatures {
+		s.metrics.setTemperature(ctx, t, device)
+	}
+	for _, h := range sn.Status.Humidities {
+		s.metrics.setHumidity(ctx, h, device)
+	}
+	for _, dp := range sn.Status.DevicePowers {
+		s.metrics.setDevicePower(ctx, dp, device)
+		s.setComponentErrors(ctx, src, "devicepower", dp.ID, dp.Errors, device)
+	}
+	if full && sn.Status.System != nil {
+		s.metrics.setSys(ctx, sn.Status.System, device)
+	}
+	if err := s.metrics.setMeters(ctx, sn.Frame.Params, device); err != nil {
+		log.Ctx(ctx).Warn().Err(err).Str("src", src).Msg("decoding meter components")
+	}
+}
+
+// labelDevice describes the device which sent a notification. The MAC and name are taken from
+// dev when the device is known to discovery.
+func (s *Server) labelDevice(src string, dev *discovery.Device) labels.Device {
+	d := labels.SrcDevice(src)
+	if mac, ok := s.macs[src]; ok {
+		d.MAC = mac
+	}
+	if dev != nil {
+		if dev.MACAddr != "" {
+			d.MAC = dev.MACAddr
+			d.Location = s.locations[dev.MACAddr].location
 		}
-		for _, h := range sn.Status.Humidities {
-			s.metrics.setHumidity(ctx, h, sn.Frame.Src)
+		// Like the prometheus exporter, unnamed devices are named by MAC.
+		if dev.Name != "" {
+			d.Name = dev.Name
+		} else if dev.MACAddr != "" {
+			d.Name = dev.MACAddr
 		}
 	}
-	return nil
+	return d
+}
+
+// setComponentErrors reports active errors as 1, and previously seen errors which have cleared as 0.
+func (s *Server) setComponentErrors(ctx context.Context, src, componentType string, id int, errs []string, device []attribute.KeyValue) {
+	key := fmt.Sprintf("%s/%s:%d", src, componentType, id)
+	seen := s.componentErrors[key]
+	if seen == nil && len(errs) == 0 {
+		return
+	}
+	if seen == nil {
+		seen = make(map[string]struct{})
+		s.componentErrors[key] = seen
+	}
+	active := make(map[string]struct{}, len(errs))
+	for _, e := range errs {
+		active[e] = struct{}{}
+		seen[e] = struct{}{}
+	}
+	for e := range seen {
+		_, isActive := active[e]
+		attrs := append([]attribute.KeyValue{
+			attribute.Int("id", id),
+			attribute.String("type", componentType),
+			attribute.String("error", e),
+		}, device...)
+		s.metrics.componentError.Record(ctx, bool2int64(isActive), metric.WithAttributeSet(attribute.NewSet(attrs...)))
+	}
 }
 
 func (s *Server) stop(ctx context.Context) {
@@ -200,9 +462,10 @@ type metrics struct {
 	covers struct {
 		position               metric.Float64Gauge
 		positionControlEnabled metric.Int64Gauge
+		state                  metric.Int64Gauge
 	}
 	input struct {
-		enabled  metric.Int64Gauge
+		state    metric.Int64Gauge
 		percent  metric.Float64Gauge
 		xPercent metric.Float64Gauge
 	}
@@ -214,6 +477,7 @@ type metrics struct {
 		voltage                  metric.Float64Gauge
 		current                  metric.Float64Gauge
 		instantaneousActivePower metric.Float64Gauge
+		apparentPower            metric.Float64Gauge
 	}
 	temperature struct {
 		celsius    metric.Float64Gauge
@@ -222,40 +486,96 @@ type metrics struct {
 	humidity struct {
 		relative metric.Float64Gauge
 	}
+	devicePower struct {
+		batteryVoltage  metric.Float64Gauge
+		batteryPercent  metric.Float64Gauge
+		externalPresent metric.Int64Gauge
+	}
+	sys struct {
+		uptime          metric.Float64Gauge
+		ramSize         metric.Int64Gauge
+		ramFree         metric.Int64Gauge
+		fsSize          metric.Int64Gauge
+		fsFree          metric.Int64Gauge
+		restartRequired metric.Int64Gauge
+	}
+	componentError metric.Int64Gauge
+	// accumulated is nil unless an energy accumulator is configured.
+	accumulated *accumulatedEnergy
 }
 
-func (m *metrics) setSwitch(ctx context.Context, s *shelly.SwitchStatus, src string) {
-	attrs := []attribute.KeyValue{
-		attribute.Int("id", s.ID),
-		attribute.String("instance", src),
+// powerReading holds the electrical measurements common to switches, covers and meters.
+type powerReading struct {
+	activePower   *float64
+	apparentPower *float64
+	voltage       *float64
+	current       *float64
+	pf            *float64
+	freq          *float64
+	// total and totalReturned are in watt-hours.
+	total         *float64
+	totalReturned *float64
+}
+
+func (m *metrics) setPower(ctx context.Context, r powerReading, attrSet attribute.Set) {
+	if r.activePower != nil {
+		m.energy.instantaneousActivePower.Record(ctx, *r.activePower, metric.WithAttributeSet(attrSet))
 	}
-	attrSet := attribute.NewSet(attrs...)
-	if s.Output != nil {
-		m.switches.output.Record(ctx, bool2int64(*s.Output), metric.WithAttributeSet(attrSet))
+	if r.apparentPower != nil {
+		m.energy.apparentPower.Record(ctx, *r.apparentPower, metric.WithAttributeSet(attrSet))
 	}
-	attrs = append(attrs, attribute.String("type", "switch"))
-	attrSet = attribute.NewSet(attrs...)
-	if s.APower != nil {
-		m.energy.instantaneousActivePower.Record(ctx, *s.APower, metric.WithAttributeSet(attrSet))
+	if r.voltage != nil {
+		m.energy.voltage.Record(ctx, *r.voltage, metric.WithAttributeSet(attrSet))
 	}
-	if s.Voltage != nil {
-		m.energy.voltage.Record(ctx, *s.Voltage, metric.WithAttributeSet(attrSet))
+	if r.current != nil {
+		m.energy.current.Record(ctx, *r.current, metric.WithAttributeSet(attrSet))
 	}
-	if s.Current != nil {
-		m.energy.current.Record(ctx, *s.Current, metric.WithAttributeSet(attrSet))
+	if r.pf != nil {
+		m.energy.powerFactor.Record(ctx, *r.pf, metric.WithAttributeSet(attrSet))
 	}
-	if s.PF != nil {
-		m.energy.powerFactor.Record(ctx, *s.PF, metric.WithAttributeSet(attrSet))
+	if r.freq != nil {
+		m.energy.networkFrequency.Record(ctx, *r.freq, metric.WithAttributeSet(attrSet))
 	}
-	if s.Freq != nil {
-		m.energy.networkFrequency.Record(ctx, *s.Freq, metric.WithAttributeSet(attrSet))
+	if r.total != nil {
+		m.energy.total.Record(ctx, *r.total*3600, metric.WithAttributeSet(attrSet))
+		if m.accumulated != nil {
+			m.accumulated.record(*r.total, false, attrSet)
+		}
 	}
-	if s.AEnergy != nil {
-		m.energy.total.Record(ctx, s.AEnergy.Total*3600, metric.WithAttributeSet(attrSet))
+	if r.totalReturned != nil {
+		m.energy.totalReturned.Record(ctx, *r.totalReturned*3600, metric.WithAttributeSet(attrSet))
+		if m.accumulated != nil {
+			m.accumulated.record(*r.totalReturned, true, attrSet)
+		}
+	}
+}
+
+func energyTotal(c *shelly.EnergyCounters) *float64 {
+	if c == nil {
+		return nil
 	}
-	if s.RetAEnergy != nil {
-		m.energy.totalReturned.Record(ctx, s.RetAEnergy.Total*3600, metric.WithAttributeSet(attrSet))
+	return &c.Total
+}
+
+func (m *metrics) setSwitch(ctx context.Context, s *shelly.SwitchStatus, device []attribute.KeyValue) {
+	attrs := append([]attribute.KeyValue{
+		attribute.Int("id", s.ID),
+	}, device...)
+	attrSet := attribute.NewSet(attrs...)
+	if s.Output != nil {
+		m.switches.output.Record(ctx, bool2int64(*s.Output), metric.WithAttributeSet(attrSet))
 	}
+	attrs = append(attrs, attribute.String("type", "switch"))
+	attrSet = attribute.NewSet(attrs...)
+	m.setPower(ctx, powerReading{
+		activePower:   s.APower,
+		voltage:       s.Voltage,
+		current:       s.Current,
+		pf:            s.PF,
+		freq:          s.Freq,
+		total:         energyTotal(s.AEnergy),
+		totalReturned: energyTotal(s.RetAEnergy),
+	}, attrSet)
 	if s.Temperature != nil {
 		if s.Temperature.C != nil {
 			m.temperature.celsius.Record(ctx, *s.Temperature.C, metric.WithAttributeSet(attrSet))
@@ -266,12 +586,85 @@ func (m *metrics) setSwitch(ctx context.Context, s *shelly.SwitchStatus, src str
 	}
 }
 
-func (m *metrics) setTemperature(ctx context.Context, t *shelly.TemperatureStatus, src string) {
-	attrs := []attribute.KeyValue{
+func (m *metrics) setCover(ctx context.Context, c *shelly.CoverStatus, device []attribute.KeyValue) {
+	attrs := append([]attribute.KeyValue{
+		attribute.Int("id", c.ID),
+		attribute.String("type", "cover"),
+	}, device...)
+	attrSet := attribute.NewSet(attrs...)
+	if c.CurrentPos != nil {
+		m.covers.position.Record(ctx, *c.CurrentPos, metric.WithAttributeSet(attrSet))
+	}
+	if c.PosControl != nil {
+		m.covers.positionControlEnabled.Record(ctx, bool2int64(*c.PosControl), metric.WithAttributeSet(attrSet))
+	}
+	if c.State != nil {
+		for _, state := range coverStates {
+			stateAttrSet := attribute.NewSet(append(attrs, attribute.String("state", state))...)
+			m.covers.state.Record(ctx, bool2int64(state == *c.State), metric.WithAttributeSet(stateAttrSet))
+		}
+	}
+	m.setPower(ctx, powerReading{
+		activePower: c.APower,
+		voltage:     c.Voltage,
+		current:     c.Current,
+		pf:          c.PF,
+		freq:        c.Freq,
+		total:       energyTotal(c.AEnergy),
+	}, attrSet)
+}
+
+func (m *metrics) setInput(ctx context.Context, in *shelly.InputStatus, device []attribute.KeyValue) {
+	attrs := append([]attribute.KeyValue{
+		attribute.Int("id", in.ID),
+		attribute.String("type", "input"),
+	}, device...)
+	attrSet := attribute.NewSet(attrs...)
+	if in.State != nil {
+		m.input.state.Record(ctx, bool2int64(*in.State), metric.WithAttributeSet(attrSet))
+	}
+	if in.Percent != nil {
+		m.input.percent.Record(ctx, *in.Percent, metric.WithAttributeSet(attrSet))
+	}
+	if in.XPercent != nil {
+		m.input.xPercent.Record(ctx, *in.XPercent, metric.WithAttributeSet(attrSet))
+	}
+}
+
+func (m *metrics) setDevicePower(ctx context.Context, dp *shelly.DevicePowerStatus, device []attribute.KeyValue) {
+	attrs := append([]attribute.KeyValue{
+		attribute.Int("id", dp.ID),
+		attribute.String("type", "devicepower"),
+	}, device...)
+	attrSet := attribute.NewSet(attrs...)
+	if dp.Battery != nil {
+		if dp.Battery.V != nil {
+			m.devicePower.batteryVoltage.Record(ctx, *dp.Battery.V, metric.WithAttributeSet(attrSet))
+		}
+		if dp.Battery.Percent != nil {
+			m.devicePower.batteryPercent.Record(ctx, *dp.Battery.Percent, metric.WithAttributeSet(attrSet))
+		}
+	}
+	if dp.External != nil {
+		m.devicePower.externalPresent.Record(ctx, bool2int64(dp.External.Present), metric.WithAttributeSet(attrSet))
+	}
+}
+
+func (m *metrics) setSys(ctx context.Context, sys *shelly.SysStatus, device []attribute.KeyValue) {
+	attrSet := attribute.NewSet(device...)
+	m.sys.uptime.Record(ctx, sys.Uptime, metric.WithAttributeSet(attrSet))
+	m.sys.ramSize.Record(ctx, int64(sys.RamSize), metric.WithAttributeSet(attrSet))
+	m.sys.ramFree.Record(ctx, int64(sys.RamFree), metric.WithAttributeSet(attrSet))
+	m.sys.fsSize.Record(ctx, int64(sys.FS_Size), metric.WithAttributeSet(attrSet))
+	m.sys.fsFree.Record(ctx, int64(sys.FS_Free), metric.WithAttributeSet(attrSet))
+	m.sys.restartRequired.Record(ctx, bool2int64(sys.RestartRequired), metric.WithAttributeSet(attrSet))
+}
+
+func (m *metrics) setTemperature(ctx context.Context, t *shelly.TemperatureStatus, device []attribute.KeyValue) {
+	attrs := append([]attribute.KeyValue{
 		attribute.Int("id", t.ID),
-		attribute.String("instance", src),
 		attribute.String("type", "temperature"),
-	}
+	}, device...)
 	attrSet := attribute.NewSet(attrs...)
 	if t.TC != nil {
 		m.temperature.celsius.Record(ctx, *t.TC, metric.WithAttributeSet(attrSet))
@@ -281,12 +674,11 @@ func (m *metrics) setTemperature(ctx context.Context, t *shelly.TemperatureStatu
 	}
 }
 
-func (m *metrics) setHumidity(ctx context.Context, h *shelly.HumidityStatus, src string) {
-	attrs := []attribute.KeyValue{
+func (m *metrics) setHumidity(ctx context.Context, h *shelly.HumidityStatus, device []attribute.KeyValue) {
+	attrs := append([]attribute.KeyValue{
 		attribute.Int("id", h.ID),
-		attribute.String("instance", src),
 		attribute.String("type", "humidity"),
-	}
+	}, device...)
 	attrSet := attribute.NewSet(attrs...)
 	if h.RH != nil {
 		m.humidity.relative.Record(ctx, *h.RH, metric.WithAttributeSet(attrSet))
@@ -0,0 +1,261 @@
+package otelserver
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"github.com/jcodybaker/shellyctl/pkg/labels"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkMetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func testStatusNotification(t *testing.T, src, params string) discovery.StatusNotification {
+	t.Helper()
+	s := &shelly.NotifyStatus{}
+	require.NoError(t, json.Unmarshal([]byte(params), s))
+	return discovery.StatusNotification{
+		Status: s,
+		Frame: &frame.Frame{
+			Src:    src,
+			Params: json.RawMessage(params),
+		},
+	}
+}
+
+// gaugeValues returns the values of a gauge or counter keyed by the encoded attribute set.
+func gaugeValues(t *testing.T, rm metricdata.ResourceMetrics, name string) map[string]float64 {
+	t.Helper()
+	out := make(map[string]float64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			switch g := m.Data.(type) {
+			case metricdata.Gauge[float64]:
+				for _, dp := range g.DataPoints {
+					out[dp.Attributes.Encoded(attribute.DefaultEncoder())] = dp.Value
+				}
+			case metricdata.Gauge[int64]:
+				for _, dp := range g.DataPoints {
+					out[dp.Attributes.Encoded(attribute.DefaultEncoder())] = float64(dp.Value)
+				}
+			case metricdata.Sum[float64]:
+				for _, dp := range g.DataPoints {
+					out[dp.Attributes.Encoded(attribute.DefaultEncoder())] = dp.Value
+				}
+			case metricdata.Sum[int64]:
+				for _, dp := range g.DataPoints {
+					out[dp.Attributes.Encoded(attribute.DefaultEncoder())] = float64(dp.Value)
+				}
+			default:
+				t.Fatalf("unexpected data type %T for %q", m.Data, name)
+			}
+		}
+	}
+	return out
+}
+
+func TestRecordStatus(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.ID = "shellyplus2pm-a8032abe5424"
+	d1.Name = "garage"
+
+	reader := sdkMetric.NewManualReader()
+	s, err := NewServer(ctx, td.Discoverer, WithMetricsReader(reader))
+	require.NoError(t, err)
+
+	s.recordStatus(ctx, testStatusNotification(t, d1.ID, `{
+		"ts": 1700000000,
+		"sys": {"mac": "A8032ABE5424", "uptime": 120, "ram_size": 1000, "ram_free": 500, "fs_size": 2000, "fs_free": 1500, "restart_required": false},
+		"cover:0": {"id": 0, "state": "opening", "apower": 50.5, "current_pos": 40, "pos_control": true, "aenergy": {"total": 2}},
+		"input:0": {"id": 0, "state": true},
+		"devicepower:0": {"id": 0, "battery": {"V": 3.1, "percent": 80}, "external": {"present": false}},
+		"em1:0": {"id": 0, "voltage": 230.1, "act_power": 100, "aprt_power": 110},
+		"em:1": {"id": 1, "a_voltage": 230, "b_voltage": 231, "c_voltage": 232, "total_act_power": 300, "user_calibrated_phase": []},
+		"pm1:0": {"id": 0, "apower": 10, "aenergy": {"total": 1.5}}
+	}`), d1.Device, true)
+	s.recordStatus(ctx, testStatusNotification(t, d1.ID, `{
+		"ts": 1700000010,
+		"switch:0": {"id": 0, "output": true, "errors": ["overtemp"]}
+	}`), d1.Device, false)
+	s.recordStatus(ctx, testStatusNotification(t, d1.ID, `{
+		"ts": 1700000020,
+		"switch:0": {"id": 0, "output": true, "errors": []}
+	}`), d1.Device, false)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+
+	// The MAC from discovery is preferred over the one reported in sys.
+	device := "device_name=garage,id=0,instance=shellyplus2pm-a8032abe5424,mac=" + d1.MACAddr
+	assert.Equal(t, map[string]float64{device + ",type=cover": 40}, gaugeValues(t, rm, "cover.position"))
+	coverStates := gaugeValues(t, rm, "cover.state")
+	assert.Len(t, coverStates, 6)
+	assert.Equal(t, 1.0, coverStates[device+",state=opening,type=cover"])
+	assert.Equal(t, 0.0, coverStates[device+",state=closed,type=cover"])
+	assert.Equal(t, map[string]float64{device + ",type=input": 1}, gaugeValues(t, rm, "input.state"))
+	assert.Equal(t, map[string]float64{device: 1}, gaugeValues(t, rm, "switch.output"))
+	assert.Equal(t, map[string]float64{device + ",type=devicepower": 80}, gaugeValues(t, rm, "device_power.battery.percent"))
+	assert.Equal(t, map[string]float64{
+		"device_name=garage,instance=shellyplus2pm-a8032abe5424,mac=" + d1.MACAddr: 120,
+	}, gaugeValues(t, rm, "sys.uptime"))
+	assert.Equal(t, map[string]float64{
+		device + ",type=cover": 50.5,
+		device + ",type=em1":   100,
+		device + ",type=pm1":   10,
+		"device_name=garage,id=1,instance=shellyplus2pm-a8032abe5424,mac=" + d1.MACAddr + ",phase=total,type=em": 300,
+	}, gaugeValues(t, rm, "energy.active_power"))
+	assert.Equal(t, map[string]float64{
+		device + ",type=cover": 2 * 3600,
+		device + ",type=pm1":   1.5 * 3600,
+	}, gaugeValues(t, rm, "energy.total"))
+	assert.Equal(t, 231.0, gaugeValues(t, rm, "energy.voltage")["device_name=garage,id=1,instance=shellyplus2pm-a8032abe5424,mac="+d1.MACAddr+",phase=b,type=em"])
+	// The error was reported active and has since cleared.
+	assert.Equal(t, map[string]float64{
+		"device_name=garage,error=overtemp,id=0,instance=shellyplus2pm-a8032abe5424,mac=" + d1.MACAddr + ",type=switch": 0,
+	}, gaugeValues(t, rm, "component.error"))
+}
+
+func TestPoll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+
+	reader := sdkMetric.NewManualReader()
+	s, err := NewServer(ctx, td.Discoverer, WithMetricsReader(reader), WithPollInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Run(ctx))
+	}()
+
+	// Devices without an ID are identified by their instance.
+	expect := map[string]float64{
+		"device_name=" + d1.MACAddr + ",id=0,instance=" + d1.Instance() + ",mac=" + d1.MACAddr: 1,
+	}
+	require.Eventually(t, func() bool {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(ctx, &rm))
+		return assert.ObjectsAreEqual(expect, gaugeValues(t, rm, "switch.output"))
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestPollLocation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+	d1.AddMockResponse("Sys.GetConfig", nil, json.RawMessage(`{"location": {"tz": "America/New_York", "lat": 40.7, "lon": -74}}`))
+
+	m, err := labels.NewMapper(labels.WithLocation(true), labels.WithDropInstance(true))
+	require.NoError(t, err)
+	reader := sdkMetric.NewManualReader()
+	s, err := NewServer(ctx, td.Discoverer, WithMetricsReader(reader), WithPollInterval(10*time.Millisecond), WithLabelMapper(m))
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, s.Run(ctx))
+	}()
+
+	expect := map[string]float64{
+		"device_name=" + d1.MACAddr + ",id=0,location_lat=40.7,location_lon=-74,location_tz=America/New_York,mac=" + d1.MACAddr: 1,
+	}
+	require.Eventually(t, func() bool {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(ctx, &rm))
+		return assert.ObjectsAreEqual(expect, gaugeValues(t, rm, "switch.output"))
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestResolveLocationAsync(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Sys.GetConfig", nil, json.RawMessage(`{"location": {"tz": "America/New_York", "lat": 40.7, "lon": -74}}`))
+	devs := td.AllDevices()
+	require.Len(t, devs, 1)
+	dev := devs[0]
+
+	m, err := labels.NewMapper(labels.WithLocation(true))
+	require.NoError(t, err)
+	s, err := NewServer(ctx, td.Discoverer, WithMetricsReader(sdkMetric.NewManualReader()), WithLabelMapper(m))
+	require.NoError(t, err)
+
+	// Only one fetch runs for each device.
+	s.fetchingLocations[dev.MACAddr] = struct{}{}
+	s.resolveLocationAsync(ctx, dev)
+	s.locationFetches.Wait()
+	assert.NotContains(t, s.locations, dev.MACAddr)
+
+	delete(s.fetchingLocations, dev.MACAddr)
+	s.resolveLocationAsync(ctx, dev)
+	s.locationFetches.Wait()
+	assert.Empty(t, s.fetchingLocations)
+	require.Contains(t, s.locations, dev.MACAddr)
+	assert.Equal(t, "America/New_York", *s.locations[dev.MACAddr].location.TZ)
+}
+
+func TestAccumulatedEnergy(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.ID = "shellyplus1pm-a8032abe5424"
+	d1.Name = "heater"
+
+	a, err := energy.NewAccumulator("")
+	require.NoError(t, err)
+	reader := sdkMetric.NewManualReader()
+	s, err := NewServer(ctx, td.Discoverer, WithMetricsReader(reader), WithEnergyAccumulator(a))
+	require.NoError(t, err)
+
+	s.recordStatus(ctx, testStatusNotification(t, d1.ID, `{
+		"switch:0": {"id": 0, "aenergy": {"total": 100}, "ret_aenergy": {"total": 4}}
+	}`), d1.Device, false)
+	// The device rebooted and its consumed energy counter restarted from zero.
+	s.recordStatus(ctx, testStatusNotification(t, d1.ID, `{
+		"switch:0": {"id": 0, "aenergy": {"total": 1.5}, "ret_aenergy": {"total": 4}}
+	}`), d1.Device, false)
+	// The device rebooted again, and its counters passed their previous totals before they were
+	// observed. Its uptime shows the reboot.
+	sn := testStatusNotification(t, d1.ID, `{
+		"sys": {"uptime": 60},
+		"switch:0": {"id": 0, "aenergy": {"total": 2}, "ret_aenergy": {"total": 4.5}}
+	}`)
+	sn.ReceivedAt = time.Now().Add(time.Hour)
+	s.recordStatus(ctx, sn, d1.Device, false)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	device := "device_name=heater,id=0,instance=shellyplus1pm-a8032abe5424,mac=" + d1.MACAddr
+	assert.Equal(t, map[string]float64{device + ",type=switch": 103.5}, gaugeValues(t, rm, "energy.accumulated"))
+	assert.Equal(t, map[string]float64{device + ",type=switch": 8.5}, gaugeValues(t, rm, "energy.accumulated_returned"))
+	assert.Equal(t, map[string]float64{
+		"device_name=heater,direction=consumed,id=0,instance=shellyplus1pm-a8032abe5424,mac=" + d1.MACAddr + ",type=switch": 2,
+		"device_name=heater,direction=returned,id=0,instance=shellyplus1pm-a8032abe5424,mac=" + d1.MACAddr + ",type=switch": 1,
+	}, gaugeValues(t, rm, "energy.counter_resets"))
+	assert.Equal(t, map[energy.Key]energy.Counter{
+		{Device: d1.MACAddr, Component: "switch:0"}:                 {Total: 103.5, Resets: 2},
+		{Device: d1.MACAddr, Component: "switch:0", Returned: true}: {Total: 8.5, Resets: 1},
+	}, a.Counters())
+}
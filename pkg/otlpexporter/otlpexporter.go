@@ -0,0 +1,441 @@
+// Package otlpexporter builds OTLP metric, trace and log exporters from a single configuration.
+// The configuration may be populated from the standard OTEL_EXPORTER_OTLP_* environment variables
+// so shellyctl can be configured like other OpenTelemetry instrumented software.
+package otlpexporter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkLog "go.opentelemetry.io/otel/sdk/log"
+	sdkMetric "go.opentelemetry.io/otel/sdk/metric"
+	sdkTrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+	// Registers the gzip compressor used by the grpc exporters.
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	// ProtocolGRPC exports via OTLP/gRPC.
+	ProtocolGRPC = "grpc"
+	// ProtocolHTTP exports via OTLP/HTTP without TLS.
+	ProtocolHTTP = "http"
+	// ProtocolHTTPS exports via OTLP/HTTP with TLS.
+	ProtocolHTTPS = "https"
+
+	// DefaultTimeout is the default maximum time to wait for an export request to complete.
+	DefaultTimeout = 10 * time.Second
+)
+
+// Signal identifies the type of telemetry an exporter sends. It selects signal specific
+// environment variables and the default OTLP/HTTP path.
+type Signal string
+
+const (
+	SignalMetrics Signal = "metrics"
+	SignalTraces  Signal = "traces"
+	SignalLogs    Signal = "logs"
+)
+
+// Config describes an OTLP exporter.
+type Config struct {
+	// Protocol is one of ProtocolGRPC, ProtocolHTTP, or ProtocolHTTPS.
+	Protocol string
+	// Endpoint is either a `host:port` or a URL. OTLP/HTTP URLs without a path are sent to the
+	// signal's default path, ex. `/v1/metrics`.
+	Endpoint string
+	// BaseEndpoint is a URL to which OTLP/HTTP exporters append the signal's path, as with
+	// OTEL_EXPORTER_OTLP_ENDPOINT. It's ignored if Endpoint is set.
+	BaseEndpoint string
+	// Insecure disables TLS. Endpoint URLs with an `http` scheme are always insecure.
+	Insecure bool
+	Gzip     bool
+	Headers  map[string]string
+
+	// CAFile is a PEM encoded CA bundle used to verify the collector's certificate.
+	CAFile string
+	// ClientCertFile and ClientKeyFile are a PEM encoded certificate and key presented to the
+	// collector for mutual TLS.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	Timeout time.Duration
+	Retry   RetryConfig
+}
+
+// RetryConfig configures retries of failed exports.
+type RetryConfig struct {
+	Enabled         bool
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	MaxElapsedTime  time.Duration
+}
+
+// Default returns the default configuration, which exports to a local collector via gRPC.
+func Default() *Config {
+	return &Config{
+		Protocol: ProtocolGRPC,
+		Timeout:  DefaultTimeout,
+		Retry: RetryConfig{
+			Enabled:         true,
+			InitialInterval: 5 * time.Second,
+			MaxInterval:     30 * time.Second,
+			MaxElapsedTime:  time.Minute,
+		},
+	}
+}
+
+// ApplyEnv overrides the configuration with the standard OTEL_EXPORTER_OTLP_* environment
+// variables. Signal specific variables (ex. OTEL_EXPORTER_OTLP_METRICS_ENDPOINT) take precedence
+// over the generic variables. lookup is typically os.LookupEnv.
+func (c *Config) ApplyEnv(signal Signal, lookup func(string) (string, bool)) error {
+	get := func(name string) (string, bool) {
+		if v, ok := lookup("OTEL_EXPORTER_OTLP_" + strings.ToUpper(string(signal)) + "_" + name); ok {
+			return v, true
+		}
+		return lookup("OTEL_EXPORTER_OTLP_" + name)
+	}
+	if v, ok := get("PROTOCOL"); ok {
+		switch v {
+		case "grpc":
+			c.Protocol = ProtocolGRPC
+		case "http/protobuf":
+			// TLS is disabled by an `http://` endpoint, once it's resolved.
+			c.Protocol = ProtocolHTTPS
+		case "http/json":
+			return fmt.Errorf("unsupported OTLP protocol %q; use http/protobuf", v)
+		default:
+			return fmt.Errorf("unsupported OTLP protocol %q", v)
+		}
+	}
+	if v, ok := lookup("OTEL_EXPORTER_OTLP_" + strings.ToUpper(string(signal)) + "_ENDPOINT"); ok {
+		c.Endpoint = v
+	} else if v, ok := lookup("OTEL_EXPORTER_OTLP_ENDPOINT"); ok {
+		// The signal's path is appended once the protocol is known, which flags may change.
+		c.BaseEndpoint = v
+	}
+	if v, ok := get("INSECURE"); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("parsing OTLP insecure: %w", err)
+		}
+		c.Insecure = b
+	}
+	if v, ok := get("HEADERS"); ok {
+		headers, err := ParseHeaders(strings.Split(v, ","), true)
+		if err != nil {
+			return err
+		}
+		c.Headers = headers
+	}
+	if v, ok := get("COMPRESSION"); ok {
+		switch v {
+		case "gzip":
+			c.Gzip = true
+		case "none", "":
+			c.Gzip = false
+		default:
+			return fmt.Errorf("unsupported OTLP compression %q", v)
+		}
+	}
+	if v, ok := get("TIMEOUT"); ok {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("parsing OTLP timeout: %w", err)
+		}
+		c.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	if v, ok := get("CERTIFICATE"); ok {
+		c.CAFile = v
+	}
+	if v, ok := get("CLIENT_CERTIFICATE"); ok {
+		c.ClientCertFile = v
+	}
+	if v, ok := get("CLIENT_KEY"); ok {
+		c.ClientKeyFile = v
+	}
+	return nil
+}
+
+// ParseHeaders parses headers specified as `k=v`. If unescape is true, keys and values are URL
+// decoded as required for OTEL_EXPORTER_OTLP_HEADERS.
+func ParseHeaders(kvs []string, unescape bool) (map[string]string, error) {
+	headers := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q; expected k=v", kv)
+		}
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if unescape {
+			var err error
+			if k, err = url.PathUnescape(k); err != nil {
+				return nil, fmt.Errorf("decoding header %q: %w", kv, err)
+			}
+			if v, err = url.PathUnescape(v); err != nil {
+				return nil, fmt.Errorf("decoding header %q: %w", kv, err)
+			}
+		}
+		if k == "" {
+			return nil, fmt.Errorf("invalid header %q; empty name", kv)
+		}
+		headers[k] = v
+	}
+	return headers, nil
+}
+
+// TLSConfig returns the client TLS configuration, or nil if no CA or client certificate is
+// configured.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.CAFile == "" && c.ClientCertFile == "" && c.ClientKeyFile == "" {
+		return nil, nil
+	}
+	if c.insecure() {
+		return nil, errors.New("OTLP CA and client certificate options require TLS, but the exporter is insecure")
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		b, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading OTLP CA file: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in OTLP CA file %q", c.CAFile)
+		}
+	}
+	if c.ClientCertFile != "" || c.ClientKeyFile != "" {
+		if c.ClientCertFile == "" || c.ClientKeyFile == "" {
+			return nil, errors.New("OTLP client certificate and key must be specified together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCertFile, c.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading OTLP client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// endpoint returns the endpoint for the signal, and whether it's a URL. OTLP/HTTP URLs are given
+// the signal's path if they have none, or if they're the BaseEndpoint.
+func (c *Config) endpoint(signal Signal) (string, bool) {
+	endpoint, base := c.Endpoint, false
+	if endpoint == "" {
+		endpoint, base = c.BaseEndpoint, true
+	}
+	if !strings.Contains(endpoint, "://") {
+		return endpoint, false
+	}
+	if c.Protocol == ProtocolGRPC {
+		return endpoint, true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		// The exporter will report the invalid URL.
+		return endpoint, true
+	}
+	switch {
+	case base:
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/" + string(signal)
+	case u.Path == "" || u.Path == "/":
+		u.Path = "/v1/" + string(signal)
+	}
+	return u.String(), true
+}
+
+// insecure reports if TLS should be disabled.
+func (c *Config) insecure() bool {
+	if c.Insecure || c.Protocol == ProtocolHTTP {
+		return true
+	}
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = c.BaseEndpoint
+	}
+	return strings.HasPrefix(strings.ToLower(endpoint), "http://")
+}
+
+// exporterOptions converts the configuration into the options of an exporter package. Each
+// package has its own option types, but the same set of options.
+type exporterOptions[O any] struct {
+	timeout     func(time.Duration) O
+	retry       func(RetryConfig) O
+	endpoint    func(string) O
+	endpointURL func(string) O
+	insecure    func() O
+	tls         func(*tls.Config) O
+	headers     func(map[string]string) O
+	gzip        func() O
+}
+
+func (o exporterOptions[O]) build(c *Config, signal Signal) ([]O, error) {
+	tc, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts := []O{o.timeout(c.Timeout), o.retry(c.Retry)}
+	if endpoint, isURL := c.endpoint(signal); isURL {
+		opts = append(opts, o.endpointURL(endpoint))
+	} else if endpoint != "" {
+		opts = append(opts, o.endpoint(endpoint))
+	}
+	if c.insecure() {
+		opts = append(opts, o.insecure())
+	} else if tc != nil {
+		opts = append(opts, o.tls(tc))
+	}
+	if len(c.Headers) > 0 {
+		opts = append(opts, o.headers(c.Headers))
+	}
+	if c.Gzip {
+		opts = append(opts, o.gzip())
+	}
+	return opts, nil
+}
+
+// MetricExporter builds an OTLP metric exporter.
+func (c *Config) MetricExporter(ctx context.Context) (sdkMetric.Exporter, error) {
+	switch c.Protocol {
+	case ProtocolGRPC:
+		opts, err := exporterOptions[otlpmetricgrpc.Option]{
+			timeout: otlpmetricgrpc.WithTimeout,
+			retry: func(r RetryConfig) otlpmetricgrpc.Option {
+				return otlpmetricgrpc.WithRetry(otlpmetricgrpc.RetryConfig(r))
+			},
+			endpoint:    otlpmetricgrpc.WithEndpoint,
+			endpointURL: otlpmetricgrpc.WithEndpointURL,
+			insecure:    otlpmetricgrpc.WithInsecure,
+			tls: func(tc *tls.Config) otlpmetricgrpc.Option {
+				return otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tc))
+			},
+			headers: otlpmetricgrpc.WithHeaders,
+			gzip:    func() otlpmetricgrpc.Option { return otlpmetricgrpc.WithCompressor("gzip") },
+		}.build(c, SignalMetrics)
+		if err != nil {
+			return nil, err
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case ProtocolHTTP, ProtocolHTTPS:
+		opts, err := exporterOptions[otlpmetrichttp.Option]{
+			timeout: otlpmetrichttp.WithTimeout,
+			retry: func(r RetryConfig) otlpmetrichttp.Option {
+				return otlpmetrichttp.WithRetry(otlpmetrichttp.RetryConfig(r))
+			},
+			endpoint:    otlpmetrichttp.WithEndpoint,
+			endpointURL: otlpmetrichttp.WithEndpointURL,
+			insecure:    otlpmetrichttp.WithInsecure,
+			tls:         otlpmetrichttp.WithTLSClientConfig,
+			headers:     otlpmetrichttp.WithHeaders,
+			gzip:        func() otlpmetrichttp.Option { return otlpmetrichttp.WithCompression(otlpmetrichttp.GzipCompression) },
+		}.build(c, SignalMetrics)
+		if err != nil {
+			return nil, err
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+	return nil, fmt.Errorf("unsupported OTLP protocol %q", c.Protocol)
+}
+
+// TraceExporter builds an OTLP span exporter.
+func (c *Config) TraceExporter(ctx context.Context) (sdkTrace.SpanExporter, error) {
+	switch c.Protocol {
+	case ProtocolGRPC:
+		opts, err := exporterOptions[otlptracegrpc.Option]{
+			timeout: otlptracegrpc.WithTimeout,
+			retry: func(r RetryConfig) otlptracegrpc.Option {
+				return otlptracegrpc.WithRetry(otlptracegrpc.RetryConfig(r))
+			},
+			endpoint:    otlptracegrpc.WithEndpoint,
+			endpointURL: otlptracegrpc.WithEndpointURL,
+			insecure:    otlptracegrpc.WithInsecure,
+			tls: func(tc *tls.Config) otlptracegrpc.Option {
+				return otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tc))
+			},
+			headers: otlptracegrpc.WithHeaders,
+			gzip:    func() otlptracegrpc.Option { return otlptracegrpc.WithCompressor("gzip") },
+		}.build(c, SignalTraces)
+		if err != nil {
+			return nil, err
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case ProtocolHTTP, ProtocolHTTPS:
+		opts, err := exporterOptions[otlptracehttp.Option]{
+			timeout: otlptracehttp.WithTimeout,
+			retry: func(r RetryConfig) otlptracehttp.Option {
+				return otlptracehttp.WithRetry(otlptracehttp.RetryConfig(r))
+			},
+			endpoint:    otlptracehttp.WithEndpoint,
+			endpointURL: otlptracehttp.WithEndpointURL,
+			insecure:    otlptracehttp.WithInsecure,
+			tls:         otlptracehttp.WithTLSClientConfig,
+			headers:     otlptracehttp.WithHeaders,
+			gzip:        func() otlptracehttp.Option { return otlptracehttp.WithCompression(otlptracehttp.GzipCompression) },
+		}.build(c, SignalTraces)
+		if err != nil {
+			return nil, err
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	return nil, fmt.Errorf("unsupported OTLP protocol %q", c.Protocol)
+}
+
+// LogExporter builds an OTLP log exporter.
+func (c *Config) LogExporter(ctx context.Context) (sdkLog.Exporter, error) {
+	switch c.Protocol {
+	case ProtocolGRPC:
+		opts, err := exporterOptions[otlploggrpc.Option]{
+			timeout: otlploggrpc.WithTimeout,
+			retry: func(r RetryConfig) otlploggrpc.Option {
+				return otlploggrpc.WithRetry(otlploggrpc.RetryConfig(r))
+			},
+			endpoint:    otlploggrpc.WithEndpoint,
+			endpointURL: otlploggrpc.WithEndpointURL,
+			insecure:    otlploggrpc.WithInsecure,
+			tls: func(tc *tls.Config) otlploggrpc.Option {
+				return otlploggrpc.WithTLSCredentials(credentials.NewTLS(tc))
+			},
+			headers: otlploggrpc.WithHeaders,
+			gzip:    func() otlploggrpc.Option { return otlploggrpc.WithCompressor("gzip") },
+		}.build(c, SignalLogs)
+		if err != nil {
+			return nil, err
+		}
+		return otlploggrpc.New(ctx, opts...)
+	case ProtocolHTTP, ProtocolHTTPS:
+		opts, err := exporterOptions[otlploghttp.Option]{
+			timeout: otlploghttp.WithTimeout,
+			retry: func(r RetryConfig) otlploghttp.Option {
+				return otlploghttp.WithRetry(otlploghttp.RetryConfig(r))
+			},
+			endpoint:    otlploghttp.WithEndpoint,
+			endpointURL: otlploghttp.WithEndpointURL,
+			insecure:    otlploghttp.WithInsecure,
+			tls:         otlploghttp.WithTLSClientConfig,
+			headers:     otlploghttp.WithHeaders,
+			gzip:        func() otlploghttp.Option { return otlploghttp.WithCompression(otlploghttp.GzipCompression) },
+		}.build(c, SignalLogs)
+		if err != nil {
+			return nil, err
+		}
+		return otlploghttp.New(ctx, opts...)
+	}
+	return nil, fmt.Errorf("unsupported OTLP protocol %q", c.Protocol)
+}
@@ -0,0 +1,367 @@
+package otlpexporter
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	otelLog "go.opentelemetry.io/otel/log"
+	sdkLog "go.opentelemetry.io/otel/sdk/log"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+)
+
+// receivedRequest describes a request to a stand-in OTLP receiver.
+type receivedRequest struct {
+	path     string
+	header   string
+	gzip     bool
+	bodySize int
+}
+
+// testReceiver is a stand-in OTLP/HTTP receiver which requires a client certificate.
+type testReceiver struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []receivedRequest
+}
+
+func newTestReceiver(t *testing.T, serverTLS *tls.Config) *testReceiver {
+	t.Helper()
+	tr := &testReceiver{}
+	tr.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+		gz := r.Header.Get("Content-Encoding") == "gzip"
+		if gz {
+			zr, err := gzip.NewReader(r.Body)
+			if !assert.NoError(t, err) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		b, err := io.ReadAll(body)
+		assert.NoError(t, err)
+		tr.lock.Lock()
+		tr.requests = append(tr.requests, receivedRequest{
+			path:     r.URL.Path,
+			header:   r.Header.Get("X-Test"),
+			gzip:     gz,
+			bodySize: len(b),
+		})
+		tr.lock.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	tr.TLS = serverTLS
+	tr.StartTLS()
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+// testMetricsService is a stand-in OTLP/gRPC metrics receiver.
+type testMetricsService struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	lock    sync.Mutex
+	headers []string
+}
+
+func (s *testMetricsService) Export(ctx context.Context, _ *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.headers = append(s.headers, md.Get("x-test")...)
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+// countingCompressor wraps the registered gzip compressor to count decompressed messages.
+type countingCompressor struct {
+	encoding.Compressor
+	decompressed atomic.Int32
+}
+
+func (c *countingCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	c.decompressed.Add(1)
+	return c.Compressor.Decompress(r)
+}
+
+// testPKI writes a CA, server and client certificate to dir and returns the server's TLS config.
+func testPKI(t *testing.T, dir string) *tls.Config {
+	t.Helper()
+	caCert, caKey := testutil.NewCert(t, dir, "ca", nil, nil)
+	testutil.NewCert(t, dir, "server", caCert, caKey)
+	testutil.NewCert(t, dir, "client", caCert, caKey)
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+func testConfig(dir, protocol, endpoint string) *Config {
+	c := Default()
+	c.Protocol = protocol
+	c.Endpoint = endpoint
+	c.Gzip = true
+	c.Headers = map[string]string{"x-test": "hello"}
+	c.CAFile = filepath.Join(dir, "ca.crt")
+	c.ClientCertFile = filepath.Join(dir, "client.crt")
+	c.ClientKeyFile = filepath.Join(dir, "client.key")
+	c.Retry.Enabled = false
+	return c
+}
+
+func testResourceMetrics() *metricdata.ResourceMetrics {
+	return &metricdata.ResourceMetrics{
+		ScopeMetrics: []metricdata.ScopeMetrics{{
+			Metrics: []metricdata.Metrics{{
+				Name: "switch.output",
+				Data: metricdata.Gauge[int64]{
+					DataPoints: []metricdata.DataPoint[int64]{{Time: time.Now(), Value: 1}},
+				},
+			}},
+		}},
+	}
+}
+
+func TestHTTPExporters(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	recv := newTestReceiver(t, testPKI(t, dir))
+	c := testConfig(dir, ProtocolHTTPS, recv.URL)
+
+	me, err := c.MetricExporter(ctx)
+	require.NoError(t, err)
+	require.NoError(t, me.Export(ctx, testResourceMetrics()))
+	require.NoError(t, me.Shutdown(ctx))
+
+	te, err := c.TraceExporter(ctx)
+	require.NoError(t, err)
+	require.NoError(t, te.ExportSpans(ctx, tracetest.SpanStubs{{Name: "Shelly.GetStatus"}}.Snapshots()))
+	require.NoError(t, te.Shutdown(ctx))
+
+	le, err := c.LogExporter(ctx)
+	require.NoError(t, err)
+	var r sdkLog.Record
+	r.SetBody(otelLog.StringValue("single_push"))
+	require.NoError(t, le.Export(ctx, []sdkLog.Record{r}))
+	require.NoError(t, le.Shutdown(ctx))
+
+	require.Len(t, recv.requests, 3)
+	for i, path := range []string{"/v1/metrics", "/v1/traces", "/v1/logs"} {
+		req := recv.requests[i]
+		assert.Equal(t, path, req.path)
+		assert.Equal(t, "hello", req.header)
+		assert.True(t, req.gzip, "expected %s to be gzip compressed", path)
+		assert.NotZero(t, req.bodySize)
+	}
+
+	// Without the client certificate the receiver rejects the handshake.
+	c.ClientCertFile, c.ClientKeyFile = "", ""
+	me, err = c.MetricExporter(ctx)
+	require.NoError(t, err)
+	require.Error(t, me.Export(ctx, testResourceMetrics()))
+}
+
+func TestGRPCExporter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	serverTLS := testPKI(t, dir)
+
+	gz := &countingCompressor{Compressor: encoding.GetCompressor("gzip")}
+	encoding.RegisterCompressor(gz)
+	t.Cleanup(func() { encoding.RegisterCompressor(gz.Compressor) })
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	svc := &testMetricsService{}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(serverTLS)))
+	colmetricpb.RegisterMetricsServiceServer(srv, svc)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	c := testConfig(dir, ProtocolGRPC, lis.Addr().String())
+	me, err := c.MetricExporter(ctx)
+	require.NoError(t, err)
+	require.NoError(t, me.Export(ctx, testResourceMetrics()))
+	require.NoError(t, me.Shutdown(ctx))
+
+	assert.Equal(t, []string{"hello"}, svc.headers)
+	assert.Equal(t, int32(1), gz.decompressed.Load())
+}
+
+func TestApplyEnv(t *testing.T) {
+	tcs := []struct {
+		name      string
+		signal    Signal
+		env       map[string]string
+		expect    func(*Config)
+		expectErr bool
+	}{
+		{
+			name:   "generic endpoint is a base endpoint",
+			signal: SignalMetrics,
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_PROTOCOL": "http/protobuf",
+				"OTEL_EXPORTER_OTLP_ENDPOINT": "https://collector:4318/otlp/",
+			},
+			expect: func(c *Config) {
+				c.Protocol = ProtocolHTTPS
+				c.BaseEndpoint = "https://collector:4318/otlp/"
+			},
+		},
+		{
+			name:   "signal specific values take precedence",
+			signal: SignalTraces,
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_ENDPOINT":           "collector:4317",
+				"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT":    "traces:4317",
+				"OTEL_EXPORTER_OTLP_COMPRESSION":        "gzip",
+				"OTEL_EXPORTER_OTLP_TRACES_COMPRESSION": "none",
+				"OTEL_EXPORTER_OTLP_TIMEOUT":            "2500",
+				"OTEL_EXPORTER_OTLP_METRICS_ENDPOINT":   "metrics:4317",
+				"OTEL_EXPORTER_OTLP_CERTIFICATE":        "ca.crt",
+				"OTEL_EXPORTER_OTLP_CLIENT_CERTIFICATE": "client.crt",
+				"OTEL_EXPORTER_OTLP_TRACES_CLIENT_KEY":  "client.key",
+				"OTEL_EXPORTER_OTLP_TRACES_INSECURE":    "true",
+				"OTEL_EXPORTER_OTLP_TRACES_PROTOCOL":    "grpc",
+			},
+			expect: func(c *Config) {
+				c.Endpoint = "traces:4317"
+				c.Timeout = 2500 * time.Millisecond
+				c.CAFile = "ca.crt"
+				c.ClientCertFile = "client.crt"
+				c.ClientKeyFile = "client.key"
+				c.Insecure = true
+			},
+		},
+		{
+			name:   "headers are url decoded",
+			signal: SignalLogs,
+			env: map[string]string{
+				"OTEL_EXPORTER_OTLP_HEADERS": "api-key=abc%3D123, x-tenant = home",
+			},
+			expect: func(c *Config) {
+				c.Headers = map[string]string{"api-key": "abc=123", "x-tenant": "home"}
+			},
+		},
+		{
+			name:      "unsupported protocol",
+			signal:    SignalMetrics,
+			env:       map[string]string{"OTEL_EXPORTER_OTLP_PROTOCOL": "http/json"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid header",
+			signal:    SignalMetrics,
+			env:       map[string]string{"OTEL_EXPORTER_OTLP_HEADERS": "api-key"},
+			expectErr: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Default()
+			err := c.ApplyEnv(tc.signal, func(k string) (string, bool) {
+				v, ok := tc.env[k]
+				return v, ok
+			})
+			if tc.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			expect := Default()
+			tc.expect(expect)
+			assert.Equal(t, expect, c)
+		})
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	tcs := []struct {
+		name           string
+		config         Config
+		expectEndpoint string
+		expectURL      bool
+		expectInsecure bool
+	}{
+		{
+			name:           "host and port",
+			config:         Config{Protocol: ProtocolHTTPS, Endpoint: "collector:4318"},
+			expectEndpoint: "collector:4318",
+		},
+		{
+			name:           "http url without a path",
+			config:         Config{Protocol: ProtocolHTTPS, Endpoint: "https://collector:4318"},
+			expectEndpoint: "https://collector:4318/v1/traces",
+			expectURL:      true,
+		},
+		{
+			name:           "http url with a path",
+			config:         Config{Protocol: ProtocolHTTPS, Endpoint: "https://collector:4318/custom"},
+			expectEndpoint: "https://collector:4318/custom",
+			expectURL:      true,
+		},
+		{
+			name:           "base endpoint appends the signal path",
+			config:         Config{Protocol: ProtocolHTTPS, BaseEndpoint: "http://collector:4318/otlp/"},
+			expectEndpoint: "http://collector:4318/otlp/v1/traces",
+			expectURL:      true,
+			expectInsecure: true,
+		},
+		{
+			name:           "endpoint takes precedence over base endpoint",
+			config:         Config{Protocol: ProtocolHTTPS, Endpoint: "https://traces:4318", BaseEndpoint: "http://collector:4318"},
+			expectEndpoint: "https://traces:4318/v1/traces",
+			expectURL:      true,
+		},
+		{
+			name:           "grpc base endpoint is used as is",
+			config:         Config{Protocol: ProtocolGRPC, BaseEndpoint: "http://collector:4317"},
+			expectEndpoint: "http://collector:4317",
+			expectURL:      true,
+			expectInsecure: true,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoint, isURL := tc.config.endpoint(SignalTraces)
+			assert.Equal(t, tc.expectEndpoint, endpoint)
+			assert.Equal(t, tc.expectURL, isURL)
+			assert.Equal(t, tc.expectInsecure, tc.config.insecure())
+		})
+	}
+}
+
+func TestTLSConfigInsecure(t *testing.T) {
+	for _, c := range []*Config{
+		{Protocol: ProtocolGRPC, Insecure: true, CAFile: "ca.crt"},
+		{Protocol: ProtocolHTTP, ClientCertFile: "client.crt", ClientKeyFile: "client.key"},
+		{Protocol: ProtocolHTTPS, Endpoint: "http://collector:4318", CAFile: "ca.crt"},
+	} {
+		_, err := c.TLSConfig()
+		assert.Error(t, err, "%+v", c)
+	}
+}
@@ -54,6 +54,20 @@ func MinJSON(ctx context.Context, msg, field string, f any, raw json.RawMessage)
 	return err
 }
 
+// NDJSON outputs the data as a single line of compact JSON, suitable for streaming to jq or log
+// shippers.
+func NDJSON(ctx context.Context, msg, field string, f any, raw json.RawMessage) error {
+	if raw == nil {
+		return EchoMinJSON(ctx, msg, field, f, nil)
+	}
+	var b bytes.Buffer
+	if err := json.Compact(&b, raw); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(os.Stdout, b.String())
+	return err
+}
+
 // Log encodes the data as a structured log.
 func Log(ctx context.Context, msg, field string, f any, raw json.RawMessage) error {
 	log.Ctx(ctx).Info().Any(field, f).Msg(msg)
@@ -185,6 +199,8 @@ func ByName(name string) (Outputter, error) {
 		return JSON, nil
 	case "min-json":
 		return MinJSON, nil
+	case "ndjson":
+		return NDJSON, nil
 	case "yaml":
 		return YAML, nil
 	case "text":
@@ -0,0 +1,59 @@
+package promserver
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// bthomeCollector collects the readings of BTHome devices. Measurement metric names depend on the
+// measurements received, so it's registered as an unchecked collector.
+type bthomeCollector struct {
+	s *Server
+}
+
+var _ prometheus.Collector = (*bthomeCollector)(nil)
+
+// Describe implements prometheus.Collector. It describes nothing, making the collector unchecked.
+func (c *bthomeCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect implements prometheus.Collector.
+func (c *bthomeCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.s
+	name := func(n string) string {
+		return prometheus.BuildFQName(s.namespace, "bthome", n)
+	}
+	rssiDesc := prometheus.NewDesc(name("rssi_dbm"),
+		`Signal strength of the device's last BTHome advertisement.`,
+		[]string{"mac", "name"}, nil)
+	lastSeenDesc := prometheus.NewDesc(name("last_seen_timestamp_seconds"),
+		`Time of the device's last BTHome advertisement.`,
+		[]string{"mac", "name"}, nil)
+	eventsDesc := prometheus.NewDesc(name("events_total"),
+		`Number of button and dimmer events received, ex. button presses.`,
+		[]string{"mac", "name", "event", "index", "type"}, nil)
+	descs := make(map[string]*prometheus.Desc)
+	for _, d := range s.bthome.Devices() {
+		ch <- prometheus.MustNewConstMetric(rssiDesc, prometheus.GaugeValue, float64(d.RSSI), d.MACAddr, d.Name)
+		ch <- prometheus.MustNewConstMetric(lastSeenDesc, prometheus.GaugeValue, float64(d.LastSeen.UnixMilli())/1000, d.MACAddr, d.Name)
+		for _, m := range d.Measurements {
+			metric := m.MetricName()
+			desc, ok := descs[metric]
+			if !ok {
+				help := `BTHome ` + m.Name + ` measurement`
+				if m.Unit != "" {
+					help += ` in ` + m.Unit
+				}
+				if m.Binary {
+					help = `1 if the BTHome ` + m.Name + ` sensor is active; 0 otherwise.`
+				}
+				desc = prometheus.NewDesc(name(metric), help, []string{"mac", "name", "index"}, nil)
+				descs[metric] = desc
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.Value, d.MACAddr, d.Name, strconv.Itoa(m.Index))
+		}
+		for e, n := range d.EventCounts {
+			ch <- prometheus.MustNewConstMetric(eventsDesc, prometheus.CounterValue, float64(n), d.MACAddr, d.Name, e.Name, strconv.Itoa(e.Index), e.Type)
+		}
+	}
+}
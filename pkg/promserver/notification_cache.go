@@ -1,83 +1,230 @@
 package promserver
 
 import (
-	"container/list"
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/jcodybaker/go-shelly"
 	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/internal/jsonmerge"
+	"github.com/rs/zerolog/log"
 )
 
 const (
 	defaultNotificationCacheTTL = 15 * time.Minute
 )
 
+// notificationCache maintains the latest known component state of each device which reports via
+// NotifyFullStatus and NotifyStatus notifications. Full statuses replace a device's state, while
+// NotifyStatus deltas are merged into the existing components. Full statuses and deltas are
+// received separately and may be applied out of order, so fields which were updated after a
+// notification are kept.
 type notificationCache struct {
 	lock       sync.Mutex
-	statuses   *list.List
+	devices    map[string]*deviceState
 	discoverer *discovery.Discoverer
 	ttl        time.Duration
+	now        func() time.Time
 }
 
-type timestampedStatus struct {
-	localTS time.Time
-	discovery.StatusNotification
+// deviceState is the merged component model for a single device, keyed by notification src.
+type deviceState struct {
+	// lastSeen is the local time the most recent notification was received. Devices which haven't
+	// reported within the cache TTL are expired.
+	lastSeen time.Time
+	// components maps component keys (ex. `switch:0`) to their fields.
+	components map[string]map[string]fieldState
+}
+
+// fieldState is the last reported value of a single component field.
+type fieldState struct {
+	value any
+	ts    time.Time
+}
+
+// cachedStatus is a point-in-time view of a device's merged state.
+type cachedStatus struct {
+	src    string
+	status *shelly.NotifyStatus
+	// componentTS holds the most recent update time of each component, keyed like `switch:0`.
+	componentTS map[string]time.Time
+	// uptimeTS is when the `sys` component's uptime was reported. Other sys fields are updated
+	// separately, so componentTS["sys"] may be later.
+	uptimeTS time.Time
 }
 
 func newNotificationCache(ttl time.Duration, d *discovery.Discoverer) *notificationCache {
 	return &notificationCache{
-		statuses:   list.New(),
+		devices:    make(map[string]*deviceState),
 		ttl:        ttl,
 		discoverer: d,
+		now:        time.Now,
 	}
 }
 
-func (c *notificationCache) consumer(ctx context.Context) {
-	fsnChan := c.discoverer.GetFullStatusNotifications(50)
-	fsChan := c.discoverer.GetStatusNotifications(50)
+// consumer applies notifications until ctx is done. If ready is set, it's called once the
+// notifications are subscribed.
+func (c *notificationCache) consumer(ctx context.Context, ready func()) {
+	l := log.Ctx(ctx)
+	fullStatus := c.discoverer.SubscribeFullStatus()
+	defer fullStatus.Unsubscribe()
+	status := c.discoverer.SubscribeStatus()
+	defer status.Unsubscribe()
+	if ready != nil {
+		ready()
+	}
 	for {
-		var notification timestampedStatus
+		var notification discovery.StatusNotification
+		var full bool
 		select {
 		case <-ctx.Done():
 			return
-		case notification.StatusNotification = <-fsnChan:
-		case notification.StatusNotification = <-fsChan:
+		case notification = <-fullStatus.C():
+			full = true
+		case notification = <-status.C():
+		}
+		if err := c.apply(notification, full); err != nil {
+			l.Warn().Err(err).Str("src", notification.Frame.Src).Msg("caching status notification")
+		}
+	}
+}
+
+// apply merges a notification into the device's state. If full is true the notification
+// replaces all previously known fields, except those updated after it.
+func (c *notificationCache) apply(n discovery.StatusNotification, full bool) error {
+	var params map[string]any
+	d := json.NewDecoder(bytes.NewReader(n.Frame.Params))
+	// Numbers are kept as reported, rather than rounded through float64.
+	d.UseNumber()
+	if err := d.Decode(&params); err != nil {
+		return fmt.Errorf("decoding notification params: %w", err)
+	}
+	now := c.now()
+	// The device provides a timestamp which we'll report for the fields it updated, but some
+	// skew is expected, and there's non-trivial chance it's totally whacky wrong. For that reason
+	// expiry is based on the local receive time.
+	ts := now
+	if n.Status != nil && n.Status.TS > 0 {
+		ts = notificationTime(n.Status.TS)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ds, ok := c.devices[n.Frame.Src]
+	if !ok {
+		ds = &deviceState{components: make(map[string]map[string]fieldState)}
+		c.devices[n.Frame.Src] = ds
+	}
+	ds.lastSeen = now
+	if full {
+		// Fields which aren't in the full status were removed, unless they're newer.
+		for key, component := range ds.components {
+			for f, fs := range component {
+				if !fs.ts.After(ts) {
+					delete(component, f)
+				}
+			}
+			if len(component) == 0 {
+				delete(ds.components, key)
+			}
 		}
-		now := time.Now()
-		// The underlying statuses have a timestamp provided by the device. We'll report that for
-		// the metric but some skew is expected, and there's non-trivial chance it's totally whacky wrong.
-		// For that reason we capture the local timestamp here and base the cache-purge on this.
-		notification.localTS = now
-		c.lock.Lock()
-		c.statuses.PushBack(notification)
-		c.lockedPurge(now)
-		c.lock.Unlock()
 	}
+	for key, raw := range params {
+		fields, ok := raw.(map[string]any)
+		if !ok {
+			// Non-component params like `ts`.
+			continue
+		}
+		component, ok := ds.components[key]
+		if !ok {
+			component = make(map[string]fieldState)
+			ds.components[key] = component
+		}
+		for f, v := range fields {
+			prev, ok := component[f]
+			if ok && prev.ts.After(ts) {
+				continue
+			}
+			// Deltas of nested objects like `aenergy` may only include the changed values.
+			if vm, isMap := v.(map[string]any); isMap && ok {
+				if pm, isMap := prev.value.(map[string]any); isMap {
+					v = jsonmerge.Merge(pm, vm)
+				}
+			}
+			component[f] = fieldState{value: v, ts: ts}
+		}
+	}
+	c.lockedPurge(now)
+	return nil
 }
 
 func (c *notificationCache) lockedPurge(now time.Time) {
 	expiry := now.Add(-1 * c.ttl)
-	for e := c.statuses.Front(); e != nil; e = e.Next() {
-		status := e.Value.(timestampedStatus)
-		if status.localTS.Before(expiry) {
-			c.statuses.Remove(e)
-		} else {
-			// The list is ordered by the monotonically increasing timestamp, so we only need to
-			// inspect up to the first non-expired entry.
-			break
+	for src, ds := range c.devices {
+		if ds.lastSeen.Before(expiry) {
+			delete(c.devices, src)
 		}
 	}
 }
 
-func (c *notificationCache) getStatuses() (out []discovery.StatusNotification) {
-	now := time.Now()
+// getStatuses returns the current merged state of each unexpired device.
+func (c *notificationCache) getStatuses(ctx context.Context) (out []cachedStatus) {
+	l := log.Ctx(ctx)
 	c.lock.Lock()
-	c.lockedPurge(now)
-	for e := c.statuses.Front(); e != nil; e = e.Next() {
-		status := e.Value.(timestampedStatus)
-		out = append(out, status.StatusNotification)
+	defer c.lock.Unlock()
+	c.lockedPurge(c.now())
+	for src, ds := range c.devices {
+		cs := cachedStatus{
+			src:         src,
+			status:      &shelly.NotifyStatus{},
+			componentTS: make(map[string]time.Time, len(ds.components)),
+		}
+		merged := make(map[string]map[string]any, len(ds.components))
+		for key, fields := range ds.components {
+			component := make(map[string]any, len(fields))
+			var latest time.Time
+			for f, fs := range fields {
+				component[f] = fs.value
+				if fs.ts.After(latest) {
+					latest = fs.ts
+				}
+			}
+			// Deltas may omit the id, but the component key always carries it.
+			if _, ok := component["id"]; !ok {
+				if _, id, ok := strings.Cut(key, ":"); ok {
+					if _, err := strconv.Atoi(id); err == nil {
+						component["id"] = json.Number(id)
+					}
+				}
+			}
+			merged[key] = component
+			cs.componentTS[key] = latest
+		}
+		if uptime, ok := ds.components["sys"]["uptime"]; ok {
+			cs.uptimeTS = uptime.ts
+		}
+		b, err := json.Marshal(merged)
+		if err == nil {
+			err = json.Unmarshal(b, cs.status)
+		}
+		if err != nil {
+			l.Err(err).Str("src", src).Msg("decoding cached status")
+			continue
+		}
+		out = append(out, cs)
 	}
-	c.lock.Unlock()
 	return out
 }
+
+// notificationTime converts a notification's fractional unix timestamp.
+func notificationTime(ts float64) time.Time {
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
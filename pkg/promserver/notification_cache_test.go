@@ -0,0 +1,145 @@
+package promserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testStatusNotification(t *testing.T, src, params string) discovery.StatusNotification {
+	t.Helper()
+	s := &shelly.NotifyStatus{}
+	require.NoError(t, json.Unmarshal([]byte(params), s))
+	return discovery.StatusNotification{
+		Status: s,
+		Frame: &frame.Frame{
+			Src:    src,
+			Params: json.RawMessage(params),
+		},
+	}
+}
+
+func TestNotificationCacheMerge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	c := newNotificationCache(time.Minute, nil)
+	c.now = func() time.Time { return now }
+
+	const src = "shellyplus1pm-a8032abe5424"
+	require.NoError(t, c.apply(testStatusNotification(t, src,
+		`{"ts": 1700000000.5, "switch:0": {"id": 0, "output": false, "apower": 0}, "input:0": {"id": 0, "state": false}}`,
+	), true))
+	require.NoError(t, c.apply(testStatusNotification(t, src,
+		`{"ts": 1700000010, "switch:0": {"output": true}}`,
+	), false))
+	// A delta for the same component should be merged, not duplicated.
+	require.NoError(t, c.apply(testStatusNotification(t, src,
+		`{"ts": 1700000020, "switch:0": {"id": 0, "apower": 12.5}}`,
+	), false))
+
+	statuses := c.getStatuses(ctx)
+	require.Len(t, statuses, 1)
+	s := statuses[0]
+	assert.Equal(t, src, s.src)
+	require.Len(t, s.status.Switches, 1)
+	assert.Equal(t, 0, s.status.Switches[0].ID)
+	assert.Equal(t, shelly.BoolPtr(true), s.status.Switches[0].Output)
+	assert.Equal(t, shelly.Float64Ptr(12.5), s.status.Switches[0].APower)
+	require.Len(t, s.status.Inputs, 1)
+	assert.Equal(t, shelly.BoolPtr(false), s.status.Inputs[0].State)
+	assert.Equal(t, time.Unix(1700000020, 0), s.componentTS["switch:0"])
+	assert.Equal(t, time.Unix(1700000000, int64(500*time.Millisecond)), s.componentTS["input:0"])
+
+	// A full status replaces all previously known components.
+	require.NoError(t, c.apply(testStatusNotification(t, src,
+		`{"ts": 1700000030, "switch:0": {"id": 0, "output": false}}`,
+	), true))
+	statuses = c.getStatuses(ctx)
+	require.Len(t, statuses, 1)
+	assert.Empty(t, statuses[0].status.Inputs)
+	assert.Nil(t, statuses[0].status.Switches[0].APower)
+}
+
+func TestNotificationCacheOutOfOrder(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000100, 0)
+	c := newNotificationCache(time.Minute, nil)
+	c.now = func() time.Time { return now }
+
+	const src = "shellyplus1pm-a8032abe5424"
+	require.NoError(t, c.apply(testStatusNotification(t, src,
+		`{"ts": 1700000010, "switch:0": {"id": 0, "output": true, "aenergy": {"total": 12.5, "minute_ts": 1700000000}}}`,
+	), true))
+	// Nested objects are merged.
+	require.NoError(t, c.apply(testStatusNotification(t, src,
+		`{"ts": 1700000020, "switch:0": {"aenergy": {"total": 13}}}`,
+	), false))
+	// A full status which was sent before the delta, but applied after it, doesn't replace the
+	// newer fields.
+	require.NoError(t, c.apply(testStatusNotification(t, src,
+		`{"ts": 1700000015, "switch:0": {"id": 0, "output": false, "aenergy": {"total": 12.8, "minute_ts": 1700000000}}, "input:0": {"id": 0, "state": true}}`,
+	), true))
+
+	statuses := c.getStatuses(ctx)
+	require.Len(t, statuses, 1)
+	s := statuses[0]
+	require.Len(t, s.status.Switches, 1)
+	assert.Equal(t, shelly.BoolPtr(false), s.status.Switches[0].Output)
+	require.NotNil(t, s.status.Switches[0].AEnergy)
+	assert.Equal(t, 13.0, s.status.Switches[0].AEnergy.Total)
+	assert.Equal(t, 1700000000.0, s.status.Switches[0].AEnergy.MinuteTS)
+	require.Len(t, s.status.Inputs, 1)
+	assert.Equal(t, time.Unix(1700000020, 0), s.componentTS["switch:0"])
+}
+
+func TestNotificationCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	c := newNotificationCache(time.Minute, nil)
+	c.now = func() time.Time { return now }
+
+	require.NoError(t, c.apply(testStatusNotification(t, "shellyplus1-000000000001",
+		`{"switch:0": {"id": 0, "output": true}}`,
+	), false))
+	now = now.Add(45 * time.Second)
+	require.NoError(t, c.apply(testStatusNotification(t, "shellyplus1-000000000002",
+		`{"switch:0": {"id": 0, "output": true}}`,
+	), false))
+	require.Len(t, c.getStatuses(ctx), 2)
+
+	now = now.Add(30 * time.Second)
+	statuses := c.getStatuses(ctx)
+	require.Len(t, statuses, 1)
+	assert.Equal(t, "shellyplus1-000000000002", statuses[0].src)
+	// Without a device timestamp, fields are stamped with the local receive time.
+	assert.Equal(t, time.Unix(1700000045, 0), statuses[0].componentTS["switch:0"])
+}
+
+func TestNotificationCacheReady(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := discovery.NewTestDiscoverer(t)
+	c := newNotificationCache(time.Minute, td.Discoverer)
+
+	var b bytes.Buffer
+	require.NoError(t, discovery.NewRecorder(&b).Record(time.Now(), &frame.Frame{
+		Src:    "shellyplus1pm-a8032abe5424",
+		Method: "NotifyFullStatus",
+		Params: json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`),
+	}))
+
+	// Notifications replayed once the consumer is ready aren't lost.
+	ready := make(chan struct{})
+	go c.consumer(ctx, func() { close(ready) })
+	<-ready
+	require.NoError(t, td.Replay(ctx, &b))
+	require.Eventually(t, func() bool { return len(c.getStatuses(ctx)) == 1 }, time.Second, time.Millisecond)
+}
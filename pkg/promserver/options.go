@@ -1,6 +1,12 @@
 package promserver
 
-import "time"
+import (
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/bthome"
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"github.com/jcodybaker/shellyctl/pkg/labels"
+)
 
 const (
 	// DefaultConcurrency is the default probe concurrency.
@@ -14,6 +20,8 @@ const (
 	DefaultNamespace = "shelly"
 	// DefaultSubsystem is the default subsystem for metrics.
 	DefaultSubsystem = "status"
+	// DefaultPollMaxBackoff is the default upper bound on the delay between polls of a failing device.
+	DefaultPollMaxBackoff = 5 * time.Minute
 )
 
 type Option func(*Server)
@@ -59,3 +67,68 @@ func WithNotificationCacheCacheTTL(ttl time.Duration) Option {
 		s.notificationCacheTTL = ttl
 	}
 }
+
+// WithPollInterval enables background polling. Each device is queried on its own schedule of
+// roughly this interval and scrapes are served from the latest results, rather than querying
+// every device during the scrape. A zero interval disables background polling.
+func WithPollInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.pollInterval = interval
+	}
+}
+
+// WithPollJitter sets the maximum random offset added to or subtracted from each poll interval.
+// This spreads requests over time when many devices are discovered at once. Defaults to 10% of
+// the poll interval.
+func WithPollJitter(jitter time.Duration) Option {
+	return func(s *Server) {
+		s.pollJitter = jitter
+	}
+}
+
+// WithPollMaxBackoff sets the upper bound on the delay between polls of a device which is failing.
+func WithPollMaxBackoff(maxBackoff time.Duration) Option {
+	return func(s *Server) {
+		s.pollMaxBackoff = maxBackoff
+	}
+}
+
+// WithPollStaleness sets the maximum age of a poll result which will be reported. Devices without
+// a successful poll within this duration are omitted from scrapes. Defaults to 3x the poll interval.
+func WithPollStaleness(staleness time.Duration) Option {
+	return func(s *Server) {
+		s.pollStaleness = staleness
+	}
+}
+
+// WithLabelMapper configures the device labels attached to each metric.
+func WithLabelMapper(m *labels.Mapper) Option {
+	return func(s *Server) {
+		s.labelMapper = m
+	}
+}
+
+// WithEnergyAccumulator enables the `energy_wh_total`, `returned_energy_wh_total`, and
+// `energy_counter_resets_total` metrics, which remain monotonic when a device resets its energy
+// counters.
+func WithEnergyAccumulator(a *energy.Accumulator) Option {
+	return func(s *Server) {
+		s.energy = a
+	}
+}
+
+// WithReady sets a function which is called once the server has subscribed to the discoverer's
+// notifications, so they can be replayed without loss.
+func WithReady(ready func()) Option {
+	return func(s *Server) {
+		s.ready = ready
+	}
+}
+
+// WithBTHomeListener exports the latest readings of BTHome devices received by the listener, like
+// Shelly BLU sensors and buttons, as `bthome_*` metrics.
+func WithBTHomeListener(l *bthome.Listener) Option {
+	return func(s *Server) {
+		s.bthome = l
+	}
+}
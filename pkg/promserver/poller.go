@@ -0,0 +1,149 @@
+package promserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/devicepoll"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// deviceSnapshot is the most recent successful poll of a device.
+type deviceSnapshot struct {
+	dev     *discovery.Device
+	status  *shelly.ShellyGetStatusResponse
+	config  *shelly.ShellyGetConfigResponse
+	fetched time.Time
+}
+
+// poller refreshes device state in the background so scrape latency is independent of the
+// number of devices and their responsiveness.
+type poller struct {
+	s   *Server
+	now func() time.Time
+
+	*devicepoll.Poller
+
+	lock      sync.Mutex
+	snapshots map[string]*deviceSnapshot
+}
+
+func newPoller(s *Server) (*poller, error) {
+	if s.pollJitter == 0 {
+		s.pollJitter = s.pollInterval / 10
+	}
+	if s.pollMaxBackoff == 0 {
+		s.pollMaxBackoff = DefaultPollMaxBackoff
+	}
+	if s.pollStaleness == 0 {
+		s.pollStaleness = 3 * s.pollInterval
+	}
+	p := &poller{
+		s:         s,
+		now:       time.Now,
+		snapshots: make(map[string]*deviceSnapshot),
+	}
+	var err error
+	p.Poller, err = devicepoll.New(s.discoverer, s.pollInterval, p.start,
+		devicepoll.WithJitter(s.pollJitter),
+		devicepoll.WithMaxBackoff(s.pollMaxBackoff),
+		devicepoll.WithConcurrency(s.concurrency),
+	)
+	return p, err
+}
+
+// start returns funcs which store each successful poll of dev, and drop its snapshot once the
+// device is removed. Snapshots are kept when the poller itself stops.
+func (p *poller) start(dev *discovery.Device) (devicepoll.PollFunc, func(bool)) {
+	poll := func(ctx context.Context) error {
+		reqCtx, cancel := context.WithTimeout(ctx, p.s.deviceTimeout)
+		defer cancel()
+		status, config, err := p.s.fetchDevice(reqCtx, dev)
+		if err != nil {
+			return err
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.snapshots[dev.MACAddr] = &deviceSnapshot{
+			dev:     dev,
+			status:  status,
+			config:  config,
+			fetched: p.now(),
+		}
+		return nil
+	}
+	stop := func(removed bool) {
+		if !removed {
+			return
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		delete(p.snapshots, dev.MACAddr)
+	}
+	return poll, stop
+}
+
+// collect emits metrics from the latest snapshot of each device. Snapshots older than the
+// staleness threshold are skipped so a dead device's last values aren't reported indefinitely.
+func (p *poller) collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	l := log.Ctx(ctx)
+	now := p.now()
+	p.lock.Lock()
+	snapshots := make([]*deviceSnapshot, 0, len(p.snapshots))
+	for _, snap := range p.snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	p.lock.Unlock()
+	for _, snap := range snapshots {
+		age := now.Sub(snap.fetched)
+		d := p.s.newDeviceInfo(snap.dev, snap.config)
+		m, err := metricWithOptionalTimestamp(
+			p.s.pollAgeSecondsDesc,
+			prometheus.GaugeValue,
+			age.Seconds(),
+			time.Time{},
+			d,
+		)
+		if err != nil {
+			l.Err(err).Msg("encoding metric")
+		} else {
+			ch <- m
+		}
+		if age > p.s.pollStaleness {
+			l.Debug().
+				Str("mac", snap.dev.MACAddr).
+				Dur("age", age).
+				Msg("omitting stale device snapshot")
+			continue
+		}
+		ctx := l.With().Str("mac", snap.dev.MACAddr).Logger().WithContext(ctx)
+		if !p.s.sampleTimestamps {
+			p.s.collectDeviceStatus(ctx, ch, snap.fetched, snap.dev, snap.status, snap.config)
+			continue
+		}
+		tch, wait := withTimestamp(ch, snap.fetched)
+		p.s.collectDeviceStatus(ctx, tch, snap.fetched, snap.dev, snap.status, snap.config)
+		wait()
+	}
+}
+
+// withTimestamp returns a channel which forwards metrics to ch stamped with ts. The returned
+// function closes the channel and waits for the forwarded metrics to be sent.
+func withTimestamp(ch chan<- prometheus.Metric, ts time.Time) (chan<- prometheus.Metric, func()) {
+	tch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range tch {
+			ch <- prometheus.NewMetricWithTimestamp(ts, m)
+		}
+	}()
+	return tch, func() {
+		close(tch)
+		<-done
+	}
+}
@@ -5,13 +5,15 @@ import (
 	"fmt"
 	"math"
 	"net/http"
-	"regexp"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/jcodybaker/go-shelly"
+	"github.com/jcodybaker/shellyctl/pkg/bthome"
 	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"github.com/jcodybaker/shellyctl/pkg/labels"
 	"github.com/mongoose-os/mos/common/mgrpc"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -65,6 +67,33 @@ func NewServer(
 	func(ctx context.Context),
 	http.Handler,
 ) {
+	s := newServer(ctx, discoverer, opts...)
+	mux := http.NewServeMux()
+	mux.Handle("/", promhttp.HandlerFor(s.promReg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/sd", s.serveServiceDiscovery)
+	mux.HandleFunc("/probe", s.serveProbe)
+	s.Handler = mux
+	return s.run, s
+}
+
+// NewGatherer creates the collector served by NewServer for exporters which push metrics rather
+// than serving them. Each Gather has the same effect as a scrape, but metrics from poll snapshots
+// carry the time the device was polled. The returned function consumes
+// notifications, and polls devices if enabled, until its context is done.
+func NewGatherer(
+	ctx context.Context,
+	discoverer *discovery.Discoverer,
+	opts ...Option,
+) (
+	func(ctx context.Context),
+	prometheus.Gatherer,
+) {
+	s := newServer(ctx, discoverer, opts...)
+	s.sampleTimestamps = true
+	return s.run, s.promReg
+}
+
+func newServer(ctx context.Context, discoverer *discovery.Discoverer, opts ...Option) *Server {
 	s := &Server{
 		discoverer:           discoverer,
 		promReg:              prometheus.NewRegistry(),
@@ -79,12 +108,25 @@ func NewServer(
 	for _, o := range opts {
 		o(s)
 	}
+	if s.labelMapper == nil {
+		// The default mapper has no options which can fail validation.
+		s.labelMapper, _ = labels.NewMapper()
+	}
+	if s.notificationCacheTTL == 0 {
+		s.notificationCacheTTL = defaultNotificationCacheTTL
+	}
 	if s.notificationCache == nil {
-		s.notificationCache = newNotificationCache(defaultNotificationCacheTTL, s.discoverer)
+		s.notificationCache = newNotificationCache(s.notificationCacheTTL, s.discoverer)
+	}
+	if s.pollInterval > 0 {
+		// Only a non-positive interval is rejected by the poller.
+		s.poller, _ = newPoller(s)
 	}
-	s.Handler = promhttp.HandlerFor(s.promReg, promhttp.HandlerOpts{})
 	s.initDescs()
 	s.promReg.MustRegister(s)
+	if s.bthome != nil {
+		s.promReg.MustRegister(&bthomeCollector{s: s})
+	}
 	for _, e := range baseKnownSwitchErrors {
 		s.knownSwitchErrors.Store(e, struct{}{})
 	}
@@ -94,7 +136,21 @@ func NewServer(
 	for _, e := range baseKnownCoverErrors {
 		s.knownCoverErrors.Store(e, struct{}{})
 	}
-	return s.notificationCache.consumer, s
+	return s
+}
+
+// run consumes notifications and, if enabled, polls devices in the background until ctx is done.
+func (s *Server) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	if s.poller != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.poller.Run(ctx)
+		}()
+	}
+	s.notificationCache.consumer(ctx, s.ready)
 }
 
 type Server struct {
@@ -111,6 +167,22 @@ type Server struct {
 	notificationCacheTTL time.Duration
 	notificationCache    *notificationCache
 
+	energy *energy.Accumulator
+
+	bthome *bthome.Listener
+
+	// ready, if set, is called once notifications are subscribed.
+	ready func()
+
+	pollInterval   time.Duration
+	pollJitter     time.Duration
+	pollMaxBackoff time.Duration
+	pollStaleness  time.Duration
+	poller         *poller
+	// sampleTimestamps stamps metrics from poll snapshots with the time they were fetched. Pushed
+	// metrics need the time of the values, while scrapes are stamped by Prometheus.
+	sampleTimestamps bool
+
 	switchOutputOnDesc                *prometheus.Desc
 	coverPositionDesc                 *prometheus.Desc
 	coverStateDesc                    *prometheus.Desc
@@ -121,6 +193,9 @@ type Server struct {
 	inputXPercentDesc                 *prometheus.Desc
 	totalEnergyWattHoursDesc          *prometheus.Desc
 	totalReturnedEnergyWattHoursDesc  *prometheus.Desc
+	accumulatedEnergyDesc             *prometheus.Desc
+	accumulatedReturnedEnergyDesc     *prometheus.Desc
+	energyCounterResetsDesc           *prometheus.Desc
 	temperatureCelsiusDesc            *prometheus.Desc
 	temperatureFahrenheitDesc         *prometheus.Desc
 	networkFrequencyHertzDesc         *prometheus.Desc
@@ -129,6 +204,14 @@ type Server struct {
 	currentAmperesDesc                *prometheus.Desc
 	instantaneousActivePowerWattsDesc *prometheus.Desc
 	componentErrorDesc                *prometheus.Desc
+	pollAgeSecondsDesc                *prometheus.Desc
+	mqttOnlineDesc                    *prometheus.Desc
+	mqttOnlineLastChangeDesc          *prometheus.Desc
+	mqttConnectedDesc                 *prometheus.Desc
+	mqttConnectsDesc                  *prometheus.Desc
+	mqttConnectionsLostDesc           *prometheus.Desc
+
+	labelMapper *labels.Mapper
 
 	allDescs []*prometheus.Desc
 	// knownSwitchErrors tracks all known switch error states, both those documented and any unexpected
@@ -189,109 +272,163 @@ func (s *Server) initDescs() {
 	s.switchOutputOnDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "switch_output_on"),
 		`1 if the switch output is on; 0 if it is off.`,
-		[]string{"instance", "mac", "device_name", "component_name", "id"},
+		s.labelNames("component_name", "id"),
 		nil,
 	)
 	s.coverPositionDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "cover_position_percent"),
 		`Only present if Cover is calibrated. Represents current position in percent from 0 (fully closed) to 100 (fully open); null if the position is unknown`,
-		[]string{"instance", "mac", "device_name", "component_name", "id"},
+		s.labelNames("component_name", "id"),
 		nil,
 	)
 	s.coverStateDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "cover_state"),
 		`Only present if Cover is calibrated. Represents current position in percent from 0 (fully closed) to 100 (fully open); null if the position is unknown`,
-		[]string{"instance", "mac", "device_name", "component_name", "id", "state"},
+		s.labelNames("component_name", "id", "state"),
 		nil,
 	)
 	s.coverPositionControlEnabled = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "cover_position_enabled"),
 		`1 if position control is enabled; 0 otherwise.`,
-		[]string{"instance", "mac", "device_name", "component_name", "id", "state"},
+		s.labelNames("component_name", "id", "state"),
 		nil,
 	)
 	s.inputEnabledDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "input_enabled"),
 		`1 if the input is enabled; 0 if it is disabled.`,
-		[]string{"instance", "mac", "device_name", "component_name", "id"},
+		s.labelNames("component_name", "id"),
 		nil,
 	)
 	s.inputStateOnDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "input_state_on"),
 		`1 if the input is active; 0 if it is off.`,
-		[]string{"instance", "mac", "device_name", "component_name", "id"},
+		s.labelNames("component_name", "id"),
 		nil,
 	)
 	s.inputPercentDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "input_percent"),
 		`Analog value in percent.`,
-		[]string{"instance", "mac", "device_name", "component_name", "id"},
+		s.labelNames("component_name", "id"),
 		nil,
 	)
 	s.inputXPercentDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "input_xpercent"),
 		`percent transformed with config.xpercent.expr. Present only when both config.xpercent.expr and config.xpercent.unit are set to non-empty values.`,
-		[]string{"instance", "mac", "device_name", "component_name", "id"},
+		s.labelNames("component_name", "id"),
 		nil,
 	)
 	s.totalEnergyWattHoursDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "total_energy_watt_hours"),
 		`Total energy consumed in Watt-hours.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.totalReturnedEnergyWattHoursDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "total_returned_energy_watt_hours"),
 		`Total returned energy consumed in Watt-hours`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
+		nil,
+	)
+	s.accumulatedEnergyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "energy_wh_total"),
+		`Total energy consumed in Watt-hours, accumulated across device counter resets.`,
+		s.labelNames("component_name", "component", "id"),
+		nil,
+	)
+	s.accumulatedReturnedEnergyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "returned_energy_wh_total"),
+		`Total returned energy in Watt-hours, accumulated across device counter resets.`,
+		s.labelNames("component_name", "component", "id"),
+		nil,
+	)
+	s.energyCounterResetsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "energy_counter_resets_total"),
+		`Number of times the device's energy counter was observed to reset. The "direction" label is either "consumed" or "returned".`,
+		s.labelNames("component_name", "component", "id", "direction"),
 		nil,
 	)
 	s.temperatureCelsiusDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "temperature_celsius"),
 		`Temperature in degrees celsius.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.temperatureFahrenheitDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "temperature_fahrenheit"),
 		`Temperature in degrees farenheit.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.networkFrequencyHertzDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "network_frequency_hertz"),
 		`Last measured network frequency in Hz.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.powerFactorDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "power_factor"),
 		`Last measured power factor.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.voltageDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "voltage"),
 		`Last measured voltage.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.currentAmperesDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "current_amperes"),
 		`Last measured current in amperes.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.instantaneousActivePowerWattsDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "instantaneous_active_power_watts"),
 		`Last measured instantaneous active power (in Watts) delivered to the attached load (shown if applicable)`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id"},
+		s.labelNames("component_name", "component", "id"),
 		nil,
 	)
 	s.componentErrorDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(s.namespace, s.subsystem, "component_error"),
 		`1 if the error condition ("error" label) is active; 0 or omitted if the error has cleared.`,
-		[]string{"instance", "mac", "device_name", "component_name", "component", "id", "error"},
+		s.labelNames("component_name", "component", "id", "error"),
+		nil,
+	)
+	s.pollAgeSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "poll_age_seconds"),
+		`Seconds since the device was last successfully polled. Only reported in background polling mode.`,
+		s.labelNames(),
+		nil,
+	)
+	s.mqttOnlineDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "mqtt_online"),
+		`1 if the device's MQTT online topic reports it connected to the broker; 0 if its last-will reports it disconnected.`,
+		s.labelNames(),
+		nil,
+	)
+	s.mqttOnlineLastChangeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "mqtt_online_last_change_timestamp_seconds"),
+		`Unix time at which the device's MQTT online state was last reported to change.`,
+		s.labelNames(),
+		nil,
+	)
+	s.mqttConnectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "mqtt_connected"),
+		`1 if shellyctl is connected to the MQTT broker; 0 while it's reconnecting.`,
+		nil,
+		nil,
+	)
+	s.mqttConnectsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "mqtt_connects_total"),
+		`Number of times shellyctl has connected to the MQTT broker, including reconnects.`,
+		nil,
+		nil,
+	)
+	s.mqttConnectionsLostDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(s.namespace, s.subsystem, "mqtt_connections_lost_total"),
+		`Number of times shellyctl's connection to the MQTT broker was unexpectedly lost.`,
+		nil,
 		nil,
 	)
 	s.allDescs = append(s.allDescs,
@@ -301,6 +438,9 @@ func (s *Server) initDescs() {
 		s.inputXPercentDesc,
 		s.totalEnergyWattHoursDesc,
 		s.totalReturnedEnergyWattHoursDesc,
+		s.accumulatedEnergyDesc,
+		s.accumulatedReturnedEnergyDesc,
+		s.energyCounterResetsDesc,
 		s.temperatureCelsiusDesc,
 		s.temperatureFahrenheitDesc,
 		s.networkFrequencyHertzDesc,
@@ -308,7 +448,13 @@ func (s *Server) initDescs() {
 		s.voltageDesc,
 		s.currentAmperesDesc,
 		s.instantaneousActivePowerWattsDesc,
-		s.componentErrorDesc)
+		s.componentErrorDesc,
+		s.pollAgeSecondsDesc,
+		s.mqttOnlineDesc,
+		s.mqttOnlineLastChangeDesc,
+		s.mqttConnectedDesc,
+		s.mqttConnectsDesc,
+		s.mqttConnectionsLostDesc)
 }
 
 // Describe implements prometheus.Collector.
@@ -329,6 +475,15 @@ func (s *Server) Collect(ch chan<- prometheus.Metric) {
 		}
 		l.Debug().Dur("duration", duration).Msg("finished all collection")
 	}()
+	if s.poller != nil {
+		// The poller handles discovery and device queries in the background; scrapes are
+		// served entirely from its snapshots.
+		s.poller.collect(s.ctx, ch)
+		s.collectCached(s.ctx, ch)
+		s.collectPresence(ch)
+		s.collectMQTTConnection(ch)
+		return
+	}
 	l.Debug().Msg("starting discovery")
 	if _, err := s.discoverer.Search(s.ctx); err != nil {
 		l.Err(err).Msg("finding new devices")
@@ -360,57 +515,76 @@ func (s *Server) Collect(ch chan<- prometheus.Metric) {
 	go func() {
 		defer wg.Done()
 		s.collectCached(s.ctx, ch)
+		s.collectPresence(ch)
+		s.collectMQTTConnection(ch)
 	}()
 }
 
+// deviceInfo holds the device label values shared by all of a device's metrics.
 type deviceInfo struct {
-	instance string
-	name     string
-	mac      string
+	labels []string
+	// energyKey identifies the device's accumulated energy counters. It is the MAC address when
+	// known, falling back to the instance.
+	energyKey string
+	// boot is when the device last booted, or zero if unknown. A boot after the last observation
+	// of an energy counter means the counter was reset.
+	boot time.Time
 }
 
 func (s *Server) collectDevice(ctx context.Context, dev *discovery.Device, ch chan<- prometheus.Metric) {
-	// Default the device_name label to the MAC, not dev.BestName() - BestName() falls back to
-	// the connection URI, which is meant for user-facing auth prompts, not for a metric label
-	// (it varies with the RPC transport and would balloon label cardinality on the URI's port).
-	name := dev.Name
-	if name == "" {
-		name = dev.MACAddr
-	}
-	d := &deviceInfo{
-		name:     name,
-		instance: dev.Instance(),
-		mac:      dev.MACAddr,
-	}
 	l := log.Ctx(ctx).With().
-		Str("mac", d.mac).
-		Str("uri", d.instance).
+		Str("mac", dev.MACAddr).
+		Str("uri", dev.Instance()).
 		Logger()
 	ctx = l.WithContext(ctx)
 	start := time.Now()
-	c, err := s.deviceConn(dev)
-	if err != nil {
-		l.Err(err).Msg("connecting to device")
-		return
-	}
 	defer func() {
 		l.Debug().Dur("duration", time.Since(start)).Msg("finished device collection")
 	}()
+	status, config, err := s.fetchDevice(ctx, dev)
+	if err != nil {
+		l.Err(err).Msg("querying device")
+		return
+	}
+	s.collectDeviceStatus(ctx, ch, start, dev, status, config)
+}
+
+// fetchDevice queries the current status and config of a device. Cached connections are
+// dropped when a request fails.
+func (s *Server) fetchDevice(
+	ctx context.Context,
+	dev *discovery.Device,
+) (*shelly.ShellyGetStatusResponse, *shelly.ShellyGetConfigResponse, error) {
+	c, err := s.deviceConn(dev)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to device: %w", err)
+	}
 	status, _, err := (&shelly.ShellyGetStatusRequest{}).Do(ctx, c, dev.AuthCallback(ctx))
 	if err != nil {
-		l.Err(err).Msg("querying device status")
 		s.dropDeviceConn(dev)
-		return
+		return nil, nil, fmt.Errorf("querying device status: %w", err)
 	}
 	config, _, err := (&shelly.ShellyGetConfigRequest{}).Do(ctx, c, dev.AuthCallback(ctx))
 	if err != nil {
-		l.Err(err).Msg("querying device status")
 		s.dropDeviceConn(dev)
-		return
+		return nil, nil, fmt.Errorf("querying device config: %w", err)
 	}
+	return status, config, nil
+}
 
-	if config.System != nil && config.System.Device != nil && config.System.Device.Name != nil {
-		d.name = *config.System.Device.Name
+// collectDeviceStatus emits metrics for all components described by a device's status and config.
+func (s *Server) collectDeviceStatus(
+	ctx context.Context,
+	ch chan<- prometheus.Metric,
+	ts time.Time,
+	dev *discovery.Device,
+	status *shelly.ShellyGetStatusResponse,
+	config *shelly.ShellyGetConfigResponse,
+) {
+	l := log.Ctx(ctx)
+	d := s.newDeviceInfo(dev, config)
+	if status.System != nil {
+		d.boot = energy.BootTime(ts, status.System.Uptime)
 	}
 
 	if len(config.Switches) != len(status.Switches) {
@@ -423,19 +597,51 @@ func (s *Server) collectDevice(ctx context.Context, dev *discovery.Device, ch ch
 
 	for i, swc := range config.Switches {
 		sws := status.Switches[i]
-		s.collectSwitchComponent(ctx, ch, start, d, swc, sws)
+		s.collectSwitchComponent(ctx, ch, ts, d, swc, sws)
 	}
 
 	for i, cc := range config.Covers {
 		cs := status.Covers[i]
-		s.collectCoverComponent(ctx, ch, start, d, cc, cs)
+		s.collectCoverComponent(ctx, ch, ts, d, cc, cs)
 	}
 
 	for i, ic := range config.Inputs {
 		is := status.Inputs[i]
-		s.collectInputComponent(ctx, ch, start, d, ic, is)
+		s.collectInputComponent(ctx, ch, ts, d, ic, is)
+	}
+}
+
+func (s *Server) newDeviceInfo(dev *discovery.Device, config *shelly.ShellyGetConfigResponse) *deviceInfo {
+	// Default the device_name label to the MAC, not dev.BestName() - BestName() falls back to
+	// the connection URI, which is meant for user-facing auth prompts, not for a metric label
+	// (it varies with the RPC transport and would balloon label cardinality on the URI's port).
+	ld := labels.Device{
+		Instance: dev.Instance(),
+		MAC:      dev.MACAddr,
+		Name:     dev.Name,
+	}
+	if ld.Name == "" {
+		ld.Name = dev.MACAddr
+	}
+	if config != nil && config.System != nil {
+		if config.System.Device != nil && config.System.Device.Name != nil {
+			ld.Name = *config.System.Device.Name
+		}
+		ld.Location = config.System.Location
+	}
+	return &deviceInfo{labels: s.labelMapper.Values(ld), energyKey: energyKey(ld)}
+}
+
+func energyKey(ld labels.Device) string {
+	if ld.MAC != "" {
+		return energy.DeviceKey(ld.MAC)
 	}
+	return ld.Instance
+}
 
+// labelNames returns the device label names followed by the metric specific names.
+func (s *Server) labelNames(names ...string) []string {
+	return append(s.labelMapper.Names(), names...)
 }
 
 func (s *Server) collectSwitchComponent(
@@ -459,16 +665,14 @@ func (s *Server) collectSwitchComponent(
 		prometheus.GaugeValue,
 		ptrBoolToFloat64(sws.Output),
 		ts,
-		d.instance,
-		d.mac,
-		d.name,
+		d,
 		componentName,
 		strconv.Itoa(sws.ID),
 	)
 	if err != nil {
 		l.Err(err).Msg("encoding metric")
 	} else {
-	ch <- m
+		ch <- m
 	}
 
 	if sws.AEnergy != nil {
@@ -478,9 +682,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.CounterValue,
 			sws.AEnergy.Total,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -490,6 +692,7 @@ func (s *Server) collectSwitchComponent(
 		} else {
 			ch <- m
 		}
+		s.collectAccumulatedEnergy(ctx, ch, ts, d, false, sws.AEnergy.Total, componentName, componentType, strconv.Itoa(sws.ID))
 	}
 	if sws.RetAEnergy != nil {
 		// total_returned_energy_watt_hours
@@ -498,9 +701,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.CounterValue,
 			sws.RetAEnergy.Total,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -510,6 +711,7 @@ func (s *Server) collectSwitchComponent(
 		} else {
 			ch <- m
 		}
+		s.collectAccumulatedEnergy(ctx, ch, ts, d, true, sws.RetAEnergy.Total, componentName, componentType, strconv.Itoa(sws.ID))
 	}
 	if sws.Temperature != nil && sws.Temperature.C != nil {
 		// temperature_celsius
@@ -518,9 +720,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			*sws.Temperature.C,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -538,9 +738,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			*sws.Temperature.F,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -558,9 +756,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			*sws.Freq,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -578,9 +774,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			*sws.PF,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -598,9 +792,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			*sws.Voltage,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -618,9 +810,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			*sws.Current,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -638,9 +828,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			*sws.APower,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -680,9 +868,7 @@ func (s *Server) collectSwitchComponent(
 			prometheus.GaugeValue,
 			eValue,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(sws.ID),
@@ -722,16 +908,14 @@ func (s *Server) collectCoverComponent(
 		prometheus.GaugeValue,
 		currentPos,
 		ts,
-		d.instance,
-		d.mac,
-		d.name,
+		d,
 		componentName,
 		strconv.Itoa(cc.ID),
 	)
 	if err != nil {
 		l.Err(err).Msg("encoding metric")
 	} else {
-	ch <- m
+		ch <- m
 	}
 
 	// cover_position_control_enabled
@@ -740,16 +924,14 @@ func (s *Server) collectCoverComponent(
 		prometheus.GaugeValue,
 		ptrBoolToFloat64(cs.PosControl),
 		ts,
-		d.instance,
-		d.mac,
-		d.name,
+		d,
 		componentName,
 		strconv.Itoa(cc.ID),
 	)
 	if err != nil {
 		l.Err(err).Msg("encoding metric")
 	} else {
-	ch <- m
+		ch <- m
 	}
 
 	// cover_state
@@ -763,9 +945,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			stateActive,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			strconv.Itoa(cc.ID),
 			state,
@@ -784,9 +964,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.CounterValue,
 			cs.AEnergy.Total,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -796,6 +974,7 @@ func (s *Server) collectCoverComponent(
 		} else {
 			ch <- m
 		}
+		s.collectAccumulatedEnergy(ctx, ch, ts, d, false, cs.AEnergy.Total, componentName, componentType, strconv.Itoa(cc.ID))
 	}
 	if cs.Temperature != nil && cs.Temperature.C != nil {
 		// temperature_celsius
@@ -804,9 +983,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			*cs.Temperature.C,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -824,9 +1001,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			*cs.Temperature.F,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -844,9 +1019,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			*cs.Freq,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -864,9 +1037,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			*cs.PF,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -884,9 +1055,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			*cs.Voltage,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -904,9 +1073,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			*cs.Current,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -924,9 +1091,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			*cs.APower,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -966,9 +1131,7 @@ func (s *Server) collectCoverComponent(
 			prometheus.GaugeValue,
 			eValue,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(cc.ID),
@@ -1005,9 +1168,7 @@ func (s *Server) collectInputComponent(
 			prometheus.GaugeValue,
 			ptrBoolToFloat64(ic.Enable),
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			strconv.Itoa(ic.ID),
 		)
@@ -1025,9 +1186,7 @@ func (s *Server) collectInputComponent(
 			prometheus.GaugeValue,
 			ptrBoolToFloat64(is.State),
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			strconv.Itoa(ic.ID),
 		)
@@ -1045,9 +1204,7 @@ func (s *Server) collectInputComponent(
 			prometheus.GaugeValue,
 			*is.Percent,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			strconv.Itoa(ic.ID),
 		)
@@ -1064,9 +1221,7 @@ func (s *Server) collectInputComponent(
 			prometheus.GaugeValue,
 			*is.XPercent,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			strconv.Itoa(ic.ID),
 		)
@@ -1105,9 +1260,7 @@ func (s *Server) collectInputComponent(
 			prometheus.GaugeValue,
 			eValue,
 			ts,
-			d.instance,
-			d.mac,
-			d.name,
+			d,
 			componentName,
 			componentType,
 			strconv.Itoa(ic.ID),
@@ -1123,68 +1276,142 @@ func (s *Server) collectInputComponent(
 }
 
 func (s *Server) collectCached(ctx context.Context, ch chan<- prometheus.Metric) {
-	cached := s.notificationCache.getStatuses()
-	for _, c := range cached {
+	for _, c := range s.notificationCache.getStatuses(ctx) {
 		ctx := log.Ctx(ctx).With().
-			Str("src", c.Frame.Src).
+			Str("src", c.src).
 			Logger().WithContext(ctx)
-		ts := time.Unix(
-			int64(c.Status.TS),
-			int64(c.Status.TS-math.Floor(c.Status.TS)*float64(time.Second)),
-		)
-		d := &deviceInfo{
-			name:     c.Frame.Src,
-			mac:      macFromName(c.Frame.Src),
-			instance: c.Frame.Src,
+		ld := labels.SrcDevice(c.src)
+		d := &deviceInfo{labels: s.labelMapper.Values(ld), energyKey: energyKey(ld)}
+		if c.status.System != nil {
+			d.boot = energy.BootTime(c.uptimeTS, c.status.System.Uptime)
 		}
-		for _, sws := range c.Status.Switches {
+		for _, sws := range c.status.Switches {
+			key := fmt.Sprintf("switch:%d", sws.ID)
 			swc := &shelly.SwitchConfig{
 				ID:   sws.ID,
-				Name: shelly.StrPtr(fmt.Sprintf("switch:%d", sws.ID)),
+				Name: shelly.StrPtr(key),
 			}
-			s.collectSwitchComponent(ctx, ch, ts, d, swc, sws)
+			s.collectSwitchComponent(ctx, ch, c.componentTS[key], d, swc, sws)
 		}
 
-		for _, cs := range c.Status.Covers {
+		for _, cs := range c.status.Covers {
+			key := fmt.Sprintf("cover:%d", cs.ID)
 			cc := &shelly.CoverConfig{
 				ID:   cs.ID,
-				Name: shelly.StrPtr(fmt.Sprintf("cover:%d", cs.ID)),
+				Name: shelly.StrPtr(key),
 			}
-			s.collectCoverComponent(ctx, ch, ts, d, cc, cs)
+			s.collectCoverComponent(ctx, ch, c.componentTS[key], d, cc, cs)
 		}
 
-		for _, is := range c.Status.Inputs {
+		for _, is := range c.status.Inputs {
+			key := fmt.Sprintf("input:%d", is.ID)
 			ic := &shelly.InputConfig{
 				ID:   is.ID,
-				Name: shelly.StrPtr(fmt.Sprintf("input:%d", is.ID)),
+				Name: shelly.StrPtr(key),
 			}
-			s.collectInputComponent(ctx, ch, ts, d, ic, is)
+			s.collectInputComponent(ctx, ch, c.componentTS[key], d, ic, is)
 		}
 	}
 }
 
-func ptrBoolToFloat64(b *bool) float64 {
-	if b == nil || !*b {
-		return 0
+// collectPresence emits the last reported MQTT presence of each device, and when it changed. The
+// presence isn't stamped with the time it changed, since Prometheus drops samples that old.
+// Devices which are known to discovery share their other metrics' labels.
+func (s *Server) collectPresence(ch chan<- prometheus.Metric) {
+	for _, p := range s.discoverer.Presence() {
+		var d *deviceInfo
+		if dev := s.discoverer.DeviceBySrc(p.Prefix); dev != nil {
+			d = s.newDeviceInfo(dev, nil)
+		} else {
+			ld := labels.SrcDevice(p.Prefix)
+			d = &deviceInfo{labels: s.labelMapper.Values(ld), energyKey: energyKey(ld)}
+		}
+		var v float64
+		if p.Online {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(s.mqttOnlineDesc, prometheus.GaugeValue, v, d.labels...)
+		ch <- prometheus.MustNewConstMetric(
+			s.mqttOnlineLastChangeDesc,
+			prometheus.GaugeValue,
+			float64(p.Since.UnixMilli())/1000,
+			d.labels...,
+		)
 	}
-	return 1
 }
 
-var reMACFromName = regexp.MustCompile(`^shelly.+-([A-Za-z0-9]{12})$`)
+// collectMQTTConnection emits the state of the discoverer's connection to the MQTT broker. It is
+// a no-op unless MQTT is configured.
+func (s *Server) collectMQTTConnection(ch chan<- prometheus.Metric) {
+	state, ok := s.discoverer.MQTTConnectionState()
+	if !ok {
+		return
+	}
+	var connected float64
+	if state.Connected {
+		connected = 1
+	}
+	ch <- prometheus.MustNewConstMetric(s.mqttConnectedDesc, prometheus.GaugeValue, connected)
+	ch <- prometheus.MustNewConstMetric(s.mqttConnectsDesc, prometheus.CounterValue, float64(state.Connects))
+	ch <- prometheus.MustNewConstMetric(s.mqttConnectionsLostDesc, prometheus.CounterValue, float64(state.ConnectionsLost))
+}
+
+// collectAccumulatedEnergy emits the energy counters accumulated across device counter resets.
+// It is a no-op unless an energy accumulator is configured.
+func (s *Server) collectAccumulatedEnergy(
+	ctx context.Context,
+	ch chan<- prometheus.Metric,
+	ts time.Time,
+	d *deviceInfo,
+	returned bool,
+	total float64,
+	componentName, componentType, id string,
+) {
+	if s.energy == nil {
+		return
+	}
+	l := log.Ctx(ctx)
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	c := s.energy.Observe(energy.Key{
+		Device:    d.energyKey,
+		Component: componentType + ":" + id,
+		Returned:  returned,
+	}, total, ts, d.boot)
+	desc, direction := s.accumulatedEnergyDesc, "consumed"
+	if returned {
+		desc, direction = s.accumulatedReturnedEnergyDesc, "returned"
+	}
+	// energy_wh_total / returned_energy_wh_total
+	m, err := metricWithOptionalTimestamp(desc, prometheus.CounterValue, c.Total, time.Time{}, d, componentName, componentType, id)
+	if err != nil {
+		l.Err(err).Msg("encoding metric")
+	} else {
+		ch <- m
+	}
+	// energy_counter_resets_total
+	m, err = metricWithOptionalTimestamp(s.energyCounterResetsDesc, prometheus.CounterValue, float64(c.Resets), time.Time{}, d, componentName, componentType, id, direction)
+	if err != nil {
+		l.Err(err).Msg("encoding metric")
+	} else {
+		ch <- m
+	}
+}
 
-func macFromName(name string) string {
-	m := reMACFromName.FindStringSubmatch(name)
-	if len(m) == 2 {
-		return m[1]
+func ptrBoolToFloat64(b *bool) float64 {
+	if b == nil || !*b {
+		return 0
 	}
-	return ""
+	return 1
 }
 
 // metricWithOptionalTimestamp builds a metric, attaching ct as a created-timestamp when
 // possible. Created timestamps are only a valid concept for counters - NewConstMetricWithCreatedTimestamp
 // returns an error for any other value type - so non-counters always fall back to a plain
-// NewConstMetric and ct is ignored for them.
-func metricWithOptionalTimestamp(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, ct time.Time, labelValues ...string) (prometheus.Metric, error) {
+// NewConstMetric and ct is ignored for them. The device's labels precede labelValues.
+func metricWithOptionalTimestamp(desc *prometheus.Desc, valueType prometheus.ValueType, value float64, ct time.Time, d *deviceInfo, labelValues ...string) (prometheus.Metric, error) {
+	labelValues = append(append([]string{}, d.labels...), labelValues...)
 	if ct.IsZero() || valueType != prometheus.CounterValue {
 		return prometheus.NewConstMetric(desc, valueType, value, labelValues...)
 	}
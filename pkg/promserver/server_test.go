@@ -9,9 +9,14 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/jcodybaker/shellyctl/pkg/energy"
+	"github.com/jcodybaker/shellyctl/pkg/labels"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
 )
 
@@ -750,3 +755,335 @@ shelly_status_voltage{component="switch",component_name="Lift Pump",device_name=
 		})
 	}
 }
+
+func TestServiceDiscovery(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.Name = "pump"
+
+	_, ps := NewServer(ctx, td.Discoverer)
+	metricserver := httptest.NewServer(ps)
+	t.Cleanup(metricserver.Close)
+
+	resp, err := http.Get(metricserver.URL + "/sd")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var groups []targetGroup
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&groups))
+	require.Equal(t, []targetGroup{
+		{
+			Targets: []string{d1.Address()},
+			Labels: map[string]string{
+				"__meta_shelly_mac":    d1.MACAddr,
+				"__meta_shelly_model":  "",
+				"__meta_shelly_name":   "pump",
+				"__meta_shelly_source": "",
+			},
+		},
+	}, groups)
+}
+
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+	d1.AddMockResponse("Shelly.GetConfig", nil, json.RawMessage(`{"switch:0": {"id": 0, "name": "Heater"}}`))
+	// d2 should never be queried by a probe targeting d1.
+	td.NewTestDevice(t, true)
+
+	_, ps := NewServer(ctx, td.Discoverer)
+	metricserver := httptest.NewServer(ps)
+	t.Cleanup(metricserver.Close)
+
+	resp, err := http.Get(metricserver.URL + "/probe")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(metricserver.URL + "/probe?target=unknown")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	expect := strings.NewReplacer("$INSTANCE_DEVICE_1", d1.Instance(), "$MAC_DEVICE_1", d1.MACAddr).Replace(
+		`# HELP shelly_status_switch_output_on 1 if the switch output is on; 0 if it is off.
+# TYPE shelly_status_switch_output_on gauge
+shelly_status_switch_output_on{component_name="Heater",device_name="$MAC_DEVICE_1",id="0",instance="$INSTANCE_DEVICE_1",mac="$MAC_DEVICE_1"} 1
+`)
+	require.NoError(t, testutil.ScrapeAndCompare(
+		metricserver.URL+"/probe?target="+d1.Address(),
+		bytes.NewBufferString(expect),
+		"shelly_status_switch_output_on",
+	))
+}
+
+func TestPollerCollect(t *testing.T) {
+	ctx := context.Background()
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+	d1.AddMockResponse("Shelly.GetConfig", nil, json.RawMessage(`{"switch:0": {"id": 0, "name": "Heater"}}`))
+
+	run, ps := NewServer(ctx, td.Discoverer, WithPollInterval(10*time.Millisecond))
+	s := ps.(*Server)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(runCtx)
+	}()
+	require.Eventually(t, func() bool {
+		s.poller.lock.Lock()
+		defer s.poller.lock.Unlock()
+		return s.poller.snapshots[d1.MACAddr] != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	// Stop polling; scrapes continue to be served from the last snapshot.
+	cancel()
+	<-done
+
+	metricserver := httptest.NewServer(ps)
+	t.Cleanup(metricserver.Close)
+	expect := strings.NewReplacer("$INSTANCE_DEVICE_1", d1.Instance(), "$MAC_DEVICE_1", d1.MACAddr).Replace(
+		`# HELP shelly_status_switch_output_on 1 if the switch output is on; 0 if it is off.
+# TYPE shelly_status_switch_output_on gauge
+shelly_status_switch_output_on{component_name="Heater",device_name="$MAC_DEVICE_1",id="0",instance="$INSTANCE_DEVICE_1",mac="$MAC_DEVICE_1"} 1
+`)
+	require.NoError(t, testutil.ScrapeAndCompare(metricserver.URL, bytes.NewBufferString(expect), "shelly_status_switch_output_on"))
+
+	// Once the snapshot is stale, the device's component metrics are omitted.
+	s.poller.now = func() time.Time { return time.Now().Add(time.Hour) }
+	require.NoError(t, testutil.ScrapeAndCompare(metricserver.URL, bytes.NewBufferString(""), "shelly_status_switch_output_on"))
+}
+
+func TestGathererPollTimestamps(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+	d1.AddMockResponse("Shelly.GetConfig", nil, json.RawMessage(`{"switch:0": {"id": 0, "name": "Heater"}}`))
+
+	start := time.Now()
+	run, g := NewGatherer(ctx, td.Discoverer, WithPollInterval(10*time.Millisecond))
+	go run(ctx)
+	var m *dto.Metric
+	require.Eventually(t, func() bool {
+		mfs, err := g.Gather()
+		require.NoError(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() == "shelly_status_switch_output_on" && len(mf.GetMetric()) > 0 {
+				m = mf.GetMetric()[0]
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	// Pushed values carry the time the device was polled.
+	require.NotNil(t, m.TimestampMs)
+	require.GreaterOrEqual(t, m.GetTimestampMs(), start.UnixMilli())
+	require.LessOrEqual(t, m.GetTimestampMs(), time.Now().UnixMilli())
+}
+
+func TestPollerStopsOfflineDevices(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.ID = "shellyplus1-test"
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+	d1.AddMockResponse("Shelly.GetConfig", nil, json.RawMessage(`{"switch:0": {"id": 0, "name": "Heater"}}`))
+
+	run, ps := NewServer(ctx, td.Discoverer, WithPollInterval(10*time.Millisecond))
+	s := ps.(*Server)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		run(ctx)
+	}()
+	polled := func() bool {
+		s.poller.lock.Lock()
+		defer s.poller.lock.Unlock()
+		return s.poller.snapshots[d1.MACAddr] != nil && s.poller.Polling(d1.MACAddr)
+	}
+	require.Eventually(t, polled, 5*time.Second, 10*time.Millisecond)
+
+	td.SetPresence(ctx, d1.ID, false, time.Now())
+	require.Eventually(t, func() bool {
+		s.poller.lock.Lock()
+		defer s.poller.lock.Unlock()
+		return s.poller.snapshots[d1.MACAddr] == nil && !s.poller.Polling(d1.MACAddr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	td.SetPresence(ctx, d1.ID, true, time.Now())
+	require.Eventually(t, polled, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestCollectLabelMapper(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "output": true}}`))
+	d1.AddMockResponse("Shelly.GetConfig", nil, json.RawMessage(`{
+		"switch:0": {"id": 0, "name": "Heater"},
+		"sys": {"device": {"name": "garage"}, "location": {"tz": "America/New_York", "lat": 40.7, "lon": -74}}
+	}`))
+
+	m, err := labels.NewMapper(
+		labels.WithDropInstance(true),
+		labels.WithLocation(true),
+		labels.WithStaticLabels(map[string]string{"site": "home"}),
+		labels.WithDeviceLabels("garage", map[string]string{"room": "garage"}),
+	)
+	require.NoError(t, err)
+	_, ps := NewServer(ctx, td.Discoverer, WithLabelMapper(m))
+	metricserver := httptest.NewServer(ps)
+	t.Cleanup(metricserver.Close)
+
+	expect := strings.NewReplacer("$MAC_DEVICE_1", d1.MACAddr).Replace(
+		`# HELP shelly_status_switch_output_on 1 if the switch output is on; 0 if it is off.
+# TYPE shelly_status_switch_output_on gauge
+shelly_status_switch_output_on{component_name="Heater",device_name="garage",id="0",location_lat="40.7",location_lon="-74",location_tz="America/New_York",mac="$MAC_DEVICE_1",room="garage",site="home"} 1
+`)
+	require.NoError(t, testutil.ScrapeAndCompare(
+		metricserver.URL,
+		bytes.NewBufferString(expect),
+		"shelly_status_switch_output_on",
+	))
+}
+
+func TestCollectAccumulatedEnergy(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	d1 := td.NewTestDevice(t, true)
+	d1.AddMockResponse("Shelly.GetConfig", nil, json.RawMessage(`{"switch:0": {"id": 0, "name": "Heater"}}`))
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "aenergy": {"total": 100}}}`))
+
+	a, err := energy.NewAccumulator("")
+	require.NoError(t, err)
+	_, ps := NewServer(ctx, td.Discoverer, WithEnergyAccumulator(a))
+	metricserver := httptest.NewServer(ps)
+	t.Cleanup(metricserver.Close)
+
+	expect := func(total string, resets string) *bytes.Buffer {
+		return bytes.NewBufferString(strings.NewReplacer(
+			"$INSTANCE_DEVICE_1", d1.Instance(),
+			"$MAC_DEVICE_1", d1.MACAddr,
+			"$TOTAL", total,
+			"$RESETS", resets,
+		).Replace(`# HELP shelly_status_energy_wh_total Total energy consumed in Watt-hours, accumulated across device counter resets.
+# TYPE shelly_status_energy_wh_total counter
+shelly_status_energy_wh_total{component="switch",component_name="Heater",device_name="$MAC_DEVICE_1",id="0",instance="$INSTANCE_DEVICE_1",mac="$MAC_DEVICE_1"} $TOTAL
+# HELP shelly_status_energy_counter_resets_total Number of times the device's energy counter was observed to reset. The "direction" label is either "consumed" or "returned".
+# TYPE shelly_status_energy_counter_resets_total counter
+shelly_status_energy_counter_resets_total{component="switch",component_name="Heater",device_name="$MAC_DEVICE_1",direction="consumed",id="0",instance="$INSTANCE_DEVICE_1",mac="$MAC_DEVICE_1"} $RESETS
+`))
+	}
+	names := []string{"shelly_status_energy_wh_total", "shelly_status_energy_counter_resets_total"}
+	require.NoError(t, testutil.ScrapeAndCompare(metricserver.URL, expect("100", "0"), names...))
+
+	// The device rebooted and its counter restarted from zero.
+	d1.AddMockResponse("Shelly.GetStatus", nil, json.RawMessage(`{"switch:0": {"id": 0, "aenergy": {"total": 3.5}}}`))
+	require.NoError(t, testutil.ScrapeAndCompare(metricserver.URL, expect("103.5", "1"), names...))
+}
+
+func TestCollectCachedEnergyBoot(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	a, err := energy.NewAccumulator("")
+	require.NoError(t, err)
+	_, ps := NewServer(ctx, td.Discoverer, WithEnergyAccumulator(a))
+	s := ps.(*Server)
+	now := time.Unix(1700000000, 0)
+	s.notificationCache.now = func() time.Time { return now }
+	collect := func() {
+		ch := make(chan prometheus.Metric, 100)
+		s.collectCached(ctx, ch)
+	}
+	k := energy.Key{Device: "A8032ABE5424", Component: "switch:0"}
+
+	const src = "shellyplus1pm-a8032abe5424"
+	require.NoError(t, s.notificationCache.apply(testStatusNotification(t, src,
+		`{"ts": 1700000000, "sys": {"uptime": 5, "ram_free": 1000}, "switch:0": {"id": 0, "aenergy": {"total": 100}}}`,
+	), true))
+	collect()
+	require.Equal(t, energy.Counter{Total: 100}, a.Counters()[k])
+
+	// A later sys delta without the uptime mustn't move the boot time forward.
+	now = now.Add(10 * time.Minute)
+	require.NoError(t, s.notificationCache.apply(testStatusNotification(t, src,
+		`{"ts": 1700000600, "sys": {"ram_free": 900}, "switch:0": {"aenergy": {"total": 110}}}`,
+	), false))
+	collect()
+	require.Equal(t, energy.Counter{Total: 110}, a.Counters()[k])
+}
+
+func TestCollectPresence(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	_, ps := NewServer(ctx, td.Discoverer)
+	metricserver := httptest.NewServer(ps)
+	t.Cleanup(metricserver.Close)
+
+	t0 := time.Unix(1700000000, 0)
+	td.SetPresence(ctx, "shellyplus1-a8032abe5424", true, t0)
+	td.SetPresence(ctx, "shellyplusi4-c4d8d5567890", true, t0)
+	td.SetPresence(ctx, "shellyplusi4-c4d8d5567890", false, t0.Add(time.Minute))
+
+	expect := `# HELP shelly_status_mqtt_online 1 if the device's MQTT online topic reports it connected to the broker; 0 if its last-will reports it disconnected.
+# TYPE shelly_status_mqtt_online gauge
+shelly_status_mqtt_online{device_name="shellyplus1-a8032abe5424",instance="shellyplus1-a8032abe5424",mac="a8032abe5424"} 1
+shelly_status_mqtt_online{device_name="shellyplusi4-c4d8d5567890",instance="shellyplusi4-c4d8d5567890",mac="c4d8d5567890"} 0
+# HELP shelly_status_mqtt_online_last_change_timestamp_seconds Unix time at which the device's MQTT online state was last reported to change.
+# TYPE shelly_status_mqtt_online_last_change_timestamp_seconds gauge
+shelly_status_mqtt_online_last_change_timestamp_seconds{device_name="shellyplus1-a8032abe5424",instance="shellyplus1-a8032abe5424",mac="a8032abe5424"} 1.7e+09
+shelly_status_mqtt_online_last_change_timestamp_seconds{device_name="shellyplusi4-c4d8d5567890",instance="shellyplusi4-c4d8d5567890",mac="c4d8d5567890"} 1.70000006e+09
+`
+	require.NoError(t, testutil.ScrapeAndCompare(
+		metricserver.URL,
+		bytes.NewBufferString(expect),
+		"shelly_status_mqtt_online",
+		"shelly_status_mqtt_online_last_change_timestamp_seconds",
+	))
+}
+
+func TestCollectMQTTConnection(t *testing.T) {
+	ctx := context.Background()
+	td := discovery.NewTestDiscoverer(t)
+	_, ps := NewServer(ctx, td.Discoverer)
+	metricserver := httptest.NewServer(ps)
+	t.Cleanup(metricserver.Close)
+
+	// No metrics are reported without MQTT.
+	require.NoError(t, testutil.ScrapeAndCompare(
+		metricserver.URL,
+		bytes.NewBufferString(""),
+		"shelly_status_mqtt_connected",
+	))
+
+	td.SetMQTTConnectionState(discovery.MQTTConnectionState{Connected: true, Connects: 2, ConnectionsLost: 1})
+	expect := `# HELP shelly_status_mqtt_connected 1 if shellyctl is connected to the MQTT broker; 0 while it's reconnecting.
+# TYPE shelly_status_mqtt_connected gauge
+shelly_status_mqtt_connected 1
+# HELP shelly_status_mqtt_connects_total Number of times shellyctl has connected to the MQTT broker, including reconnects.
+# TYPE shelly_status_mqtt_connects_total counter
+shelly_status_mqtt_connects_total 2
+# HELP shelly_status_mqtt_connections_lost_total Number of times shellyctl's connection to the MQTT broker was unexpectedly lost.
+# TYPE shelly_status_mqtt_connections_lost_total counter
+shelly_status_mqtt_connections_lost_total 1
+`
+	require.NoError(t, testutil.ScrapeAndCompare(
+		metricserver.URL,
+		bytes.NewBufferString(expect),
+		"shelly_status_mqtt_connected",
+		"shelly_status_mqtt_connects_total",
+		"shelly_status_mqtt_connections_lost_total",
+	))
+}
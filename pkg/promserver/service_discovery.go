@@ -0,0 +1,101 @@
+package promserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// targetGroup is a single entry in the Prometheus http_sd_config format.
+// See https://prometheus.io/docs/prometheus/latest/http_sd/
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// serveServiceDiscovery lists all known devices in the Prometheus HTTP service discovery format.
+// Each device is returned as its own target group so its metadata labels can be used for
+// relabeling. The target address is the device address accepted by the `/probe` endpoint's
+// `target` parameter.
+func (s *Server) serveServiceDiscovery(w http.ResponseWriter, r *http.Request) {
+	l := log.Ctx(s.ctx)
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, err := s.discoverer.Search(r.Context()); err != nil {
+		l.Err(err).Msg("finding new devices")
+	}
+	devs := s.discoverer.AllDevices()
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].MACAddr < devs[j].MACAddr
+	})
+	groups := make([]targetGroup, 0, len(devs))
+	for _, dev := range devs {
+		groups = append(groups, targetGroup{
+			Targets: []string{dev.Address()},
+			Labels: map[string]string{
+				"__meta_shelly_mac":    dev.MACAddr,
+				"__meta_shelly_model":  dev.Model,
+				"__meta_shelly_name":   dev.Name,
+				"__meta_shelly_source": dev.Source(),
+			},
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(groups); err != nil {
+		l.Err(err).Msg("encoding service discovery response")
+	}
+}
+
+// serveProbe collects metrics for a single device identified by the `target` query parameter.
+// The target may be a device address (as returned by `/sd`) or MAC address.
+func (s *Server) serveProbe(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "`target` parameter is required", http.StatusBadRequest)
+		return
+	}
+	dev := s.deviceByTarget(target)
+	if dev == nil {
+		http.Error(w, "unknown target", http.StatusNotFound)
+		return
+	}
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(&probeCollector{s: s, dev: dev})
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+func (s *Server) deviceByTarget(target string) *discovery.Device {
+	for _, dev := range s.discoverer.AllDevices() {
+		if dev.Address() == target || strings.EqualFold(dev.MACAddr, target) {
+			return dev
+		}
+	}
+	return nil
+}
+
+// probeCollector implements prometheus.Collector for a single device.
+type probeCollector struct {
+	s   *Server
+	dev *discovery.Device
+}
+
+// Describe implements prometheus.Collector.
+func (p *probeCollector) Describe(ch chan<- *prometheus.Desc) {
+	p.s.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (p *probeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(p.s.ctx, p.s.deviceTimeout)
+	defer cancel()
+	p.s.collectDevice(ctx, p.dev, ch)
+}
@@ -0,0 +1,93 @@
+package pushexporter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Line protocol can't represent line breaks in names or tag values, so they're replaced with
+// escaped spaces.
+var (
+	measurementEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, ` `, `\ `, "\n", `\ `, "\r", `\ `)
+	tagEscaper         = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\ `, "\r", `\ `)
+)
+
+// encodeLineProtocol encodes samples as InfluxDB line protocol with nanosecond timestamps. Each
+// metric is a measurement with its labels as tags and a single `value` field.
+func encodeLineProtocol(samples []sample) []byte {
+	var b strings.Builder
+	for _, s := range samples {
+		b.WriteString(measurementEscaper.Replace(s.name))
+		for _, l := range s.labels {
+			if l.GetValue() == "" {
+				// Line protocol has no empty tag values; an empty label is equivalent to none.
+				continue
+			}
+			b.WriteByte(',')
+			b.WriteString(tagEscaper.Replace(l.GetName()))
+			b.WriteByte('=')
+			b.WriteString(tagEscaper.Replace(l.GetValue()))
+		}
+		b.WriteString(" value=")
+		b.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(s.ts*1e6, 10))
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// Field numbers of the remote-write protobuf messages.
+// https://github.com/prometheus/prometheus/blob/main/prompb/remote.proto
+const (
+	writeRequestTimeseries = 1
+	timeSeriesLabels       = 1
+	timeSeriesSamples      = 2
+	labelName              = 1
+	labelValue             = 2
+	sampleValue            = 1
+	sampleTimestamp        = 2
+)
+
+// encodeRemoteWrite encodes samples as a snappy compressed remote-write WriteRequest. Each sample
+// is its own time series with the metric name as the `__name__` label.
+func encodeRemoteWrite(samples []sample) []byte {
+	var req []byte
+	for _, s := range samples {
+		var ts []byte
+		// Labels must be sorted by name; `__name__` sorts before the valid label names which
+		// client_golang has already sorted.
+		ts = appendLabel(ts, "__name__", s.name)
+		for _, l := range s.labels {
+			if l.GetValue() == "" {
+				continue
+			}
+			ts = appendLabel(ts, l.GetName(), l.GetValue())
+		}
+		var smp []byte
+		smp = protowire.AppendTag(smp, sampleValue, protowire.Fixed64Type)
+		smp = protowire.AppendFixed64(smp, math.Float64bits(s.value))
+		smp = protowire.AppendTag(smp, sampleTimestamp, protowire.VarintType)
+		smp = protowire.AppendVarint(smp, uint64(s.ts))
+		ts = protowire.AppendTag(ts, timeSeriesSamples, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, smp)
+
+		req = protowire.AppendTag(req, writeRequestTimeseries, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return s2.EncodeSnappy(nil, req)
+}
+
+func appendLabel(b []byte, name, value string) []byte {
+	var l []byte
+	l = protowire.AppendTag(l, labelName, protowire.BytesType)
+	l = protowire.AppendString(l, name)
+	l = protowire.AppendTag(l, labelValue, protowire.BytesType)
+	l = protowire.AppendString(l, value)
+	b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+	return protowire.AppendBytes(b, l)
+}
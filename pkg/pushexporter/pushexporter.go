@@ -0,0 +1,338 @@
+// Package pushexporter periodically gathers metrics from a prometheus.Gatherer and writes them to
+// an HTTP endpoint as InfluxDB line protocol or with the Prometheus remote-write protocol. It lets
+// the metrics served by promserver be stored in systems which ingest pushed metrics, like InfluxDB
+// and VictoriaMetrics.
+package pushexporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// FormatLineProtocol writes InfluxDB line protocol.
+	FormatLineProtocol = "line-protocol"
+	// FormatRemoteWrite writes with the Prometheus remote-write protocol.
+	FormatRemoteWrite = "remote-write"
+
+	// DefaultInterval is the default interval at which metrics are gathered and written.
+	DefaultInterval = 30 * time.Second
+	// DefaultBatchSize is the default maximum number of samples written in each request.
+	DefaultBatchSize = 1000
+	// DefaultTimeout is the default time limit of each write request.
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxRetries is the default number of times a failed write is retried.
+	DefaultMaxRetries = 3
+	// DefaultRetryInterval is the default delay before the first retry of a failed write. The
+	// delay doubles with each retry.
+	DefaultRetryInterval = time.Second
+)
+
+// Exporter writes gathered metrics to an HTTP endpoint.
+type Exporter struct {
+	endpoint string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	now      func() time.Time
+
+	format        string
+	interval      time.Duration
+	batchSize     int
+	timeout       time.Duration
+	gzip          bool
+	headers       map[string]string
+	maxRetries    int
+	retryInterval time.Duration
+
+	// skipped holds the names of metric families of unsupported types which have been logged.
+	skipped sync.Map
+}
+
+// Option provides optional parameters for the Exporter.
+type Option func(*Exporter)
+
+// WithFormat sets the format written, either FormatLineProtocol or FormatRemoteWrite.
+func WithFormat(format string) Option {
+	return func(e *Exporter) {
+		e.format = format
+	}
+}
+
+// WithInterval sets the interval at which metrics are gathered and written.
+func WithInterval(d time.Duration) Option {
+	return func(e *Exporter) {
+		e.interval = d
+	}
+}
+
+// WithBatchSize sets the maximum number of samples written in each request.
+func WithBatchSize(n int) Option {
+	return func(e *Exporter) {
+		e.batchSize = n
+	}
+}
+
+// WithTimeout limits the time of each write request.
+func WithTimeout(d time.Duration) Option {
+	return func(e *Exporter) {
+		e.timeout = d
+	}
+}
+
+// WithGzip compresses line protocol requests with gzip. Remote-write requests are always
+// compressed with snappy as the protocol requires.
+func WithGzip(enable bool) Option {
+	return func(e *Exporter) {
+		e.gzip = enable
+	}
+}
+
+// WithHeaders sets headers sent with each request, ex. `Authorization`.
+func WithHeaders(headers map[string]string) Option {
+	return func(e *Exporter) {
+		e.headers = headers
+	}
+}
+
+// WithRetries sets the number of times a failed write is retried, and the delay before the first
+// retry. The delay doubles with each retry.
+func WithRetries(max int, interval time.Duration) Option {
+	return func(e *Exporter) {
+		e.maxRetries = max
+		e.retryInterval = interval
+	}
+}
+
+// WithHTTPClient sets the client used to make requests.
+func WithHTTPClient(c *http.Client) Option {
+	return func(e *Exporter) {
+		e.client = c
+	}
+}
+
+// NewExporter creates an Exporter which writes the metrics of g to endpoint.
+func NewExporter(endpoint string, g prometheus.Gatherer, opts ...Option) (*Exporter, error) {
+	e := &Exporter{
+		endpoint:      endpoint,
+		gatherer:      g,
+		client:        http.DefaultClient,
+		now:           time.Now,
+		format:        FormatLineProtocol,
+		interval:      DefaultInterval,
+		batchSize:     DefaultBatchSize,
+		timeout:       DefaultTimeout,
+		maxRetries:    DefaultMaxRetries,
+		retryInterval: DefaultRetryInterval,
+	}
+	for _, o := range opts {
+		o(e)
+	}
+	if endpoint == "" {
+		return nil, errors.New("endpoint is required")
+	}
+	if e.format != FormatLineProtocol && e.format != FormatRemoteWrite {
+		return nil, fmt.Errorf("unsupported format %q; expected %q or %q", e.format, FormatLineProtocol, FormatRemoteWrite)
+	}
+	if e.interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	}
+	if e.batchSize < 1 {
+		e.batchSize = 1
+	}
+	return e, nil
+}
+
+// Run gathers and writes metrics each interval until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	l := log.Ctx(ctx)
+	t := time.NewTicker(e.interval)
+	defer t.Stop()
+	for {
+		if err := e.Export(ctx); err != nil && ctx.Err() == nil {
+			l.Err(err).Str("endpoint", e.endpoint).Msg("exporting metrics")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Export gathers metrics once and writes them in batches. Each failed batch is retried before
+// the remaining batches are written; the first error is returned.
+func (e *Exporter) Export(ctx context.Context) error {
+	mfs, err := e.gatherer.Gather()
+	if err != nil {
+		if len(mfs) == 0 {
+			return fmt.Errorf("gathering metrics: %w", err)
+		}
+		// Gather returns the metrics it could collect along with any errors.
+		log.Ctx(ctx).Warn().Err(err).Msg("gathering metrics")
+	}
+	samples, skipped := flatten(mfs, e.now())
+	for _, mf := range skipped {
+		if _, logged := e.skipped.LoadOrStore(mf.GetName(), struct{}{}); !logged {
+			log.Ctx(ctx).Warn().
+				Str("metric", mf.GetName()).
+				Str("type", mf.GetType().String()).
+				Msg("skipping metric of unsupported type")
+		}
+	}
+	var firstErr error
+	for len(samples) > 0 {
+		n := min(e.batchSize, len(samples))
+		if err := e.write(ctx, samples[:n]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		samples = samples[n:]
+	}
+	return firstErr
+}
+
+// sample is a single metric value with its labels, sorted by name.
+type sample struct {
+	name   string
+	labels []*dto.LabelPair
+	value  float64
+	// ts is the sample time in milliseconds since the epoch.
+	ts int64
+}
+
+// flatten returns each gauge, counter, and untyped value of the metric families, and the families
+// of other types which were skipped. Values keep their timestamp, ex. the time a device was polled;
+// those without one are given the time now.
+func flatten(mfs []*dto.MetricFamily, now time.Time) (out []sample, skipped []*dto.MetricFamily) {
+	for _, mf := range mfs {
+		switch mf.GetType() {
+		case dto.MetricType_GAUGE, dto.MetricType_COUNTER, dto.MetricType_UNTYPED:
+		default:
+			skipped = append(skipped, mf)
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			s := sample{
+				name:   mf.GetName(),
+				labels: m.GetLabel(),
+				ts:     now.UnixMilli(),
+			}
+			if m.TimestampMs != nil {
+				s.ts = m.GetTimestampMs()
+			}
+			switch {
+			case m.Gauge != nil:
+				s.value = m.Gauge.GetValue()
+			case m.Counter != nil:
+				s.value = m.Counter.GetValue()
+			case m.Untyped != nil:
+				s.value = m.Untyped.GetValue()
+			default:
+				continue
+			}
+			if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+				continue
+			}
+			out = append(out, s)
+		}
+	}
+	return out, skipped
+}
+
+// write sends a batch of samples, retrying failures which may be temporary.
+func (e *Exporter) write(ctx context.Context, samples []sample) error {
+	var body []byte
+	headers := map[string]string{}
+	switch e.format {
+	case FormatRemoteWrite:
+		body = encodeRemoteWrite(samples)
+		headers["Content-Type"] = "application/x-protobuf"
+		headers["Content-Encoding"] = "snappy"
+		headers["X-Prometheus-Remote-Write-Version"] = "0.1.0"
+	default:
+		body = encodeLineProtocol(samples)
+		headers["Content-Type"] = "text/plain; charset=utf-8"
+		if e.gzip {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(body); err != nil {
+				return fmt.Errorf("compressing request: %w", err)
+			}
+			if err := zw.Close(); err != nil {
+				return fmt.Errorf("compressing request: %w", err)
+			}
+			body = buf.Bytes()
+			headers["Content-Encoding"] = "gzip"
+		}
+	}
+	for k, v := range e.headers {
+		headers[k] = v
+	}
+
+	delay := e.retryInterval
+	for attempt := 0; ; attempt++ {
+		err := e.post(ctx, body, headers)
+		var pe *permanentError
+		if err == nil || errors.As(err, &pe) || attempt >= e.maxRetries {
+			return err
+		}
+		log.Ctx(ctx).Warn().Err(err).Dur("delay", delay).Msg("retrying metrics write")
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// permanentError is a write failure which won't succeed if retried.
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string {
+	return p.err.Error()
+}
+
+func (p *permanentError) Unwrap() error {
+	return p.err
+}
+
+// post makes a single write request. Responses other than 429 or 5xx statuses are permanent.
+func (e *Exporter) post(ctx context.Context, body []byte, headers map[string]string) error {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{fmt.Errorf("building request: %w", err)}
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("writing metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("writing metrics: unexpected status %q: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return &permanentError{err}
+}
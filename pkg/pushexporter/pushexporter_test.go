@@ -0,0 +1,235 @@
+package pushexporter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+type testEndpoint struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	statuses []int
+}
+
+func newTestEndpoint(t *testing.T, statuses ...int) *testEndpoint {
+	te := &testEndpoint{statuses: statuses}
+	te.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		te.lock.Lock()
+		defer te.lock.Unlock()
+		te.requests = append(te.requests, r)
+		te.bodies = append(te.bodies, body)
+		status := http.StatusNoContent
+		if len(te.statuses) > 0 {
+			status, te.statuses = te.statuses[0], te.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(te.Close)
+	return te
+}
+
+func testGatherer(t *testing.T) prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	power := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "shelly_switch_active_power_watts",
+	}, []string{"device_name", "switch"})
+	power.WithLabelValues("Garage Door", "0").Set(12.5)
+	power.WithLabelValues("", "1").Set(math.NaN())
+	energy := prometheus.NewCounter(prometheus.CounterOpts{Name: "shelly_energy_total"})
+	energy.Add(1000)
+	reg.MustRegister(power, energy)
+	return reg
+}
+
+func TestExportLineProtocol(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEndpoint(t)
+	e, err := NewExporter(te.URL, testGatherer(t), WithHeaders(map[string]string{"Authorization": "Token abc"}))
+	require.NoError(t, err)
+	e.now = func() time.Time { return time.UnixMilli(1700000000123) }
+
+	require.NoError(t, e.Export(ctx))
+	require.Len(t, te.bodies, 1)
+	assert.Equal(t, "Token abc", te.requests[0].Header.Get("Authorization"))
+	assert.Equal(t,
+		"shelly_energy_total value=1000 1700000000123000000\n"+
+			`shelly_switch_active_power_watts,device_name=Garage\ Door,switch=0 value=12.5 1700000000123000000`+"\n",
+		string(te.bodies[0]))
+}
+
+func TestExportGzipBatches(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEndpoint(t)
+	e, err := NewExporter(te.URL, testGatherer(t), WithGzip(true), WithBatchSize(1))
+	require.NoError(t, err)
+	e.now = func() time.Time { return time.UnixMilli(1700000000123) }
+
+	require.NoError(t, e.Export(ctx))
+	require.Len(t, te.bodies, 2)
+	assert.Equal(t, "gzip", te.requests[1].Header.Get("Content-Encoding"))
+	zr, err := gzip.NewReader(bytes.NewReader(te.bodies[1]))
+	require.NoError(t, err)
+	body, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, `shelly_switch_active_power_watts,device_name=Garage\ Door,switch=0 value=12.5 1700000000123000000`+"\n", string(body))
+}
+
+func TestExportRetries(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEndpoint(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	e, err := NewExporter(te.URL, testGatherer(t), WithRetries(2, time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, e.Export(ctx))
+	assert.Len(t, te.bodies, 3)
+
+	// Client errors aren't retried.
+	te = newTestEndpoint(t, http.StatusBadRequest)
+	e, err = NewExporter(te.URL, testGatherer(t), WithRetries(2, time.Millisecond))
+	require.NoError(t, err)
+	assert.ErrorContains(t, e.Export(ctx), `unexpected status "400 Bad Request"`)
+	assert.Len(t, te.bodies, 1)
+
+	// Retries are limited.
+	te = newTestEndpoint(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	e, err = NewExporter(te.URL, testGatherer(t), WithRetries(1, time.Millisecond))
+	require.NoError(t, err)
+	assert.Error(t, e.Export(ctx))
+	assert.Len(t, te.bodies, 2)
+}
+
+func TestExportRemoteWrite(t *testing.T) {
+	ctx := context.Background()
+	te := newTestEndpoint(t)
+	e, err := NewExporter(te.URL, testGatherer(t), WithFormat(FormatRemoteWrite))
+	require.NoError(t, err)
+	e.now = func() time.Time { return time.UnixMilli(1700000000123) }
+
+	require.NoError(t, e.Export(ctx))
+	require.Len(t, te.bodies, 1)
+	assert.Equal(t, "snappy", te.requests[0].Header.Get("Content-Encoding"))
+	assert.Equal(t, "0.1.0", te.requests[0].Header.Get("X-Prometheus-Remote-Write-Version"))
+	body, err := s2.Decode(nil, te.bodies[0])
+	require.NoError(t, err)
+
+	type series struct {
+		labels [][2]string
+		value  float64
+		ts     int64
+	}
+	var got []series
+	for _, tsb := range fields(t, body, writeRequestTimeseries) {
+		var s series
+		for _, lb := range fields(t, tsb, timeSeriesLabels) {
+			name, value := fields(t, lb, labelName), fields(t, lb, labelValue)
+			s.labels = append(s.labels, [2]string{string(name[0]), string(value[0])})
+		}
+		smp := fields(t, tsb, timeSeriesSamples)[0]
+		num, _, n := protowire.ConsumeTag(smp)
+		require.Equal(t, protowire.Number(sampleValue), num)
+		bits, m := protowire.ConsumeFixed64(smp[n:])
+		s.value = math.Float64frombits(bits)
+		_, _, k := protowire.ConsumeTag(smp[n+m:])
+		ts, _ := protowire.ConsumeVarint(smp[n+m+k:])
+		s.ts = int64(ts)
+		got = append(got, s)
+	}
+	assert.Equal(t, []series{
+		{labels: [][2]string{{"__name__", "shelly_energy_total"}}, value: 1000, ts: 1700000000123},
+		{
+			labels: [][2]string{
+				{"__name__", "shelly_switch_active_power_watts"},
+				{"device_name", "Garage Door"},
+				{"switch", "0"},
+			},
+			value: 12.5,
+			ts:    1700000000123,
+		},
+	}, got)
+}
+
+func TestNewExporterValidation(t *testing.T) {
+	_, err := NewExporter("", testGatherer(t))
+	assert.EqualError(t, err, "endpoint is required")
+	_, err = NewExporter("http://localhost", testGatherer(t), WithFormat("json"))
+	assert.EqualError(t, err, `unsupported format "json"; expected "line-protocol" or "remote-write"`)
+}
+
+// fields returns the values of the length-delimited fields numbered num.
+func fields(t *testing.T, b []byte, num protowire.Number) [][]byte {
+	var out [][]byte
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		require.GreaterOrEqual(t, l, 0)
+		b = b[l:]
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		require.GreaterOrEqual(t, l, 0)
+		if n == num && typ == protowire.BytesType {
+			v, _ := protowire.ConsumeBytes(b)
+			out = append(out, v)
+		}
+		b = b[l:]
+	}
+	return out
+}
+
+func TestEncodeLineProtocolEscaping(t *testing.T) {
+	samples := []sample{{
+		name: "shelly_switch_output_on",
+		labels: []*dto.LabelPair{
+			{Name: proto.String("device_name"), Value: proto.String(`Shed\Pump, "A=1"`)},
+			{Name: proto.String("component_name"), Value: proto.String("line\nbreak")},
+		},
+		value: 1,
+		ts:    1700000000123,
+	}}
+	assert.Equal(t,
+		`shelly_switch_output_on,device_name=Shed\\Pump\,\ "A\=1",component_name=line\ break value=1 1700000000123000000`+"\n",
+		string(encodeLineProtocol(samples)))
+}
+
+func TestFlatten(t *testing.T) {
+	now := time.UnixMilli(1700000000123)
+	mfs := []*dto.MetricFamily{
+		{
+			Name: proto.String("shelly_switch_output_on"),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{
+				{Gauge: &dto.Gauge{Value: proto.Float64(1)}},
+				// Polled values keep the time they were fetched.
+				{Gauge: &dto.Gauge{Value: proto.Float64(0)}, TimestampMs: proto.Int64(1699999990000)},
+			},
+		},
+		{
+			Name:   proto.String("shelly_request_duration_seconds"),
+			Type:   dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{Histogram: &dto.Histogram{SampleCount: proto.Uint64(1)}}},
+		},
+	}
+	samples, skipped := flatten(mfs, now)
+	assert.Equal(t, []sample{
+		{name: "shelly_switch_output_on", value: 1, ts: 1700000000123},
+		{name: "shelly_switch_output_on", value: 0, ts: 1699999990000},
+	}, samples)
+	require.Len(t, skipped, 1)
+	assert.Equal(t, "shelly_request_duration_seconds", skipped[0].GetName())
+}
@@ -0,0 +1,264 @@
+package rpcqueue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/jcodybaker/shellyctl/pkg/discovery"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DefaultSrc is the src of published requests. Devices publish their responses to
+	// `<src>/rpc`.
+	DefaultSrc = "shellyctl-queue"
+	// DefaultMaxWakes is the number of device wakes in which a request may be published without
+	// an answer before it fails.
+	DefaultMaxWakes = 3
+	// DefaultSyncInterval is the interval at which a Dispatcher publishes requests added by other
+	// processes to devices which are online.
+	DefaultSyncInterval = 10 * time.Second
+)
+
+// Publisher publishes MQTT messages. It's satisfied by mqtt.Client.
+type Publisher interface {
+	Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token
+}
+
+// Deliver returns the oldest pending request of a device which has woken, counting the wake, or
+// nil if it has none. Requests which were already published in maxWakes wakes without an answer
+// fail instead, and are returned in failed. sent is the frame ID of the request already published
+// during the current wake, if any, which isn't returned again.
+func (s *Store) Deliver(device string, maxWakes int, sent int64) (next *Request, failed []*Request, err error) {
+	err = s.update(func(sf *stateFile) error {
+		for {
+			h := sf.head(device)
+			if h == nil || h.FrameID == sent {
+				return nil
+			}
+			if maxWakes > 0 && h.Wakes >= maxWakes {
+				h.Error = fmt.Sprintf("no response after %d device wakes", h.Wakes)
+				s.complete(h, StateFailed)
+				failed = append(failed, h)
+				continue
+			}
+			h.Wakes++
+			next = h
+			return nil
+		}
+	})
+	return next, failed, err
+}
+
+// publish sends a request to its device. It isn't retained, since a device which received it
+// would execute it again each time it reconnects.
+func publish(p Publisher, src string, r *Request) error {
+	payload, err := json.Marshal(&frame.Frame{
+		Src:    src,
+		Dst:    r.Device,
+		ID:     r.FrameID,
+		Method: r.Method,
+		Params: r.Params,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding request %q: %w", r.ID, err)
+	}
+	token := p.Publish(r.Device+"/rpc", 1, false, payload)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("publishing request %q for %q: %w", r.ID, r.Device, err)
+	}
+	return nil
+}
+
+// Respond records a response frame to a published request. It returns the completed request, or
+// nil if the frame doesn't answer a pending request.
+func (s *Store) Respond(f *frame.Frame) (*Request, error) {
+	var out *Request
+	err := s.update(func(sf *stateFile) error {
+		r := sf.find(func(r *Request) bool {
+			return r.FrameID == f.ID && r.State == StatePending
+		})
+		if r == nil {
+			return nil
+		}
+		if f.Error != nil {
+			r.Error = fmt.Sprintf("%s (code %d)", f.Error.Message, f.Error.Code)
+			s.complete(r, StateFailed)
+		} else {
+			r.Result = f.Result
+			s.complete(r, StateDone)
+		}
+		out = r
+		return nil
+	})
+	return out, err
+}
+
+// Dispatcher publishes queued requests and collects their responses.
+type Dispatcher struct {
+	store        *Store
+	disc         *discovery.Discoverer
+	src          string
+	maxWakes     int
+	syncInterval time.Duration
+	onResult     func(*Request)
+}
+
+// DispatcherOption provides optional parameters for NewDispatcher.
+type DispatcherOption func(*Dispatcher)
+
+// WithSrc sets the src of published requests, which determines the topic of their responses.
+func WithSrc(src string) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.src = src
+	}
+}
+
+// WithMaxWakes sets the number of device wakes in which a request may be published without an
+// answer before it fails. 0 retries indefinitely.
+func WithMaxWakes(n int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.maxWakes = n
+	}
+}
+
+// WithSyncInterval sets the interval at which requests added by other processes are published to
+// devices which are online.
+func WithSyncInterval(interval time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.syncInterval = interval
+	}
+}
+
+// WithResultFunc sets a function called with each request as it completes.
+func WithResultFunc(f func(*Request)) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.onResult = f
+	}
+}
+
+// NewDispatcher creates a Dispatcher for the requests in store, using the discoverer's MQTT
+// connection and device presence.
+func NewDispatcher(store *Store, disc *discovery.Discoverer, opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		store:        store,
+		disc:         disc,
+		src:          DefaultSrc,
+		maxWakes:     DefaultMaxWakes,
+		syncInterval: DefaultSyncInterval,
+		onResult:     func(*Request) {},
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	return d
+}
+
+// Run publishes pending requests and records responses until ctx is done. Each device is sent
+// its oldest pending request when it reports it's online, and the next once it answers. Only one
+// Dispatcher may run for a store at a time.
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ll := log.Ctx(ctx).With().Str("component", "rpcqueue").Logger()
+	c := d.disc.MQTTClient()
+	if c == nil {
+		return errors.New("not connected to an MQTT broker")
+	}
+	unlock, err := d.store.lockDispatcher()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	presence := d.disc.SubscribePresence()
+	defer presence.Unsubscribe()
+
+	// Responses are handed to the loop below, which may be busy publishing with the same client.
+	responses := make(chan *frame.Frame)
+	topic := d.src + "/rpc"
+	token := c.Subscribe(topic, 1, func(_ mqtt.Client, m mqtt.Message) {
+		f := &frame.Frame{}
+		if err := json.Unmarshal(m.Payload(), f); err != nil {
+			ll.Warn().Err(err).Str("topic", m.Topic()).Msg("parsing rpc response")
+			return
+		}
+		go func() {
+			select {
+			case responses <- f:
+			case <-ctx.Done():
+			}
+		}()
+	})
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return fmt.Errorf("subscribing to %q: %w", topic, err)
+	}
+	defer c.Unsubscribe(topic)
+
+	// sent holds the frame ID of the request published to each online device during its current
+	// wake.
+	sent := make(map[string]int64)
+	deliver := func(device string) {
+		r, failed, err := d.store.Deliver(device, d.maxWakes, sent[device])
+		if err != nil {
+			ll.Err(err).Str("prefix", device).Msg("delivering queued request")
+			return
+		}
+		for _, f := range failed {
+			d.onResult(f)
+		}
+		if r == nil {
+			return
+		}
+		if err := publish(c, d.src, r); err != nil {
+			ll.Err(err).Msg("publishing queued request")
+			return
+		}
+		sent[device] = r.FrameID
+	}
+	for _, p := range d.disc.Presence() {
+		if p.Online {
+			sent[p.Prefix] = 0
+			deliver(p.Prefix)
+		}
+	}
+	t := time.NewTicker(d.syncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			for device := range sent {
+				deliver(device)
+			}
+		case f := <-responses:
+			r, err := d.store.Respond(f)
+			if err != nil {
+				ll.Err(err).Int64("frame_id", f.ID).Msg("recording rpc response")
+				continue
+			}
+			if r == nil {
+				ll.Debug().Int64("frame_id", f.ID).Str("src", f.Src).Msg("ignoring response to unknown request")
+				continue
+			}
+			d.onResult(r)
+			if _, ok := sent[r.Device]; ok {
+				deliver(r.Device)
+			}
+		case pn := <-presence.C():
+			if !pn.Online {
+				delete(sent, pn.Prefix)
+				continue
+			}
+			ll.Debug().Str("prefix", pn.Prefix).Msg("device connected")
+			// Each connection is a new wake.
+			sent[pn.Prefix] = 0
+			deliver(pn.Prefix)
+		}
+	}
+}
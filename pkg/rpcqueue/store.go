@@ -0,0 +1,303 @@
+// Package rpcqueue queues RPCs for MQTT devices which are only occasionally connected, like
+// battery powered sensors which wake periodically. Requests are persisted locally, and a
+// Dispatcher publishes them to the device's RPC topic when the device reports it's online, then
+// collects the responses. Requests aren't retained by the broker, so a device only receives a
+// request while a Dispatcher is running.
+package rpcqueue
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const stateVersion = 1
+
+// State describes the progress of a queued request.
+type State string
+
+const (
+	// StatePending requests are waiting for a response from the device.
+	StatePending State = "pending"
+	// StateDone requests received a successful response.
+	StateDone State = "done"
+	// StateFailed requests received an error response, or weren't answered within the allowed
+	// number of device wakes.
+	StateFailed State = "failed"
+	// StateCancelled requests were cancelled before the device responded.
+	StateCancelled State = "cancelled"
+)
+
+var (
+	// ErrNotFound is returned for requests which aren't in the queue.
+	ErrNotFound = errors.New("request not found")
+	// ErrNotPending is returned when cancelling a request which has already completed.
+	ErrNotPending = errors.New("request is not pending")
+	// ErrDispatcherRunning is returned when starting a Dispatcher while another is running.
+	ErrDispatcherRunning = errors.New("another dispatcher is running")
+)
+
+// Request is a queued RPC.
+type Request struct {
+	ID string `json:"id"`
+	// FrameID identifies the RPC frame published to the device, and its response.
+	FrameID int64 `json:"frame_id"`
+	// Device is the MQTT topic prefix of the device.
+	Device string          `json:"device"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+	State  State           `json:"state"`
+
+	Created   time.Time  `json:"created"`
+	Completed *time.Time `json:"completed,omitempty"`
+	// Wakes counts the device wakes in which the request was published to the device.
+	Wakes  int             `json:"wakes,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type stateFile struct {
+	Version  int        `json:"version"`
+	Requests []*Request `json:"requests"`
+}
+
+// Store persists queued requests to a JSON file. Each operation holds an exclusive lock on a
+// `.lock` file beside it while it reads and atomically replaces the file, so a Store may be shared
+// by separate processes, like a CLI adding requests and a Dispatcher collecting responses.
+type Store struct {
+	path string
+	now  func() time.Time
+
+	// lock serializes operations within the process. The file lock serializes them between
+	// processes.
+	lock sync.Mutex
+}
+
+// DefaultPath returns the default location of the queue file within the user's config directory.
+func DefaultPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "shellyctl", "rpc-queue.json")
+}
+
+// NewStore creates a Store which persists requests to path. The file is created when the first
+// request is added.
+func NewStore(path string) *Store {
+	return &Store{path: path, now: time.Now}
+}
+
+// Add queues a request for the device with the given MQTT topic prefix.
+func (s *Store) Add(device, method string, params json.RawMessage) (*Request, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, fmt.Errorf("generating request id: %w", err)
+	}
+	r := &Request{
+		ID:      hex.EncodeToString(b[:4]),
+		FrameID: int64(binary.BigEndian.Uint64(b[:]) >> 1),
+		Device:  device,
+		Method:  method,
+		Params:  params,
+		State:   StatePending,
+		Created: s.now(),
+	}
+	err := s.update(func(sf *stateFile) error {
+		sf.Requests = append(sf.Requests, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// List returns all requests, ordered by creation.
+func (s *Store) List() ([]*Request, error) {
+	unlock, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	sf, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return sf.Requests, nil
+}
+
+// Cancel cancels a pending request.
+func (s *Store) Cancel(id string) (*Request, error) {
+	var out *Request
+	err := s.update(func(sf *stateFile) error {
+		r := sf.find(func(r *Request) bool { return r.ID == id })
+		if r == nil {
+			return fmt.Errorf("%w: %q", ErrNotFound, id)
+		}
+		if r.State != StatePending {
+			return fmt.Errorf("%w: %q is %s", ErrNotPending, id, r.State)
+		}
+		s.complete(r, StateCancelled)
+		out = r
+		return nil
+	})
+	return out, err
+}
+
+func (s *Store) complete(r *Request, state State) {
+	now := s.now()
+	r.State = state
+	r.Completed = &now
+}
+
+// update loads the state, applies f, and saves the state if f succeeds.
+func (s *Store) update(f func(*stateFile) error) error {
+	unlock, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sf, err := s.load()
+	if err != nil {
+		return err
+	}
+	if err := f(sf); err != nil {
+		return err
+	}
+	return s.save(sf)
+}
+
+// acquire locks the store against other goroutines and processes. The lock is held on a separate
+// file because save replaces the queue file, which would release a lock held on it.
+func (s *Store) acquire() (unlock func(), err error) {
+	s.lock.Lock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("creating rpc queue directory: %w", err)
+	}
+	f, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, fmt.Errorf("opening rpc queue lock: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		s.lock.Unlock()
+		return nil, fmt.Errorf("locking rpc queue: %w", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+		s.lock.Unlock()
+	}, nil
+}
+
+// lockDispatcher marks a Dispatcher as running for the store until unlock is called. It fails if
+// another Dispatcher is running.
+func (s *Store) lockDispatcher() (unlock func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return nil, fmt.Errorf("creating rpc queue directory: %w", err)
+	}
+	f, err := os.OpenFile(s.path+".run", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening rpc queue dispatcher lock: %w", err)
+	}
+	ok, err := tryLockFile(f)
+	if err != nil || !ok {
+		f.Close()
+		if err == nil {
+			err = ErrDispatcherRunning
+		}
+		return nil, fmt.Errorf("locking rpc queue dispatcher: %w", err)
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// DispatcherRunning reports whether a Dispatcher is running for the store, in this or another
+// process.
+func (s *Store) DispatcherRunning() (bool, error) {
+	unlock, err := s.lockDispatcher()
+	if errors.Is(err, ErrDispatcherRunning) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	unlock()
+	return false, nil
+}
+
+func (s *Store) load() (*stateFile, error) {
+	sf := &stateFile{Version: stateVersion}
+	b, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading rpc queue: %w", err)
+	}
+	if err := json.Unmarshal(b, sf); err != nil {
+		return nil, fmt.Errorf("parsing rpc queue %q: %w", s.path, err)
+	}
+	if sf.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported rpc queue version %d in %q", sf.Version, s.path)
+	}
+	sort.SliceStable(sf.Requests, func(i, j int) bool {
+		return sf.Requests[i].Created.Before(sf.Requests[j].Created)
+	})
+	return sf, nil
+}
+
+func (s *Store) save(sf *stateFile) error {
+	b, err := json.MarshalIndent(sf, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding rpc queue: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("creating rpc queue directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("creating rpc queue: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("writing rpc queue: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("writing rpc queue: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("replacing rpc queue: %w", err)
+	}
+	return nil
+}
+
+func (sf *stateFile) find(match func(*Request) bool) *Request {
+	for _, r := range sf.Requests {
+		if match(r) {
+			return r
+		}
+	}
+	return nil
+}
+
+// head returns the oldest pending request for a device, or nil.
+func (sf *stateFile) head(device string) *Request {
+	return sf.find(func(r *Request) bool {
+		return r.Device == device && r.State == StatePending
+	})
+}
@@ -0,0 +1,182 @@
+package rpcqueue
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/mongoose-os/mos/common/mgrpc/frame"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type published struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+type testPublisher struct {
+	published []published
+}
+
+func (p *testPublisher) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	p.published = append(p.published, published{topic: topic, retained: retained, payload: string(payload.([]byte))})
+	return doneToken{}
+}
+
+type doneToken struct{}
+
+func (doneToken) Wait() bool                       { return true }
+func (doneToken) WaitTimeout(_ time.Duration) bool { return true }
+func (doneToken) Done() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+func (doneToken) Error() error { return nil }
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue", "rpc-queue.json")
+	s := NewStore(path)
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	first, err := s.Add("shellyhtg3-a8032abe5424", "Sys.SetConfig", json.RawMessage(`{"config":{"device":{"name":"attic"}}}`))
+	require.NoError(t, err)
+	now = now.Add(time.Second)
+	second, err := s.Add("shellyhtg3-a8032abe5424", "Shelly.Reboot", nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.NotEqual(t, first.FrameID, second.FrameID)
+
+	cancelled, err := s.Cancel(second.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StateCancelled, cancelled.State)
+	_, err = s.Cancel(second.ID)
+	assert.ErrorIs(t, err, ErrNotPending)
+	_, err = s.Cancel("bogus")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Requests are persisted.
+	reqs, err := NewStore(path).List()
+	require.NoError(t, err)
+	require.Len(t, reqs, 2)
+	assert.Equal(t, first.ID, reqs[0].ID)
+	assert.Equal(t, StatePending, reqs[0].State)
+	assert.JSONEq(t, `{"config":{"device":{"name":"attic"}}}`, string(reqs[0].Params))
+	assert.Equal(t, StateCancelled, reqs[1].State)
+	assert.Equal(t, now, *reqs[1].Completed)
+}
+
+func TestStoreSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpc-queue.json")
+	// Separate Stores only share the file lock, like separate processes.
+	stores := []*Store{NewStore(path), NewStore(path)}
+	const perStore = 100
+	var wg sync.WaitGroup
+	for _, s := range stores {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perStore; i++ {
+				_, err := s.Add("shellyhtg3-a8032abe5424", "Shelly.GetStatus", nil)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	reqs, err := NewStore(path).List()
+	require.NoError(t, err)
+	assert.Len(t, reqs, len(stores)*perStore)
+}
+
+func TestDeliver(t *testing.T) {
+	s := NewStore(filepath.Join(t.TempDir(), "rpc-queue.json"))
+	p := &testPublisher{}
+
+	a1, err := s.Add("attic", "Switch.Set", json.RawMessage(`{"id":0,"on":true}`))
+	require.NoError(t, err)
+	a2, err := s.Add("attic", "Switch.Set", json.RawMessage(`{"id":0,"on":false}`))
+	require.NoError(t, err)
+	b1, err := s.Add("garage", "Shelly.Reboot", nil)
+	require.NoError(t, err)
+
+	// The oldest request is delivered once per wake.
+	r, failed, err := s.Deliver("attic", DefaultMaxWakes, 0)
+	require.NoError(t, err)
+	assert.Empty(t, failed)
+	require.NotNil(t, r)
+	assert.Equal(t, a1.ID, r.ID)
+	assert.Equal(t, 1, r.Wakes)
+	r, _, err = s.Deliver("attic", DefaultMaxWakes, a1.FrameID)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+
+	// Requests aren't retained, so they aren't executed again when the device reconnects.
+	require.NoError(t, publish(p, DefaultSrc, a1))
+	require.Len(t, p.published, 1)
+	assert.Equal(t, "attic/rpc", p.published[0].topic)
+	assert.False(t, p.published[0].retained)
+	var f frame.Frame
+	require.NoError(t, json.Unmarshal([]byte(p.published[0].payload), &f))
+	assert.Equal(t, DefaultSrc, f.Src)
+	assert.Equal(t, a1.FrameID, f.ID)
+	assert.Equal(t, "Switch.Set", f.Method)
+
+	// A response completes the request, and the next is delivered.
+	r, err = s.Respond(&frame.Frame{ID: a1.FrameID, Result: json.RawMessage(`{"was_on":false}`)})
+	require.NoError(t, err)
+	assert.Equal(t, StateDone, r.State)
+	assert.JSONEq(t, `{"was_on":false}`, string(r.Result))
+	r, err = s.Respond(&frame.Frame{ID: a1.FrameID})
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	r, _, err = s.Deliver("attic", DefaultMaxWakes, a1.FrameID)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, a2.ID, r.ID)
+
+	// Error responses fail the request.
+	r, err = s.Respond(&frame.Frame{ID: a2.FrameID, Error: &frame.Error{Code: 401, Message: "unauthorized"}})
+	require.NoError(t, err)
+	assert.Equal(t, StateFailed, r.State)
+	assert.Equal(t, "unauthorized (code 401)", r.Error)
+
+	// Requests fail once they've been delivered in the maximum number of wakes.
+	for i := 0; i < DefaultMaxWakes; i++ {
+		r, failed, err = s.Deliver("garage", DefaultMaxWakes, 0)
+		require.NoError(t, err)
+		assert.Empty(t, failed)
+		assert.Equal(t, b1.ID, r.ID)
+	}
+	r, failed, err = s.Deliver("garage", DefaultMaxWakes, 0)
+	require.NoError(t, err)
+	assert.Nil(t, r)
+	require.Len(t, failed, 1)
+	assert.Equal(t, StateFailed, failed[0].State)
+	assert.Equal(t, "no response after 3 device wakes", failed[0].Error)
+}
+
+func TestDispatcherRunning(t *testing.T) {
+	s := NewStore(filepath.Join(t.TempDir(), "rpc-queue.json"))
+	running, err := s.DispatcherRunning()
+	require.NoError(t, err)
+	assert.False(t, running)
+
+	unlock, err := s.lockDispatcher()
+	require.NoError(t, err)
+	running, err = s.DispatcherRunning()
+	require.NoError(t, err)
+	assert.True(t, running)
+	_, err = s.lockDispatcher()
+	assert.ErrorIs(t, err, ErrDispatcherRunning)
+
+	unlock()
+	running, err = s.DispatcherRunning()
+	require.NoError(t, err)
+	assert.False(t, running)
+}
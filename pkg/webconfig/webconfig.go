@@ -0,0 +1,393 @@
+// Package webconfig configures TLS and authentication for the metrics HTTP servers. The file
+// format is compatible with the Prometheus exporter-toolkit web-config.yml, so an existing
+// configuration can be shared with other exporters.
+package webconfig
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+	"sigs.k8s.io/yaml"
+)
+
+// Config describes TLS and authentication settings for an HTTP server.
+type Config struct {
+	TLSServerConfig  *TLSServerConfig `json:"tls_server_config,omitempty"`
+	HTTPServerConfig HTTPServerConfig `json:"http_server_config,omitempty"`
+	RateLimit        *RateLimitConfig `json:"rate_limit,omitempty"`
+
+	// BasicAuthUsers maps usernames to bcrypt hashed passwords.
+	BasicAuthUsers map[string]string `json:"basic_auth_users,omitempty"`
+
+	// BearerTokens are accepted in an `Authorization: Bearer` header. Bearer tokens are not part
+	// of the Prometheus web-config format and can only be set programmatically.
+	BearerTokens []string `json:"-"`
+}
+
+// TLSServerConfig configures the server's certificate and client certificate verification.
+type TLSServerConfig struct {
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// Cert and Key are PEM encoded alternatives to CertFile and KeyFile.
+	Cert           string `json:"cert,omitempty"`
+	Key            string `json:"key,omitempty"`
+	ClientAuthType string `json:"client_auth_type,omitempty"`
+	ClientCAFile   string `json:"client_ca_file,omitempty"`
+	// ClientAllowedSANs, if set, requires a verified client certificate with one of these
+	// subject alternative names.
+	ClientAllowedSANs []string `json:"client_allowed_sans,omitempty"`
+	MinVersion        string   `json:"min_version,omitempty"`
+	MaxVersion        string   `json:"max_version,omitempty"`
+	// CipherSuites are named as in crypto/tls, like TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. They
+	// don't apply to TLS 1.3.
+	CipherSuites     []string `json:"cipher_suites,omitempty"`
+	CurvePreferences []string `json:"curve_preferences,omitempty"`
+	// PreferServerCipherSuites is accepted for compatibility, but has no effect. Go chooses the
+	// cipher suite order itself.
+	PreferServerCipherSuites *bool `json:"prefer_server_cipher_suites,omitempty"`
+}
+
+// HTTPServerConfig configures HTTP specific behavior.
+type HTTPServerConfig struct {
+	// HTTP2 enables HTTP/2 over TLS. It defaults to true.
+	HTTP2 *bool `json:"http2,omitempty"`
+	// Headers are added to every response.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// RateLimitConfig limits the rate of requests, across all clients. Requests over the limit get a
+// 429 response.
+type RateLimitConfig struct {
+	// Interval is the time between requests once Burst is exhausted. Zero disables the limit.
+	Interval Duration `json:"interval,omitempty"`
+	Burst    int      `json:"burst,omitempty"`
+}
+
+// Duration is a time.Duration written as a string, like "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+var curves = map[string]tls.CurveID{
+	"CurveP256": tls.CurveP256,
+	"CurveP384": tls.CurveP384,
+	"CurveP521": tls.CurveP521,
+	"X25519":    tls.X25519,
+}
+
+// dummyHash is compared against the passwords of unknown users, so they take as long to reject
+// as a wrong password.
+const dummyHash = "$2a$10$Wetwws2McgNCuAVI8aRD9eYRFeUZkcdbxGY4Bi7xWW4iAE4Zq8SQy"
+
+// authCacheSize bounds the number of remembered password checks.
+const authCacheSize = 100
+
+// authCache remembers the result of recent password checks. bcrypt is deliberately slow, and
+// scrapers send the same credentials with every request.
+var authCache = struct {
+	lock    sync.Mutex
+	results map[[sha256.Size]byte]bool
+}{results: make(map[[sha256.Size]byte]bool)}
+
+// Load reads a web-config.yml file. Relative file paths within the config are resolved relative
+// to the directory containing the config file.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading web config: %w", err)
+	}
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("parsing web config %q: %w", path, err)
+	}
+	if t := c.TLSServerConfig; t != nil {
+		dir := filepath.Dir(path)
+		t.CertFile = joinDir(dir, t.CertFile)
+		t.KeyFile = joinDir(dir, t.KeyFile)
+		t.ClientCAFile = joinDir(dir, t.ClientCAFile)
+	}
+	return c, nil
+}
+
+func joinDir(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// TLSConfig builds a server tls.Config. It returns nil if TLS is not configured.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	t := c.TLSServerConfig
+	if t == nil || (t.CertFile == "" && t.KeyFile == "" && t.Cert == "" && t.Key == "") {
+		if t != nil && t.ClientCAFile != "" {
+			return nil, errors.New("client_ca_file requires cert_file and key_file")
+		}
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.MinVersion != "" {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q", t.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if t.MaxVersion != "" {
+		v, ok := tlsVersions[t.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown max_version %q", t.MaxVersion)
+		}
+		cfg.MaxVersion = v
+	}
+	for _, name := range t.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		cfg.CipherSuites = append(cfg.CipherSuites, id)
+	}
+	for _, name := range t.CurvePreferences {
+		id, ok := curves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q", name)
+		}
+		cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+	}
+
+	clientAuth, ok := clientAuthTypes[t.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", t.ClientAuthType)
+	}
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %q", t.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		if t.ClientAuthType == "" {
+			// A CA without an explicit auth type implies mTLS.
+			clientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if (clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert) && cfg.ClientCAs == nil {
+		return nil, fmt.Errorf("client_auth_type %q requires client_ca_file", t.ClientAuthType)
+	}
+	if len(t.ClientAllowedSANs) > 0 {
+		if clientAuth != tls.RequireAndVerifyClientCert {
+			return nil, errors.New("client_allowed_sans requires client_auth_type RequireAndVerifyClientCert")
+		}
+		cfg.VerifyPeerCertificate = verifySANs(t.ClientAllowedSANs)
+	}
+	cfg.ClientAuth = clientAuth
+
+	// The certificate is loaded last, so the settings above are validated without it.
+	cert, err := t.certificate()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Certificates = []tls.Certificate{cert}
+	return cfg, nil
+}
+
+// certificate loads the server certificate, from files or inline PEM.
+func (t *TLSServerConfig) certificate() (tls.Certificate, error) {
+	if t.CertFile != "" && t.Cert != "" {
+		return tls.Certificate{}, errors.New("cert_file and cert are mutually exclusive")
+	}
+	if t.KeyFile != "" && t.Key != "" {
+		return tls.Certificate{}, errors.New("key_file and key are mutually exclusive")
+	}
+	certPEM, keyPEM := []byte(t.Cert), []byte(t.Key)
+	if t.CertFile != "" {
+		var err error
+		if certPEM, err = os.ReadFile(t.CertFile); err != nil {
+			return tls.Certificate{}, fmt.Errorf("reading TLS certificate: %w", err)
+		}
+	}
+	if t.KeyFile != "" {
+		var err error
+		if keyPEM, err = os.ReadFile(t.KeyFile); err != nil {
+			return tls.Certificate{}, fmt.Errorf("reading TLS key: %w", err)
+		}
+	}
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		return tls.Certificate{}, errors.New("both cert_file and key_file are required for TLS")
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if s.Name == name {
+			return s.ID, true
+		}
+	}
+	return 0, false
+}
+
+// verifySANs rejects client certificates without one of the allowed subject alternative names.
+// It's called after the certificate chain is verified.
+func verifySANs(allowed []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			leaf := chain[0]
+			sans := slices.Concat(leaf.DNSNames, leaf.EmailAddresses)
+			for _, ip := range leaf.IPAddresses {
+				sans = append(sans, ip.String())
+			}
+			for _, uri := range leaf.URIs {
+				sans = append(sans, uri.String())
+			}
+			for _, san := range sans {
+				if slices.Contains(allowed, san) {
+					return nil
+				}
+			}
+		}
+		return errors.New("client certificate has no allowed subject alternative name")
+	}
+}
+
+// Handler wraps h with the configured rate limit, authentication and response headers. If neither
+// basic auth users nor bearer tokens are configured, all requests are allowed.
+func (c *Config) Handler(h http.Handler) http.Handler {
+	var limiter *rate.Limiter
+	if rl := c.RateLimit; rl != nil && rl.Interval > 0 {
+		limiter = rate.NewLimiter(rate.Every(time.Duration(rl.Interval)), rl.Burst)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range c.HTTPServerConfig.Headers {
+			w.Header().Set(k, v)
+		}
+		if limiter != nil && !limiter.Allow() {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		if !c.authorized(r) {
+			if len(c.BasicAuthUsers) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="shellyctl"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (c *Config) authorized(r *http.Request) bool {
+	if len(c.BasicAuthUsers) == 0 && len(c.BearerTokens) == 0 {
+		return true
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		hash, known := c.BasicAuthUsers[user]
+		if !known {
+			hash = dummyHash
+		}
+		return checkPassword(user, hash, pass) && known
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range c.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkPassword reports whether pass matches the bcrypt hash, remembering the result.
+func checkPassword(user, hash, pass string) bool {
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + pass))
+	authCache.lock.Lock()
+	ok, cached := authCache.results[key]
+	authCache.lock.Unlock()
+	if cached {
+		return ok
+	}
+	ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	authCache.lock.Lock()
+	defer authCache.lock.Unlock()
+	if len(authCache.results) >= authCacheSize {
+		// Evict an arbitrary entry.
+		for k := range authCache.results {
+			delete(authCache.results, k)
+			break
+		}
+	}
+	authCache.results[key] = ok
+	return ok
+}
+
+// ListenAndServe serves srv, using TLS if it is configured.
+func (c *Config) ListenAndServe(srv *http.Server) error {
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		return srv.ListenAndServe()
+	}
+	srv.TLSConfig = tlsConfig
+	if h2 := c.HTTPServerConfig.HTTP2; h2 != nil && !*h2 {
+		// A non-nil, empty TLSNextProto disables HTTP/2.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	// The certificate is already loaded in TLSConfig.
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,322 @@
+package webconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jcodybaker/shellyctl/pkg/internal/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web-config.yml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+tls_server_config:
+  cert_file: server.crt
+  key_file: /etc/shellyctl/server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt
+http_server_config:
+  headers:
+    X-Frame-Options: deny
+basic_auth_users:
+  prometheus: $2y$10$abcdefghijklmnopqrstuv
+`), 0600))
+
+	c, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, &TLSServerConfig{
+		CertFile:       filepath.Join(dir, "server.crt"),
+		KeyFile:        "/etc/shellyctl/server.key",
+		ClientAuthType: "RequireAndVerifyClientCert",
+		ClientCAFile:   filepath.Join(dir, "ca.crt"),
+	}, c.TLSServerConfig)
+	assert.Equal(t, map[string]string{"X-Frame-Options": "deny"}, c.HTTPServerConfig.Headers)
+	assert.Equal(t, map[string]string{"prometheus": "$2y$10$abcdefghijklmnopqrstuv"}, c.BasicAuthUsers)
+
+	require.NoError(t, os.WriteFile(path, []byte("basic_auth_user: {}\n"), 0600))
+	_, err = Load(path)
+	require.Error(t, err)
+
+	// The other exporter-toolkit settings are accepted.
+	require.NoError(t, os.WriteFile(path, []byte(`
+tls_server_config:
+  cert: |
+    -----BEGIN CERTIFICATE-----
+  key_file: server.key
+  client_allowed_sans: [scraper.example.com]
+  cipher_suites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256]
+  curve_preferences: [X25519]
+  prefer_server_cipher_suites: true
+http_server_config:
+  http2: false
+rate_limit:
+  interval: 1s
+  burst: 5
+`), 0600))
+	c, err = Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, "-----BEGIN CERTIFICATE-----\n", c.TLSServerConfig.Cert)
+	assert.Equal(t, []string{"scraper.example.com"}, c.TLSServerConfig.ClientAllowedSANs)
+	assert.Equal(t, []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}, c.TLSServerConfig.CipherSuites)
+	assert.Equal(t, []string{"X25519"}, c.TLSServerConfig.CurvePreferences)
+	require.NotNil(t, c.HTTPServerConfig.HTTP2)
+	assert.False(t, *c.HTTPServerConfig.HTTP2)
+	assert.Equal(t, &RateLimitConfig{Interval: Duration(time.Second), Burst: 5}, c.RateLimit)
+}
+
+func TestHandler(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tcs := []struct {
+		name   string
+		config Config
+		req    func(r *http.Request)
+		expect int
+	}{
+		{
+			name:   "no auth configured",
+			req:    func(r *http.Request) {},
+			expect: http.StatusOK,
+		},
+		{
+			name:   "basic auth valid",
+			config: Config{BasicAuthUsers: map[string]string{"prometheus": string(hash)}},
+			req:    func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") },
+			expect: http.StatusOK,
+		},
+		{
+			name:   "basic auth wrong password",
+			config: Config{BasicAuthUsers: map[string]string{"prometheus": string(hash)}},
+			req:    func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") },
+			expect: http.StatusUnauthorized,
+		},
+		{
+			name:   "basic auth unknown user",
+			config: Config{BasicAuthUsers: map[string]string{"prometheus": string(hash)}},
+			req:    func(r *http.Request) { r.SetBasicAuth("grafana", "secret") },
+			expect: http.StatusUnauthorized,
+		},
+		{
+			name:   "missing credentials",
+			config: Config{BasicAuthUsers: map[string]string{"prometheus": string(hash)}},
+			req:    func(r *http.Request) {},
+			expect: http.StatusUnauthorized,
+		},
+		{
+			name:   "bearer token valid",
+			config: Config{BearerTokens: []string{"token1", "token2"}},
+			req:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token2") },
+			expect: http.StatusOK,
+		},
+		{
+			name:   "bearer token invalid",
+			config: Config{BearerTokens: []string{"token1"}},
+			req:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token2") },
+			expect: http.StatusUnauthorized,
+		},
+		{
+			name: "bearer token with basic auth configured",
+			config: Config{
+				BasicAuthUsers: map[string]string{"prometheus": string(hash)},
+				BearerTokens:   []string{"token1"},
+			},
+			req:    func(r *http.Request) { r.Header.Set("Authorization", "Bearer token1") },
+			expect: http.StatusOK,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			tc.req(r)
+			w := httptest.NewRecorder()
+			tc.config.Handler(ok).ServeHTTP(w, r)
+			assert.Equal(t, tc.expect, w.Code)
+		})
+	}
+}
+
+func TestHandlerRateLimit(t *testing.T) {
+	c := &Config{RateLimit: &RateLimitConfig{Interval: Duration(time.Hour), Burst: 2}}
+	h := c.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var codes []int
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		codes = append(codes, w.Code)
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	assert.True(t, checkPassword("prometheus", string(hash), "secret"))
+	assert.False(t, checkPassword("prometheus", string(hash), "wrong"))
+	assert.False(t, checkPassword("grafana", dummyHash, "secret"))
+
+	// Results are remembered, so a cached result is returned without comparing the hash.
+	key := sha256.Sum256([]byte("prometheus\x00" + string(hash) + "\x00secret"))
+	authCache.lock.Lock()
+	assert.True(t, authCache.results[key])
+	authCache.results[key] = false
+	authCache.lock.Unlock()
+	assert.False(t, checkPassword("prometheus", string(hash), "secret"))
+
+	for i := 0; i < authCacheSize*2; i++ {
+		checkPassword("prometheus", "invalid", strconv.Itoa(i))
+	}
+	authCache.lock.Lock()
+	assert.Len(t, authCache.results, authCacheSize)
+	authCache.lock.Unlock()
+}
+
+func TestTLSConfigMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := testutil.NewCert(t, dir, "ca", nil, nil)
+	testutil.NewCert(t, dir, "server", caCert, caKey)
+	clientCert, clientKey := testutil.NewCert(t, dir, "client", caCert, caKey)
+
+	c := &Config{TLSServerConfig: &TLSServerConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}}
+	tlsConfig, err := c.TLSConfig()
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = client.Get(srv.URL)
+	require.Error(t, err, "expected handshake to fail without a client certificate")
+
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots,
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{clientCert.Raw},
+			PrivateKey:  clientKey,
+		}},
+	}}
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTLSConfigOptions(t *testing.T) {
+	dir := t.TempDir()
+	caCert, caKey := testutil.NewCert(t, dir, "ca", nil, nil)
+	testutil.NewCert(t, dir, "server", caCert, caKey)
+	clientCert, clientKey := testutil.NewCert(t, dir, "client", caCert, caKey)
+	certPEM, err := os.ReadFile(filepath.Join(dir, "server.crt"))
+	require.NoError(t, err)
+	keyPEM, err := os.ReadFile(filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots,
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{clientCert.Raw},
+			PrivateKey:  clientKey,
+		}},
+	}}}
+
+	for _, tc := range []struct {
+		sans      []string
+		expectErr bool
+	}{
+		{sans: []string{"scraper.example.com", "localhost"}},
+		{sans: []string{"scraper.example.com"}, expectErr: true},
+	} {
+		c := &Config{TLSServerConfig: &TLSServerConfig{
+			Cert:              string(certPEM),
+			Key:               string(keyPEM),
+			ClientCAFile:      filepath.Join(dir, "ca.crt"),
+			ClientAllowedSANs: tc.sans,
+			CipherSuites:      []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			CurvePreferences:  []string{"CurveP256", "X25519"},
+		}}
+		tlsConfig, err := c.TLSConfig()
+		require.NoError(t, err)
+		assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, tlsConfig.CipherSuites)
+		assert.Equal(t, []tls.CurveID{tls.CurveP256, tls.X25519}, tlsConfig.CurvePreferences)
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.TLS = tlsConfig
+		srv.StartTLS()
+		resp, err := client.Get(srv.URL)
+		if tc.expectErr {
+			require.Error(t, err, "expected handshake to fail for SANs %v", tc.sans)
+		} else {
+			require.NoError(t, err)
+			resp.Body.Close()
+		}
+		srv.Close()
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	tcs := []struct {
+		name   string
+		config TLSServerConfig
+	}{
+		{
+			name:   "cert without key",
+			config: TLSServerConfig{CertFile: "server.crt"},
+		},
+		{
+			name:   "client CA without cert",
+			config: TLSServerConfig{ClientCAFile: "ca.crt"},
+		},
+		{
+			name:   "missing files",
+			config: TLSServerConfig{CertFile: "missing.crt", KeyFile: "missing.key"},
+		},
+		{
+			name:   "cert and cert file",
+			config: TLSServerConfig{Cert: "-----BEGIN CERTIFICATE-----", CertFile: "server.crt", KeyFile: "server.key"},
+		},
+		{
+			name:   "unknown cipher suite",
+			config: TLSServerConfig{Cert: "cert", Key: "key", CipherSuites: []string{"TLS_NOPE"}},
+		},
+		{
+			name:   "allowed SANs without client CA",
+			config: TLSServerConfig{Cert: "cert", Key: "key", ClientAllowedSANs: []string{"localhost"}},
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := (&Config{TLSServerConfig: &tc.config}).TLSConfig()
+			require.Error(t, err)
+		})
+	}
+
+	tlsConfig, err := (&Config{}).TLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+}